@@ -6,28 +6,33 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
 type AuthService struct {
-	googleConfig *oauth2.Config
+	googleConfig  *oauth2.Config
+	tokenVerifier *GoogleIDTokenVerifier
 }
 
 type GoogleUser struct {
-	ID      string `json:"id"`
-	Email   string `json:"email"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	VerifiedEmail bool   `json:"verified_email"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+	Locale        string `json:"locale"`
 }
 
 type TokenResponse struct {
-	Token string     `json:"token"`
-	User  GoogleUser `json:"user"`
+	*SessionTokens
+	User *User `json:"user"`
 }
 
 func NewAuthService() *AuthService {
@@ -43,7 +48,8 @@ func NewAuthService() *AuthService {
 	}
 
 	return &AuthService{
-		googleConfig: config,
+		googleConfig:  config,
+		tokenVerifier: NewGoogleIDTokenVerifier(),
 	}
 }
 
@@ -59,34 +65,56 @@ func (s *AuthService) GoogleSignIn(c *gin.Context) {
 	}
 
 	// Verify Google credential token
-	// In production, you would verify the JWT token from Google
-	// For now, we'll mock the response
-	
-	user := GoogleUser{
-		ID:      "123456789",
-		Email:   "user@example.com",
-		Name:    "Demo User",
-		Picture: "https://via.placeholder.com/150",
+	claims, err := s.tokenVerifier.Verify(c.Request.Context(), req.Credential)
+	if err != nil {
+		fmt.Printf("❌ Google credential rejected: %v\n", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Google credential"})
+		return
 	}
 
-	// Generate JWT token
-	token := generateJWT(user.ID, user.Email)
+	// Create user in database if not exists
+	user := store.UpsertGoogleUser(GoogleUser{
+		ID:            claims.Subject,
+		Email:         claims.Email,
+		VerifiedEmail: claims.EmailVerified,
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+		Locale:        claims.Locale,
+	})
+	claimGuestSession(c, user.ID)
+
+	// Generate access and refresh tokens
+	tokens, err := issueSession(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue tokens"})
+		return
+	}
 
 	c.JSON(http.StatusOK, TokenResponse{
-		Token: token,
-		User:  user,
+		SessionTokens: tokens,
+		User:          user,
 	})
 }
 
 // GoogleLoginRedirect redirects to Google OAuth page
 func (s *AuthService) GoogleLoginRedirect(c *gin.Context) {
-	// Generate state token for CSRF protection
-	state := generateRandomState()
-	
-	// Store state in session or database
-	// For demo, we'll just pass it through
+	sessionID, err := startOAuthSession(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
 
-	url := s.googleConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	// Generate state token for CSRF protection, bound to this browser
+	state, entry, err := oauthStates.Issue(flowGoogleLogin, "", sessionID, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate state"})
+		return
+	}
+
+	url := s.googleConfig.AuthCodeURL(state,
+		oauth2.AccessTypeOffline,
+		oauth2.S256ChallengeOption(entry.CodeVerifier),
+	)
 	c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
@@ -100,9 +128,17 @@ func (s *AuthService) GoogleLoginCallback(c *gin.Context) {
 		return
 	}
 
+	// Verify state
+	sessionID, _ := c.Cookie(oauthSessionCookie)
+	entry, err := oauthStates.Consume(state, flowGoogleLogin, sessionID)
+	if err != nil || sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+		return
+	}
+
 	// Exchange code for token
 	ctx := context.Background()
-	token, err := s.googleConfig.Exchange(ctx, code)
+	token, err := s.googleConfig.Exchange(ctx, code, oauth2.VerifierOption(entry.CodeVerifier))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to exchange token"})
 		return
@@ -123,42 +159,81 @@ func (s *AuthService) GoogleLoginCallback(c *gin.Context) {
 		return
 	}
 
+	// Anyone can put someone else's address on a Google account, and we
+	// link accounts by email
+	if !googleUser.VerifiedEmail {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Google account email is not verified"})
+		return
+	}
+
 	// Create user in database if not exists
-	// ...
+	user := store.UpsertGoogleUser(googleUser)
+	claimGuestSession(c, user.ID)
 
-	// Generate JWT token
-	jwtToken := generateJWT(googleUser.ID, googleUser.Email)
+	redirectWithAuthCode(c, user)
+}
 
-	// Redirect to frontend with token
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		frontendURL = "http://localhost:3000"
+// ExchangeAuthCode trades the one-time code from the login redirect for tokens
+func (s *AuthService) ExchangeAuthCode(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
 	}
 
-	c.Redirect(http.StatusTemporaryRedirect, 
-		fmt.Sprintf("%s/app?token=%s", frontendURL, jwtToken))
-}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
 
-// Helper function to generate JWT token
-func generateJWT(userID, email string) string {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"email":   email,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 days
+	authCode := store.ConsumeAuthCode(hashToken(req.Code))
+	if authCode == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired code"})
+		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "your-secret-key-change-this-in-production"
+	user := store.GetUser(authCode.UserID)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired code"})
+		return
 	}
 
-	tokenString, _ := token.SignedString([]byte(secret))
-	return tokenString
+	// Generate access and refresh tokens
+	tokens, err := issueSession(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, TokenResponse{
+		SessionTokens: tokens,
+		User:          user,
+	})
 }
 
-// Helper function to generate random state
-func generateRandomState() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+// Helper function to generate JWT token
+func generateJWT(user *User, sessionID string) (string, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+
+	claims := &AccessClaims{
+		UserID:    user.ID,
+		Email:     user.Email,
+		Roles:     user.Roles,
+		Scope:     strings.Join(defaultUserScopes, " "),
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    tokenIssuer(),
+			Subject:   user.ID,
+			Audience:  jwt.ClaimStrings{tokenAudience()},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	tokenString, err := tokenKeys.Sign(claims)
+	if err != nil {
+		return "", err
+	}
+	store.TrackAccessToken(user.ID, claims.ID, expiresAt)
+	return tokenString, nil
 }
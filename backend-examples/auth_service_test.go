@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestGoogleSignInLinksVerifiedEmail(t *testing.T) {
+	ks := newGoogleKeyServer(t)
+	key := ks.addKey(t, "k1")
+	existing := testUser(t)
+
+	r := gin.New()
+	r.POST("/google", (&AuthService{tokenVerifier: ks.verifier()}).GoogleSignIn)
+
+	claims := googleClaims()
+	claims.Subject = "sub-" + existing.ID
+	claims.Email = existing.Email
+	w := serveJSON(r, http.MethodPost, "/google", gin.H{"credential": signGoogleToken(t, key, "k1", claims)}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("sign in = %d %s", w.Code, w.Body.String())
+	}
+
+	var resp TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.User.ID != existing.ID {
+		t.Errorf("signed in as %s, want the existing account %s", resp.User.ID, existing.ID)
+	}
+}
+
+func TestUpsertGoogleUserNeedsVerifiedEmail(t *testing.T) {
+	existing := testUser(t)
+
+	user := store.UpsertGoogleUser(GoogleUser{ID: "sub-" + existing.ID, Email: existing.Email, Name: "Mallory"})
+	if user.ID == existing.ID {
+		t.Fatal("unverified Google email was linked to an existing account")
+	}
+	if got := store.GetUser(existing.ID); got.GoogleSubject != "" || got.Name == "Mallory" {
+		t.Errorf("existing account was changed: %+v", got)
+	}
+
+	// Nor can a linked Google account switch to an unverified address
+	linked := store.UpsertGoogleUser(GoogleUser{ID: "sub-linked-" + existing.ID, Email: "linked-" + existing.Email, VerifiedEmail: true})
+	again := store.UpsertGoogleUser(GoogleUser{ID: "sub-linked-" + existing.ID, Email: "victim@example.com"})
+	if again.ID != linked.ID || again.Email != linked.Email {
+		t.Errorf("email changed to an unverified address: %+v", again)
+	}
+}
+
+func TestEmailBelongsToOneAccount(t *testing.T) {
+	// Fresh addresses, the test moves them between accounts
+	email := strings.ToLower(t.Name()) + "-" + uuid.NewString()[:8] + "@example.com"
+	first := store.UpsertGoogleUser(GoogleUser{ID: "sub-first-" + email, Email: email, VerifiedEmail: true})
+
+	// A second Google account with the same verified address doesn't take it
+	second := store.UpsertGoogleUser(GoogleUser{ID: "sub-second-" + email, Email: strings.ToUpper(email), VerifiedEmail: true})
+	if second.ID == first.ID {
+		t.Fatal("second Google account signed in to the first")
+	}
+	for i := 0; i < 5; i++ {
+		if got := store.GetOrCreateEmailUser(email); got.ID != first.ID {
+			t.Fatalf("magic link signed in to %s, want %s", got.ID, first.ID)
+		}
+	}
+
+	// Nor can an account switch its Google email to an address that's taken
+	other := store.UpsertGoogleUser(GoogleUser{ID: "sub-other-" + email, Email: "other-" + email, VerifiedEmail: true})
+	moved := store.UpsertGoogleUser(GoogleUser{ID: "sub-other-" + email, Email: email, VerifiedEmail: true})
+	if moved.Email != other.Email {
+		t.Errorf("email moved onto an owned address: %s", moved.Email)
+	}
+
+	// A free address moves with the account and the old one is released
+	moved = store.UpsertGoogleUser(GoogleUser{ID: "sub-other-" + email, Email: "new-" + email, VerifiedEmail: true})
+	if got := store.GetOrCreateEmailUser("new-" + email); moved.Email != "new-"+email || got.ID != other.ID {
+		t.Errorf("moved to %s, magic link went to %s", moved.Email, got.ID)
+	}
+	if got := store.GetOrCreateEmailUser(other.Email); got.ID == other.ID {
+		t.Error("old address still signs in to the account")
+	}
+}
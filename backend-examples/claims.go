@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes granted to access tokens
+const (
+	ScopeSubscriptionsRead  = "subscriptions:read"
+	ScopeSubscriptionsWrite = "subscriptions:write"
+	ScopeGmailRead          = "gmail:read"
+	ScopeGmailWrite         = "gmail:write"
+)
+
+// Roles a user can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Scopes every signed-in user gets in the browser
+var defaultUserScopes = []string{
+	ScopeSubscriptionsRead,
+	ScopeSubscriptionsWrite,
+	ScopeGmailRead,
+	ScopeGmailWrite,
+}
+
+// AccessClaims are the claims in our access tokens
+type AccessClaims struct {
+	UserID string   `json:"user_id"`
+	Email  string   `json:"email"`
+	Roles  []string `json:"roles,omitempty"`
+	Scope  string   `json:"scope"`
+	// Refresh token family the token was minted from
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Validate checks required fields, called by the jwt parser after the
+// registered claims are validated
+func (c *AccessClaims) Validate() error {
+	if c.UserID == "" || c.Email == "" || c.ID == "" {
+		return errors.New("missing required claims")
+	}
+	if c.ExpiresAt == nil {
+		return jwt.ErrTokenRequiredClaimMissing
+	}
+	return nil
+}
+
+// Scopes returns the space-delimited scope claim as a slice
+func (c *AccessClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+func tokenIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "subtrack-backend"
+}
+
+func tokenAudience() string {
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		return audience
+	}
+	return "subtrack-api"
+}
+
+// hasScope reports whether granted covers required. A write scope also
+// grants read on the same resource.
+func hasScope(granted []string, required string) bool {
+	for _, scope := range granted {
+		if scope == required {
+			return true
+		}
+		if resource, ok := strings.CutSuffix(required, ":read"); ok && scope == resource+":write" {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope rejects requests whose token lacks any of the given scopes
+func RequireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted := c.GetStringSlice("scopes")
+		for _, scope := range scopes {
+			if !hasScope(granted, scope) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient scope", "required": scope})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// RequireRole rejects requests from users that have none of the given roles
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, have := range c.GetStringSlice("roles") {
+			for _, role := range roles {
+				if have == role {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient role"})
+		c.Abort()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// accessToken signs claims for user with the given scopes, which the test
+// can then adjust
+func accessToken(t *testing.T, user *User, scopes []string, adjust func(*AccessClaims)) string {
+	t.Helper()
+	now := time.Now()
+	claims := &AccessClaims{
+		UserID: user.ID,
+		Email:  user.Email,
+		Roles:  user.Roles,
+		Scope:  strings.Join(scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    tokenIssuer(),
+			Audience:  jwt.ClaimStrings{tokenAudience()},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+	if adjust != nil {
+		adjust(claims)
+	}
+	token, err := tokenKeys.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		granted  []string
+		required string
+		want     bool
+	}{
+		{[]string{ScopeSubscriptionsRead}, ScopeSubscriptionsRead, true},
+		{[]string{ScopeSubscriptionsWrite}, ScopeSubscriptionsRead, true},
+		{[]string{ScopeSubscriptionsRead}, ScopeSubscriptionsWrite, false},
+		{[]string{ScopeGmailWrite}, ScopeSubscriptionsRead, false},
+		{nil, ScopeGmailRead, false},
+	}
+	for _, tt := range tests {
+		if got := hasScope(tt.granted, tt.required); got != tt.want {
+			t.Errorf("hasScope(%v, %s) = %v", tt.granted, tt.required, got)
+		}
+	}
+}
+
+func TestAuthMiddlewareScopesAndRoles(t *testing.T) {
+	user := testUser(t)
+	ok := func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"user_id": c.GetString("user_id")}) }
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.GET("/subscriptions", RequireScope(ScopeSubscriptionsRead), ok)
+	r.POST("/gmail", RequireScope(ScopeGmailWrite), ok)
+	r.GET("/admin", RequireRole(RoleAdmin), ok)
+
+	readOnly := accessToken(t, user, []string{ScopeSubscriptionsWrite}, nil)
+	if w := serveJSON(r, http.MethodGet, "/subscriptions", nil, readOnly); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), user.ID) {
+		t.Errorf("write scope reading = %d %s", w.Code, w.Body.String())
+	}
+	if w := serveJSON(r, http.MethodPost, "/gmail", nil, readOnly); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), ScopeGmailWrite) {
+		t.Errorf("missing scope = %d %s", w.Code, w.Body.String())
+	}
+	if w := serveJSON(r, http.MethodGet, "/admin", nil, readOnly); w.Code != http.StatusForbidden {
+		t.Errorf("user on admin route = %d", w.Code)
+	}
+	admin := accessToken(t, user, nil, func(c *AccessClaims) { c.Roles = []string{RoleAdmin} })
+	if w := serveJSON(r, http.MethodGet, "/admin", nil, admin); w.Code != http.StatusOK {
+		t.Errorf("admin = %d", w.Code)
+	}
+
+	for name, adjust := range map[string]func(*AccessClaims){
+		"expired":      func(c *AccessClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) },
+		"no expiry":    func(c *AccessClaims) { c.ExpiresAt = nil },
+		"no user":      func(c *AccessClaims) { c.UserID = "" },
+		"no jti":       func(c *AccessClaims) { c.ID = "" },
+		"other issuer": func(c *AccessClaims) { c.Issuer = "someone-else" },
+		"other audience": func(c *AccessClaims) {
+			c.Audience = jwt.ClaimStrings{"another-api"}
+		},
+	} {
+		token := accessToken(t, user, []string{ScopeSubscriptionsRead}, adjust)
+		if w := serveJSON(r, http.MethodGet, "/subscriptions", nil, token); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: %d", name, w.Code)
+		}
+	}
+
+	// Unsigned tokens aren't accepted whatever they claim
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, &AccessClaims{UserID: user.ID, Email: user.Email, Scope: ScopeSubscriptionsRead}).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if w := serveJSON(r, http.MethodGet, "/subscriptions", nil, unsigned); w.Code != http.StatusUnauthorized {
+		t.Errorf("alg none = %d", w.Code)
+	}
+}
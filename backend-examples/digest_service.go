@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DigestOff     = "off"
+	DigestWeekly  = "weekly"
+	DigestMonthly = "monthly"
+
+	EventDigest = "digest"
+)
+
+// DigestSettings is when a user wants their spending digest, in their time zone
+type DigestSettings struct {
+	Frequency string `json:"frequency"` // off, weekly or monthly
+	Day       int    `json:"day"`       // weekday (0 = Sunday) for weekly, day of month (1-28) for monthly
+	Hour      int    `json:"hour"`      // local hour, 0-23
+}
+
+// Digests are opt-in, Monday 8:00 once turned on
+var defaultDigestSettings = DigestSettings{Frequency: DigestOff, Day: 1, Hour: 8}
+
+// Digest is the data a digest template is rendered from
+type Digest struct {
+	Frequency        string
+	Currency         string
+	URL              string
+	PeriodStart      time.Time
+	PeriodEnd        time.Time
+	Upcoming         []DigestCharge
+	UpcomingTotal    float64
+	TrialsEnding     []DigestCharge
+	ThisMonth        float64
+	LastMonth        float64
+	HasLastMonth     bool
+	MonthChange      float64 // percent
+	NewSubscriptions []*Subscription
+	PriceIncreases   []*Subscription
+}
+
+// DigestCharge is one dated line in a digest
+type DigestCharge struct {
+	Name   string
+	Date   time.Time
+	Amount float64
+}
+
+// DigestService sends each user's digest at their preferred day and hour.
+// Sent digests are claimed in the ledger so a restart doesn't send twice.
+type DigestService struct {
+	ledger      *ReminderLedger
+	dispatcher  NotificationDispatcher
+	interval    time.Duration
+	frontendURL string
+}
+
+func NewDigestService(ledger *ReminderLedger, dispatcher NotificationDispatcher) *DigestService {
+	interval := 15 * time.Minute
+	if value := os.Getenv("DIGEST_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		}
+	}
+
+	frontendURL := os.Getenv("FRONTEND_URL")
+	if frontendURL == "" {
+		frontendURL = "http://localhost:3000"
+	}
+
+	return &DigestService{
+		ledger:      ledger,
+		dispatcher:  dispatcher,
+		interval:    interval,
+		frontendURL: frontendURL,
+	}
+}
+
+// Start runs the digest loop in the background until ctx is cancelled
+func (s *DigestService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if sent := s.RunOnce(ctx, time.Now()); sent > 0 {
+				fmt.Printf("📰 Sent %d digests\n", sent)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RunOnce sends every digest due at now and returns how many were sent
+func (s *DigestService) RunOnce(ctx context.Context, now time.Time) int {
+	sent := 0
+	subsByUser := store.GetAllUserSubscriptions()
+
+	for _, user := range store.GetUsers() {
+		local := now.In(userLocation(user))
+		if !digestDue(user.Digest, local) {
+			continue
+		}
+
+		subs := subsByUser[user.ID]
+		if len(subs) == 0 {
+			continue
+		}
+
+		key := fmt.Sprintf("digest:%s:%s:%s", ledgerAccount(user), user.Digest.Frequency, local.Format(dateLayout))
+		if s.ledger.Sent(key) {
+			continue
+		}
+
+		notification, err := s.render(user, buildDigest(user, subs, user.Digest.Frequency, now))
+		if err != nil {
+			fmt.Printf("❌ Failed to render digest for user %s: %v\n", user.ID, err)
+			continue
+		}
+
+		claimed, err := s.ledger.Claim(key, now)
+		if err != nil {
+			fmt.Printf("❌ Reminder ledger error: %v\n", err)
+			return sent
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := s.dispatcher.Dispatch(ctx, notification); err != nil {
+			fmt.Printf("❌ Failed to dispatch digest %s: %v\n", key, err)
+			s.ledger.Release(key)
+			continue
+		}
+		sent++
+	}
+
+	return sent
+}
+
+// Preview renders the signed-in user's digest without sending it
+func (s *DigestService) Preview(c *gin.Context) {
+	user := store.GetUser(c.GetString("user_id"))
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	frequency := c.DefaultQuery("frequency", user.Digest.Frequency)
+	if frequency != DigestWeekly && frequency != DigestMonthly {
+		frequency = DigestWeekly
+	}
+
+	subs := store.GetSubscriptions(user.ID)
+	notification, err := s.render(user, buildDigest(user, subs, frequency, time.Now()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render digest"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"title": notification.Title,
+		"text":  notification.Body,
+		"html":  notification.HTML,
+	})
+}
+
+func (s *DigestService) render(user *User, digest *Digest) (*Notification, error) {
+	digest.URL = s.frontendURL + "/app"
+
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, digest); err != nil {
+		return nil, err
+	}
+	if err := digestHTMLTemplate.Execute(&html, digest); err != nil {
+		return nil, err
+	}
+
+	return &Notification{
+		UserID: user.ID,
+		Event:  EventDigest,
+		Title:  fmt.Sprintf("Your %s SubTrack digest", digest.Frequency),
+		Body:   text.String(),
+		HTML:   html.String(),
+		URL:    digest.URL,
+	}, nil
+}
+
+// buildDigest summarizes subs for the period starting today in the user's
+// time zone, looking back the same length for what changed
+func buildDigest(user *User, subs []*Subscription, frequency string, now time.Time) *Digest {
+	today := dateOnly(now.In(userLocation(user)))
+
+	periodEnd := today.AddDate(0, 0, 7)
+	lookback := today.AddDate(0, 0, -7)
+	if frequency == DigestMonthly {
+		periodEnd = today.AddDate(0, 1, 0)
+		lookback = today.AddDate(0, -1, 0)
+	}
+
+	monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+	lastMonthStart := monthStart.AddDate(0, -1, 0)
+	nextMonthStart := monthStart.AddDate(0, 1, 0)
+
+	digest := &Digest{
+		Frequency:   frequency,
+		Currency:    user.HomeCurrency,
+		PeriodStart: today,
+		PeriodEnd:   periodEnd.AddDate(0, 0, -1),
+	}
+
+	for _, sub := range subs {
+		for _, charge := range chargesBetween(sub, today, periodEnd) {
+			digest.Upcoming = append(digest.Upcoming, charge)
+			digest.UpcomingTotal += charge.Amount
+		}
+		for _, charge := range chargesBetween(sub, monthStart, nextMonthStart) {
+			digest.ThisMonth += charge.Amount
+		}
+		for _, charge := range chargesBetween(sub, lastMonthStart, monthStart) {
+			digest.LastMonth += charge.Amount
+		}
+
+		if sub.TrialEndDate != "" {
+			if end, err := time.Parse(dateLayout, sub.TrialEndDate); err == nil && !end.Before(today) && end.Before(periodEnd) {
+				digest.TrialsEnding = append(digest.TrialsEnding, DigestCharge{Name: sub.Name, Date: end})
+			}
+		}
+		if sub.DetectedAt != nil && !sub.DetectedAt.Before(lookback) {
+			digest.NewSubscriptions = append(digest.NewSubscriptions, sub)
+		}
+		if sub.PriceChangedAt != nil && !sub.PriceChangedAt.Before(lookback) && sub.Price > sub.PreviousPrice {
+			digest.PriceIncreases = append(digest.PriceIncreases, sub)
+		}
+	}
+
+	sort.Slice(digest.Upcoming, func(i, j int) bool {
+		return digest.Upcoming[i].Date.Before(digest.Upcoming[j].Date)
+	})
+	sort.Slice(digest.TrialsEnding, func(i, j int) bool {
+		return digest.TrialsEnding[i].Date.Before(digest.TrialsEnding[j].Date)
+	})
+
+	if digest.LastMonth > 0 {
+		digest.HasLastMonth = true
+		digest.MonthChange = (digest.ThisMonth - digest.LastMonth) / digest.LastMonth * 100
+	}
+
+	return digest
+}
+
+// chargesBetween lists the charges of sub in [from, to), projected from
+// nextBillingDate by its billing cycle. Charges before a price change use
+// the old price.
+func chargesBetween(sub *Subscription, from, to time.Time) []DigestCharge {
+	anchor, err := time.Parse(dateLayout, sub.NextBillingDate)
+	if err != nil {
+		return nil
+	}
+
+	amount := func(date time.Time) float64 {
+		if sub.PriceChangedAt != nil && sub.PreviousPrice > 0 && date.Before(dateOnly(*sub.PriceChangedAt)) {
+			return sub.PreviousPrice
+		}
+		return sub.Price
+	}
+
+	if _, err := addCycles(anchor, sub.BillingCycle, 0); err != nil {
+		// Unknown cycle, only the one date we know about
+		if !anchor.Before(from) && anchor.Before(to) {
+			return []DigestCharge{{Name: sub.Name, Date: anchor, Amount: amount(anchor)}}
+		}
+		return nil
+	}
+
+	// Step back to the first charge before the window, then walk forward
+	k := 0
+	for i := 0; i < 1000; i++ {
+		date, _ := addCycles(anchor, sub.BillingCycle, k)
+		if date.Before(from) {
+			break
+		}
+		k--
+	}
+
+	var charges []DigestCharge
+	for i := 0; i < 1000; i++ {
+		date, _ := addCycles(anchor, sub.BillingCycle, k)
+		if !date.Before(to) {
+			break
+		}
+		if !date.Before(from) {
+			charges = append(charges, DigestCharge{Name: sub.Name, Date: date, Amount: amount(date)})
+		}
+		k++
+	}
+	return charges
+}
+
+// digestDue reports whether local is on the user's digest day, at or after
+// their preferred hour
+func digestDue(settings DigestSettings, local time.Time) bool {
+	if local.Hour() < settings.Hour {
+		return false
+	}
+
+	switch settings.Frequency {
+	case DigestWeekly:
+		return int(local.Weekday()) == settings.Day
+	case DigestMonthly:
+		return local.Day() == settings.Day
+	}
+	return false
+}
+
+func validDigestSettings(settings *DigestSettings) bool {
+	if settings.Hour < 0 || settings.Hour > 23 {
+		return false
+	}
+
+	switch settings.Frequency {
+	case DigestOff:
+		return true
+	case DigestWeekly:
+		return settings.Day >= 0 && settings.Day <= 6
+	case DigestMonthly:
+		return settings.Day >= 1 && settings.Day <= 28
+	}
+	return false
+}
+
+// userLocation returns the user's time zone, UTC if unset or invalid
+func userLocation(user *User) *time.Location {
+	if loc, err := time.LoadLocation(user.TimeZone); err == nil && user.TimeZone != "" {
+		return loc
+	}
+	return time.UTC
+}
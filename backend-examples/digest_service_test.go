@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChargesBetween(t *testing.T) {
+	changed := day("2026-03-01")
+	sub := &Subscription{Name: "Spotify", Price: 12, PreviousPrice: 10, PriceChangedAt: &changed, BillingCycle: "monthly", NextBillingDate: "2026-03-15"}
+
+	var got []string
+	for _, charge := range chargesBetween(sub, day("2026-01-01"), day("2026-05-01")) {
+		got = append(got, charge.Date.Format(dateLayout)+" "+formatMoney(charge.Amount, "USD"))
+	}
+	if want := "2026-01-15 $10,2026-02-15 $10,2026-03-15 $12,2026-04-15 $12"; strings.Join(got, ",") != want {
+		t.Errorf("charges = %s, want %s", strings.Join(got, ","), want)
+	}
+
+	yearly := &Subscription{Price: 99, BillingCycle: "yearly", NextBillingDate: "2027-02-01"}
+	if charges := chargesBetween(yearly, day("2026-01-01"), day("2026-12-31")); len(charges) != 1 || charges[0].Date != day("2026-02-01") {
+		t.Errorf("yearly charges = %+v", charges)
+	}
+
+	// Without a known cycle only the next billing date counts
+	odd := &Subscription{Price: 5, BillingCycle: "fortnightly-ish", NextBillingDate: "2026-03-15"}
+	if charges := chargesBetween(odd, day("2026-01-01"), day("2026-05-01")); len(charges) != 1 {
+		t.Errorf("unknown cycle charges = %+v", charges)
+	}
+}
+
+func TestBuildDigest(t *testing.T) {
+	user := &User{TimeZone: "Asia/Bangkok", HomeCurrency: "THB"}
+	changed, detected := day("2026-10-15"), day("2026-10-17")
+	subs := []*Subscription{
+		{Name: "Netflix", Price: 15.49, BillingCycle: "monthly", NextBillingDate: "2026-10-22"},
+		{Name: "Spotify", Price: 12, PreviousPrice: 10, PriceChangedAt: &changed, BillingCycle: "monthly", NextBillingDate: "2026-11-05"},
+		{Name: "Calm", Price: 70, BillingCycle: "yearly", NextBillingDate: "2026-10-24", TrialEndDate: "2026-10-24", DetectedAt: &detected},
+	}
+
+	// Already Monday the 19th in Bangkok
+	digest := buildDigest(user, subs, DigestWeekly, time.Date(2026, 10, 18, 20, 0, 0, 0, time.UTC))
+	if digest.PeriodStart != day("2026-10-19") || digest.PeriodEnd != day("2026-10-25") || digest.Currency != "THB" {
+		t.Errorf("period = %s to %s in %s", digest.PeriodStart, digest.PeriodEnd, digest.Currency)
+	}
+	if len(digest.Upcoming) != 2 || digest.Upcoming[0].Name != "Netflix" || digest.Upcoming[1].Name != "Calm" || math.Abs(digest.UpcomingTotal-85.49) > 0.001 {
+		t.Errorf("upcoming = %+v, total %.2f", digest.Upcoming, digest.UpcomingTotal)
+	}
+	if len(digest.TrialsEnding) != 1 || len(digest.NewSubscriptions) != 1 || digest.NewSubscriptions[0].Name != "Calm" {
+		t.Errorf("trials %+v, new %+v", digest.TrialsEnding, digest.NewSubscriptions)
+	}
+	if len(digest.PriceIncreases) != 1 || digest.PriceIncreases[0].Name != "Spotify" {
+		t.Errorf("price increases = %+v", digest.PriceIncreases)
+	}
+
+	// October has Spotify at the old price, September has no Calm
+	if math.Abs(digest.ThisMonth-95.49) > 0.001 || math.Abs(digest.LastMonth-25.49) > 0.001 || !digest.HasLastMonth {
+		t.Errorf("this month %.2f, last month %.2f", digest.ThisMonth, digest.LastMonth)
+	}
+}
+
+func TestDigestDue(t *testing.T) {
+	monday8 := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		settings DigestSettings
+		local    time.Time
+		want     bool
+	}{
+		{DigestSettings{DigestWeekly, 1, 8}, monday8, true},
+		{DigestSettings{DigestWeekly, 1, 8}, monday8.Add(-time.Minute), false},
+		{DigestSettings{DigestWeekly, 2, 8}, monday8, false},
+		{DigestSettings{DigestMonthly, 19, 8}, monday8.Add(3 * time.Hour), true},
+		{DigestSettings{DigestOff, 1, 8}, monday8, false},
+	}
+	for _, tt := range tests {
+		if got := digestDue(tt.settings, tt.local); got != tt.want {
+			t.Errorf("digestDue(%+v, %s) = %v", tt.settings, tt.local, got)
+		}
+	}
+
+	for _, settings := range []DigestSettings{{DigestWeekly, 7, 8}, {DigestMonthly, 29, 8}, {DigestMonthly, 1, 24}, {"daily", 1, 8}} {
+		if validDigestSettings(&settings) {
+			t.Errorf("%+v accepted", settings)
+		}
+	}
+}
+
+func TestDigestSentOnceAtLocalHour(t *testing.T) {
+	user := testUser(t)
+	store.UpdateUser(user.ID, func(u *User) {
+		u.TimeZone = "Asia/Bangkok"
+		u.Digest = DigestSettings{Frequency: DigestWeekly, Day: int(time.Monday), Hour: 8}
+	})
+	store.SaveSubscription(user.ID, &Subscription{ID: generateTempID(), Name: "Netflix", Price: 15.49, BillingCycle: "monthly", NextBillingDate: "2026-10-22"})
+
+	ledger, err := OpenReminderLedger(filepath.Join(t.TempDir(), "digests.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := &recordingDispatcher{}
+	service := &DigestService{ledger: ledger, dispatcher: dispatcher, frontendURL: "https://app.example"}
+
+	// 7:30, 8:30 and 9:00 on Monday in Bangkok
+	for _, now := range []time.Time{
+		time.Date(2026, 10, 19, 0, 30, 0, 0, time.UTC),
+		time.Date(2026, 10, 19, 1, 30, 0, 0, time.UTC),
+		time.Date(2026, 10, 19, 2, 0, 0, 0, time.UTC),
+	} {
+		service.RunOnce(context.Background(), now)
+	}
+	if got := dispatcher.count(user.ID); got != 1 {
+		t.Fatalf("sent %d digests, want 1", got)
+	}
+
+	// Nor again after a restart gives the account a new ID
+	store.DeleteUser(user.ID)
+	again := testUser(t)
+	store.UpdateUser(again.ID, func(u *User) {
+		u.TimeZone = "Asia/Bangkok"
+		u.Digest = DigestSettings{Frequency: DigestWeekly, Day: int(time.Monday), Hour: 8}
+	})
+	store.SaveSubscription(again.ID, &Subscription{ID: generateTempID(), Name: "Netflix", Price: 15.49, BillingCycle: "monthly", NextBillingDate: "2026-10-22"})
+	service.RunOnce(context.Background(), time.Date(2026, 10, 19, 2, 30, 0, 0, time.UTC))
+	if got := dispatcher.count(again.ID); got != 0 {
+		t.Errorf("sent %d digests after restart, want 0", got)
+	}
+
+	dispatcher.mu.Lock()
+	defer dispatcher.mu.Unlock()
+	for _, n := range dispatcher.sent {
+		if n.UserID != user.ID {
+			continue
+		}
+		if n.Event != EventDigest || n.Title != "Your weekly SubTrack digest" || !strings.Contains(n.Body, "Netflix") ||
+			!strings.Contains(n.HTML, "Netflix") || n.URL != "https://app.example/app" {
+			t.Errorf("digest = %+v", n)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"text/template"
+	"time"
+)
+
+var digestFuncs = map[string]interface{}{
+	"money": formatMoney,
+	"date": func(t time.Time) string {
+		return t.Format("Mon, Jan 2")
+	},
+	"change": func(percent float64) string {
+		return fmt.Sprintf("%+.0f%%", percent)
+	},
+}
+
+var digestTextTemplate = template.Must(template.New("digest.txt").Funcs(digestFuncs).Parse(
+	`Here is your {{.Frequency}} summary for {{date .PeriodStart}} to {{date .PeriodEnd}}.
+
+Monthly spend: {{money .ThisMonth .Currency}}{{if .HasLastMonth}} ({{change .MonthChange}} vs {{money .LastMonth .Currency}} last month){{end}}
+{{if .Upcoming}}
+Coming up ({{money .UpcomingTotal .Currency}}):
+{{range .Upcoming}}- {{date .Date}}  {{.Name}}  {{money .Amount $.Currency}}
+{{end}}{{end}}{{if .TrialsEnding}}
+Trials ending:
+{{range .TrialsEnding}}- {{date .Date}}  {{.Name}}
+{{end}}{{end}}{{if .PriceIncreases}}
+Price increases:
+{{range .PriceIncreases}}- {{.Name}}: {{money .PreviousPrice $.Currency}} -> {{money .Price $.Currency}}
+{{end}}{{end}}{{if .NewSubscriptions}}
+Newly detected:
+{{range .NewSubscriptions}}- {{.Name}}  {{money .Price $.Currency}} {{.BillingCycle}}
+{{end}}{{end}}
+You can change or turn off this digest in your SubTrack settings.`))
+
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest.html").Funcs(digestFuncs).Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: -apple-system, Segoe UI, Roboto, sans-serif; color: #1f2937; max-width: 560px; margin: 0 auto;">
+  <h2 style="margin-bottom: 4px;">Your {{.Frequency}} SubTrack digest</h2>
+  <p style="color: #6b7280; margin-top: 0;">{{date .PeriodStart}} to {{date .PeriodEnd}}</p>
+
+  <p style="font-size: 18px;">
+    Monthly spend: <strong>{{money .ThisMonth .Currency}}</strong>
+    {{if .HasLastMonth}}<span style="color: {{if gt .MonthChange 0.0}}#dc2626{{else}}#16a34a{{end}};">{{change .MonthChange}}</span> vs {{money .LastMonth .Currency}} last month{{end}}
+  </p>
+{{if .Upcoming}}
+  <h3>Coming up <span style="color: #6b7280; font-weight: normal;">{{money .UpcomingTotal .Currency}}</span></h3>
+  <table style="width: 100%; border-collapse: collapse;">
+  {{range .Upcoming}}<tr>
+      <td style="padding: 4px 0; color: #6b7280;">{{date .Date}}</td>
+      <td style="padding: 4px 0;">{{.Name}}</td>
+      <td style="padding: 4px 0; text-align: right;">{{money .Amount $.Currency}}</td>
+    </tr>
+  {{end}}</table>
+{{end}}{{if .TrialsEnding}}
+  <h3>Trials ending</h3>
+  <ul>{{range .TrialsEnding}}<li>{{.Name}} on {{date .Date}}</li>{{end}}</ul>
+{{end}}{{if .PriceIncreases}}
+  <h3>Price increases</h3>
+  <ul>{{range .PriceIncreases}}<li>{{.Name}}: {{money .PreviousPrice $.Currency}} &rarr; <strong>{{money .Price $.Currency}}</strong></li>{{end}}</ul>
+{{end}}{{if .NewSubscriptions}}
+  <h3>Newly detected</h3>
+  <ul>{{range .NewSubscriptions}}<li>{{.Name}}, {{money .Price $.Currency}} {{.BillingCycle}}</li>{{end}}</ul>
+{{end}}
+  <p><a href="{{.URL}}" style="color: #2563eb;">Open SubTrack</a></p>
+  <p style="color: #9ca3af; font-size: 12px;">You can change or turn off this digest in your SubTrack settings.</p>
+</body>
+</html>
+`))
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,7 +17,8 @@ import (
 )
 
 type GmailService struct {
-	config *oauth2.Config
+	config  *oauth2.Config
+	scanner *MailScanner
 }
 
 type ConnectRequest struct {
@@ -41,7 +42,7 @@ type CallbackResponse struct {
 	SubscriptionsFound int    `json:"subscriptionsFound"`
 }
 
-func NewGmailService() *GmailService {
+func NewGmailService(scanner *MailScanner) *GmailService {
 	config := &oauth2.Config{
 		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
 		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
@@ -53,7 +54,8 @@ func NewGmailService() *GmailService {
 	}
 
 	return &GmailService{
-		config: config,
+		config:  config,
+		scanner: scanner,
 	}
 }
 
@@ -68,18 +70,20 @@ func (s *GmailService) InitiateConnection(c *gin.Context) {
 	// Get user from context (set by AuthMiddleware)
 	userID := c.GetString("user_id")
 	
-	// Generate state token that includes user_id and email
-	state := generateState(userID, req.Email)
-	
+	// Generate state token bound to this user
+	state, entry, err := oauthStates.Issue(flowGmailConnect, userID, "", req.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate state"})
+		return
+	}
+
 	// Generate OAuth URL with backend callback
-	authURL := s.config.AuthCodeURL(state, 
+	authURL := s.config.AuthCodeURL(state,
 		oauth2.AccessTypeOffline,
 		oauth2.ApprovalForce,
+		oauth2.S256ChallengeOption(entry.CodeVerifier),
 	)
 
-	// Store state in session/cache for verification
-	// storeState(userID, state)
-
 	c.JSON(http.StatusOK, ConnectResponse{
 		AuthURL: authURL,
 		State:   state,
@@ -89,22 +93,35 @@ func (s *GmailService) InitiateConnection(c *gin.Context) {
 // InitiateConnectionRedirect starts the Gmail OAuth flow with redirect
 func (s *GmailService) InitiateConnectionRedirect(c *gin.Context) {
 	// Get user from context (set by AuthMiddleware)
-	// If no auth, create temporary user session
+	// If no auth, use the visitor's guest session
 	userID := c.GetString("user_id")
 	if userID == "" {
-		userID = "temp_" + generateTempID()
+		guest, err := startGuestSession(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+			return
+		}
+		userID = guest.ID
 	}
 	
+	sessionID, err := startOAuthSession(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
+
 	// Generate state token - no email needed, Google will provide it
-	state := generateState(userID, "")
-	
-	// Store state in session for verification later
-	c.SetCookie("gmail_state", state, 3600, "/", "", false, true)
-	
+	state, entry, err := oauthStates.Issue(flowGmailConnect, userID, sessionID, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate state"})
+		return
+	}
+
 	// Generate OAuth URL with backend callback
-	authURL := s.config.AuthCodeURL(state, 
+	authURL := s.config.AuthCodeURL(state,
 		oauth2.AccessTypeOffline,
 		oauth2.ApprovalForce,
+		oauth2.S256ChallengeOption(entry.CodeVerifier),
 	)
 
 	fmt.Printf("🔗 Redirecting to Google OAuth for user: %s\n", userID)
@@ -135,20 +152,18 @@ func (s *GmailService) HandleCallbackRedirect(c *gin.Context) {
 		return
 	}
 
-	// Verify state
-	savedState, err := c.Cookie("gmail_state")
-	if err != nil || savedState != state {
+	// Verify state against the session that started the flow
+	sessionID, _ := c.Cookie(oauthSessionCookie)
+	entry, err := oauthStates.Consume(state, flowGmailConnect, sessionID)
+	if err != nil || sessionID == "" {
 		c.Redirect(http.StatusTemporaryRedirect, frontendURL+"/app?error=invalid_state")
 		return
 	}
 
-	// Clear the state cookie
-	c.SetCookie("gmail_state", "", -1, "/", "", false, true)
-
 	ctx := context.Background()
 
 	// Exchange authorization code for token
-	token, err := s.config.Exchange(ctx, code)
+	token, err := s.config.Exchange(ctx, code, oauth2.VerifierOption(entry.CodeVerifier))
 	if err != nil {
 		c.Redirect(http.StatusTemporaryRedirect, frontendURL+"/app?error=token_exchange_failed")
 		return
@@ -168,12 +183,14 @@ func (s *GmailService) HandleCallbackRedirect(c *gin.Context) {
 		return
 	}
 
-	// Store token in database (for now, just log)
-	// storeGmailToken(userID, token)
+	// Store token under the user (or guest) that started the flow
+	store.SaveGmailToken(entry.UserID, token)
 	fmt.Printf("✅ Gmail connected: %s\n", profile.EmailAddress)
 
-	// Start scanning for subscriptions in background
-	go s.scanAndStoreSubscriptions("temp_user", gmailService)
+	// Start scanning for subscriptions in background, from the start of the
+	// mailbox as it may be a different account
+	store.DeleteMailboxState(gmailMailbox(entry.UserID).Key)
+	go s.scan(entry.UserID, gmailService)
 
 	// Redirect to dashboard with success
 	c.Redirect(http.StatusTemporaryRedirect, frontendURL+"/app?gmail_connected=true&email="+profile.EmailAddress)
@@ -190,22 +207,23 @@ func (s *GmailService) HandleCallback(c *gin.Context) {
 	userID := c.GetString("user_id")
 
 	// Verify state token
-	// if !verifyState(userID, req.State) {
-	// 	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
-	// 	return
-	// }
+	entry, err := oauthStates.Consume(req.State, flowGmailConnect, "")
+	if err != nil || entry.UserID != userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+		return
+	}
 
 	ctx := context.Background()
 
 	// Exchange authorization code for token
-	token, err := s.config.Exchange(ctx, req.Code)
+	token, err := s.config.Exchange(ctx, req.Code, oauth2.VerifierOption(entry.CodeVerifier))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to exchange token"})
 		return
 	}
 
 	// Store token in database
-	// storeGmailToken(userID, token)
+	store.SaveGmailToken(userID, token)
 
 	// Create Gmail service
 	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(s.config.TokenSource(ctx, token)))
@@ -221,8 +239,10 @@ func (s *GmailService) HandleCallback(c *gin.Context) {
 		return
 	}
 
-	// Start scanning for subscriptions in background
-	go s.scanAndStoreSubscriptions(userID, gmailService)
+	// Start scanning for subscriptions in background, from the start of the
+	// mailbox as it may be a different account
+	store.DeleteMailboxState(gmailMailbox(userID).Key)
+	go s.scan(userID, gmailService)
 
 	c.JSON(http.StatusOK, CallbackResponse{
 		Success:            true,
@@ -236,13 +256,21 @@ func (s *GmailService) ScanEmails(c *gin.Context) {
 	userID := c.GetString("user_id")
 
 	// Get stored token from database
-	// token := getGmailToken(userID)
-	// if token == nil {
-	// 	c.JSON(http.StatusUnauthorized, gin.H{"error": "Gmail not connected"})
-	// 	return
-	// }
+	token, ok := store.GetGmailToken(userID).(*oauth2.Token)
+	if !ok || token == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Gmail not connected"})
+		return
+	}
+
+	ctx := context.Background()
+	gmailService, err := gmail.NewService(ctx, option.WithTokenSource(s.config.TokenSource(ctx, token)))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Gmail service"})
+		return
+	}
+
+	go s.scan(userID, gmailService)
 
-	// For demo, return success
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "Scan started",
@@ -254,7 +282,8 @@ func (s *GmailService) Disconnect(c *gin.Context) {
 	userID := c.GetString("user_id")
 
 	// Delete token from database
-	// deleteGmailToken(userID)
+	store.DeleteGmailToken(userID)
+	store.DeleteMailboxState(gmailMailbox(userID).Key)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -262,119 +291,147 @@ func (s *GmailService) Disconnect(c *gin.Context) {
 	})
 }
 
-// Background function to scan emails for subscriptions
-func (s *GmailService) scanAndStoreSubscriptions(userID string, gmailService *gmail.Service) {
-	ctx := context.Background()
-
-	// Search queries for subscription-related emails
-	queries := []string{
-		"subject:(receipt OR invoice OR subscription OR renewal OR payment)",
-		"from:(noreply OR no-reply OR billing OR subscriptions)",
+// scan runs a subscription scan over the user's Gmail in the background
+func (s *GmailService) scan(userID string, gmailService *gmail.Service) {
+	provider := &GmailProvider{service: gmailService}
+	if err := s.scanner.scanAndStoreSubscriptions(userID, provider, gmailMailbox(userID)); err != nil {
+		fmt.Printf("❌ Gmail scan failed for user %s: %v\n", userID, err)
 	}
+}
 
-	subscriptions := make(map[string]*Subscription)
+func gmailMailbox(userID string) Mailbox {
+	return Mailbox{Key: "gmail:" + userID, Source: SourceGmail, Label: "Gmail"}
+}
 
-	for _, query := range queries {
-		// Search emails
-		messages, err := gmailService.Users.Messages.List("me").
-			Q(query).
-			MaxResults(100).
-			Do()
-		
-		if err != nil {
-			continue
-		}
+// GmailProvider reads a mailbox through the Gmail API
+type GmailProvider struct {
+	service *gmail.Service
+}
 
-		// Process each message
-		for _, msg := range messages.Messages {
-			message, err := gmailService.Users.Messages.Get("me", msg.Id).
-				Format("full").
-				Do()
-			
-			if err != nil {
-				continue
-			}
+// Cursor is the current time in Unix seconds, for Gmail's after: operator
+func (p *GmailProvider) Cursor(ctx context.Context) (string, error) {
+	return strconv.FormatInt(time.Now().Unix(), 10), nil
+}
 
-			// Extract subscription info using AI/pattern matching
-			sub := s.extractSubscriptionInfo(message)
-			if sub != nil {
-				subscriptions[sub.Name] = sub
-			}
-		}
+func (p *GmailProvider) Search(ctx context.Context, query MailQuery, cursor string) ([]string, error) {
+	terms := make([]string, 0, 2)
+	if len(query.Subjects) > 0 {
+		terms = append(terms, "subject:("+strings.Join(query.Subjects, " OR ")+")")
+	}
+	if len(query.Senders) > 0 {
+		terms = append(terms, "from:("+strings.Join(query.Senders, " OR ")+")")
+	}
+	q := "{" + strings.Join(terms, " ") + "}"
+	if cursor != "" {
+		q += " after:" + cursor
 	}
 
-	// Store subscriptions in storage
-	for _, sub := range subscriptions {
-		store.SaveSubscription(userID, sub)
-		fmt.Printf("✅ Found subscription: %s - $%.2f\n", sub.Name, sub.Price)
+	call := p.service.Users.Messages.List("me").Q(q).Context(ctx)
+	if query.Limit > 0 {
+		call = call.MaxResults(int64(query.Limit))
 	}
-	
-	fmt.Printf("📧 Finished scanning Gmail. Found %d subscriptions\n", len(subscriptions))
+	messages, err := call.Do()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(messages.Messages))
+	for _, msg := range messages.Messages {
+		ids = append(ids, msg.Id)
+	}
+	return ids, nil
 }
 
-// Extract subscription information from email
-func (s *GmailService) extractSubscriptionInfo(message *gmail.Message) *Subscription {
-	// Get email body
-	var body string
-	if message.Payload.Body.Data != "" {
-		decoded, _ := base64.URLEncoding.DecodeString(message.Payload.Body.Data)
-		body = string(decoded)
+func (p *GmailProvider) Fetch(ctx context.Context, id string) (*MailboxMessage, error) {
+	message, err := p.service.Users.Messages.Get("me", id).
+		Format("full").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
 	}
 
-	// Get subject and from
-	var subject, from string
+	result := &MailboxMessage{
+		ID:   message.Id,
+		Date: time.UnixMilli(message.InternalDate),
+	}
+	if message.Payload == nil {
+		return result, nil
+	}
 	for _, header := range message.Payload.Headers {
-		if header.Name == "Subject" {
-			subject = header.Value
-		}
-		if header.Name == "From" {
-			from = header.Value
+		switch header.Name {
+		case "Subject":
+			result.Subject = header.Value
+		case "From":
+			result.From = header.Value
 		}
 	}
 
-	// Simple pattern matching (in production, use AI/ML)
-	// This is a simplified example
-	subscriptionKeywords := map[string]struct {
-		name     string
-		category string
-	}{
-		"netflix":  {"Netflix", "streaming"},
-		"spotify":  {"Spotify", "streaming"},
-		"adobe":    {"Adobe Creative Cloud", "productivity"},
-		"youtube":  {"YouTube Premium", "streaming"},
-		"github":   {"GitHub", "development"},
-		"chatgpt":  {"ChatGPT Plus", "ai"},
+	// Gmail has already decoded the transfer encoding and charset. PDF
+	// attachments are usually only referenced by ID and downloaded after.
+	var pdfs []*gmail.MessagePartBody
+	var walk func(part *gmail.MessagePart)
+	walk = func(part *gmail.MessagePart) {
+		if part.Body != nil && part.Body.Data != "" && part.Filename == "" {
+			if decoded, err := decodeBase64URL(part.Body.Data); err == nil {
+				switch {
+				case strings.HasPrefix(part.MimeType, "text/plain") && result.Text == "":
+					result.Text = string(decoded)
+				case strings.HasPrefix(part.MimeType, "text/html") && result.HTML == "":
+					result.HTML = string(decoded)
+				}
+			}
+		}
+		if isPDFAttachment(part.MimeType, part.Filename) && part.Body != nil {
+			pdfs = append(pdfs, part.Body)
+		}
+		for _, child := range part.Parts {
+			walk(child)
+		}
 	}
+	walk(message.Payload)
 
-	bodyLower := strings.ToLower(body + " " + subject + " " + from)
-	
-	for keyword, info := range subscriptionKeywords {
-		if strings.Contains(bodyLower, keyword) {
-			// Extract price (simplified - would use regex in production)
-			// For demo, return a subscription
-			return &Subscription{
-				ID:              generateTempID(), // Generate unique ID
-				Name:            info.name,
-				Price:           9.99, // Would extract from email
-				BillingCycle:    "monthly",
-				NextBillingDate: time.Now().AddDate(0, 1, 0).Format("2006-01-02"),
-				Category:        info.category,
-				IsAutoDetected:  true,
-			}
+	for _, body := range pdfs {
+		if len(result.Attachments) == maxPDFAttachments {
+			break
+		}
+		if text := p.attachmentText(ctx, message.Id, body); text != "" {
+			result.Attachments = append(result.Attachments, text)
 		}
 	}
 
-	return nil
+	return result, nil
 }
 
-// Helper to generate state token
-func generateState(userID, email string) string {
-	return base64.URLEncoding.EncodeToString(
-		[]byte(fmt.Sprintf("%s:%s:%d", userID, email, time.Now().Unix())),
-	)
+// attachmentText downloads a PDF attachment, unless Gmail already included
+// it in the message, and returns its text
+func (p *GmailProvider) attachmentText(ctx context.Context, messageID string, body *gmail.MessagePartBody) string {
+	if body.Size > maxPDFAttachmentSize {
+		return ""
+	}
+
+	data := body.Data
+	if data == "" && body.AttachmentId != "" {
+		attachment, err := p.service.Users.Messages.Attachments.Get("me", messageID, body.AttachmentId).
+			Context(ctx).
+			Do()
+		if err != nil {
+			return ""
+		}
+		data = attachment.Data
+	}
+
+	decoded, err := decodeBase64URL(data)
+	if err != nil {
+		return ""
+	}
+	text, err := pdfText(decoded)
+	if err != nil {
+		return ""
+	}
+	return text
 }
 
-// Helper to generate a temporary ID
-func generateTempID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
-}
\ No newline at end of file
+func (p *GmailProvider) Close() error {
+	return nil
+}
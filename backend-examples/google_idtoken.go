@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const defaultGoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+var (
+	errUnknownKeyID     = errors.New("unknown key id")
+	errEmailNotVerified = errors.New("email not verified")
+)
+
+// Google issues ID tokens with either form of the issuer
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// GoogleIDClaims are the claims we read from a Google ID token
+type GoogleIDClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+	Locale        string `json:"locale"`
+	jwt.RegisteredClaims
+}
+
+// JWKSCache fetches a JSON Web Key Set and keeps it until it expires.
+// An unknown "kid" triggers a refresh so rotated keys are picked up.
+type JWKSCache struct {
+	url         string
+	client      *http.Client
+	keys        map[string]*rsa.PublicKey
+	expiresAt   time.Time
+	lastFetch   time.Time
+	minInterval time.Duration
+	mu          sync.Mutex
+}
+
+func NewJWKSCache(url string) *JWKSCache {
+	return &JWKSCache{
+		url:         url,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		keys:        make(map[string]*rsa.PublicKey),
+		minInterval: 30 * time.Second,
+	}
+}
+
+// Key returns the public key for kid, refreshing the set when needed
+func (j *JWKSCache) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	if key, ok := j.keys[kid]; ok && now.Before(j.expiresAt) {
+		return key, nil
+	}
+
+	// Don't hammer the key server with unknown kids
+	if now.Sub(j.lastFetch) >= j.minInterval || now.After(j.expiresAt) {
+		if err := j.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	key, ok := j.keys[kid]
+	if !ok {
+		return nil, errUnknownKeyID
+	}
+	return key, nil
+}
+
+func (j *JWKSCache) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch jwks: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		key, err := parseRSAJWK(k.N, k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	j.keys = keys
+	j.lastFetch = time.Now()
+	j.expiresAt = j.lastFetch.Add(cacheMaxAge(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+func parseRSAJWK(n, e string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
+
+// cacheMaxAge reads max-age from a Cache-Control header, defaulting to one hour
+func cacheMaxAge(header string) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if value, ok := strings.CutPrefix(directive, "max-age="); ok {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return time.Hour
+}
+
+// GoogleIDTokenVerifier checks Google Sign-In credentials
+type GoogleIDTokenVerifier struct {
+	clientID string
+	jwks     *JWKSCache
+}
+
+func NewGoogleIDTokenVerifier() *GoogleIDTokenVerifier {
+	jwksURL := os.Getenv("GOOGLE_JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = defaultGoogleJWKSURL
+	}
+
+	return &GoogleIDTokenVerifier{
+		clientID: os.Getenv("GOOGLE_CLIENT_ID"),
+		jwks:     NewJWKSCache(jwksURL),
+	}
+}
+
+// Verify validates signature, audience, issuer, expiry and email verification
+func (v *GoogleIDTokenVerifier) Verify(ctx context.Context, credential string) (*GoogleIDClaims, error) {
+	if v.clientID == "" {
+		return nil, errors.New("GOOGLE_CLIENT_ID is not configured")
+	}
+
+	claims := &GoogleIDClaims{}
+	_, err := jwt.ParseWithClaims(credential, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errUnknownKeyID
+		}
+		return v.jwks.Key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithAudience(v.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	validIssuer := false
+	for _, iss := range googleIssuers {
+		if claims.Issuer == iss {
+			validIssuer = true
+			break
+		}
+	}
+	if !validIssuer {
+		return nil, jwt.ErrTokenInvalidIssuer
+	}
+
+	if !claims.EmailVerified {
+		return nil, errEmailNotVerified
+	}
+
+	return claims, nil
+}
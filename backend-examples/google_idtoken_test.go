@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testGoogleClientID = "test-client.apps.googleusercontent.com"
+
+// googleKeyServer stands in for Google's JWKS endpoint
+type googleKeyServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+}
+
+func newGoogleKeyServer(t *testing.T) *googleKeyServer {
+	t.Helper()
+	ks := &googleKeyServer{keys: make(map[string]*rsa.PrivateKey)}
+	ks.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		ks.fetches++
+
+		keys := make([]map[string]string, 0, len(ks.keys))
+		for kid, key := range ks.keys {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(ks.Close)
+	return ks
+}
+
+func (ks *googleKeyServer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.mu.Lock()
+	ks.keys[kid] = key
+	ks.mu.Unlock()
+	return key
+}
+
+func (ks *googleKeyServer) verifier() *GoogleIDTokenVerifier {
+	return &GoogleIDTokenVerifier{clientID: testGoogleClientID, jwks: NewJWKSCache(ks.URL)}
+}
+
+func googleClaims() *GoogleIDClaims {
+	now := time.Now()
+	return &GoogleIDClaims{
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Name:          "Alice",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "https://accounts.google.com",
+			Subject:   "google-sub-1",
+			Audience:  jwt.ClaimStrings{testGoogleClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	}
+}
+
+func signGoogleToken(t *testing.T, key *rsa.PrivateKey, kid string, claims *GoogleIDClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestGoogleIDTokenVerify(t *testing.T) {
+	ks := newGoogleKeyServer(t)
+	key := ks.addKey(t, "k1")
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name    string
+		kid     string
+		key     *rsa.PrivateKey
+		modify  func(*GoogleIDClaims)
+		wantErr bool
+	}{
+		{name: "valid", kid: "k1", key: key},
+		{name: "issuer without scheme", kid: "k1", key: key, modify: func(c *GoogleIDClaims) { c.Issuer = "accounts.google.com" }},
+		{name: "wrong audience", kid: "k1", key: key, modify: func(c *GoogleIDClaims) { c.Audience = jwt.ClaimStrings{"someone-else"} }, wantErr: true},
+		{name: "wrong issuer", kid: "k1", key: key, modify: func(c *GoogleIDClaims) { c.Issuer = "https://evil.example" }, wantErr: true},
+		{name: "expired", kid: "k1", key: key, modify: func(c *GoogleIDClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour)) }, wantErr: true},
+		{name: "no expiry", kid: "k1", key: key, modify: func(c *GoogleIDClaims) { c.ExpiresAt = nil }, wantErr: true},
+		{name: "email not verified", kid: "k1", key: key, modify: func(c *GoogleIDClaims) { c.EmailVerified = false }, wantErr: true},
+		{name: "signed by another key", kid: "k1", key: other, wantErr: true},
+		{name: "unknown kid", kid: "nope", key: key, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := googleClaims()
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			got, err := ks.verifier().Verify(context.Background(), signGoogleToken(t, tt.key, tt.kid, claims))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if got.Subject != "google-sub-1" || got.Email != "alice@example.com" {
+				t.Errorf("claims = %+v", got)
+			}
+		})
+	}
+}
+
+func TestGoogleIDTokenRejectsOtherAlgorithms(t *testing.T) {
+	ks := newGoogleKeyServer(t)
+	ks.addKey(t, "k1")
+
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, googleClaims())
+	hs.Header["kid"] = "k1"
+	signed, _ := hs.SignedString([]byte("secret"))
+	if _, err := ks.verifier().Verify(context.Background(), signed); err == nil {
+		t.Error("HS256 token accepted")
+	}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, googleClaims())
+	none.Header["kid"] = "k1"
+	unsigned, _ := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := ks.verifier().Verify(context.Background(), unsigned); err == nil {
+		t.Error("unsigned token accepted")
+	}
+}
+
+func TestGoogleIDTokenKeyRotation(t *testing.T) {
+	ks := newGoogleKeyServer(t)
+	key1 := ks.addKey(t, "k1")
+	verifier := ks.verifier()
+	verifier.jwks.minInterval = 0
+
+	if _, err := verifier.Verify(context.Background(), signGoogleToken(t, key1, "k1", googleClaims())); err != nil {
+		t.Fatalf("first key: %v", err)
+	}
+
+	// A token signed with a key published after the cache was filled
+	key2 := ks.addKey(t, "k2")
+	if _, err := verifier.Verify(context.Background(), signGoogleToken(t, key2, "k2", googleClaims())); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if ks.fetches != 2 {
+		t.Errorf("fetches = %d, want 2", ks.fetches)
+	}
+
+	// Cached keys don't refetch
+	verifier.Verify(context.Background(), signGoogleToken(t, key1, "k1", googleClaims()))
+	if ks.fetches != 2 {
+		t.Errorf("fetches = %d after cached key, want 2", ks.fetches)
+	}
+}
+
+func TestJWKSCacheThrottlesUnknownKids(t *testing.T) {
+	ks := newGoogleKeyServer(t)
+	ks.addKey(t, "k1")
+	cache := NewJWKSCache(ks.URL)
+
+	for i := 0; i < 5; i++ {
+		if _, err := cache.Key(context.Background(), "missing"); !errors.Is(err, errUnknownKeyID) {
+			t.Fatalf("err = %v, want errUnknownKeyID", err)
+		}
+	}
+	if ks.fetches != 1 {
+		t.Errorf("fetches = %d, want 1", ks.fetches)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"public, max-age=19845, must-revalidate": 19845 * time.Second,
+		"no-cache":                               time.Hour,
+		"max-age=abc":                            time.Hour,
+		"":                                       time.Hour,
+	}
+	for header, want := range tests {
+		if got := cacheMaxAge(header); got != want {
+			t.Errorf("cacheMaxAge(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
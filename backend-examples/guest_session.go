@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	guestCookie      = "guest_session"
+	guestTTL         = 7 * 24 * time.Hour
+	guestSweepPeriod = time.Hour
+	guestIDPrefix    = "guest_"
+
+	// How long subscriptions found by a guest's unfinished scan still go to
+	// the account the guest signed in to
+	mergedGuestTTL = 24 * time.Hour
+)
+
+// GuestSession lets a visitor connect Gmail before signing in. Its data is
+// stored under the guest ID until it is merged into a real account or expires.
+type GuestSession struct {
+	ID        string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// mergedGuest records where a guest's data went when it signed in
+type mergedGuest struct {
+	UserID    string
+	ExpiresAt time.Time
+}
+
+// guestFromCookie returns the visitor's guest session, or nil
+func guestFromCookie(c *gin.Context) *GuestSession {
+	token, err := c.Cookie(guestCookie)
+	if err != nil || token == "" {
+		return nil
+	}
+	return store.GetGuestSession(hashToken(token))
+}
+
+// startGuestSession returns the existing guest session or creates a new one
+func startGuestSession(c *gin.Context) (*GuestSession, error) {
+	if guest := guestFromCookie(c); guest != nil {
+		return guest, nil
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	guest := &GuestSession{
+		ID:        guestIDPrefix + uuid.NewString(),
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(guestTTL),
+	}
+	store.SaveGuestSession(guest)
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(guestCookie, token, int(guestTTL.Seconds()), "/", "", false, true)
+	return guest, nil
+}
+
+// claimGuestSession moves the visitor's guest data into userID and ends the
+// guest session
+func claimGuestSession(c *gin.Context, userID string) {
+	guest := guestFromCookie(c)
+	if guest == nil {
+		return
+	}
+
+	moved := store.MergeGuest(guest.ID, userID)
+	c.SetCookie(guestCookie, "", -1, "/", "", false, true)
+
+	fmt.Printf("🔀 Merged guest %s into user %s (%d subscriptions)\n", guest.ID, userID, moved)
+}
+
+// GuestOrAuthMiddleware accepts a bearer token like AuthMiddleware, or falls
+// back to the guest session cookie when no Authorization header is sent
+func GuestOrAuthMiddleware() gin.HandlerFunc {
+	auth := AuthMiddleware()
+
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			auth(c)
+			return
+		}
+
+		guest := guestFromCookie(c)
+		if guest == nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			c.Abort()
+			return
+		}
+
+		c.Set("user_id", guest.ID)
+		c.Set("scopes", []string{ScopeSubscriptionsRead, ScopeSubscriptionsWrite})
+		c.Set("auth_type", authTypeGuest)
+
+		c.Next()
+	}
+}
+
+// startGuestJanitor deletes expired guest sessions and their data
+func startGuestJanitor() {
+	ticker := time.NewTicker(guestSweepPeriod)
+	go func() {
+		for range ticker.C {
+			if purged := store.PurgeExpiredGuests(time.Now()); purged > 0 {
+				fmt.Printf("🧹 Purged %d expired guest sessions\n", purged)
+			}
+		}
+	}()
+}
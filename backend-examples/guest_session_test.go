@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMergeGuestRehomesLateScanResults(t *testing.T) {
+	user := testUser(t)
+	guestID := guestIDPrefix + uuid.NewString()
+	store.SaveGuestSession(&GuestSession{ID: guestID, TokenHash: hashToken(guestID), ExpiresAt: time.Now().Add(guestTTL)})
+	store.SaveSubscription(guestID, &Subscription{ID: "1", Name: "Netflix", Price: 15.49})
+
+	if moved := store.MergeGuest(guestID, user.ID); moved != 1 {
+		t.Fatalf("moved = %d, want 1", moved)
+	}
+
+	// The guest's scan is still running and finds another subscription
+	store.SaveSubscription(guestID, &Subscription{ID: "2", Name: "Spotify", Price: 10.99})
+	store.SaveMailboxState(gmailMailbox(guestID).Key, MailboxState{Cursor: "42"})
+
+	if got := len(store.GetSubscriptions(user.ID)); got != 2 {
+		t.Errorf("account has %d subscriptions, want 2", got)
+	}
+	if got := store.GetSubscriptions(guestID); len(got) != 0 {
+		t.Errorf("%d subscriptions left under the guest ID", len(got))
+	}
+
+	// Once the merge is old, leftovers under the guest ID are swept
+	store.PurgeExpiredGuests(time.Now().Add(mergedGuestTTL + time.Minute))
+	if state := store.GetMailboxState(gmailMailbox(guestID).Key); state.Cursor != "" {
+		t.Error("mailbox state of the merged guest was kept")
+	}
+	store.SaveSubscription(guestID, &Subscription{ID: "3", Name: "Hulu"})
+	if got := len(store.GetSubscriptions(user.ID)); got != 2 {
+		t.Errorf("write after the merge expired reached the account")
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IMAPSecurityTLS      = "tls"      // implicit TLS, usually port 993
+	IMAPSecuritySTARTTLS = "starttls" // upgrade on port 143
+	IMAPSecurityNone     = "none"     // only with IMAP_ALLOW_INSECURE
+
+	IMAPAuthPassword = "password" // username and (app) password
+	IMAPAuthXOAUTH2  = "xoauth2"  // username and OAuth access token
+
+	imapTimeout = 30 * time.Second
+	// RFC 2177 asks clients to re-issue IDLE at least every 29 minutes
+	imapIdleRefresh = 25 * time.Minute
+	maxIMAPLiteral  = 25 << 20
+)
+
+var (
+	errIMAPAuth            = errors.New("mailbox rejected the credentials")
+	errIMAPIdleUnsupported = errors.New("server does not support IDLE")
+
+	imapLiteral     = regexp.MustCompile(`\{(\d+)\+?\}$`)
+	imapUIDValidity = regexp.MustCompile(`\[UIDVALIDITY (\d+)\]`)
+	imapUIDNext     = regexp.MustCompile(`\[UIDNEXT (\d+)\]`)
+	imapExists      = regexp.MustCompile(`^\* \d+ EXISTS`)
+)
+
+// IMAPConfig says how to reach and log in to a mailbox
+type IMAPConfig struct {
+	Host         string
+	Port         int
+	Security     string
+	Username     string
+	AuthMethod   string
+	Secret       string // password or access token
+	Mailbox      string
+	AllowPrivate bool // allow loopback and private addresses, for tests and self-hosted servers
+}
+
+// IMAPProvider reads one mailbox over IMAP4rev1 (RFC 3501). The mailbox is
+// opened read-only and messages are fetched with BODY.PEEK so nothing is
+// marked as read.
+type IMAPProvider struct {
+	mu          sync.Mutex
+	conn        net.Conn
+	reader      *bufio.Reader
+	tag         int
+	caps        map[string]bool
+	uidValidity uint64
+	uidNext     uint64
+}
+
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// DialIMAP connects, logs in and opens the configured mailbox
+func DialIMAP(ctx context.Context, config IMAPConfig) (*IMAPProvider, error) {
+	address := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	dialer := &net.Dialer{Timeout: imapTimeout}
+	if !config.AllowPrivate {
+		dialer.Control = refusePrivateAddress
+	}
+
+	var conn net.Conn
+	var err error
+	if config.Security == IMAPSecurityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: config.Host}}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &IMAPProvider{conn: conn, reader: bufio.NewReader(conn)}
+	if err := p.open(ctx, config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *IMAPProvider) open(ctx context.Context, config IMAPConfig) error {
+	p.conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, err := p.readResponse()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting.line, "* OK") && !strings.HasPrefix(greeting.line, "* PREAUTH") {
+		return fmt.Errorf("unexpected greeting: %s", greeting.line)
+	}
+
+	if err := p.capability(ctx); err != nil {
+		return err
+	}
+
+	if config.Security == IMAPSecuritySTARTTLS {
+		if !p.caps["STARTTLS"] {
+			return errors.New("server does not offer STARTTLS")
+		}
+		if _, err := p.command(ctx, "STARTTLS", nil); err != nil {
+			return err
+		}
+		p.conn = tls.Client(p.conn, &tls.Config{ServerName: config.Host})
+		p.reader = bufio.NewReader(p.conn)
+		// Capabilities from before TLS can't be trusted
+		if err := p.capability(ctx); err != nil {
+			return err
+		}
+	}
+
+	if !strings.HasPrefix(greeting.line, "* PREAUTH") {
+		if err := p.authenticate(ctx, config); err != nil {
+			return err
+		}
+	}
+
+	mailbox := config.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	quoted, err := imapQuote(mailbox)
+	if err != nil {
+		return err
+	}
+	responses, err := p.command(ctx, "EXAMINE "+quoted, nil)
+	if err != nil {
+		return err
+	}
+	for _, resp := range responses {
+		if match := imapUIDValidity.FindStringSubmatch(resp.line); match != nil {
+			p.uidValidity, _ = strconv.ParseUint(match[1], 10, 32)
+		}
+		if match := imapUIDNext.FindStringSubmatch(resp.line); match != nil {
+			p.uidNext, _ = strconv.ParseUint(match[1], 10, 32)
+		}
+	}
+	return nil
+}
+
+func (p *IMAPProvider) capability(ctx context.Context) error {
+	responses, err := p.command(ctx, "CAPABILITY", nil)
+	if err != nil {
+		return err
+	}
+	p.caps = make(map[string]bool)
+	for _, resp := range responses {
+		if strings.HasPrefix(resp.line, "* CAPABILITY ") {
+			for _, capability := range strings.Fields(resp.line)[2:] {
+				p.caps[strings.ToUpper(capability)] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (p *IMAPProvider) authenticate(ctx context.Context, config IMAPConfig) error {
+	var err error
+	switch {
+	case config.AuthMethod == IMAPAuthXOAUTH2:
+		ir := base64.StdEncoding.EncodeToString([]byte("user=" + config.Username + "\x01auth=Bearer " + config.Secret + "\x01\x01"))
+		err = p.saslAuthenticate(ctx, "XOAUTH2", ir)
+	case p.caps["AUTH=PLAIN"]:
+		ir := base64.StdEncoding.EncodeToString([]byte("\x00" + config.Username + "\x00" + config.Secret))
+		err = p.saslAuthenticate(ctx, "PLAIN", ir)
+	case p.caps["LOGINDISABLED"]:
+		return errors.New("server does not allow password login without TLS")
+	default:
+		user, qerr := imapQuote(config.Username)
+		if qerr != nil {
+			return qerr
+		}
+		pass, qerr := imapQuote(config.Secret)
+		if qerr != nil {
+			return qerr
+		}
+		_, err = p.command(ctx, "LOGIN "+user+" "+pass, nil)
+	}
+
+	var no *imapStatusError
+	if errors.As(err, &no) {
+		return fmt.Errorf("%w: %s", errIMAPAuth, no.status)
+	}
+	return err
+}
+
+// saslAuthenticate sends the initial response inline when the server
+// supports SASL-IR. An error challenge is answered with an empty line so the
+// server finishes with NO.
+func (p *IMAPProvider) saslAuthenticate(ctx context.Context, mechanism, initial string) error {
+	sent := false
+	continuation := func(challenge string) (string, error) {
+		if sent {
+			return "", nil
+		}
+		sent = true
+		return initial, nil
+	}
+
+	cmd := "AUTHENTICATE " + mechanism
+	if p.caps["SASL-IR"] {
+		cmd += " " + initial
+		sent = true
+	}
+	_, err := p.command(ctx, cmd, continuation)
+	return err
+}
+
+// Cursor is "<UIDVALIDITY>:<last UID>"
+func (p *IMAPProvider) Cursor(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	last := uint64(0)
+	if p.uidNext > 0 {
+		last = p.uidNext - 1
+	} else {
+		// Servers may leave out UIDNEXT
+		uids, err := p.search(ctx, "ALL")
+		if err != nil {
+			return "", err
+		}
+		for _, uid := range uids {
+			if uid > last {
+				last = uid
+			}
+		}
+	}
+	return fmt.Sprintf("%d:%d", p.uidValidity, last), nil
+}
+
+func (p *IMAPProvider) Search(ctx context.Context, query MailQuery, cursor string) ([]string, error) {
+	keys := make([]string, 0, len(query.Subjects)+len(query.Senders))
+	for _, subject := range query.Subjects {
+		quoted, err := imapQuote(subject)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, "SUBJECT "+quoted)
+	}
+	for _, sender := range query.Senders {
+		quoted, err := imapQuote(sender)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, "FROM "+quoted)
+	}
+	if len(keys) == 0 {
+		return []string{}, nil
+	}
+	criteria := "(" + imapOr(keys) + ")"
+
+	// A cursor from another UIDVALIDITY means the mailbox was rebuilt and
+	// its UIDs no longer mean the same messages
+	after := uint64(0)
+	if validity, last, ok := strings.Cut(cursor, ":"); ok && validity == strconv.FormatUint(p.uidValidity, 10) {
+		after, _ = strconv.ParseUint(last, 10, 32)
+		criteria = fmt.Sprintf("UID %d:* %s", after+1, criteria)
+	}
+
+	p.mu.Lock()
+	uids, err := p.search(ctx, criteria)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// "n:*" always includes the newest message, even below n
+	kept := uids[:0]
+	for _, uid := range uids {
+		if uid > after {
+			kept = append(kept, uid)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i] > kept[j] })
+	if query.Limit > 0 && len(kept) > query.Limit {
+		kept = kept[:query.Limit]
+	}
+
+	ids := make([]string, len(kept))
+	for i, uid := range kept {
+		ids[i] = strconv.FormatUint(uid, 10)
+	}
+	return ids, nil
+}
+
+func (p *IMAPProvider) search(ctx context.Context, criteria string) ([]uint64, error) {
+	responses, err := p.command(ctx, "UID SEARCH "+criteria, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make([]uint64, 0)
+	for _, resp := range responses {
+		if !strings.HasPrefix(resp.line, "* SEARCH") {
+			continue
+		}
+		for _, field := range strings.Fields(resp.line)[2:] {
+			if uid, err := strconv.ParseUint(field, 10, 32); err == nil {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	return uids, nil
+}
+
+func (p *IMAPProvider) Fetch(ctx context.Context, id string) (*MailboxMessage, error) {
+	if _, err := strconv.ParseUint(id, 10, 32); err != nil {
+		return nil, fmt.Errorf("invalid UID %q", id)
+	}
+
+	p.mu.Lock()
+	responses, err := p.command(ctx, "UID FETCH "+id+" (UID BODY.PEEK[])", nil)
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, resp := range responses {
+		if strings.Contains(resp.line, "FETCH") && len(resp.literals) > 0 {
+			return parseRawMessage(id, resp.literals[0])
+		}
+	}
+	return nil, fmt.Errorf("message %s not found", id)
+}
+
+// Idle waits for new mail with IDLE (RFC 2177). It returns true when a
+// message arrives, and false when the wait should simply be restarted.
+func (p *IMAPProvider) Idle(ctx context.Context) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.caps["IDLE"] {
+		return false, errIMAPIdleUnsupported
+	}
+
+	p.tag++
+	tag := fmt.Sprintf("A%04d", p.tag)
+	p.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := io.WriteString(p.conn, tag+" IDLE\r\n"); err != nil {
+		return false, err
+	}
+	resp, err := p.readResponse()
+	if err != nil {
+		return false, err
+	}
+	if !strings.HasPrefix(resp.line, "+") {
+		return false, fmt.Errorf("IDLE refused: %s", resp.line)
+	}
+
+	var once sync.Once
+	done := func() {
+		once.Do(func() { io.WriteString(p.conn, "DONE\r\n") })
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			done()
+		case <-time.After(imapIdleRefresh):
+			done()
+		case <-stop:
+		}
+	}()
+
+	newMail := false
+	p.conn.SetDeadline(time.Now().Add(imapIdleRefresh + imapTimeout))
+	for {
+		resp, err := p.readResponse()
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case imapExists.MatchString(resp.line):
+			newMail = true
+			done()
+		case strings.HasPrefix(resp.line, tag+" "):
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			return newMail, nil
+		}
+	}
+}
+
+// Close logs out and closes the connection
+func (p *IMAPProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.command(context.Background(), "LOGOUT", nil)
+	return p.conn.Close()
+}
+
+// command sends a tagged command and reads until its completion, returning
+// the untagged responses. continuation answers "+" requests.
+func (p *IMAPProvider) command(ctx context.Context, cmd string, continuation func(string) (string, error)) ([]imapResponse, error) {
+	p.tag++
+	tag := fmt.Sprintf("A%04d", p.tag)
+
+	deadline := time.Now().Add(imapTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	p.conn.SetDeadline(deadline)
+
+	if _, err := io.WriteString(p.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	untagged := make([]imapResponse, 0)
+	for {
+		resp, err := p.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case strings.HasPrefix(resp.line, "+"):
+			if continuation == nil {
+				return nil, fmt.Errorf("unexpected continuation for %s", strings.Fields(cmd)[0])
+			}
+			reply, err := continuation(strings.TrimSpace(strings.TrimPrefix(resp.line, "+")))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.WriteString(p.conn, reply+"\r\n"); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(resp.line, tag+" "):
+			status := strings.TrimPrefix(resp.line, tag+" ")
+			if strings.HasPrefix(status, "OK") {
+				return untagged, nil
+			}
+			return untagged, &imapStatusError{status: status}
+		default:
+			untagged = append(untagged, resp)
+		}
+	}
+}
+
+// readResponse reads one response line, including any literals it carries
+func (p *IMAPProvider) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	var line strings.Builder
+	for {
+		chunk, err := p.reader.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		chunk = strings.TrimRight(chunk, "\r\n")
+		line.WriteString(chunk)
+
+		match := imapLiteral.FindStringSubmatch(chunk)
+		if match == nil {
+			resp.line = line.String()
+			return resp, nil
+		}
+		size, err := strconv.Atoi(match[1])
+		if err != nil || size > maxIMAPLiteral {
+			return resp, fmt.Errorf("literal too large")
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(p.reader, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+type imapStatusError struct {
+	status string
+}
+
+func (e *imapStatusError) Error() string {
+	return "IMAP: " + e.status
+}
+
+// imapQuote makes a quoted string. Line breaks can't be quoted.
+func imapQuote(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return "", errors.New("value contains a line break")
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`, nil
+}
+
+// imapOr joins search keys with the prefix OR operator
+func imapOr(keys []string) string {
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	return "OR " + keys[0] + " " + imapOr(keys[1:])
+}
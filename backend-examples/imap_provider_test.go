@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	testIMAPUser     = "alice@example.com"
+	testIMAPPassword = `app "pass" \ word`
+)
+
+// imapServer is a small IMAP4rev1 server holding one read-only mailbox
+type imapServer struct {
+	net.Listener
+	mu         sync.Mutex
+	validity   uint64
+	messages   map[uint64]string // UID -> raw message
+	greeting   string
+	mailOnIdle bool // announce a new message while idling
+	searches   []string
+}
+
+func newIMAPServer(t *testing.T) *imapServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &imapServer{Listener: ln, validity: 1, messages: make(map[uint64]string), greeting: "* OK IMAP4rev1 ready"}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *imapServer) add(uid uint64, from, subject, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[uid] = fmt.Sprintf("From: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, subject, time.Now().Format(time.RFC1123Z), body)
+}
+
+func (s *imapServer) config() IMAPConfig {
+	host, port, _ := net.SplitHostPort(s.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	return IMAPConfig{
+		Host:         host,
+		Port:         portNumber,
+		Security:     IMAPSecurityNone,
+		Username:     testIMAPUser,
+		AuthMethod:   IMAPAuthPassword,
+		Secret:       testIMAPPassword,
+		AllowPrivate: true,
+	}
+}
+
+func (s *imapServer) uids() []uint64 {
+	uids := make([]uint64, 0, len(s.messages))
+	for uid := range s.messages {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+var imapSearchRange = regexp.MustCompile(`^UID (\d+):\* `)
+
+func (s *imapServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	write := func(lines ...string) {
+		for _, line := range lines {
+			fmt.Fprint(conn, line+"\r\n")
+		}
+	}
+
+	s.mu.Lock()
+	write(s.greeting)
+	s.mu.Unlock()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, cmd, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		verb := strings.ToUpper(strings.Fields(cmd + " ")[0])
+		if verb == "UID" {
+			verb += " " + strings.ToUpper(strings.Fields(cmd)[1])
+		}
+
+		s.mu.Lock()
+		switch verb {
+		case "CAPABILITY":
+			write("* CAPABILITY IMAP4rev1 IDLE", tag+" OK CAPABILITY completed")
+		case "LOGIN":
+			args := imapArgs(strings.TrimPrefix(cmd, "LOGIN "))
+			if len(args) == 2 && args[0] == testIMAPUser && args[1] == testIMAPPassword {
+				write(tag + " OK LOGIN completed")
+			} else {
+				write(tag + " NO [AUTHENTICATIONFAILED] Invalid credentials")
+			}
+		case "EXAMINE":
+			uids := s.uids()
+			next := uint64(1)
+			if len(uids) > 0 {
+				next = uids[len(uids)-1] + 1
+			}
+			write(fmt.Sprintf("* %d EXISTS", len(uids)),
+				fmt.Sprintf("* OK [UIDVALIDITY %d] UIDs valid", s.validity),
+				fmt.Sprintf("* OK [UIDNEXT %d] Predicted next UID", next),
+				tag+" OK [READ-ONLY] EXAMINE completed")
+		case "UID SEARCH":
+			criteria := strings.TrimPrefix(cmd, "UID SEARCH ")
+			s.searches = append(s.searches, criteria)
+			found := make([]string, 0)
+			uids := s.uids()
+			for i, uid := range uids {
+				// Like real servers, n:* includes the newest message even below n
+				if match := imapSearchRange.FindStringSubmatch(criteria); match != nil {
+					from, _ := strconv.ParseUint(match[1], 10, 32)
+					if uid < from && i != len(uids)-1 {
+						continue
+					}
+				}
+				found = append(found, strconv.FormatUint(uid, 10))
+			}
+			write(strings.TrimSpace("* SEARCH "+strings.Join(found, " ")), tag+" OK SEARCH completed")
+		case "UID FETCH":
+			uid, _ := strconv.ParseUint(strings.Fields(cmd)[2], 10, 32)
+			if raw, ok := s.messages[uid]; ok {
+				fmt.Fprintf(conn, "* 1 FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", uid, len(raw), raw)
+			}
+			write(tag + " OK FETCH completed")
+		case "IDLE":
+			write("+ idling")
+			if s.mailOnIdle {
+				write(fmt.Sprintf("* %d EXISTS", len(s.messages)+1))
+			}
+			s.mu.Unlock()
+			if done, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(done) != "DONE" {
+				return
+			}
+			s.mu.Lock()
+			write(tag + " OK IDLE terminated")
+		case "LOGOUT":
+			write("* BYE", tag+" OK LOGOUT completed")
+			s.mu.Unlock()
+			return
+		default:
+			write(tag + " BAD unknown command")
+		}
+		s.mu.Unlock()
+	}
+}
+
+// imapArgs splits atoms and quoted strings
+func imapArgs(value string) []string {
+	args := make([]string, 0)
+	for value = strings.TrimSpace(value); value != ""; value = strings.TrimSpace(value) {
+		if value[0] != '"' {
+			atom, rest, _ := strings.Cut(value, " ")
+			args, value = append(args, atom), rest
+			continue
+		}
+		var arg strings.Builder
+		i := 1
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] == '\\' {
+				i++
+			}
+			arg.WriteByte(value[i])
+		}
+		args, value = append(args, arg.String()), value[i+1:]
+	}
+	return args
+}
+
+func dialTestIMAP(t *testing.T, config IMAPConfig) *IMAPProvider {
+	t.Helper()
+	p, err := DialIMAP(context.Background(), config)
+	if err != nil {
+		t.Fatalf("DialIMAP: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestIMAPLoginFailure(t *testing.T) {
+	server := newIMAPServer(t)
+	config := server.config()
+	config.Secret = "wrong"
+
+	if _, err := DialIMAP(context.Background(), config); !errors.Is(err, errIMAPAuth) {
+		t.Errorf("err = %v, want errIMAPAuth", err)
+	}
+}
+
+func TestIMAPRefusesPrivateAddresses(t *testing.T) {
+	config := newIMAPServer(t).config()
+	config.AllowPrivate = false
+
+	if _, err := DialIMAP(context.Background(), config); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("err = %v, want errPrivateAddress", err)
+	}
+}
+
+func TestIMAPFetchReadsLiterals(t *testing.T) {
+	server := newIMAPServer(t)
+	server.add(7, "Netflix <info@account.netflix.com>", "Your Netflix receipt", "Total: $15.49/month\r\n(with a parenthesis) and {braces}")
+	p := dialTestIMAP(t, server.config())
+
+	message, err := p.Fetch(context.Background(), "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != "7" || message.Subject != "Your Netflix receipt" || !strings.Contains(message.Text, "{braces}") {
+		t.Errorf("message = %+v", message)
+	}
+
+	if _, err := p.Fetch(context.Background(), "8"); err == nil {
+		t.Error("missing message fetched")
+	}
+	if _, err := p.Fetch(context.Background(), "1:*"); err == nil {
+		t.Error("UID range accepted as an ID")
+	}
+}
+
+func TestIMAPSearchCursor(t *testing.T) {
+	server := newIMAPServer(t)
+	server.add(3, "a@example.com", "receipt one", "")
+	server.add(4, "b@example.com", "receipt two", "")
+	query := MailQuery{Subjects: []string{"receipt"}}
+
+	p := dialTestIMAP(t, server.config())
+	cursor, err := p.Cursor(context.Background())
+	if err != nil || cursor != "1:4" {
+		t.Fatalf("cursor = %q, %v", cursor, err)
+	}
+
+	// Nothing new: the server still answers 5:* with UID 4
+	ids, err := p.Search(context.Background(), query, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("search after cursor = %v, want none", ids)
+	}
+
+	server.add(5, "c@example.com", "receipt three", "")
+	p2 := dialTestIMAP(t, server.config())
+	if ids, _ := p2.Search(context.Background(), query, cursor); strings.Join(ids, ",") != "5" {
+		t.Errorf("new messages = %v, want [5]", ids)
+	}
+
+	// The mailbox was rebuilt, so the old cursor's UIDs mean nothing
+	server.mu.Lock()
+	server.validity = 2
+	server.searches = nil
+	server.mu.Unlock()
+	p3 := dialTestIMAP(t, server.config())
+	if ids, _ := p3.Search(context.Background(), query, cursor); strings.Join(ids, ",") != "5,4,3" {
+		t.Errorf("after UIDVALIDITY change = %v, want every message newest first", ids)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.searches) != 1 || strings.HasPrefix(server.searches[0], "UID ") {
+		t.Errorf("searches = %q, want one without a UID range", server.searches)
+	}
+}
+
+func TestIMAPIdle(t *testing.T) {
+	server := newIMAPServer(t)
+	server.mu.Lock()
+	server.mailOnIdle = true
+	server.mu.Unlock()
+	p := dialTestIMAP(t, server.config())
+
+	newMail, err := p.Idle(context.Background())
+	if err != nil || !newMail {
+		t.Fatalf("Idle = %v, %v, want new mail", newMail, err)
+	}
+
+	// The connection is usable after DONE
+	if _, err := p.Cursor(context.Background()); err != nil {
+		t.Errorf("command after IDLE: %v", err)
+	}
+
+	server.mu.Lock()
+	server.mailOnIdle = false
+	server.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if newMail, err := p.Idle(ctx); newMail || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled Idle = %v, %v", newMail, err)
+	}
+}
+
+func TestIMAPScanStoresSubscriptions(t *testing.T) {
+	server := newIMAPServer(t)
+	server.add(1, "Netflix <info@account.netflix.com>", "Your Netflix receipt", "Thanks for your payment.\r\nTotal: $15.49/month")
+	user := testUser(t)
+	t.Setenv("IMAP_ALLOW_INSECURE", "true")
+	service := NewMailAccountService(NewMailScanner(nil))
+
+	config := server.config()
+	account := &MailAccount{
+		ID: uuid.NewString(), UserID: user.ID, Label: "Test", Host: config.Host, Port: config.Port,
+		Security: IMAPSecurityNone, Username: testIMAPUser, AuthMethod: IMAPAuthPassword, Secret: testIMAPPassword,
+	}
+	store.SaveMailAccount(account)
+	service.scanAccount(user.ID, account.ID)
+
+	if got := store.GetMailAccount(user.ID, account.ID); got.LastError != "" || got.LastScanAt == nil {
+		t.Errorf("account after scan = %+v", got)
+	}
+	subs := store.GetSubscriptions(user.ID)
+	if len(subs) != 1 || subs[0].Name != "Netflix" || subs[0].Price != 15.49 || subs[0].Sources[0] != SourceIMAP {
+		t.Errorf("subscriptions = %+v", subs)
+	}
+}
+
+func TestCreateMailAccountHidesServerReplies(t *testing.T) {
+	server := newIMAPServer(t)
+	server.mu.Lock()
+	server.greeting = "* BYE internal-db.corp.example is not an IMAP server"
+	server.mu.Unlock()
+	t.Setenv("IMAP_ALLOW_INSECURE", "true")
+
+	r := gin.New()
+	r.POST("/accounts", AuthMiddleware(), NewMailAccountService(NewMailScanner(nil)).CreateAccount)
+	tokens, _ := issueSession(testUser(t))
+	config := server.config()
+	request := CreateMailAccountRequest{Host: config.Host, Port: config.Port, Security: IMAPSecurityNone, Username: testIMAPUser, Password: "wrong"}
+
+	w := serveJSON(r, http.MethodPost, "/accounts", request, tokens.AccessToken)
+	if w.Code != http.StatusBadGateway || strings.Contains(w.Body.String(), "internal-db") {
+		t.Errorf("bad greeting = %d %s", w.Code, w.Body.String())
+	}
+
+	server.mu.Lock()
+	server.greeting = "* OK ready"
+	server.mu.Unlock()
+	if w := serveJSON(r, http.MethodPost, "/accounts", request, tokens.AccessToken); w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "AUTHENTICATIONFAILED") {
+		t.Errorf("wrong password = %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const maxStatementSize = 5 << 20
+
+// Transaction is one line of an imported bank or card statement
+type Transaction struct {
+	ID          string  `json:"id"`
+	UserID      string  `json:"-"`
+	ImportID    string  `json:"importId"`
+	Date        string  `json:"date"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"` // negative for money out
+	Currency    string  `json:"currency"`
+	Reference   string  `json:"reference,omitempty"`
+}
+
+// StatementImport records one uploaded statement file
+type StatementImport struct {
+	ID               string    `json:"id"`
+	UserID           string    `json:"-"`
+	FileName         string    `json:"fileName"`
+	Format           string    `json:"format"`
+	Profile          string    `json:"profile,omitempty"`
+	Account          string    `json:"account,omitempty"`
+	Currency         string    `json:"currency"`
+	TransactionCount int       `json:"transactionCount"`
+	Duplicates       int       `json:"duplicates"`
+	Skipped          int       `json:"skipped"`
+	Detected         int       `json:"detected"` // subscriptions found after this import
+	DateFrom         string    `json:"dateFrom,omitempty"`
+	DateTo           string    `json:"dateTo,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+type ImportService struct {
+	dispatcher NotificationDispatcher
+}
+
+func NewImportService(dispatcher NotificationDispatcher) *ImportService {
+	return &ImportService{dispatcher: dispatcher}
+}
+
+// ListProfiles returns the CSV column-mapping profiles
+func (s *ImportService) ListProfiles(c *gin.Context) {
+	profiles := make([]*CSVProfile, 0, len(csvProfiles))
+	for _, profile := range csvProfiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+
+	c.JSON(http.StatusOK, gin.H{"profiles": profiles})
+}
+
+// ImportStatement parses an uploaded CSV, OFX or QIF statement and stores its
+// transactions. Lines already imported from an overlapping statement are
+// counted as duplicates and not stored again.
+//
+// Form fields: file (required), format, profile, mapping (JSON CSVProfile
+// for banks without a profile), currency, account.
+func (s *ImportService) ImportStatement(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	// Leave room for the multipart envelope around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxStatementSize+(1<<20))
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Statement file is required"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	data, err := readLimited(file, maxStatementSize)
+	file.Close()
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+
+	currency := strings.ToUpper(strings.TrimSpace(c.PostForm("currency")))
+	if currency == "" {
+		if user := store.GetUser(userID); user != nil {
+			currency = user.HomeCurrency
+		}
+	}
+	if !currencyCodePattern.MatchString(currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid currency code"})
+		return
+	}
+
+	format := strings.ToLower(c.PostForm("format"))
+	if format == "" {
+		format = detectStatementFormat(fileHeader.Filename, data)
+	}
+
+	imp := &StatementImport{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		FileName:  fileHeader.Filename,
+		Format:    format,
+		Account:   strings.TrimSpace(c.PostForm("account")),
+		Currency:  currency,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var parsed []ParsedTransaction
+	switch format {
+	case FormatCSV:
+		profile, err := csvProfileFromForm(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		imp.Profile = profile.Name
+		parsed, imp.Skipped, err = parseCSVStatement(data, profile)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+	case FormatOFX:
+		var ofxCurrency string
+		parsed, ofxCurrency, imp.Skipped, err = parseOFXStatement(data)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if ofxCurrency != "" && c.PostForm("currency") == "" {
+			imp.Currency = strings.ToUpper(ofxCurrency)
+		}
+	case FormatQIF:
+		parsed, imp.Skipped, err = parseQIFStatement(data, nil)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be csv, ofx or qif"})
+		return
+	}
+
+	if len(parsed) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "No transactions found in file"})
+		return
+	}
+
+	txns := make([]*Transaction, 0, len(parsed))
+	for _, p := range parsed {
+		txnCurrency := imp.Currency
+		if p.Currency != "" {
+			txnCurrency = strings.ToUpper(p.Currency)
+		}
+
+		date := p.Date.Format(dateLayout)
+		if imp.DateFrom == "" || date < imp.DateFrom {
+			imp.DateFrom = date
+		}
+		if date > imp.DateTo {
+			imp.DateTo = date
+		}
+
+		txns = append(txns, &Transaction{
+			ID:          uuid.NewString(),
+			UserID:      userID,
+			ImportID:    imp.ID,
+			Date:        date,
+			Description: p.Description,
+			Amount:      p.Amount,
+			Currency:    txnCurrency,
+			Reference:   p.Reference,
+		})
+	}
+
+	store.SaveStatementImport(imp, txns)
+
+	fmt.Printf("🏦 Imported %d transactions from %s (%s) for user %s\n", imp.TransactionCount, imp.FileName, imp.Format, userID)
+
+	// The new lines may complete a pattern with earlier imports
+	if imp.TransactionCount > 0 {
+		imp.Detected = len(s.storeRecurring(c.Request.Context(), userID))
+	}
+
+	c.JSON(http.StatusCreated, imp)
+}
+
+// ListImports returns the user's imported statements, newest first
+func (s *ImportService) ListImports(c *gin.Context) {
+	imports := store.GetStatementImports(c.GetString("user_id"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"imports": imports,
+		"total":   len(imports),
+	})
+}
+
+// GetImport returns one import with its transactions
+func (s *ImportService) GetImport(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	imp := store.GetStatementImport(userID, c.Param("id"))
+	if imp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"import":       imp,
+		"transactions": store.GetTransactions(userID, imp.ID),
+	})
+}
+
+// DeleteImport removes an import and its transactions
+func (s *ImportService) DeleteImport(c *gin.Context) {
+	if !store.DeleteStatementImport(c.GetString("user_id"), c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Import deleted",
+	})
+}
+
+// ListTransactions returns all imported transactions, newest first
+func (s *ImportService) ListTransactions(c *gin.Context) {
+	txns := store.GetTransactions(c.GetString("user_id"), "")
+
+	c.JSON(http.StatusOK, gin.H{
+		"transactions": txns,
+		"total":        len(txns),
+	})
+}
+
+// ListRecurring previews the recurring charges found in the user's
+// transactions without saving them, including low-confidence ones
+func (s *ImportService) ListRecurring(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	charges := detectRecurringCharges(store.GetTransactions(userID, ""), s.today(userID))
+
+	c.JSON(http.StatusOK, gin.H{
+		"recurring":     charges,
+		"total":         len(charges),
+		"minConfidence": minRecurringConfidence,
+	})
+}
+
+// DetectRecurring saves the confident recurring charges as subscriptions
+func (s *ImportService) DetectRecurring(c *gin.Context) {
+	subs := s.storeRecurring(c.Request.Context(), c.GetString("user_id"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"subscriptions": subs,
+		"total":         len(subs),
+	})
+}
+
+// storeRecurring runs detection over all of the user's transactions and saves
+// the confident results the same way a Gmail scan does
+func (s *ImportService) storeRecurring(ctx context.Context, userID string) []*Subscription {
+	subs := make([]*Subscription, 0)
+	for _, charge := range detectRecurringCharges(store.GetTransactions(userID, ""), s.today(userID)) {
+		if charge.Confidence >= minRecurringConfidence {
+			subs = append(subs, charge.Subscription)
+		}
+	}
+
+	storeDetectedSubscriptions(ctx, s.dispatcher, userID, subs)
+	return subs
+}
+
+// today is the user's local date, which next billing dates are rolled to
+func (s *ImportService) today(userID string) time.Time {
+	now := time.Now()
+	if user := store.GetUser(userID); user != nil {
+		now = now.In(userLocation(user))
+	}
+	return dateOnly(now)
+}
+
+// csvProfileFromForm picks the named profile, or builds one from a custom
+// mapping
+func csvProfileFromForm(c *gin.Context) (*CSVProfile, error) {
+	if mapping := c.PostForm("mapping"); mapping != "" {
+		var profile CSVProfile
+		if err := json.Unmarshal([]byte(mapping), &profile); err != nil {
+			return nil, fmt.Errorf("invalid mapping: %w", err)
+		}
+		if len(profile.Date) == 0 || (len(profile.Amount) == 0 && len(profile.Debit) == 0 && len(profile.Credit) == 0) {
+			return nil, fmt.Errorf("mapping needs a date column and an amount, debit or credit column")
+		}
+		if len(profile.DateLayouts) == 0 {
+			profile.DateLayouts = csvProfiles["generic"].DateLayouts
+		}
+		profile.Name = "custom"
+		return &profile, nil
+	}
+
+	name := c.DefaultPostForm("profile", "generic")
+	profile := csvProfiles[name]
+	if profile == nil {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	return profile, nil
+}
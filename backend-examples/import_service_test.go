@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func importRouter() *gin.Engine {
+	s := NewImportService(&recordingDispatcher{})
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.POST("/statements", s.ImportStatement)
+	r.GET("/statements/:id", s.GetImport)
+	r.DELETE("/statements/:id", s.DeleteImport)
+	return r
+}
+
+func uploadStatement(t *testing.T, r http.Handler, token, fileName, data string, fields map[string]string) *StatementImport {
+	t.Helper()
+	w := serveUpload(r, "/statements", fileName, []byte(data), fields, token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("import %s = %d %s", fileName, w.Code, w.Body.String())
+	}
+	var imp StatementImport
+	if err := json.Unmarshal(w.Body.Bytes(), &imp); err != nil {
+		t.Fatal(err)
+	}
+	return &imp
+}
+
+func TestImportStatementSkipsDuplicates(t *testing.T) {
+	r := importRouter()
+	tokens, _ := issueSession(testUser(t))
+	csv := "Date,Description,Amount\n" +
+		"2026-01-05,NETFLIX.COM,-15.49\n" +
+		"2026-01-06,COFFEE,-3.20\n"
+
+	first := uploadStatement(t, r, tokens.AccessToken, "jan.csv", csv, map[string]string{"currency": "USD"})
+	if first.Format != FormatCSV || first.TransactionCount != 2 || first.DateFrom != "2026-01-05" || first.DateTo != "2026-01-06" {
+		t.Errorf("first import = %+v", first)
+	}
+
+	// The same lines again, plus one new one
+	again := uploadStatement(t, r, tokens.AccessToken, "jan-feb.csv", csv+"2026-02-05,NETFLIX.COM,-15.49\n", map[string]string{"currency": "USD"})
+	if again.TransactionCount != 1 || again.Duplicates != 2 {
+		t.Errorf("second import saved %d with %d duplicates, want 1 and 2", again.TransactionCount, again.Duplicates)
+	}
+
+	if w := serveJSON(r, http.MethodDelete, "/statements/"+first.ID, nil, tokens.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("delete = %d", w.Code)
+	}
+	if w := serveJSON(r, http.MethodGet, "/statements/"+first.ID, nil, tokens.AccessToken); w.Code != http.StatusNotFound {
+		t.Errorf("get after delete = %d", w.Code)
+	}
+}
+
+func TestImportStatementFormats(t *testing.T) {
+	r := importRouter()
+	tokens, _ := issueSession(testUser(t))
+
+	ofx := "OFXHEADER:100\n<OFX><CURDEF>GBP\n<STMTTRN><DTPOSTED>20260105<TRNAMT>-9.99<FITID>A1<NAME>SPOTIFY</STMTTRN></OFX>"
+	imp := uploadStatement(t, r, tokens.AccessToken, "download", ofx, map[string]string{"currency": ""})
+	if imp.Format != FormatOFX || imp.Currency != "GBP" {
+		t.Errorf("OFX import = %+v, want the file's currency", imp)
+	}
+
+	thai := "วันที่,รายละเอียด,ถอนเงิน,ฝากเงิน\n05/01/2569,NETFLIX,419.00,\n"
+	imp = uploadStatement(t, r, tokens.AccessToken, "kbank.csv", thai, map[string]string{"profile": "kbank", "currency": "THB"})
+	if imp.Profile != "kbank" || imp.DateFrom != "2026-01-05" {
+		t.Errorf("KBank import = %+v", imp)
+	}
+
+	for name, fields := range map[string]map[string]string{
+		"unknown profile": {"profile": "nope", "currency": "USD"},
+		"bad mapping":     {"mapping": `{"date":["when"]}`, "currency": "USD"},
+		"bad currency":    {"currency": "dollars"},
+	} {
+		if w := serveUpload(r, "/statements", "x.csv", []byte("Date,Amount\n2026-01-05,-1\n"), fields, tokens.AccessToken); w.Code != http.StatusBadRequest {
+			t.Errorf("%s = %d, want 400", name, w.Code)
+		}
+	}
+
+	if w := serveUpload(r, "/statements", "empty.csv", []byte("Date,Description,Amount\n"), map[string]string{"currency": "USD"}, tokens.AccessToken); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("file without transactions = %d, want 422", w.Code)
+	}
+}
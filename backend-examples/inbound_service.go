@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SourceInbound = "inbound"
+
+	maxInboundMessageSize = 10 << 20
+	maxAllowedSenders     = 20
+)
+
+var (
+	errInboundDisabled  = errors.New("inbound email is not configured")
+	errInboundRecipient = errors.New("no such forwarding address")
+	errInboundSender    = errors.New("sender is not allowed")
+	errInboundUnchecked = errors.New("sender could not be verified")
+	errInboundSpam      = errors.New("message looks like spam")
+	errInboundTooLarge  = errors.New("message is too large")
+)
+
+// Senders of forwarding confirmations, accepted before the user's mailbox
+// is on the allowlist
+var forwardingConfirmationSenders = map[string]string{
+	"forwarding-noreply@google.com": "https://mail.google.com/",
+}
+
+// InboundAddress is a user's private address for forwarding receipts to
+type InboundAddress struct {
+	UserID         string     `json:"-"`
+	LocalPart      string     `json:"-"`
+	Address        string     `json:"address"`
+	AllowedSenders []string   `json:"allowedSenders"` // addresses or "@domain", the account email is always allowed
+	Verification   string     `json:"verification,omitempty"`
+	VerifyURL      string     `json:"verifyUrl,omitempty"`
+	Received       int        `json:"received"`
+	Rejected       int        `json:"rejected"`
+	LastReceivedAt *time.Time `json:"lastReceivedAt,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+func (a *InboundAddress) copy() *InboundAddress {
+	result := *a
+	result.AllowedSenders = append([]string(nil), a.AllowedSenders...)
+	return &result
+}
+
+// allows reports whether mail with this envelope sender may be delivered.
+// Header addresses aren't considered: anyone can write them.
+func (a *InboundAddress) allows(accountEmail, envelopeFrom string) bool {
+	sender := normalizeSender(envelopeFrom)
+	if sender == "" {
+		return false
+	}
+	if accountEmail != "" && sender == normalizeSender(accountEmail) {
+		return true
+	}
+	for _, allowed := range a.AllowedSenders {
+		if strings.HasPrefix(allowed, "@") && strings.HasSuffix(sender, allowed) || sender == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+type UpdateInboundSendersRequest struct {
+	AllowedSenders []string `json:"allowedSenders"`
+}
+
+// InboundService gives each user an address to forward receipts to, for
+// people who would rather not connect a mailbox. Mail arrives through the
+// embedded SMTP receiver or a raw MIME webhook from an inbound relay.
+//
+// The envelope sender is only believed once it is verified: by our own SPF
+// check when mail comes straight to the SMTP receiver, or by the SPF result
+// a relay we trust wrote in Authentication-Results.
+type InboundService struct {
+	scanner       *MailScanner
+	domain        string
+	webhookSecret string
+	smtpAddr      string
+	smtpHostname  string
+	resolver      spfResolver
+	relays        []*net.IPNet // SMTP clients whose Authentication-Results we read
+	authservID    string       // the authserv-id those relays and the webhook's relay write results under
+}
+
+func NewInboundService(scanner *MailScanner) *InboundService {
+	domain := strings.ToLower(os.Getenv("INBOUND_DOMAIN"))
+	return &InboundService{
+		scanner:       scanner,
+		domain:        domain,
+		webhookSecret: os.Getenv("INBOUND_WEBHOOK_SECRET"),
+		smtpAddr:      os.Getenv("INBOUND_SMTP_ADDR"),
+		smtpHostname:  envOr("INBOUND_SMTP_HOSTNAME", domain),
+		resolver:      net.DefaultResolver,
+		relays:        parseRelays(os.Getenv("INBOUND_TRUSTED_RELAYS")),
+		authservID:    strings.ToLower(os.Getenv("INBOUND_AUTHSERV_ID")),
+	}
+}
+
+// parseRelays reads a comma-separated list of IPs and CIDR ranges
+func parseRelays(value string) []*net.IPNet {
+	var relays []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			fmt.Printf("⚠️  INBOUND_TRUSTED_RELAYS: ignoring %q\n", entry)
+			continue
+		}
+		relays = append(relays, network)
+	}
+	return relays
+}
+
+// trustedRelay reports whether ip is one of the configured relays
+func (s *InboundService) trustedRelay(ip net.IP) bool {
+	if s.authservID == "" {
+		return false
+	}
+	for _, relay := range s.relays {
+		if relay.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start runs the SMTP receiver when INBOUND_SMTP_ADDR is set
+func (s *InboundService) Start(ctx context.Context) {
+	if s.domain == "" || s.smtpAddr == "" {
+		return
+	}
+
+	go func() {
+		if err := s.ListenSMTP(ctx, s.smtpAddr); err != nil {
+			fmt.Printf("❌ Inbound SMTP stopped: %v\n", err)
+		}
+	}()
+}
+
+// GetAddress returns the user's forwarding address, creating it on first use
+func (s *InboundService) GetAddress(c *gin.Context) {
+	if s.domain == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Email forwarding is not configured"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	if address := store.GetInboundAddress(userID); address != nil {
+		c.JSON(http.StatusOK, address)
+		return
+	}
+
+	address, err := s.newAddress(userID, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create forwarding address"})
+		return
+	}
+	c.JSON(http.StatusCreated, address)
+}
+
+// RotateAddress replaces the user's address, e.g. after it leaked. Mail to
+// the old address is rejected from then on.
+func (s *InboundService) RotateAddress(c *gin.Context) {
+	if s.domain == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Email forwarding is not configured"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	var senders []string
+	if old := store.GetInboundAddress(userID); old != nil {
+		senders = old.AllowedSenders
+	}
+
+	address, err := s.newAddress(userID, senders)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create forwarding address"})
+		return
+	}
+	c.JSON(http.StatusOK, address)
+}
+
+// UpdateSenders replaces the addresses and domains allowed to forward mail
+func (s *InboundService) UpdateSenders(c *gin.Context) {
+	var req UpdateInboundSendersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if len(req.AllowedSenders) > maxAllowedSenders {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d senders are allowed", maxAllowedSenders)})
+		return
+	}
+
+	senders := make([]string, 0, len(req.AllowedSenders))
+	for _, sender := range req.AllowedSenders {
+		sender = strings.ToLower(strings.TrimSpace(sender))
+		if !strings.HasPrefix(sender, "@") {
+			sender = normalizeSender(sender)
+		}
+		if !strings.Contains(sender, "@") || strings.HasSuffix(sender, "@") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Senders must be email addresses or @domain"})
+			return
+		}
+		senders = append(senders, sender)
+	}
+
+	address := store.UpdateInboundAddress(c.GetString("user_id"), func(a *InboundAddress) {
+		a.AllowedSenders = senders
+	})
+	if address == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No forwarding address yet"})
+		return
+	}
+	c.JSON(http.StatusOK, address)
+}
+
+// Webhook accepts one raw MIME message from an inbound relay. The relay
+// passes the envelope in ?to= and ?from=, or the X-Inbound-Recipient and
+// X-Inbound-Sender headers.
+func (s *InboundService) Webhook(c *gin.Context) {
+	if s.domain == "" || s.webhookSecret == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.webhookSecret)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid webhook secret"})
+		return
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(c.Request.Body, maxInboundMessageSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read message"})
+		return
+	}
+
+	recipient := firstNonEmpty(c.Query("to"), c.GetHeader("X-Inbound-Recipient"))
+	sender := firstNonEmpty(c.Query("from"), c.GetHeader("X-Inbound-Sender"))
+	if recipient == "" {
+		recipient = s.headerRecipient(raw)
+	}
+
+	found, err := s.deliver(c.Request.Context(), recipient, sender, raw, false)
+	if err != nil {
+		c.JSON(inboundErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"subscriptionsFound": found})
+}
+
+// lookup returns the forwarding address for a recipient on our domain
+func (s *InboundService) lookup(recipient string) (*InboundAddress, error) {
+	if s.domain == "" {
+		return nil, errInboundDisabled
+	}
+
+	local, domain, ok := strings.Cut(normalizeSender(recipient), "@")
+	if !ok || domain != s.domain {
+		return nil, errInboundRecipient
+	}
+	address := store.FindInboundAddress(local)
+	if address == nil {
+		return nil, errInboundRecipient
+	}
+	return address, nil
+}
+
+// deliver runs one forwarded message through the extractors for the owner
+// of the recipient address. It returns how many subscriptions were found.
+// Unless spfPassed, the relay's Authentication-Results must vouch for the
+// envelope sender.
+func (s *InboundService) deliver(ctx context.Context, recipient, envelopeFrom string, raw []byte, spfPassed bool) (int, error) {
+	address, err := s.lookup(recipient)
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) > maxInboundMessageSize {
+		return 0, errInboundTooLarge
+	}
+
+	header, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return 0, err
+	}
+	if looksLikeSpam(header.Header) {
+		s.reject(address.UserID)
+		return 0, errInboundSpam
+	}
+	if !spfPassed && !s.relayVerified(header.Header, envelopeFrom) {
+		s.reject(address.UserID)
+		return 0, errInboundUnchecked
+	}
+
+	message, err := parseRawMessage("", raw)
+	if err != nil {
+		return 0, err
+	}
+
+	if prefix, ok := forwardingConfirmationSenders[normalizeSender(envelopeFrom)]; ok {
+		s.saveConfirmation(address.UserID, message, prefix)
+		return 0, nil
+	}
+
+	accountEmail := ""
+	if user := store.GetUser(address.UserID); user != nil {
+		accountEmail = user.Email
+	}
+	// Forwarding keeps the original From, so only the envelope says who
+	// forwarded the message
+	if !address.allows(accountEmail, envelopeFrom) {
+		s.reject(address.UserID)
+		return 0, errInboundSender
+	}
+
+	unwrapForwarded(message)
+
+	scan := newMailScan(address.UserID, Mailbox{Key: "inbound:" + address.UserID, Source: SourceInbound, Label: "Forwarded email"}, time.Time{})
+	s.scanner.read(scan, message)
+	found := s.scanner.save(ctx, scan)
+
+	received := time.Now().UTC()
+	store.UpdateInboundAddress(address.UserID, func(a *InboundAddress) {
+		a.Received++
+		a.LastReceivedAt = &received
+	})
+
+	fmt.Printf("📨 Forwarded email for %s: %d subscriptions\n", address.UserID, found)
+	return found, nil
+}
+
+func (s *InboundService) reject(userID string) {
+	store.UpdateInboundAddress(userID, func(a *InboundAddress) { a.Rejected++ })
+}
+
+var confirmationURLPattern = regexp.MustCompile(`https://[^\s"'<>]+`)
+
+// saveConfirmation keeps a mailbox's forwarding confirmation so the user can
+// finish setting up forwarding from the app
+func (s *InboundService) saveConfirmation(userID string, message *MailboxMessage, prefix string) {
+	verifyURL := ""
+	for _, link := range confirmationURLPattern.FindAllString(message.Body(), -1) {
+		if strings.HasPrefix(link, prefix) {
+			verifyURL = link
+			break
+		}
+	}
+
+	store.UpdateInboundAddress(userID, func(a *InboundAddress) {
+		a.Verification = message.Subject
+		a.VerifyURL = verifyURL
+	})
+}
+
+// headerRecipient finds our address in the message headers, for relays that
+// don't pass the envelope recipient
+func (s *InboundService) headerRecipient(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+
+	for _, name := range []string{"Delivered-To", "X-Original-To", "To", "Cc"} {
+		for _, value := range msg.Header[name] {
+			addresses, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, address := range addresses {
+				if strings.HasSuffix(strings.ToLower(address.Address), "@"+s.domain) {
+					return address.Address
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (s *InboundService) newAddress(userID string, senders []string) (*InboundAddress, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	local := "u-" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+
+	address := &InboundAddress{
+		UserID:         userID,
+		LocalPart:      local,
+		Address:        local + "@" + s.domain,
+		AllowedSenders: append([]string{}, senders...),
+		CreatedAt:      time.Now().UTC(),
+	}
+	store.SaveInboundAddress(address)
+	return address.copy(), nil
+}
+
+// normalizeSender lowercases an address and drops any "+tag", so Gmail's
+// "alice+caf_=...@gmail.com" forwarding envelope matches alice@gmail.com
+func normalizeSender(value string) string {
+	if parsed, err := mail.ParseAddress(value); err == nil {
+		value = parsed.Address
+	}
+	value = strings.ToLower(strings.Trim(strings.TrimSpace(value), "<>"))
+
+	local, domain, ok := strings.Cut(value, "@")
+	if !ok {
+		return value
+	}
+	local, _, _ = strings.Cut(local, "+")
+	return local + "@" + domain
+}
+
+// relayVerified reports whether our relay's Authentication-Results, the
+// topmost one, has SPF passing for the envelope sender's domain. Results
+// further down could have been written by anyone.
+func (s *InboundService) relayVerified(header mail.Header, envelopeFrom string) bool {
+	results := header["Authentication-Results"]
+	_, domain, ok := strings.Cut(normalizeSender(envelopeFrom), "@")
+	if s.authservID == "" || len(results) == 0 || !ok {
+		return false
+	}
+
+	parts := strings.Split(strings.ToLower(results[0]), ";")
+	if id := strings.Fields(parts[0]); len(id) == 0 || id[0] != s.authservID {
+		return false
+	}
+	for _, part := range parts[1:] {
+		fields := strings.Fields(part)
+		if len(fields) == 0 || fields[0] != "spf=pass" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if value, ok := strings.CutPrefix(field, "smtp.mailfrom="); ok {
+				value = strings.Trim(value, "\"<>")
+				if _, mailFromDomain, found := strings.Cut(value, "@"); found {
+					value = mailFromDomain
+				}
+				if value == domain {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// looksLikeSpam checks the verdicts relays and upstream filters add
+func looksLikeSpam(header mail.Header) bool {
+	if strings.EqualFold(strings.TrimSpace(header.Get("X-Spam-Flag")), "yes") {
+		return true
+	}
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(header.Get("X-Spam-Status"))), "yes") {
+		return true
+	}
+	results := strings.ToLower(strings.Join(header["Authentication-Results"], ";"))
+	return strings.Contains(results, "dmarc=fail")
+}
+
+// Lines mail clients put above a message forwarded inline
+var forwardedMarkers = []string{
+	"---------- Forwarded message ---------",
+	"-------- Forwarded Message --------",
+	"Begin forwarded message:",
+	"-----Original Message-----",
+}
+
+// unwrapForwarded takes the sender, subject and date from the header block
+// of a message forwarded inline, since extractors recognize receipts by the
+// original sender
+func unwrapForwarded(message *MailboxMessage) {
+	lines := message.Lines()
+	for i, line := range lines {
+		marked := false
+		for _, marker := range forwardedMarkers {
+			if strings.Contains(line, marker) {
+				marked = true
+				break
+			}
+		}
+		if !marked {
+			continue
+		}
+
+		for _, field := range lines[i+1:] {
+			name, value, ok := strings.Cut(field, ":")
+			if !ok || strings.Contains(name, " ") {
+				break
+			}
+			value = strings.TrimSpace(value)
+			switch strings.ToLower(name) {
+			case "from":
+				message.From = value
+			case "subject":
+				message.Subject = value
+			case "date", "sent":
+				if date, ok := parseForwardedDate(value); ok {
+					message.Date = date
+				}
+			}
+		}
+		return
+	}
+}
+
+// Date formats clients write in forwarded headers
+var forwardedDateLayouts = []string{
+	"Mon, Jan 2, 2006 at 3:04 PM",
+	"January 2, 2006 at 3:04:05 PM MST",
+	"Monday, January 2, 2006 3:04 PM",
+	"Mon, 2 Jan 2006 15:04",
+}
+
+func parseForwardedDate(value string) (time.Time, bool) {
+	if date, err := mail.ParseDate(value); err == nil {
+		return date, true
+	}
+	for _, layout := range forwardedDateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func inboundErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInboundDisabled), errors.Is(err, errInboundRecipient):
+		return http.StatusNotFound
+	case errors.Is(err, errInboundSender), errors.Is(err, errInboundUnchecked):
+		return http.StatusForbidden
+	case errors.Is(err, errInboundSpam):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errInboundTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
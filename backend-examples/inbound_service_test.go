@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const netflixReceipt = "Netflix <info@account.netflix.com>"
+
+// inboundTestService receives for inbound.test. SPF for mail.example allows
+// only loopback, where the tests connect from.
+func inboundTestService(relays string) *InboundService {
+	return &InboundService{
+		scanner:       NewMailScanner(nil),
+		domain:        "inbound.test",
+		webhookSecret: "hook-secret",
+		smtpHostname:  "inbound.test",
+		resolver: &fakeDNS{txt: map[string][]string{
+			"mail.example":  {"v=spf1 ip4:127.0.0.1 -all"},
+			"spoof.example": {"v=spf1 -all"},
+		}},
+		relays:     parseRelays(relays),
+		authservID: "mx.inbound.test",
+	}
+}
+
+// listenTestSMTP serves SMTP on a loopback port until the test ends
+func listenTestSMTP(t *testing.T, s *InboundService) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveSMTP(ctx, conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// sendSMTP sends one message and returns the MAIL reply, then the reply to
+// the data, or "" when MAIL was refused
+func sendSMTP(t *testing.T, addr, from, to, raw string) (string, string) {
+	t.Helper()
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	command := func(format string, args ...interface{}) string {
+		t.Helper()
+		if err := conn.PrintfLine(format, args...); err != nil {
+			t.Fatal(err)
+		}
+		return readSMTPReply(t, conn)
+	}
+
+	conn.ReadResponse(220)
+	command("EHLO client.test")
+	mailReply := command("MAIL FROM:<%s>", from)
+	if !strings.HasPrefix(mailReply, "250 ") {
+		return mailReply, ""
+	}
+	if reply := command("RCPT TO:<%s>", to); !strings.HasPrefix(reply, "250 ") {
+		t.Fatalf("RCPT = %s", reply)
+	}
+	command("DATA")
+	w := conn.DotWriter()
+	w.Write([]byte(raw))
+	w.Close()
+	return mailReply, readSMTPReply(t, conn)
+}
+
+func readSMTPReply(t *testing.T, conn *textproto.Conn) string {
+	t.Helper()
+	code, message, err := conn.ReadResponse(0)
+	if code == 0 {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%d %s", code, message)
+}
+
+func TestInboundSMTPChecksEnvelopeSender(t *testing.T) {
+	s := inboundTestService("")
+	user := testUser(t)
+	address, _ := s.newAddress(user.ID, []string{"me@mail.example"})
+	addr := listenTestSMTP(t, s)
+	receipt := rawMessage(netflixReceipt, "Your Netflix receipt", "Total: $15.49/month")
+
+	// Gmail-style forwarding envelope from an address SPF allows
+	if _, reply := sendSMTP(t, addr, "me+caf_=x@mail.example", address.Address, receipt); reply != "250 2.0.0 Message accepted" {
+		t.Errorf("allowed sender: %s", reply)
+	}
+	if subs := store.GetSubscriptions(user.ID); len(subs) != 1 || subs[0].Name != "Netflix" {
+		t.Errorf("subscriptions = %+v", subs)
+	}
+
+	// An envelope the domain's SPF doesn't allow is refused at MAIL
+	if reply, _ := sendSMTP(t, addr, "me@spoof.example", address.Address, receipt); !strings.HasPrefix(reply, "550 5.7.23") {
+		t.Errorf("SPF fail: MAIL = %s", reply)
+	}
+	if reply, _ := sendSMTP(t, addr, "me@nospf.example", address.Address, receipt); !strings.HasPrefix(reply, "550 5.7.23") {
+		t.Errorf("no SPF record: MAIL = %s", reply)
+	}
+
+	// Allowed addresses in the headers don't help another envelope sender
+	spoofed := "Sender: me@mail.example\r\nResent-From: me@mail.example\r\nX-Forwarded-For: me@mail.example u@inbound.test\r\n" +
+		rawMessage("me@mail.example", "Your Netflix receipt", "Total: $15.49/month")
+	if _, reply := sendSMTP(t, addr, "other@mail.example", address.Address, spoofed); !strings.Contains(reply, "Sender is not allowed") {
+		t.Errorf("header-only sender: %s", reply)
+	}
+	if got := store.GetInboundAddress(user.ID); got.Received != 1 || got.Rejected != 1 {
+		t.Errorf("received %d, rejected %d", got.Received, got.Rejected)
+	}
+}
+
+func TestInboundSMTPTrustedRelay(t *testing.T) {
+	s := inboundTestService("127.0.0.1")
+	user := testUser(t)
+	address, _ := s.newAddress(user.ID, []string{"me@relayed.example"})
+	addr := listenTestSMTP(t, s)
+	receipt := rawMessage(netflixReceipt, "Your Netflix receipt", "Total: $15.49/month")
+
+	// The relay checked SPF, so no SPF record of ours is needed
+	verified := "Authentication-Results: mx.inbound.test; spf=pass (sender allowed) smtp.mailfrom=me@relayed.example\r\n" + receipt
+	if mail, reply := sendSMTP(t, addr, "me@relayed.example", address.Address, verified); reply != "250 2.0.0 Message accepted" {
+		t.Errorf("verified by relay: MAIL %s, DATA %s", mail, reply)
+	}
+
+	for name, raw := range map[string]string{
+		"no results":   receipt,
+		"softfail":     "Authentication-Results: mx.inbound.test; spf=softfail smtp.mailfrom=me@relayed.example\r\n" + receipt,
+		"other domain": "Authentication-Results: mx.inbound.test; spf=pass smtp.mailfrom=bob@elsewhere.example\r\n" + receipt,
+		// Results the sender wrote end up below the relay's
+		"forged below": "Authentication-Results: other.example; spf=pass smtp.mailfrom=me@relayed.example\r\n" +
+			"Authentication-Results: mx.inbound.test; spf=pass smtp.mailfrom=me@relayed.example\r\n" + receipt,
+	} {
+		if _, reply := sendSMTP(t, addr, "me@relayed.example", address.Address, raw); reply != "550 5.7.1 Sender could not be verified" {
+			t.Errorf("%s: %s", name, reply)
+		}
+	}
+}
+
+func TestInboundWebhookNeedsRelayResults(t *testing.T) {
+	s := inboundTestService("")
+	user := testUser(t)
+	address, _ := s.newAddress(user.ID, []string{"@mail.example"})
+	receipt := rawMessage(netflixReceipt, "Your Netflix receipt", "Total: $15.49/month")
+
+	r := gin.New()
+	r.POST("/webhook", s.Webhook)
+	post := func(from, raw string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook?to="+address.Address+"&from="+from, strings.NewReader(raw))
+		req.Header.Set("Authorization", "Bearer hook-secret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	verified := "Authentication-Results: mx.inbound.test; spf=pass smtp.mailfrom=mail.example\r\n" + receipt
+	if code := post("me@mail.example", verified); code != http.StatusAccepted {
+		t.Errorf("verified = %d", code)
+	}
+	if code := post("me@mail.example", receipt); code != http.StatusForbidden {
+		t.Errorf("unverified = %d", code)
+	}
+	if code := post("me@other.example", "Authentication-Results: mx.inbound.test; spf=pass smtp.mailfrom=other.example\r\n"+receipt); code != http.StatusForbidden {
+		t.Errorf("verified but not allowed = %d", code)
+	}
+
+	// Without an authserv-id nothing can be verified
+	s.authservID = ""
+	if code := post("me@mail.example", verified); code != http.StatusForbidden {
+		t.Errorf("no authserv-id = %d", code)
+	}
+}
+
+func TestParseRelays(t *testing.T) {
+	relays := parseRelays(" 192.0.2.1, 2001:db8::/32,bogus ,")
+	if len(relays) != 2 || !relays[0].Contains(net.ParseIP("192.0.2.1")) || relays[0].Contains(net.ParseIP("192.0.2.2")) ||
+		!relays[1].Contains(net.ParseIP("2001:db8::1")) {
+		t.Errorf("relays = %v", relays)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxSMTPConnections = 50
+	maxSMTPRecipients  = 20
+	maxSMTPLine        = 4096
+	smtpTimeout        = 5 * time.Minute
+)
+
+// ListenSMTP accepts forwarded mail for our domain until ctx is cancelled.
+// It only receives: there is no relaying and recipients are checked at RCPT
+// so unknown addresses are refused before the message is sent.
+func (s *InboundService) ListenSMTP(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	fmt.Printf("📨 Receiving forwarded email on %s\n", addr)
+
+	slots := make(chan struct{}, maxSMTPConnections)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		select {
+		case slots <- struct{}{}:
+			go func() {
+				defer func() { <-slots }()
+				s.serveSMTP(ctx, conn)
+			}()
+		default:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			fmt.Fprintf(conn, "421 4.3.2 %s Too many connections, try again later\r\n", s.smtpHostname)
+			conn.Close()
+		}
+	}
+}
+
+// smtpSession is one client's envelope so far
+type smtpSession struct {
+	remoteIP   net.IP
+	relay      bool // a trusted relay, which verifies senders for us
+	helo       bool
+	from       string
+	hasFrom    bool
+	spfPassed  bool
+	recipients []string
+}
+
+func (s *smtpSession) reset() {
+	s.from, s.hasFrom, s.spfPassed, s.recipients = "", false, false, nil
+}
+
+func (s *InboundService) serveSMTP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, maxSMTPLine)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	reply("220 %s ESMTP SubTrack", s.smtpHostname)
+
+	session := &smtpSession{}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		session.remoteIP = addr.IP
+		session.relay = s.trustedRelay(addr.IP)
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(smtpTimeout))
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			reply("500 5.5.2 Line too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		command, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+		arg = strings.TrimSpace(arg)
+
+		switch strings.ToUpper(command) {
+		case "EHLO":
+			session.reset()
+			session.helo = true
+			reply("250-%s", s.smtpHostname)
+			reply("250-SIZE %d", maxInboundMessageSize)
+			reply("250-8BITMIME")
+			reply("250 ENHANCEDSTATUSCODES")
+		case "HELO":
+			session.reset()
+			session.helo = true
+			reply("250 %s", s.smtpHostname)
+		case "MAIL":
+			if !session.helo {
+				reply("503 5.5.1 Send EHLO first")
+				continue
+			}
+			from, params, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				reply("501 5.5.4 Syntax: MAIL FROM:<address>")
+				continue
+			}
+			if size, err := strconv.Atoi(params["SIZE"]); err == nil && size > maxInboundMessageSize {
+				reply("552 5.3.4 Message too large")
+				continue
+			}
+			spfPassed := false
+			if !session.relay && from != "" {
+				switch checkSPF(ctx, s.resolver, session.remoteIP, from) {
+				case spfPass:
+					spfPassed = true
+				case spfTempError:
+					reply("451 4.4.3 Could not check SPF, try again later")
+					continue
+				default:
+					reply("550 5.7.23 SPF check failed for %s", from)
+					continue
+				}
+			}
+			session.reset()
+			session.from, session.hasFrom, session.spfPassed = from, true, spfPassed
+			reply("250 2.1.0 OK")
+		case "RCPT":
+			if !session.hasFrom {
+				reply("503 5.5.1 Send MAIL first")
+				continue
+			}
+			to, _, ok := smtpPath(arg, "TO:")
+			if !ok || to == "" {
+				reply("501 5.5.4 Syntax: RCPT TO:<address>")
+				continue
+			}
+			if len(session.recipients) >= maxSMTPRecipients {
+				reply("452 4.5.3 Too many recipients")
+				continue
+			}
+			if _, err := s.lookup(to); err != nil {
+				reply("550 5.1.1 No such user here")
+				continue
+			}
+			session.recipients = append(session.recipients, to)
+			reply("250 2.1.5 OK")
+		case "DATA":
+			if len(session.recipients) == 0 {
+				reply("503 5.5.1 Send RCPT first")
+				continue
+			}
+			reply("354 End data with <CR><LF>.<CR><LF>")
+
+			raw, tooLarge, err := readSMTPData(reader)
+			if err != nil {
+				return
+			}
+			if tooLarge {
+				reply("552 5.3.4 Message too large")
+			} else {
+				reply(s.deliverSMTP(ctx, session, raw))
+			}
+			session.reset()
+		case "RSET":
+			session.reset()
+			reply("250 2.0.0 OK")
+		case "NOOP":
+			reply("250 2.0.0 OK")
+		case "VRFY":
+			reply("252 2.1.5 Send some mail and we'll try")
+		case "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			reply("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+// deliverSMTP hands the message to each recipient and answers for all of
+// them: accepted if any recipient took it, otherwise the first refusal
+func (s *InboundService) deliverSMTP(ctx context.Context, session *smtpSession, raw []byte) string {
+	var firstErr error
+	delivered := 0
+	for _, recipient := range session.recipients {
+		if _, err := s.deliver(ctx, recipient, session.from, raw, session.spfPassed); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delivered++
+	}
+
+	switch {
+	case delivered > 0:
+		return "250 2.0.0 Message accepted"
+	case errors.Is(firstErr, errInboundSender):
+		return "550 5.7.1 Sender is not allowed to forward to this address"
+	case errors.Is(firstErr, errInboundUnchecked):
+		return "550 5.7.1 Sender could not be verified"
+	case errors.Is(firstErr, errInboundSpam):
+		return "550 5.7.1 Message rejected as spam"
+	case errors.Is(firstErr, errInboundTooLarge):
+		return "552 5.3.4 Message too large"
+	case errors.Is(firstErr, errInboundRecipient), errors.Is(firstErr, errInboundDisabled):
+		return "550 5.1.1 No such user here"
+	}
+	return "554 5.6.0 Message could not be read"
+}
+
+// readSMTPData reads the message up to the lone "." line. Past the size
+// limit the rest is read and dropped so the client still gets a reply.
+func readSMTPData(reader *bufio.Reader) ([]byte, bool, error) {
+	data := textproto.NewReader(reader).DotReader()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(data, maxInboundMessageSize+1)); err != nil {
+		return nil, false, err
+	}
+	if buf.Len() > maxInboundMessageSize {
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return nil, true, err
+		}
+		return nil, true, nil
+	}
+	return buf.Bytes(), false, nil
+}
+
+// smtpPath parses "FROM:<address> KEY=VALUE ..." from MAIL and RCPT
+func smtpPath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+
+	fields := strings.Fields(strings.TrimSpace(arg[len(prefix):]))
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+	path := fields[0]
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", nil, false
+	}
+
+	params := make(map[string]string)
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		params[strings.ToUpper(key)] = value
+	}
+	return strings.Trim(path, "<>"), params, true
+}
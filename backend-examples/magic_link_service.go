@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	magicLinkTTL      = 15 * time.Minute
+	magicLinkCooldown = time.Minute
+	magicLinkAudience = "magic-link"
+)
+
+type MagicLinkService struct {
+	mailer    Mailer
+	publicURL string
+}
+
+type MagicLinkRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// MagicLinkClaims are signed into the emailed link. The audience keeps them
+// from being accepted as access tokens.
+type MagicLinkClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+func NewMagicLinkService(mailer Mailer) *MagicLinkService {
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080"
+	}
+
+	return &MagicLinkService{
+		mailer:    mailer,
+		publicURL: strings.TrimRight(publicURL, "/"),
+	}
+}
+
+// RequestLink emails a single-use sign-in link
+func (s *MagicLinkService) RequestLink(c *gin.Context) {
+	var req MagicLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	address, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+		return
+	}
+	email := strings.ToLower(address.Address)
+
+	// Same response whether or not we sent anything, so the endpoint can't
+	// be used to probe for accounts or spam an inbox
+	response := gin.H{
+		"success": true,
+		"message": "If the address is valid, a sign-in link is on its way",
+	}
+
+	now := time.Now()
+	if !store.AllowMagicLink(email, now, magicLinkCooldown) {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	claims := &MagicLinkClaims{
+		Email: email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    tokenIssuer(),
+			Audience:  jwt.ClaimStrings{magicLinkAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(magicLinkTTL)),
+		},
+	}
+
+	token, err := tokenKeys.Sign(claims)
+	if err != nil {
+		store.ReleaseMagicLink(email, now)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create link"})
+		return
+	}
+	store.SaveMagicLink(claims.ID, claims.ExpiresAt.Time)
+
+	link := fmt.Sprintf("%s/api/auth/magic-link/verify?token=%s", s.publicURL, url.QueryEscape(token))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = s.mailer.Send(ctx, &MailMessage{
+		To:      email,
+		Subject: "Your SubTrack sign-in link",
+		Text: fmt.Sprintf("Click the link below to sign in to SubTrack:\n\n%s\n\n"+
+			"The link expires in %d minutes and can only be used once. "+
+			"If you didn't ask for it, you can ignore this email.\n", link, int(magicLinkTTL.Minutes())),
+	})
+	if err != nil {
+		fmt.Printf("❌ Failed to send magic link to %s: %v\n", email, err)
+		// Let the user try again rather than wait out the cooldown
+		store.ReleaseMagicLink(email, now)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// VerifyLink signs the user in from the emailed link
+func (s *MagicLinkService) VerifyLink(c *gin.Context) {
+	claims := &MagicLinkClaims{}
+	_, err := jwt.ParseWithClaims(c.Query("token"), claims, tokenKeys.Keyfunc,
+		jwt.WithValidMethods(tokenKeys.ValidMethods()),
+		jwt.WithIssuer(tokenIssuer()),
+		jwt.WithAudience(magicLinkAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims.Email == "" || !store.ConsumeMagicLink(claims.ID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired link"})
+		return
+	}
+
+	// Link to the existing account with this email, or create one
+	user := store.GetOrCreateEmailUser(claims.Email)
+	claimGuestSession(c, user.ID)
+
+	redirectWithAuthCode(c, user)
+}
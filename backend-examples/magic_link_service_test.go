@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// smtpSink is a local SMTP server that keeps what it receives. While failing
+// is set it refuses every recipient.
+type smtpSink struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	failing  bool
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 sink ESMTP")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 sink")
+		case "MAIL":
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			s.mu.Lock()
+			failing := s.failing
+			s.mu.Unlock()
+			if failing {
+				text.PrintfLine("451 4.3.0 Try again later")
+				continue
+			}
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			lines, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, strings.Join(lines, "\n"))
+			s.mu.Unlock()
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *smtpSink) setFailing(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+func (s *smtpSink) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func (s *smtpSink) mailer() *SMTPMailer {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &SMTPMailer{Addr: net.JoinHostPort(host, port), Host: host, From: "SubTrack <no-reply@example.com>"}
+}
+
+var magicLinkURL = regexp.MustCompile(`https?://\S+/api/auth/magic-link/verify\?token=\S+`)
+
+func magicLinkRouter(sink *smtpSink) *gin.Engine {
+	service := &MagicLinkService{mailer: sink.mailer(), publicURL: "https://api.subtrack.example"}
+	r := gin.New()
+	r.POST("/api/auth/magic-link", service.RequestLink)
+	r.GET("/api/auth/magic-link/verify", service.VerifyLink)
+	return r
+}
+
+func TestMagicLinkSignIn(t *testing.T) {
+	t.Setenv("FRONTEND_URL", "https://subtrack.example")
+	sink := newSMTPSink(t)
+	r := magicLinkRouter(sink)
+	email := strings.ToLower(t.Name()) + "@example.com"
+
+	if w := serveJSON(r, http.MethodPost, "/api/auth/magic-link", MagicLinkRequest{Email: email}, ""); w.Code != http.StatusOK {
+		t.Fatalf("request link = %d %s", w.Code, w.Body.String())
+	}
+
+	messages := sink.received()
+	if len(messages) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(messages))
+	}
+	if !strings.Contains(messages[0], "To: "+email) {
+		t.Errorf("message is not addressed to %s:\n%s", email, messages[0])
+	}
+	link, err := url.Parse(magicLinkURL.FindString(messages[0]))
+	if err != nil || link.Query().Get("token") == "" {
+		t.Fatalf("no sign-in link in:\n%s", messages[0])
+	}
+
+	w := serveJSON(r, http.MethodGet, link.RequestURI(), nil, "")
+	if w.Code != http.StatusTemporaryRedirect || !strings.Contains(w.Header().Get("Location"), "auth_code=") {
+		t.Fatalf("verify = %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// Links are single use
+	if w := serveJSON(r, http.MethodGet, link.RequestURI(), nil, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("second use = %d, want 401", w.Code)
+	}
+}
+
+func TestMagicLinkCooldown(t *testing.T) {
+	sink := newSMTPSink(t)
+	r := magicLinkRouter(sink)
+	email := strings.ToLower(t.Name()) + "@example.com"
+
+	// A failed send doesn't hold the address back
+	sink.setFailing(true)
+	if w := serveJSON(r, http.MethodPost, "/api/auth/magic-link", MagicLinkRequest{Email: email}, ""); w.Code != http.StatusBadGateway {
+		t.Fatalf("failed send = %d, want 502", w.Code)
+	}
+	sink.setFailing(false)
+
+	for i := 0; i < 3; i++ {
+		if w := serveJSON(r, http.MethodPost, "/api/auth/magic-link", MagicLinkRequest{Email: email}, ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d = %d", i, w.Code)
+		}
+	}
+	if got := len(sink.received()); got != 1 {
+		t.Errorf("sent %d links within the cooldown, want 1", got)
+	}
+}
+
+func TestSMTPMailerDelivers(t *testing.T) {
+	sink := newSMTPSink(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := sink.mailer().Send(ctx, &MailMessage{To: "bob@example.com", Subject: "Héllo", Text: "plain", HTML: "<p>rich</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := sink.received()[0]
+	for _, want := range []string{"multipart/alternative", "plain", "<p>rich</p>", fmt.Sprintf("Subject: %s", "=?utf-8?q?H=C3=A9llo?=")} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message lacks %q", want)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	SourceIMAP = "imap"
+
+	maxMailAccountsPerUser = 5
+	imapWatchRetry         = time.Minute
+)
+
+// MailAccount is an IMAP mailbox the user connected
+type MailAccount struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Label      string     `json:"label"`
+	Host       string     `json:"host"`
+	Port       int        `json:"port"`
+	Security   string     `json:"security"`
+	Username   string     `json:"username"`
+	AuthMethod string     `json:"authMethod"`
+	Secret     string     `json:"-"` // app password or access token
+	Mailbox    string     `json:"mailbox"`
+	Idle       bool       `json:"idle"` // scan as soon as mail arrives
+	LastScanAt *time.Time `json:"lastScanAt,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+type CreateMailAccountRequest struct {
+	Preset      string `json:"preset"` // see imapPresets, or empty with host and port
+	Label       string `json:"label"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Security    string `json:"security"`
+	Username    string `json:"username" binding:"required"`
+	AuthMethod  string `json:"authMethod"`
+	Password    string `json:"password"`
+	AccessToken string `json:"accessToken"`
+	Mailbox     string `json:"mailbox"`
+	Idle        bool   `json:"idle"`
+}
+
+type imapPreset struct {
+	Label string `json:"label"`
+	Host  string `json:"host"`
+	Port  int    `json:"port"`
+}
+
+// Providers that need an app password rather than the account password
+var imapPresets = map[string]imapPreset{
+	"yahoo":    {"Yahoo Mail", "imap.mail.yahoo.com", 993},
+	"icloud":   {"iCloud Mail", "imap.mail.me.com", 993},
+	"outlook":  {"Outlook.com", "outlook.office365.com", 993},
+	"aol":      {"AOL Mail", "imap.aol.com", 993},
+	"gmail":    {"Gmail (IMAP)", "imap.gmail.com", 993},
+	"fastmail": {"Fastmail", "imap.fastmail.com", 993},
+}
+
+type MailAccountService struct {
+	scanner       *MailScanner
+	allowInsecure bool
+
+	mu       sync.Mutex
+	scanning map[string]bool               // account ID -> scan running
+	watchers map[string]context.CancelFunc // account ID -> IDLE loop
+}
+
+func NewMailAccountService(scanner *MailScanner) *MailAccountService {
+	return &MailAccountService{
+		scanner:       scanner,
+		allowInsecure: os.Getenv("IMAP_ALLOW_INSECURE") == "true",
+		scanning:      make(map[string]bool),
+		watchers:      make(map[string]context.CancelFunc),
+	}
+}
+
+// ListPresets returns the known IMAP servers
+func (s *MailAccountService) ListPresets(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"presets": imapPresets})
+}
+
+// ListAccounts returns the user's IMAP mailboxes
+func (s *MailAccountService) ListAccounts(c *gin.Context) {
+	accounts := store.GetMailAccounts(c.GetString("user_id"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"accounts": accounts,
+		"total":    len(accounts),
+	})
+}
+
+// CreateAccount checks the credentials by logging in, saves the mailbox and
+// starts a first scan
+func (s *MailAccountService) CreateAccount(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req CreateMailAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(store.GetMailAccounts(userID)) >= maxMailAccountsPerUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d mailboxes", maxMailAccountsPerUser)})
+		return
+	}
+
+	account, err := s.accountFromRequest(userID, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), imapTimeout)
+	defer cancel()
+	provider, err := DialIMAP(ctx, s.config(account))
+	if err != nil {
+		fmt.Printf("❌ Could not open IMAP mailbox %s for user %s: %v\n", account.Host, userID, err)
+		status := http.StatusBadGateway
+		if errors.Is(err, errIMAPAuth) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": mailboxError(err)})
+		return
+	}
+	provider.Close()
+
+	store.SaveMailAccount(account)
+	fmt.Printf("📬 Connected IMAP mailbox %s for user %s\n", account.Host, userID)
+
+	go s.scanAccount(userID, account.ID)
+	if account.Idle {
+		s.watch(account)
+	}
+
+	c.JSON(http.StatusCreated, account)
+}
+
+// DeleteAccount disconnects a mailbox
+func (s *MailAccountService) DeleteAccount(c *gin.Context) {
+	accountID := c.Param("id")
+
+	if !store.DeleteMailAccount(c.GetString("user_id"), accountID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mailbox not found"})
+		return
+	}
+	s.unwatch(accountID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Mailbox disconnected",
+	})
+}
+
+// ScanAccount starts a scan of new messages in a mailbox
+func (s *MailAccountService) ScanAccount(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	account := store.GetMailAccount(userID, c.Param("id"))
+	if account == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mailbox not found"})
+		return
+	}
+
+	go s.scanAccount(userID, account.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Scan started",
+	})
+}
+
+// scanAccount connects and runs the subscription scan, one at a time per
+// mailbox
+func (s *MailAccountService) scanAccount(userID, accountID string) {
+	s.mu.Lock()
+	if s.scanning[accountID] {
+		s.mu.Unlock()
+		return
+	}
+	s.scanning[accountID] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.scanning, accountID)
+		s.mu.Unlock()
+	}()
+
+	account := store.GetMailAccount(userID, accountID)
+	if account == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), imapTimeout)
+	provider, err := DialIMAP(ctx, s.config(account))
+	cancel()
+	if err == nil {
+		err = s.scanner.scanAndStoreSubscriptions(userID, provider, imapMailbox(account))
+	}
+
+	now := time.Now().UTC()
+	store.UpdateMailAccount(userID, accountID, func(a *MailAccount) {
+		a.LastError = ""
+		if err != nil {
+			a.LastError = mailboxError(err)
+			return
+		}
+		a.LastScanAt = &now
+	})
+	if err != nil {
+		fmt.Printf("❌ IMAP scan failed for %s: %v\n", account.Host, err)
+	}
+}
+
+// watch keeps an IDLE connection open and scans when mail arrives
+func (s *MailAccountService) watch(account *MailAccount) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	if stop, ok := s.watchers[account.ID]; ok {
+		stop()
+	}
+	s.watchers[account.ID] = cancel
+	s.mu.Unlock()
+
+	go func() {
+		for ctx.Err() == nil {
+			current := store.GetMailAccount(account.UserID, account.ID)
+			if current == nil {
+				return
+			}
+
+			err := s.idle(ctx, current)
+			if errors.Is(err, errIMAPIdleUnsupported) || errors.Is(err, errIMAPAuth) {
+				store.UpdateMailAccount(account.UserID, account.ID, func(a *MailAccount) {
+					a.Idle = false
+					a.LastError = mailboxError(err)
+				})
+				s.unwatch(account.ID)
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(imapWatchRetry):
+			}
+		}
+	}()
+}
+
+// idle holds one connection in IDLE until it fails or ctx is cancelled
+func (s *MailAccountService) idle(ctx context.Context, account *MailAccount) error {
+	dialCtx, cancel := context.WithTimeout(ctx, imapTimeout)
+	provider, err := DialIMAP(dialCtx, s.config(account))
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer provider.Close()
+
+	for {
+		newMail, err := provider.Idle(ctx)
+		if err != nil {
+			return err
+		}
+		if newMail {
+			go s.scanAccount(account.UserID, account.ID)
+		}
+	}
+}
+
+func (s *MailAccountService) unwatch(accountID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stop, ok := s.watchers[accountID]; ok {
+		stop()
+		delete(s.watchers, accountID)
+	}
+}
+
+// mailboxError is the message users see. Raw errors can carry replies from
+// whatever server the user pointed us at, so those only go to the log.
+func mailboxError(err error) string {
+	switch {
+	case errors.Is(err, errIMAPAuth):
+		return "The mailbox rejected the username or password. Some providers need an app password."
+	case errors.Is(err, errIMAPIdleUnsupported):
+		return "The server does not support IDLE"
+	}
+	return "Could not open the mailbox. Check the host, port and security settings."
+}
+
+func (s *MailAccountService) config(account *MailAccount) IMAPConfig {
+	return IMAPConfig{
+		Host:         account.Host,
+		Port:         account.Port,
+		Security:     account.Security,
+		Username:     account.Username,
+		AuthMethod:   account.AuthMethod,
+		Secret:       account.Secret,
+		Mailbox:      account.Mailbox,
+		AllowPrivate: s.allowInsecure,
+	}
+}
+
+// accountFromRequest fills in the preset and checks the settings
+func (s *MailAccountService) accountFromRequest(userID string, req *CreateMailAccountRequest) (*MailAccount, error) {
+	account := &MailAccount{
+		ID:         uuid.NewString(),
+		UserID:     userID,
+		Label:      strings.TrimSpace(req.Label),
+		Host:       strings.ToLower(strings.TrimSpace(req.Host)),
+		Port:       req.Port,
+		Security:   req.Security,
+		Username:   strings.TrimSpace(req.Username),
+		AuthMethod: req.AuthMethod,
+		Mailbox:    strings.TrimSpace(req.Mailbox),
+		Idle:       req.Idle,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if req.Preset != "" {
+		preset, ok := imapPresets[req.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q", req.Preset)
+		}
+		account.Host, account.Port = preset.Host, preset.Port
+		if account.Label == "" {
+			account.Label = preset.Label
+		}
+	}
+
+	if account.Host == "" || strings.ContainsAny(account.Host, "/ :") {
+		return nil, errors.New("host is required")
+	}
+	if account.Port == 0 {
+		account.Port = 993
+	}
+	if account.Port < 1 || account.Port > 65535 {
+		return nil, errors.New("invalid port")
+	}
+	if account.Security == "" {
+		account.Security = IMAPSecurityTLS
+		if account.Port == 143 {
+			account.Security = IMAPSecuritySTARTTLS
+		}
+	}
+	switch account.Security {
+	case IMAPSecurityTLS, IMAPSecuritySTARTTLS:
+	case IMAPSecurityNone:
+		if !s.allowInsecure {
+			return nil, errors.New("security must be tls or starttls")
+		}
+	default:
+		return nil, errors.New("security must be tls or starttls")
+	}
+
+	switch account.AuthMethod {
+	case "", IMAPAuthPassword:
+		account.AuthMethod = IMAPAuthPassword
+		account.Secret = req.Password
+	case IMAPAuthXOAUTH2:
+		account.Secret = req.AccessToken
+	default:
+		return nil, errors.New("authMethod must be password or xoauth2")
+	}
+	if account.Secret == "" {
+		return nil, errors.New("password or access token is required")
+	}
+
+	if account.Mailbox == "" {
+		account.Mailbox = "INBOX"
+	}
+	if account.Label == "" {
+		account.Label = account.Host
+	}
+	return account, nil
+}
+
+func imapMailbox(account *MailAccount) Mailbox {
+	return Mailbox{Key: "imap:" + account.ID, Source: SourceIMAP, Label: account.Label}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	MailFormatEML  = "eml"
+	MailFormatZip  = "zip"
+	MailFormatMbox = "mbox"
+
+	maxMailMessageSize = 25 << 20
+	maxZipEntries      = 100000
+)
+
+// Most that all entries of one zip may expand to, as a few MB of zip can
+// hold many GB of mail
+var maxZipUncompressedSize int64 = 4 << 30
+
+var errZipTooLarge = errors.New("zip file expands to too much data")
+
+// detectMailFormat goes by the file extension, then the first bytes
+func detectMailFormat(name string, head []byte) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".eml":
+		return MailFormatEML
+	case ".zip":
+		return MailFormatZip
+	case ".mbox", ".mbx":
+		return MailFormatMbox
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return MailFormatZip
+	case bytes.HasPrefix(head, []byte("From ")):
+		return MailFormatMbox
+	}
+	return MailFormatEML
+}
+
+// readMailArchive calls visit with each message in an uploaded file, one at
+// a time, so large exports never sit in memory whole. Zip files may hold .eml
+// files and mbox files, as in a Google Takeout export. It returns how many
+// messages were too large to read.
+func readMailArchive(filePath, format string, visit func(id string, raw []byte)) (int, error) {
+	switch format {
+	case MailFormatZip:
+		return readMailZip(filePath, visit)
+	case MailFormatMbox:
+		file, err := os.Open(filePath)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		return readMbox(file, "", visit)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(file, maxMailMessageSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) > maxMailMessageSize {
+		return 1, nil
+	}
+	visit("", raw)
+	return 0, nil
+}
+
+func readMailZip(filePath string, visit func(id string, raw []byte)) (int, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer archive.Close()
+
+	if len(archive.File) > maxZipEntries {
+		return 0, errors.New("zip file has too many entries")
+	}
+
+	budget := &zipBudget{remaining: maxZipUncompressedSize}
+	skipped := 0
+	for _, entry := range archive.File {
+		name := entry.Name
+		if entry.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") {
+			continue
+		}
+
+		format := ""
+		switch strings.ToLower(path.Ext(name)) {
+		case ".eml":
+			format = MailFormatEML
+		case ".mbox", ".mbx":
+			format = MailFormatMbox
+		default:
+			continue
+		}
+
+		rc, err := entry.Open()
+		if err != nil {
+			skipped++
+			continue
+		}
+		// The uncompressed sizes in the headers can't be trusted, so count
+		// what is actually read
+		r := &zipBudgetReader{rc, budget}
+
+		if format == MailFormatMbox {
+			n, err := readMbox(r, name, visit)
+			skipped += n
+			if err != nil {
+				skipped++
+			}
+		} else {
+			raw, err := io.ReadAll(io.LimitReader(r, maxMailMessageSize+1))
+			if err != nil || len(raw) > maxMailMessageSize {
+				skipped++
+			} else {
+				visit(name, raw)
+			}
+		}
+		rc.Close()
+
+		if budget.remaining < 0 {
+			return skipped, errZipTooLarge
+		}
+	}
+	return skipped, nil
+}
+
+// zipBudget is what is left of maxZipUncompressedSize for one zip file
+type zipBudget struct {
+	remaining int64
+}
+
+type zipBudgetReader struct {
+	r      io.Reader
+	budget *zipBudget
+}
+
+func (z *zipBudgetReader) Read(p []byte) (int, error) {
+	if z.budget.remaining < 0 {
+		return 0, errZipTooLarge
+	}
+	n, err := z.r.Read(p)
+	z.budget.remaining -= int64(n)
+	if z.budget.remaining < 0 {
+		return n, errZipTooLarge
+	}
+	return n, err
+}
+
+// readMbox splits an mbox file on its "From " separator lines
+func readMbox(r io.Reader, name string, visit func(id string, raw []byte)) (int, error) {
+	mbox := newMboxReader(r)
+	for {
+		raw, err := mbox.Next()
+		if err == io.EOF {
+			return mbox.skipped, nil
+		}
+		if err != nil {
+			return mbox.skipped, err
+		}
+		visit(name+"#"+strconv.Itoa(mbox.count), raw)
+	}
+}
+
+// mboxReader reads one message at a time from an mbox file. It handles both
+// mboxo and mboxrd escaping of body lines that start with "From ".
+type mboxReader struct {
+	reader    *bufio.Reader
+	message   bytes.Buffer
+	lineStart bool // the next read starts a new line
+	prevBlank bool // the previous line was empty
+	inMessage bool // a separator has been read
+	skipLine  bool // the rest of an over-long separator line
+	done      bool
+	count     int // messages returned
+	skipped   int // messages over maxMailMessageSize
+}
+
+func newMboxReader(r io.Reader) *mboxReader {
+	return &mboxReader{
+		reader:    bufio.NewReaderSize(r, 64<<10),
+		lineStart: true,
+		prevBlank: true,
+	}
+}
+
+// Next returns the next message, or io.EOF after the last one
+func (m *mboxReader) Next() ([]byte, error) {
+	m.message.Reset()
+	oversized := false
+
+	for !m.done {
+		line, err := m.reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return nil, err
+		}
+		m.done = err == io.EOF
+
+		atStart := m.lineStart
+		complete := err == nil
+		m.lineStart = complete
+
+		if !atStart && m.skipLine {
+			m.skipLine = !complete
+			continue
+		}
+
+		if atStart && m.prevBlank && bytes.HasPrefix(line, []byte("From ")) {
+			m.skipLine = !complete
+			m.prevBlank = false
+			if m.inMessage {
+				if raw, ok := m.take(oversized); ok {
+					return raw, nil
+				}
+				oversized = false
+				continue
+			}
+			m.inMessage = true
+			continue
+		}
+
+		m.prevBlank = atStart && complete && len(bytes.TrimRight(line, "\r\n")) == 0
+		if !m.inMessage || oversized {
+			continue
+		}
+
+		// mboxrd writes ">From " as ">>From ", and "From " as ">From "
+		if atStart && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) && line[0] == '>' {
+			line = line[1:]
+		}
+		if m.message.Len()+len(line) > maxMailMessageSize {
+			oversized = true
+			m.message.Reset()
+			continue
+		}
+		m.message.Write(line)
+	}
+
+	if m.inMessage {
+		m.inMessage = false
+		if raw, ok := m.take(oversized); ok {
+			return raw, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// take returns the message read so far, counting it as skipped if it was
+// too large
+func (m *mboxReader) take(oversized bool) ([]byte, bool) {
+	if oversized {
+		m.skipped++
+		return nil, false
+	}
+	if m.message.Len() == 0 {
+		return nil, false
+	}
+	m.count++
+	raw := make([]byte, m.message.Len())
+	copy(raw, m.message.Bytes())
+	m.message.Reset()
+	return raw, true
+}
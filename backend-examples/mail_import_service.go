@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	SourceUpload = "upload"
+
+	ScanQueued  = "queued"
+	ScanRunning = "running"
+	ScanDone    = "done"
+	ScanFailed  = "failed"
+
+	maxMailUploadSize = 512 << 20 // all files in one request
+	// Uploads on disk across all users. With one job per user at a time, a
+	// user can't hold more than maxMailUploadSize of it.
+	maxMailSpoolSize = 4 << 30
+	maxScanJobs      = 20
+	// How often a running job's counters are written back
+	scanJobProgressEvery = 200
+)
+
+// ScanJob tracks a scan of uploaded mail files
+type ScanJob struct {
+	ID                 string     `json:"id"`
+	UserID             string     `json:"-"`
+	Source             string     `json:"source"`
+	Files              []string   `json:"files"`
+	Status             string     `json:"status"`
+	MessagesRead       int        `json:"messagesRead"`
+	Matched            int        `json:"matched"` // messages that looked like receipts
+	Skipped            int        `json:"skipped"` // unreadable or over 25 MB
+	SubscriptionsFound int        `json:"subscriptionsFound"`
+	Error              string     `json:"error,omitempty"`
+	CreatedAt          time.Time  `json:"createdAt"`
+	FinishedAt         *time.Time `json:"finishedAt,omitempty"`
+}
+
+func (j *ScanJob) copy() *ScanJob {
+	result := *j
+	result.Files = append([]string(nil), j.Files...)
+	return &result
+}
+
+var errSpoolFull = errors.New("upload space is full")
+
+// mailUpload is an uploaded file waiting on disk for its job
+type mailUpload struct {
+	path   string
+	name   string
+	format string
+	size   int64
+}
+
+// MailImportService scans uploaded .eml and mbox files for users who don't
+// want to connect a mailbox
+type MailImportService struct {
+	scanner *MailScanner
+
+	mu         sync.Mutex
+	spooled    int64 // bytes of uploads on disk
+	spoolLimit int64
+}
+
+func NewMailImportService(scanner *MailScanner) *MailImportService {
+	return &MailImportService{scanner: scanner, spoolLimit: maxMailSpoolSize}
+}
+
+// ImportMail accepts one or more "file" parts: .eml files, zip files of .eml
+// files or mbox exports such as Google Takeout. Files are streamed to disk
+// and scanned in the background.
+func (s *MailImportService) ImportMail(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	// Claimed before reading the upload so parallel requests can't both spool
+	job := &ScanJob{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Source:    SourceUpload,
+		Files:     []string{},
+		Status:    ScanQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	if running := store.StartScanJob(job); running != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A mail upload is already being scanned", "job": running})
+		return
+	}
+
+	// Leave room for the multipart envelope around the files
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxMailUploadSize+(1<<20))
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		store.DeleteScanJob(userID, job.ID)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload must be multipart/form-data"})
+		return
+	}
+
+	uploads := make([]mailUpload, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.removeUploads(uploads)
+			store.DeleteScanJob(userID, job.ID)
+			c.JSON(uploadError(err))
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		upload, err := s.spool(part)
+		part.Close()
+		if err != nil {
+			s.removeUploads(uploads)
+			store.DeleteScanJob(userID, job.ID)
+			c.JSON(uploadError(err))
+			return
+		}
+		uploads = append(uploads, upload)
+	}
+
+	if len(uploads) == 0 {
+		store.DeleteScanJob(userID, job.ID)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one .eml, .zip or .mbox file is required"})
+		return
+	}
+
+	job = store.UpdateScanJob(userID, job.ID, func(j *ScanJob) {
+		for _, upload := range uploads {
+			j.Files = append(j.Files, upload.name)
+		}
+	})
+	if job == nil {
+		// The account was deleted while uploading
+		s.removeUploads(uploads)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan not found"})
+		return
+	}
+
+	go s.run(userID, job.ID, uploads)
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// ListJobs returns the user's mail upload scans, newest first
+func (s *MailImportService) ListJobs(c *gin.Context) {
+	jobs := store.GetScanJobs(c.GetString("user_id"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":  jobs,
+		"total": len(jobs),
+	})
+}
+
+// GetJob returns one scan with its progress
+func (s *MailImportService) GetJob(c *gin.Context) {
+	job := store.GetScanJob(c.GetString("user_id"), c.Param("id"))
+	if job == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scan not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// run reads every message in the uploads through the same extractors as a
+// mailbox scan, then deletes the files
+func (s *MailImportService) run(userID, jobID string, uploads []mailUpload) {
+	store.UpdateScanJob(userID, jobID, func(j *ScanJob) { j.Status = ScanRunning })
+
+	scan := newMailScan(userID, Mailbox{Source: SourceUpload, Label: "Mail upload"}, time.Time{})
+	read, matched, skipped := 0, 0, 0
+	var lastErr error
+
+	visit := func(id string, raw []byte) {
+		message, err := parseRawMessage(id, raw)
+		if err != nil {
+			skipped++
+			return
+		}
+		read++
+
+		// Only messages a mailbox search would have returned
+		for _, query := range subscriptionQueries {
+			if query.Matches(message.Subject, message.From) {
+				matched++
+				s.scanner.read(scan, message)
+				break
+			}
+		}
+
+		if read%scanJobProgressEvery == 0 {
+			store.UpdateScanJob(userID, jobID, func(j *ScanJob) {
+				j.MessagesRead, j.Matched, j.Skipped = read, matched, skipped
+			})
+		}
+	}
+
+	for _, upload := range uploads {
+		n, err := readMailArchive(upload.path, upload.format, func(id string, raw []byte) {
+			if id == "" {
+				id = upload.name
+			}
+			visit(id, raw)
+		})
+		skipped += n
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", upload.name, err)
+		}
+	}
+	// Free the space before the job shows as finished
+	s.removeUploads(uploads)
+
+	found := 0
+	if read > 0 {
+		found = s.scanner.finish(context.Background(), scan)
+	}
+
+	finished := time.Now().UTC()
+	store.UpdateScanJob(userID, jobID, func(j *ScanJob) {
+		j.MessagesRead, j.Matched, j.Skipped = read, matched, skipped
+		j.SubscriptionsFound = found
+		j.FinishedAt = &finished
+		j.Status = ScanDone
+		if lastErr != nil {
+			j.Error = lastErr.Error()
+		}
+		if read == 0 {
+			j.Status = ScanFailed
+			if j.Error == "" {
+				j.Error = "No email messages found in the upload"
+			}
+		}
+	})
+}
+
+// spool copies one uploaded file to a temporary file, noting its format
+// from the name and first bytes. The bytes written count against the disk
+// budget until the upload is removed.
+func (s *MailImportService) spool(part *multipart.Part) (mailUpload, error) {
+	file, err := os.CreateTemp("", "subtrack-mail-*")
+	if err != nil {
+		return mailUpload{}, err
+	}
+	defer file.Close()
+
+	upload := mailUpload{path: file.Name(), name: part.FileName()}
+	_, err = io.Copy(spoolWriter{file, s, &upload.size}, part)
+	if err != nil {
+		s.removeUploads([]mailUpload{upload})
+		return mailUpload{}, err
+	}
+
+	head := make([]byte, 5)
+	n, _ := file.ReadAt(head, 0)
+	upload.format = detectMailFormat(upload.name, head[:n])
+	return upload, nil
+}
+
+// spoolWriter reserves disk budget before each write
+type spoolWriter struct {
+	file    *os.File
+	service *MailImportService
+	written *int64
+}
+
+func (w spoolWriter) Write(p []byte) (int, error) {
+	w.service.mu.Lock()
+	if w.service.spooled+int64(len(p)) > w.service.spoolLimit {
+		w.service.mu.Unlock()
+		return 0, errSpoolFull
+	}
+	w.service.spooled += int64(len(p))
+	w.service.mu.Unlock()
+
+	*w.written += int64(len(p))
+	return w.file.Write(p)
+}
+
+// removeUploads deletes the files and gives their space back
+func (s *MailImportService) removeUploads(uploads []mailUpload) {
+	for _, upload := range uploads {
+		os.Remove(upload.path)
+		s.mu.Lock()
+		s.spooled -= upload.size
+		s.mu.Unlock()
+	}
+}
+
+func uploadError(err error) (int, gin.H) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Uploads are limited to %d MB", maxMailUploadSize>>20)}
+	case errors.Is(err, errSpoolFull):
+		return http.StatusServiceUnavailable, gin.H{"error": "Too many uploads are being scanned, try again later"}
+	}
+	return http.StatusBadRequest, gin.H{"error": "Failed to read upload"}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func rawMessage(from, subject, body string) string {
+	return fmt.Sprintf("From: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, subject, time.Now().Format(time.RFC1123Z), body)
+}
+
+func mailImportRouter(s *MailImportService) *gin.Engine {
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.POST("/mail", s.ImportMail)
+	r.GET("/mail/:id", s.GetJob)
+	return r
+}
+
+// mailImportUser is testUser with their scan jobs removed afterwards, so
+// reruns start with the slot free
+func mailImportUser(t *testing.T) *User {
+	user := testUser(t)
+	t.Cleanup(func() {
+		for _, job := range store.GetScanJobs(user.ID) {
+			store.DeleteScanJob(user.ID, job.ID)
+		}
+	})
+	return user
+}
+
+func waitForScanJob(t *testing.T, userID, jobID string) *ScanJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job := store.GetScanJob(userID, jobID); job != nil && (job.Status == ScanDone || job.Status == ScanFailed) {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("scan did not finish")
+	return nil
+}
+
+func writeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportMailScansUpload(t *testing.T) {
+	service := NewMailImportService(NewMailScanner(nil))
+	r := mailImportRouter(service)
+	user := mailImportUser(t)
+	tokens, _ := issueSession(user)
+
+	upload := writeZip(t, map[string]string{
+		"Takeout/Mail/receipts.eml": rawMessage("Netflix <info@account.netflix.com>", "Your Netflix receipt", "Total: $15.49/month"),
+		"__MACOSX/._receipts.eml":   "junk",
+		"Takeout/readme.html":       "<p>not mail</p>",
+	})
+	w := serveUpload(r, "/mail", "takeout.zip", upload, nil, tokens.AccessToken)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload = %d %s", w.Code, w.Body.String())
+	}
+	var job ScanJob
+	json.Unmarshal(w.Body.Bytes(), &job)
+	if len(job.Files) != 1 || job.Files[0] != "takeout.zip" {
+		t.Errorf("job files = %v", job.Files)
+	}
+
+	done := waitForScanJob(t, user.ID, job.ID)
+	if done.Status != ScanDone || done.MessagesRead != 1 || done.SubscriptionsFound != 1 {
+		t.Errorf("job = %+v", done)
+	}
+	subs := store.GetSubscriptions(user.ID)
+	if len(subs) != 1 || subs[0].Name != "Netflix" || subs[0].Sources[0] != SourceUpload {
+		t.Errorf("subscriptions = %+v", subs)
+	}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if service.spooled != 0 {
+		t.Errorf("%d bytes still counted as spooled after the scan", service.spooled)
+	}
+}
+
+func TestImportMailOneJobAtATime(t *testing.T) {
+	r := mailImportRouter(NewMailImportService(NewMailScanner(nil)))
+	user := mailImportUser(t)
+	tokens, _ := issueSession(user)
+
+	// Parallel requests can't both claim the slot
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	started := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if store.StartScanJob(&ScanJob{ID: fmt.Sprint(i), UserID: user.ID, Status: ScanQueued}) == nil {
+				mu.Lock()
+				started++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if started != 1 {
+		t.Fatalf("%d jobs started, want 1", started)
+	}
+
+	w := serveUpload(r, "/mail", "receipt.eml", []byte(rawMessage("a@example.com", "receipt", "")), nil, tokens.AccessToken)
+	if w.Code != http.StatusConflict {
+		t.Errorf("upload while a job is queued = %d", w.Code)
+	}
+}
+
+func TestImportMailFailedUploadReleasesJob(t *testing.T) {
+	service := NewMailImportService(NewMailScanner(nil))
+	service.spoolLimit = 1 << 10
+	r := mailImportRouter(service)
+	user := mailImportUser(t)
+	tokens, _ := issueSession(user)
+
+	if w := serveJSON(r, http.MethodPost, "/mail", gin.H{"file": "x"}, tokens.AccessToken); w.Code != http.StatusBadRequest {
+		t.Errorf("JSON body = %d", w.Code)
+	}
+	if w := serveUpload(r, "/mail", "big.mbox", bytes.Repeat([]byte("x"), 4<<10), nil, tokens.AccessToken); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("upload over the disk budget = %d", w.Code)
+	}
+	if service.spooled != 0 {
+		t.Errorf("%d bytes still counted as spooled", service.spooled)
+	}
+	if jobs := store.GetScanJobs(user.ID); len(jobs) != 0 {
+		t.Errorf("failed uploads left jobs: %+v", jobs)
+	}
+
+	// The user isn't locked out afterwards
+	if w := serveUpload(r, "/mail", "receipt.eml", []byte(rawMessage("a@example.com", "receipt", "")), nil, tokens.AccessToken); w.Code != http.StatusAccepted {
+		t.Errorf("upload after failures = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReadMailZipBudget(t *testing.T) {
+	defer func(limit int64) { maxZipUncompressedSize = limit }(maxZipUncompressedSize)
+	maxZipUncompressedSize = 64 << 10
+
+	// Compresses to almost nothing but expands past the budget
+	var mbox strings.Builder
+	total := 0
+	for ; mbox.Len() < 256<<10; total++ {
+		mbox.WriteString(fmt.Sprintf("From sender@example.com Mon Jan  5 10:00:00 2026\n%s\n", rawMessage("a@example.com", fmt.Sprint("receipt ", total), strings.Repeat("a", 1000))))
+	}
+	path := filepath.Join(t.TempDir(), "bomb.zip")
+	os.WriteFile(path, writeZip(t, map[string]string{"All mail.mbox": mbox.String()}), 0o600)
+
+	visited := 0
+	_, err := readMailZip(path, func(id string, raw []byte) { visited++ })
+	if !errors.Is(err, errZipTooLarge) {
+		t.Errorf("err = %v, want errZipTooLarge", err)
+	}
+	if visited == 0 || visited >= total/2 {
+		t.Errorf("visited %d of %d messages before stopping", visited, total)
+	}
+
+	small := filepath.Join(t.TempDir(), "small.zip")
+	os.WriteFile(small, writeZip(t, map[string]string{
+		"a.eml": rawMessage("a@example.com", "one", "hi"),
+		"b.eml": rawMessage("b@example.com", "two", "hi"),
+	}), 0o600)
+	visited = 0
+	if _, err := readMailZip(small, func(id string, raw []byte) { visited++ }); err != nil || visited != 2 {
+		t.Errorf("small zip: visited %d, err %v", visited, err)
+	}
+}
+
+func TestReadMbox(t *testing.T) {
+	mbox := "From a@example.com Mon Jan  5 10:00:00 2026\n" +
+		"Subject: one\n\n>From the desk of Alice\n>>From quoted\n\n" +
+		"From b@example.com Mon Jan  5 11:00:00 2026\n" +
+		"Subject: two\n\nbody\n"
+
+	var messages []string
+	skipped, err := readMbox(strings.NewReader(mbox), "inbox.mbox", func(id string, raw []byte) {
+		messages = append(messages, id+"|"+string(raw))
+	})
+	if err != nil || skipped != 0 || len(messages) != 2 {
+		t.Fatalf("messages = %q, skipped %d, err %v", messages, skipped, err)
+	}
+	if !strings.HasPrefix(messages[0], "inbox.mbox#1|") || !strings.Contains(messages[0], "\nFrom the desk of Alice\n>From quoted\n") {
+		t.Errorf("first message = %q", messages[0])
+	}
+	if !strings.Contains(messages[1], "Subject: two") {
+		t.Errorf("second message = %q", messages[1])
+	}
+}
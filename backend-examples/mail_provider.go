@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// MailProvider is a mailbox we can scan for subscriptions
+type MailProvider interface {
+	// Cursor marks the mailbox's current position. Passing it to a later
+	// Search only returns messages that arrived after it.
+	Cursor(ctx context.Context) (string, error)
+	// Search returns message IDs matching query, newest first. An empty
+	// cursor searches the whole mailbox.
+	Search(ctx context.Context, query MailQuery, cursor string) ([]string, error)
+	Fetch(ctx context.Context, id string) (*MailboxMessage, error)
+	Close() error
+}
+
+// MailQuery matches messages whose subject contains any of Subjects or whose
+// sender contains any of Senders
+type MailQuery struct {
+	Subjects []string
+	Senders  []string
+	Limit    int
+}
+
+// MailboxMessage is an email, whichever provider it came from
+type MailboxMessage struct {
+	ID      string
+	From    string
+	Subject string
+	Date    time.Time
+	Text    string // text/plain body
+	HTML    string // text/html body
+	// Text of PDF attachments, where vendors often put the real invoice
+	Attachments []string
+}
+
+// Matches applies the query to a message, for mailboxes that can't search
+func (q MailQuery) Matches(subject, from string) bool {
+	subject, from = strings.ToLower(subject), strings.ToLower(from)
+	for _, term := range q.Subjects {
+		if strings.Contains(subject, strings.ToLower(term)) {
+			return true
+		}
+	}
+	for _, term := range q.Senders {
+		if strings.Contains(from, strings.ToLower(term)) {
+			return true
+		}
+	}
+	return false
+}
+
+// The queries every scan runs
+var subscriptionQueries = []MailQuery{
+	{Subjects: []string{"receipt", "invoice", "subscription", "renewal", "payment"}, Limit: 100},
+	{Senders: []string{"noreply", "no-reply", "billing", "subscriptions"}, Limit: 100},
+	{Senders: storeReceiptSenders(), Limit: 100},
+}
+
+var (
+	htmlDropped = regexp.MustCompile(`(?is)<(style|script|head)\b.*?</(style|script|head)>`)
+	htmlBreaks  = regexp.MustCompile(`(?i)<(br|/p|/div|/td|/th|/tr|/li|/h\d)\b[^>]*>`)
+	htmlTags    = regexp.MustCompile(`<[^>]*>`)
+)
+
+// Body returns the plain text body, or the HTML body with tags removed,
+// followed by the text of any PDF attachments
+func (m *MailboxMessage) Body() string {
+	body := m.Text
+	if body == "" && m.HTML != "" {
+		text := htmlDropped.ReplaceAllString(m.HTML, "")
+		text = htmlBreaks.ReplaceAllString(text, "\n")
+		body = html.UnescapeString(htmlTags.ReplaceAllString(text, " "))
+	}
+	if len(m.Attachments) > 0 {
+		body = strings.Join(append([]string{body}, m.Attachments...), "\n")
+	}
+	return body
+}
+
+// Lines returns the body as trimmed, non-empty lines
+func (m *MailboxMessage) Lines() []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(m.Body(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseRawMessage reads an RFC 822 message, as IMAP and .eml files carry
+// it, taking the first text/plain and text/html parts
+func parseRawMessage(id string, raw []byte) (*MailboxMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := &mime.WordDecoder{CharsetReader: charsetReader}
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	from, err := decoder.DecodeHeader(msg.Header.Get("From"))
+	if err != nil {
+		from = msg.Header.Get("From")
+	}
+
+	message := &MailboxMessage{
+		ID:      id,
+		From:    from,
+		Subject: subject,
+	}
+	if date, err := msg.Header.Date(); err == nil {
+		message.Date = date
+	}
+
+	if err := readMIMEPart(message, msg.Header, msg.Body, 0); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// mimeHeader is satisfied by both mail.Header and multipart part headers
+type mimeHeader interface {
+	Get(key string) string
+}
+
+func readMIMEPart(message *MailboxMessage, header mimeHeader, body io.Reader, depth int) error {
+	if depth > 10 {
+		return fmt.Errorf("MIME nesting too deep")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				// Keep what was read before the broken part
+				return nil
+			}
+			if err := readMIMEPart(message, part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if mediaType == "message/rfc822" && message.Text == "" && message.HTML == "" {
+		// Forwarded as an attachment, read the original
+		inner, err := mail.ReadMessage(body)
+		if err != nil {
+			return nil
+		}
+		return readMIMEPart(message, inner.Header, inner.Body, depth+1)
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if isPDFAttachment(mediaType, firstNonEmpty(dispositionParams["filename"], params["name"])) {
+		if len(message.Attachments) < maxPDFAttachments {
+			readPDFPart(message, header.Get("Content-Transfer-Encoding"), body)
+		}
+		return nil
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return nil
+	}
+	if disposition == "attachment" {
+		return nil
+	}
+
+	text, err := decodePartBody(header.Get("Content-Transfer-Encoding"), params["charset"], body)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case mediaType == "text/plain" && message.Text == "":
+		message.Text = text
+	case mediaType == "text/html" && message.HTML == "":
+		message.HTML = text
+	}
+	return nil
+}
+
+// readPDFPart adds the text of a PDF attachment, skipping files that are too
+// large or can't be read
+func readPDFPart(message *MailboxMessage, encoding string, body io.Reader) {
+	if strings.EqualFold(strings.TrimSpace(encoding), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxPDFAttachmentSize+1))
+	if err != nil {
+		return
+	}
+	if text, err := pdfText(data); err == nil && text != "" {
+		message.Attachments = append(message.Attachments, text)
+	}
+}
+
+func decodePartBody(encoding, charset string, body io.Reader) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// The decoder skips the line breaks
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, 5<<20))
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := charsetReader(charset, bytes.NewReader(data))
+	if err != nil {
+		return string(data), nil
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return string(data), nil
+	}
+	return string(decoded), nil
+}
+
+// charsetReader converts Thai (TIS-620, windows-874), Latin and other legacy
+// charsets to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return input, nil
+	}
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
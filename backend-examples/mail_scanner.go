@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Mailbox identifies what a scan reads: the key its cursor is saved under,
+// the source recorded on what it finds and the name shown to the user
+type Mailbox struct {
+	Key    string // e.g. "gmail:<userID>" or "imap:<accountID>"
+	Source string // see SourceGmail
+	Label  string
+}
+
+// MailboxState is where the last scan of a mailbox stopped
+type MailboxState struct {
+	Cursor   string
+	LastScan time.Time
+}
+
+// MailScanner finds subscriptions in any MailProvider
+type MailScanner struct {
+	dispatcher NotificationDispatcher
+}
+
+func NewMailScanner(dispatcher NotificationDispatcher) *MailScanner {
+	return &MailScanner{dispatcher: dispatcher}
+}
+
+// scanAndStoreSubscriptions searches the mailbox for receipts and stores the
+// subscriptions found. Scans after the first only read new messages.
+func (s *MailScanner) scanAndStoreSubscriptions(userID string, provider MailProvider, mailbox Mailbox) error {
+	ctx := context.Background()
+	defer provider.Close()
+
+	state := store.GetMailboxState(mailbox.Key)
+	scan := newMailScan(userID, mailbox, state.LastScan)
+
+	// Taken before searching so messages arriving mid-scan are read next time
+	cursor, err := provider.Cursor(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	failed := 0
+	var lastErr error
+
+	for _, query := range subscriptionQueries {
+		// Search emails
+		ids, err := provider.Search(ctx, query, state.Cursor)
+		if err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+
+		// Process each message
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			message, err := provider.Fetch(ctx, id)
+			if err != nil {
+				continue
+			}
+			s.read(scan, message)
+		}
+	}
+	if failed == len(subscriptionQueries) {
+		return fmt.Errorf("search failed: %w", lastErr)
+	}
+
+	s.finish(ctx, scan)
+	store.SaveMailboxState(mailbox.Key, MailboxState{Cursor: cursor, LastScan: scan.started})
+	return nil
+}
+
+// mailScan collects what one scan finds
+type mailScan struct {
+	userID  string
+	mailbox Mailbox
+	started time.Time
+	// Only warn about failed payments we haven't seen in an earlier scan
+	since          time.Time
+	subscriptions  map[string]*Subscription
+	received       map[string]time.Time // subscription name -> date of its receipt
+	failedPayments map[string]*Notification
+}
+
+func newMailScan(userID string, mailbox Mailbox, lastScan time.Time) *mailScan {
+	started := time.Now()
+	since := lastScan
+	if since.IsZero() {
+		since = started.AddDate(0, 0, -7)
+	}
+	return &mailScan{
+		userID:         userID,
+		mailbox:        mailbox,
+		started:        started,
+		since:          since,
+		subscriptions:  make(map[string]*Subscription),
+		received:       make(map[string]time.Time),
+		failedPayments: make(map[string]*Notification),
+	}
+}
+
+// read extracts subscriptions from one message, keeping the newest receipt
+// per name
+func (s *MailScanner) read(scan *mailScan, message *MailboxMessage) {
+	if notice := failedPaymentNotice(scan.userID, message, scan.since); notice != nil {
+		scan.failedPayments[message.ID] = notice
+	}
+
+	// Extract subscription info using AI/pattern matching
+	for _, sub := range s.extractSubscriptions(message) {
+		if received, seen := scan.received[sub.Name]; seen && !message.Date.After(received) {
+			continue
+		}
+		sub.Sources = []string{scan.mailbox.Source}
+		scan.subscriptions[sub.Name] = sub
+		scan.received[sub.Name] = message.Date
+	}
+}
+
+// finish saves what the scan found and tells the user. It returns how many
+// subscriptions were found.
+func (s *MailScanner) finish(ctx context.Context, scan *mailScan) int {
+	found := s.save(ctx, scan)
+
+	s.notify(ctx, &Notification{
+		UserID: scan.userID,
+		Event:  EventScanFinished,
+		Title:  fmt.Sprintf("%s scan finished", scan.mailbox.Label),
+		Body:   fmt.Sprintf("We found %d subscriptions in your inbox.", found),
+	})
+
+	fmt.Printf("📧 Finished scanning %s. Found %d subscriptions\n", scan.mailbox.Label, found)
+	return found
+}
+
+// save stores the subscriptions found and sends failed payment notices
+func (s *MailScanner) save(ctx context.Context, scan *mailScan) int {
+	found := make([]*Subscription, 0, len(scan.subscriptions))
+	for _, sub := range scan.subscriptions {
+		found = append(found, sub)
+	}
+	storeDetectedSubscriptions(ctx, s.dispatcher, scan.userID, found)
+
+	for _, notice := range scan.failedPayments {
+		s.notify(ctx, notice)
+	}
+	return len(found)
+}
+
+// notify hands a notification to the dispatcher, scans don't fail because of it
+func (s *MailScanner) notify(ctx context.Context, n *Notification) {
+	notifyUser(ctx, s.dispatcher, n)
+}
+
+// storeDetectedSubscriptions saves subscriptions found by a scan or a
+// statement import and tells the user about price changes
+func storeDetectedSubscriptions(ctx context.Context, dispatcher NotificationDispatcher, userID string, subs []*Subscription) {
+	for _, sub := range subs {
+		if store.SaveSubscription(userID, sub) {
+			notifyUser(ctx, dispatcher, &Notification{
+				UserID: userID,
+				Event:  EventPriceChange,
+				Title:  fmt.Sprintf("%s changed its price", sub.Name),
+				Body:   fmt.Sprintf("%s now costs %.2f instead of %.2f.", sub.Name, sub.Price, sub.PreviousPrice),
+			})
+		}
+		fmt.Printf("✅ Found subscription: %s - $%.2f\n", sub.Name, sub.Price)
+	}
+}
+
+func notifyUser(ctx context.Context, dispatcher NotificationDispatcher, n *Notification) {
+	if dispatcher == nil {
+		return
+	}
+	if err := dispatcher.Dispatch(ctx, n); err != nil {
+		fmt.Printf("❌ Failed to notify user %s: %v\n", n.UserID, err)
+	}
+}
+
+// Subjects that mean a charge didn't go through
+var failedPaymentPhrases = []string{
+	"payment failed",
+	"payment declined",
+	"card was declined",
+	"unable to process your payment",
+	"couldn't process your payment",
+	"update your payment",
+}
+
+// failedPaymentNotice returns a notification if message is a failed payment
+// email received after since
+func failedPaymentNotice(userID string, message *MailboxMessage, since time.Time) *Notification {
+	if message.Date.Before(since) {
+		return nil
+	}
+
+	lower := strings.ToLower(message.Subject)
+	for _, phrase := range failedPaymentPhrases {
+		if strings.Contains(lower, phrase) {
+			return &Notification{
+				UserID: userID,
+				Event:  EventFailedPayment,
+				Title:  "A payment failed",
+				Body:   fmt.Sprintf("%s: \"%s\". Check your payment method to keep the subscription active.", message.From, message.Subject),
+			}
+		}
+	}
+	return nil
+}
+
+// extractSubscriptions splits App Store and Google Play receipts into one
+// subscription per app. Other emails go through extractSubscriptionInfo.
+func (s *MailScanner) extractSubscriptions(message *MailboxMessage) []*Subscription {
+	from := strings.ToLower(message.From)
+	for _, extractor := range receiptExtractors {
+		for _, sender := range extractor.senders {
+			if !strings.Contains(from, sender) {
+				continue
+			}
+
+			subs := extractor.extract(message.Lines(), message.Date)
+			for _, sub := range subs {
+				sub.ID = generateTempID()
+				sub.IsAutoDetected = true
+				sub.BillingPlatform = extractor.platform
+			}
+			return subs
+		}
+	}
+
+	if sub := s.extractSubscriptionInfo(message); sub != nil {
+		sub.BillingPlatform = PlatformDirect
+		return []*Subscription{sub}
+	}
+	return nil
+}
+
+// Extract subscription information from email
+func (s *MailScanner) extractSubscriptionInfo(message *MailboxMessage) *Subscription {
+	// Simple pattern matching (in production, use AI/ML)
+	// This is a simplified example
+	bodyLower := strings.ToLower(message.Body() + " " + message.Subject + " " + message.From)
+
+	for keyword, info := range subscriptionKeywords {
+		if strings.Contains(bodyLower, keyword) {
+			sub := &Subscription{
+				ID:              generateTempID(), // Generate unique ID
+				Name:            info.name,
+				Price:           9.99, // when the email doesn't show one
+				BillingCycle:    "monthly",
+				NextBillingDate: time.Now().AddDate(0, 1, 0).Format("2006-01-02"),
+				Category:        info.category,
+				IsAutoDetected:  true,
+			}
+			readInvoiceTerms(sub, message.Lines())
+			return sub
+		}
+	}
+
+	return nil
+}
+
+var invoiceTotal = regexp.MustCompile(`(?i)^(?:grand\s+)?total\b|^amount\s+(?:due|paid|charged)\b`)
+
+// readInvoiceTerms takes the price, billing period and next billing date
+// from an invoice's lines, which include the text of PDF attachments. The
+// total line wins over the first price shown.
+func readInvoiceTerms(sub *Subscription, lines []string) {
+	priceLine, total := "", false
+	for _, line := range lines {
+		if match := receiptRenews.FindStringSubmatch(line); match != nil {
+			if date, ok := parseReceiptDate(match[1]); ok {
+				sub.NextBillingDate = date.Format(dateLayout)
+			}
+			continue
+		}
+		if total {
+			continue
+		}
+		if _, ok := receiptAmount(line); ok && (priceLine == "" || invoiceTotal.MatchString(line)) {
+			priceLine, total = line, invoiceTotal.MatchString(line)
+		}
+	}
+
+	if price, ok := receiptAmount(priceLine); ok {
+		sub.Price = price
+		if period := receiptPeriod.FindStringSubmatch(priceLine); period != nil {
+			sub.BillingCycle = cycleFromText(period[1])
+		}
+	}
+}
+
+// Services we recognize by keyword, shared with statement detection so both
+// sources store the same subscription name
+var subscriptionKeywords = map[string]struct {
+	name     string
+	category string
+}{
+	"netflix": {"Netflix", "streaming"},
+	"spotify": {"Spotify", "streaming"},
+	"adobe":   {"Adobe Creative Cloud", "productivity"},
+	"youtube": {"YouTube Premium", "streaming"},
+	"github":  {"GitHub", "development"},
+	"chatgpt": {"ChatGPT Plus", "ai"},
+}
+
+// Helper to generate a temporary ID
+func generateTempID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -14,13 +15,20 @@ func main() {
 	// Load environment variables
 	godotenv.Load()
 
+	// Load JWT signing keys, refusing to start without a real key outside dev
+	keys, err := LoadKeyManager()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	tokenKeys = keys
+
 	// Initialize Gin router
 	r := gin.Default()
 
 	// CORS configuration
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:3000", "http://localhost:5173"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -28,8 +36,40 @@ func main() {
 
 	// Initialize services
 	authService := NewAuthService()
-	gmailService := NewGmailService()
 	subscriptionService := NewSubscriptionService()
+	userService := NewUserService()
+	personalTokenService := NewPersonalTokenService()
+	mailer := NewMailer()
+	magicLinkService := NewMagicLinkService(mailer)
+	pusher, err := NewWebPusher()
+	if err != nil {
+		log.Fatalf("Failed to load VAPID key: %v", err)
+	}
+	pushService := NewPushService(pusher)
+	notificationService := NewNotificationService(NewNotifiers(mailer, pusher))
+	importService := NewImportService(notificationService)
+	reconciliationService := NewReconciliationService()
+	mailScanner := NewMailScanner(notificationService)
+	gmailService := NewGmailService(mailScanner)
+	outlookService := NewOutlookService(mailScanner)
+	mailAccountService := NewMailAccountService(mailScanner)
+	mailImportService := NewMailImportService(mailScanner)
+	inboundService := NewInboundService(mailScanner)
+
+	// Sent reminders and digests are recorded here so they go out once
+	ledgerPath := os.Getenv("REMINDER_LEDGER_PATH")
+	if ledgerPath == "" {
+		ledgerPath = "data/reminders.jsonl"
+	}
+	ledger, err := OpenReminderLedger(ledgerPath)
+	if err != nil {
+		log.Fatalf("Failed to open reminder ledger: %v", err)
+	}
+	digestService := NewDigestService(ledger, notificationService)
+	webAuthnService, err := NewWebAuthnService()
+	if err != nil {
+		log.Fatalf("Failed to configure WebAuthn: %v", err)
+	}
 
 	// Auth routes
 	authGroup := r.Group("/api/auth")
@@ -37,36 +77,184 @@ func main() {
 		authGroup.POST("/google", authService.GoogleSignIn)
 		authGroup.GET("/google/login", authService.GoogleLoginRedirect)
 		authGroup.GET("/google/callback", authService.GoogleLoginCallback)
+		authGroup.POST("/magic-link", magicLinkService.RequestLink)
+		authGroup.GET("/magic-link/verify", magicLinkService.VerifyLink)
+		authGroup.POST("/exchange", authService.ExchangeAuthCode)
+		authGroup.POST("/refresh", authService.RefreshSession)
+		authGroup.POST("/logout", authService.Logout)
+		authGroup.POST("/logout-all", AuthMiddleware(), RequireSession(), authService.LogoutAll)
+
+		// Passkeys
+		authGroup.POST("/webauthn/login/begin", webAuthnService.BeginLogin)
+		authGroup.POST("/webauthn/login/finish", webAuthnService.FinishLogin)
+
+		passkeyGroup := authGroup.Group("/webauthn")
+		passkeyGroup.Use(AuthMiddleware(), RequireSession())
+		{
+			passkeyGroup.GET("/credentials", webAuthnService.ListPasskeys)
+			// Adding or removing a passkey needs one of the existing ones
+			passkeyGroup.POST("/register/begin", RequireStepUp(), webAuthnService.BeginRegistration)
+			passkeyGroup.POST("/register/finish", RequireStepUp(), webAuthnService.FinishRegistration)
+			passkeyGroup.DELETE("/credentials/:id", RequireStepUp(), webAuthnService.DeletePasskey)
+			passkeyGroup.POST("/verify/begin", webAuthnService.BeginStepUp)
+			passkeyGroup.POST("/verify/finish", webAuthnService.FinishStepUp)
+		}
+	}
+
+	// Profile routes (protected, browser session only)
+	meGroup := r.Group("/api/me")
+	meGroup.Use(AuthMiddleware(), RequireSession())
+	{
+		meGroup.GET("", userService.GetMe)
+		meGroup.PATCH("", userService.UpdateMe)
+		meGroup.GET("/digest", digestService.Preview)
+		meGroup.DELETE("", RequireStepUp(), userService.DeleteMe)
+	}
+
+	// Personal access token routes (protected, browser session only)
+	tokenGroup := r.Group("/api/tokens")
+	tokenGroup.Use(AuthMiddleware(), RequireSession())
+	{
+		tokenGroup.POST("", personalTokenService.CreateToken)
+		tokenGroup.GET("", personalTokenService.ListTokens)
+		tokenGroup.DELETE("/:id", personalTokenService.RevokeToken)
+	}
+
+	// Notification channel routes (protected)
+	notifyGroup := r.Group("/api/notifications")
+	notifyGroup.Use(AuthMiddleware(), RequireSession())
+	{
+		notifyGroup.GET("/channels", notificationService.ListChannels)
+		notifyGroup.POST("/channels", notificationService.CreateChannel)
+		notifyGroup.PATCH("/channels/:id", notificationService.UpdateChannel)
+		notifyGroup.DELETE("/channels/:id", notificationService.DeleteChannel)
+		notifyGroup.POST("/channels/:id/test", notificationService.TestChannel)
+		notifyGroup.GET("/deliveries", notificationService.ListDeliveries)
+	}
+
+	// Web Push routes
+	r.GET("/api/push/vapid-public-key", pushService.VAPIDPublicKey)
+	pushGroup := r.Group("/api/push")
+	pushGroup.Use(AuthMiddleware(), RequireSession())
+	{
+		pushGroup.POST("/subscriptions", pushService.Subscribe)
+		pushGroup.GET("/subscriptions", pushService.ListSubscriptions)
+		pushGroup.DELETE("/subscriptions/:id", pushService.Unsubscribe)
+	}
+
+	// Settings routes (protected)
+	settingsGroup := r.Group("/api/settings")
+	settingsGroup.Use(AuthMiddleware(), RequireSession())
+	{
+		settingsGroup.GET("/notifications", notificationService.GetSettings)
+		settingsGroup.PUT("/notifications", notificationService.UpdateSettings)
 	}
 
 	// Gmail routes (protected)
 	gmailGroup := r.Group("/api/gmail")
-	gmailGroup.Use(AuthMiddleware())
+	gmailGroup.Use(AuthMiddleware(), RequireScope(ScopeGmailRead))
 	{
-		gmailGroup.POST("/connect", gmailService.InitiateConnection)
-		gmailGroup.POST("/callback", gmailService.HandleCallback)
-		gmailGroup.POST("/scan", gmailService.ScanEmails)
-		gmailGroup.DELETE("/disconnect", gmailService.Disconnect)
+		gmailWrite := RequireScope(ScopeGmailWrite)
+		gmailGroup.POST("/connect", gmailWrite, gmailService.InitiateConnection)
+		gmailGroup.POST("/callback", gmailWrite, gmailService.HandleCallback)
+		gmailGroup.POST("/scan", gmailWrite, gmailService.ScanEmails)
+		gmailGroup.DELETE("/disconnect", gmailWrite, RequireStepUp(), gmailService.Disconnect)
 	}
 
-	// Gmail redirect routes (no auth required for flow)
+	// Gmail redirect routes (no auth required for flow, guests get a session)
 	r.GET("/api/gmail/connect/redirect", gmailService.InitiateConnectionRedirect)
 	r.GET("/api/gmail/callback/redirect", gmailService.HandleCallbackRedirect)
 
+	// Outlook routes (protected), mirror the Gmail ones
+	outlookGroup := r.Group("/api/outlook")
+	outlookGroup.Use(AuthMiddleware(), RequireScope(ScopeGmailRead))
+	{
+		outlookWrite := RequireScope(ScopeGmailWrite)
+		outlookGroup.POST("/connect", outlookWrite, outlookService.InitiateConnection)
+		outlookGroup.POST("/callback", outlookWrite, outlookService.HandleCallback)
+		outlookGroup.POST("/scan", outlookWrite, outlookService.ScanEmails)
+		outlookGroup.DELETE("/disconnect", outlookWrite, RequireStepUp(), outlookService.Disconnect)
+	}
+
+	// Outlook redirect routes (no auth required for flow, guests get a session)
+	r.GET("/api/outlook/connect/redirect", outlookService.InitiateConnectionRedirect)
+	r.GET("/api/outlook/callback/redirect", outlookService.HandleCallbackRedirect)
+
+	// IMAP mailbox routes (protected), same scopes as Gmail
+	mailGroup := r.Group("/api/mail")
+	mailGroup.Use(AuthMiddleware(), RequireScope(ScopeGmailRead))
+	{
+		mailWrite := RequireScope(ScopeGmailWrite)
+		mailGroup.GET("/presets", mailAccountService.ListPresets)
+		mailGroup.GET("/accounts", mailAccountService.ListAccounts)
+		mailGroup.POST("/accounts", mailWrite, mailAccountService.CreateAccount)
+		mailGroup.POST("/accounts/:id/scan", mailWrite, mailAccountService.ScanAccount)
+		mailGroup.DELETE("/accounts/:id", mailWrite, RequireStepUp(), mailAccountService.DeleteAccount)
+	}
+
 	// Subscription routes (protected)
 	subGroup := r.Group("/api/subscriptions")
-	subGroup.Use(AuthMiddleware())
+	subGroup.Use(GuestOrAuthMiddleware(), RequireScope(ScopeSubscriptionsRead))
 	{
+		subWrite := RequireScope(ScopeSubscriptionsWrite)
 		subGroup.GET("", subscriptionService.GetSubscriptions)
 		subGroup.GET("/:id", subscriptionService.GetSubscription)
-		subGroup.DELETE("/:id", subscriptionService.DeleteSubscription)
+		subGroup.PUT("/:id/reminders", subWrite, subscriptionService.UpdateReminders)
+		subGroup.PUT("/:id/aliases", subWrite, subscriptionService.UpdateAliases)
+		subGroup.DELETE("/:id", subWrite, subscriptionService.DeleteSubscription)
 	}
 
+	// Forwarding address routes (protected), and the webhook for inbound
+	// relays, which authenticates with its own secret
+	r.POST("/api/inbound/webhook", inboundService.Webhook)
+	inboundGroup := r.Group("/api/inbound")
+	inboundGroup.Use(AuthMiddleware(), RequireScope(ScopeGmailRead))
+	{
+		inboundWrite := RequireScope(ScopeGmailWrite)
+		inboundGroup.GET("", inboundWrite, inboundService.GetAddress)
+		inboundGroup.POST("/rotate", inboundWrite, inboundService.RotateAddress)
+		inboundGroup.PUT("/senders", inboundWrite, inboundService.UpdateSenders)
+	}
+
+	// Statement and mail upload routes (protected)
+	importGroup := r.Group("/api/imports")
+	importGroup.Use(AuthMiddleware(), RequireScope(ScopeSubscriptionsRead))
+	{
+		importWrite := RequireScope(ScopeSubscriptionsWrite)
+		importGroup.GET("/profiles", importService.ListProfiles)
+		importGroup.POST("/statements", importWrite, importService.ImportStatement)
+		importGroup.GET("/statements", importService.ListImports)
+		importGroup.GET("/statements/:id", importService.GetImport)
+		importGroup.DELETE("/statements/:id", importWrite, importService.DeleteImport)
+		importGroup.GET("/recurring", importService.ListRecurring)
+		importGroup.POST("/recurring", importWrite, importService.DetectRecurring)
+		importGroup.POST("/mail", importWrite, mailImportService.ImportMail)
+		importGroup.GET("/mail", mailImportService.ListJobs)
+		importGroup.GET("/mail/:id", mailImportService.GetJob)
+	}
+	r.GET("/api/transactions", AuthMiddleware(), RequireScope(ScopeSubscriptionsRead), importService.ListTransactions)
+	r.GET("/api/reconciliation", AuthMiddleware(), RequireScope(ScopeSubscriptionsRead), reconciliationService.GetReconciliation)
+
+	// Public keys for services that verify our tokens
+	r.GET("/.well-known/jwks.json", tokenKeys.JWKS)
+
 	// Health check (add to /api prefix too)
 	r.GET("/api/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
+	// Expire unclaimed guest data and spent sessions
+	startGuestJanitor()
+	startSessionJanitor()
+
+	// Reminders for upcoming charges and digests, held back during quiet hours
+	notificationService.Start(context.Background())
+	NewReminderScheduler(ledger, notificationService).Start(context.Background())
+	digestService.Start(context.Background())
+
+	// Forwarded receipts over SMTP, when INBOUND_SMTP_ADDR is set
+	inboundService.Start(context.Background())
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
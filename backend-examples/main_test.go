@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+
+	os.Setenv("JWT_SECRET", "test-secret-that-is-long-enough-for-hs256")
+	keys, err := LoadKeyManager()
+	if err != nil {
+		panic(err)
+	}
+	tokenKeys = keys
+
+	os.Exit(m.Run())
+}
+
+// testUser returns an email account unique to the test
+func testUser(t *testing.T) *User {
+	t.Helper()
+	return store.GetOrCreateEmailUser(strings.ReplaceAll(t.Name(), "/", "-") + "@example.com")
+}
+
+// serveJSON sends a request with an optional JSON body and bearer token
+func serveJSON(r http.Handler, method, path string, body interface{}, token string) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// serveUpload posts a multipart form with one file and optional fields
+func serveUpload(r http.Handler, path, fileName string, data []byte, fields map[string]string, token string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	part, _ := form.CreateFormFile("file", fileName)
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
@@ -1,59 +1,145 @@
 package main
 
 import (
+	"errors"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// AuthMiddleware validates JWT tokens
+// How a request was authenticated
+const (
+	authTypeSession = "session"
+	authTypePAT     = "pat"
+	authTypeGuest   = "guest"
+)
+
+var (
+	errMissingAuthHeader = errors.New("Authorization header required")
+	errInvalidAuthHeader = errors.New("Invalid authorization header")
+)
+
+// AuthMiddleware validates JWT tokens and personal access tokens
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+		tokenString, err := bearerToken(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			c.Abort()
 			return
 		}
 
-		// Extract token from "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
-			c.Abort()
+		if strings.HasPrefix(tokenString, patPrefix) {
+			authenticatePAT(c, tokenString)
 			return
 		}
 
-		tokenString := parts[1]
-
-		// Parse and validate token
-		secret := os.Getenv("JWT_SECRET")
-		if secret == "" {
-			secret = "your-secret-key-change-this-in-production"
+		claims, err := parseAccessToken(tokenString)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return []byte(secret), nil
-		})
-
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		// Reject tokens revoked by logout or minted from a revoked session
+		if store.IsJTIRevoked(claims.ID) || store.IsSessionRevoked(claims.SessionID) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token revoked"})
 			c.Abort()
 			return
 		}
 
 		// Extract claims
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			c.Set("user_id", claims["user_id"].(string))
-			c.Set("email", claims["email"].(string))
+		c.Set("user_id", claims.UserID)
+		c.Set("email", claims.Email)
+		c.Set("jti", claims.ID)
+		c.Set("roles", claims.Roles)
+		c.Set("scopes", claims.Scopes())
+		c.Set("auth_type", authTypeSession)
+
+		c.Next()
+	}
+}
+
+// authenticatePAT handles requests carrying a personal access token
+func authenticatePAT(c *gin.Context, tokenString string) {
+	pat := store.UsePersonalToken(hashToken(tokenString))
+	if pat == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	user := store.GetUser(pat.UserID)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", user.ID)
+	c.Set("email", user.Email)
+	c.Set("roles", user.Roles)
+	c.Set("scopes", pat.Scopes)
+	c.Set("auth_type", authTypePAT)
+
+	c.Next()
+}
+
+// RequireSession rejects requests made with a personal access token, for
+// routes a script should never reach (such as creating more tokens)
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("auth_type") != authTypeSession {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Sign-in session required"})
+			c.Abort()
+			return
 		}
 
 		c.Next()
 	}
 }
+
+// parseBearerToken reads and validates the JWT from the Authorization header
+func parseBearerToken(c *gin.Context) (*AccessClaims, error) {
+	tokenString, err := bearerToken(c)
+	if err != nil {
+		return nil, err
+	}
+	return parseAccessToken(tokenString)
+}
+
+// bearerToken extracts the token from "Bearer <token>"
+func bearerToken(c *gin.Context) (string, error) {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		return "", errMissingAuthHeader
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", errInvalidAuthHeader
+	}
+
+	return parts[1], nil
+}
+
+// parseAccessToken validates one of our JWTs and returns its claims
+func parseAccessToken(tokenString string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, tokenKeys.Keyfunc,
+		jwt.WithValidMethods(tokenKeys.ValidMethods()),
+		jwt.WithIssuer(tokenIssuer()),
+		jwt.WithAudience(tokenAudience()),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	notifyMaxAttempts    = 3
+	notifyRetryBackoff   = 2 * time.Second
+	maxDeliveriesPerUser = 200
+
+	// Deferred notifications that fail are tried again a few more times
+	deferredMaxAttempts = 5
+	deferredRetryDelay  = 10 * time.Minute
+
+	DeliverySent   = "sent"
+	DeliveryFailed = "failed"
+)
+
+// ChannelConfig holds the per-user settings of a channel. Which fields are
+// used depends on the channel type.
+type ChannelConfig struct {
+	Address        string `json:"address,omitempty"`        // email, defaults to account email
+	LineUserID     string `json:"lineUserId,omitempty"`     // line
+	TelegramChatID string `json:"telegramChatId,omitempty"` // telegram
+	URL            string `json:"url,omitempty"`            // slack, webhook
+	Secret         string `json:"secret,omitempty"`         // webhook signing secret
+}
+
+// NotificationChannel is a place a user wants to be notified
+type NotificationChannel struct {
+	ID        string        `json:"id"`
+	UserID    string        `json:"-"`
+	Type      string        `json:"type"`
+	Name      string        `json:"name"`
+	Enabled   bool          `json:"enabled"`
+	Config    ChannelConfig `json:"config"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// Delivery is one entry in the delivery log
+type Delivery struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"`
+	ChannelID string    `json:"channelId"`
+	Channel   string    `json:"channel"`
+	Event     string    `json:"event"`
+	Title     string    `json:"title"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type CreateChannelRequest struct {
+	Type    string        `json:"type" binding:"required"`
+	Name    string        `json:"name"`
+	Enabled *bool         `json:"enabled"`
+	Config  ChannelConfig `json:"config"`
+}
+
+type UpdateChannelRequest struct {
+	Name    *string        `json:"name"`
+	Enabled *bool          `json:"enabled"`
+	Config  *ChannelConfig `json:"config"`
+}
+
+// Masked returns a copy that is safe to send back to the client
+func (ch *NotificationChannel) Masked() *NotificationChannel {
+	result := *ch
+	if result.Config.Secret != "" {
+		result.Config.Secret = "********"
+	}
+	if result.Type == ChannelSlack && result.Config.URL != "" {
+		// The webhook URL is the credential, only show where it points
+		if i := strings.Index(result.Config.URL, "/services/"); i >= 0 {
+			result.Config.URL = result.Config.URL[:i] + "/services/********"
+		}
+	}
+	return &result
+}
+
+// NotificationService manages channels and delivers notifications to them
+type NotificationService struct {
+	notifiers map[string]Notifier
+	backoff   time.Duration
+}
+
+func NewNotificationService(notifiers map[string]Notifier) *NotificationService {
+	return &NotificationService{
+		notifiers: notifiers,
+		backoff:   notifyRetryBackoff,
+	}
+}
+
+// Dispatch applies the user's preferences: events they turned off are
+// dropped and anything landing in quiet hours is held until they end.
+func (s *NotificationService) Dispatch(ctx context.Context, n *Notification) error {
+	user := store.GetUser(n.UserID)
+	if user == nil {
+		return nil
+	}
+
+	if !user.Notifications.EventEnabled(n.Event) {
+		return nil
+	}
+
+	if until, quiet := quietUntil(user, time.Now()); quiet {
+		fmt.Printf("🌙 Quiet hours for user %s, holding %q until %s\n", user.ID, n.Title, until.Format(time.RFC3339))
+		store.DeferNotification(&DeferredNotification{Notification: n, DeliverAt: until})
+		return nil
+	}
+
+	return s.dispatchNow(ctx, user, n)
+}
+
+// Start delivers deferred notifications once quiet hours are over
+func (s *NotificationService) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.deliverDeferred(ctx, now)
+			}
+		}
+	}()
+}
+
+// deliverDeferred sends the held notifications that are due, putting back
+// the ones that failed for a later try
+func (s *NotificationService) deliverDeferred(ctx context.Context, now time.Time) {
+	for _, d := range store.TakeDueNotifications(now) {
+		err := s.Dispatch(ctx, d.Notification)
+		if err == nil {
+			continue
+		}
+
+		d.Attempts++
+		if d.Attempts >= deferredMaxAttempts {
+			fmt.Printf("❌ Giving up on deferred notification for user %s after %d attempts: %v\n", d.Notification.UserID, d.Attempts, err)
+			continue
+		}
+		fmt.Printf("⚠️  Deferred notification for user %s failed, retrying: %v\n", d.Notification.UserID, err)
+		d.DeliverAt = now.Add(deferredRetryDelay)
+		store.DeferNotification(d)
+	}
+}
+
+// dispatchNow sends a notification to every enabled channel of the user. It
+// only fails if every channel failed, so a retry doesn't repeat deliveries
+// that went through.
+func (s *NotificationService) dispatchNow(ctx context.Context, user *User, n *Notification) error {
+	var channels []*NotificationChannel
+	for _, ch := range store.GetNotificationChannels(user.ID) {
+		if ch.Enabled {
+			channels = append(channels, ch)
+		}
+	}
+	if len(channels) == 0 {
+		fmt.Printf("🔕 No channels for user %s, dropping %q\n", user.ID, n.Title)
+		return nil
+	}
+
+	var lastErr error
+	delivered := 0
+	for _, ch := range channels {
+		if err := s.deliver(ctx, user, ch, n); err != nil {
+			lastErr = err
+			continue
+		}
+		delivered++
+	}
+
+	if delivered == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// deliver sends to one channel with retries and records the result
+func (s *NotificationService) deliver(ctx context.Context, user *User, ch *NotificationChannel, n *Notification) error {
+	notifier := s.notifiers[ch.Type]
+	if notifier == nil {
+		return fmt.Errorf("unknown channel type %q", ch.Type)
+	}
+
+	delivery := &Delivery{
+		ID:        uuid.NewString(),
+		UserID:    user.ID,
+		ChannelID: ch.ID,
+		Channel:   ch.Type,
+		Event:     n.Event,
+		Title:     n.Title,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var err error
+	backoff := s.backoff
+	for attempt := 1; attempt <= notifyMaxAttempts; attempt++ {
+		delivery.Attempts = attempt
+
+		err = notifier.Send(ctx, user, &ch.Config, n)
+		if err == nil || errors.Is(err, errChannelNotConfigured) {
+			break
+		}
+
+		if attempt < notifyMaxAttempts {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				attempt = notifyMaxAttempts
+			case <-time.After(backoff):
+				backoff *= 2
+			}
+		}
+	}
+
+	if err != nil {
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+	} else {
+		delivery.Status = DeliverySent
+	}
+	store.SaveDelivery(delivery)
+
+	return err
+}
+
+// ListChannels returns the user's notification channels
+func (s *NotificationService) ListChannels(c *gin.Context) {
+	channels := store.GetNotificationChannels(c.GetString("user_id"))
+
+	masked := make([]*NotificationChannel, 0, len(channels))
+	for _, ch := range channels {
+		masked = append(masked, ch.Masked())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"channels": masked,
+		"total":    len(masked),
+	})
+}
+
+// CreateChannel adds a notification channel
+func (s *NotificationService) CreateChannel(c *gin.Context) {
+	var req CreateChannelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	notifier := s.notifiers[req.Type]
+	if notifier == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown channel type"})
+		return
+	}
+	if err := notifier.Validate(&req.Config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = req.Type
+	}
+
+	ch := &NotificationChannel{
+		ID:        uuid.NewString(),
+		UserID:    c.GetString("user_id"),
+		Type:      req.Type,
+		Name:      name,
+		Enabled:   req.Enabled == nil || *req.Enabled,
+		Config:    req.Config,
+		CreatedAt: time.Now().UTC(),
+	}
+	store.SaveNotificationChannel(ch)
+
+	c.JSON(http.StatusCreated, ch.Masked())
+}
+
+// UpdateChannel renames, enables/disables or reconfigures a channel
+func (s *NotificationService) UpdateChannel(c *gin.Context) {
+	userID := c.GetString("user_id")
+	channelID := c.Param("id")
+
+	var req UpdateChannelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	existing := store.GetNotificationChannel(userID, channelID)
+	if existing == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+	if req.Config != nil {
+		// Masked values sent back unchanged keep the stored ones
+		masked := existing.Masked()
+		if req.Config.Secret == masked.Config.Secret {
+			req.Config.Secret = existing.Config.Secret
+		}
+		if req.Config.URL == masked.Config.URL {
+			req.Config.URL = existing.Config.URL
+		}
+
+		if err := s.notifiers[existing.Type].Validate(req.Config); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ch := store.UpdateNotificationChannel(userID, channelID, func(ch *NotificationChannel) {
+		if req.Name != nil && strings.TrimSpace(*req.Name) != "" {
+			ch.Name = strings.TrimSpace(*req.Name)
+		}
+		if req.Enabled != nil {
+			ch.Enabled = *req.Enabled
+		}
+		if req.Config != nil {
+			ch.Config = *req.Config
+		}
+	})
+	if ch == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ch.Masked())
+}
+
+// DeleteChannel removes a notification channel
+func (s *NotificationService) DeleteChannel(c *gin.Context) {
+	if !store.DeleteNotificationChannel(c.GetString("user_id"), c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Channel deleted",
+	})
+}
+
+// TestChannel sends a test notification to one channel
+func (s *NotificationService) TestChannel(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	ch := store.GetNotificationChannel(userID, c.Param("id"))
+	if ch == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	user := store.GetUser(userID)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	err := s.deliver(ctx, user, ch, &Notification{
+		UserID: userID,
+		Event:  "test",
+		Title:  "SubTrack test notification",
+		Body:   fmt.Sprintf("Your %s channel %q is working.", ch.Type, ch.Name),
+	})
+	if err != nil {
+		fmt.Printf("❌ Test notification on channel %s failed: %v\n", ch.ID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"success": false, "error": "Test notification could not be delivered"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Test notification sent",
+	})
+}
+
+// ListDeliveries returns the user's delivery log, newest first
+func (s *NotificationService) ListDeliveries(c *gin.Context) {
+	deliveries := store.GetDeliveries(c.GetString("user_id"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries": deliveries,
+		"total":      len(deliveries),
+	})
+}
+
+// Helper to validate a single email address
+func parseEmail(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(parsed.Address), nil
+}
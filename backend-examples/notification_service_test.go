@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyNotifier fails its first `failures` sends
+type flakyNotifier struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	sent     int
+}
+
+func (n *flakyNotifier) Validate(config *ChannelConfig) error { return nil }
+
+func (n *flakyNotifier) Send(ctx context.Context, user *User, config *ChannelConfig, notification *Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls++
+	if n.calls <= n.failures {
+		return errors.New("endpoint down")
+	}
+	n.sent++
+	return nil
+}
+
+func flakyService(t *testing.T, user *User, failures int) (*NotificationService, *flakyNotifier) {
+	t.Helper()
+	notifier := &flakyNotifier{failures: failures}
+	store.SaveNotificationChannel(&NotificationChannel{ID: "flaky-" + user.ID, UserID: user.ID, Type: "flaky", Enabled: true})
+	service := NewNotificationService(map[string]Notifier{"flaky": notifier})
+	service.backoff = time.Millisecond
+	return service, notifier
+}
+
+func TestDeferredNotificationIsRetried(t *testing.T) {
+	user := testUser(t)
+	// Fails every attempt of the first delivery
+	service, notifier := flakyService(t, user, notifyMaxAttempts)
+
+	now := time.Now()
+	store.DeferNotification(&DeferredNotification{Notification: &Notification{UserID: user.ID, Title: "Held"}, DeliverAt: now})
+
+	service.deliverDeferred(context.Background(), now)
+	if notifier.sent != 0 {
+		t.Fatal("failing endpoint counted as sent")
+	}
+
+	service.deliverDeferred(context.Background(), now.Add(time.Minute))
+	if notifier.calls != notifyMaxAttempts {
+		t.Errorf("retried before the delay: %d calls", notifier.calls)
+	}
+
+	service.deliverDeferred(context.Background(), now.Add(deferredRetryDelay))
+	if notifier.sent != 1 {
+		t.Errorf("sent = %d after retry, want 1", notifier.sent)
+	}
+}
+
+func TestDeferredNotificationGivesUp(t *testing.T) {
+	user := testUser(t)
+	service, notifier := flakyService(t, user, 1000)
+
+	now := time.Now()
+	store.DeferNotification(&DeferredNotification{Notification: &Notification{UserID: user.ID, Title: "Held"}, DeliverAt: now})
+
+	for i := 0; i < deferredMaxAttempts+2; i++ {
+		service.deliverDeferred(context.Background(), now.Add(time.Duration(i)*deferredRetryDelay))
+	}
+	if want := deferredMaxAttempts * notifyMaxAttempts; notifier.calls != want {
+		t.Errorf("calls = %d, want %d", notifier.calls, want)
+	}
+}
+
+func TestRemindersWaitForQuietHours(t *testing.T) {
+	user := testUser(t)
+	now := time.Now()
+	local := now.In(userLocation(user))
+	store.UpdateUser(user.ID, func(u *User) {
+		u.Notifications.QuietHours = QuietHours{
+			Enabled: true,
+			Start:   local.Add(-time.Hour).Format(clockLayout),
+			End:     local.Add(time.Hour).Format(clockLayout),
+		}
+	})
+	store.SaveSubscription(user.ID, &Subscription{
+		ID: generateTempID(), Name: "Disney+", Price: 7.99, BillingCycle: "monthly",
+		NextBillingDate: dateOnly(local).AddDate(0, 0, 3).Format(dateLayout),
+	})
+
+	ledgerPath := filepath.Join(t.TempDir(), "reminders.jsonl")
+	run := func(at time.Time) int {
+		ledger, err := OpenReminderLedger(ledgerPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dispatcher := &recordingDispatcher{}
+		NewReminderScheduler(ledger, dispatcher).RunOnce(context.Background(), at)
+		return dispatcher.count(user.ID)
+	}
+
+	if got := run(now); got != 0 {
+		t.Fatalf("sent %d reminders during quiet hours", got)
+	}
+	// The server restarts; the reminder wasn't claimed so it still goes out
+	if got := run(now.Add(2 * time.Hour)); got != 1 {
+		t.Errorf("sent %d reminders after quiet hours, want 1", got)
+	}
+}
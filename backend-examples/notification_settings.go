@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Events users can turn off. Anything else, like digests they opted in to,
+// is always delivered.
+const (
+	EventPriceChange   = "price_change"
+	EventScanFinished  = "scan_finished"
+	EventFailedPayment = "failed_payment"
+)
+
+var notificationEvents = []string{
+	ReminderUpcomingCharge,
+	EventPriceChange,
+	ReminderTrialEnding,
+	EventScanFinished,
+	EventFailedPayment,
+}
+
+const clockLayout = "15:04"
+
+// NotificationSettings is what a user wants to hear about and when
+type NotificationSettings struct {
+	Events     map[string]bool `json:"events"` // missing means on
+	QuietHours QuietHours      `json:"quietHours"`
+}
+
+// QuietHours is a daily window in the user's time zone when nothing is sent.
+// Start after end means the window wraps past midnight.
+type QuietHours struct {
+	Enabled bool   `json:"enabled"`
+	Start   string `json:"start"` // HH:MM
+	End     string `json:"end"`   // HH:MM
+}
+
+// DeferredNotification waits for quiet hours to end, or for another try
+type DeferredNotification struct {
+	Notification *Notification
+	DeliverAt    time.Time
+	Attempts     int // failed sends so far
+}
+
+type NotificationSettingsResponse struct {
+	Events     map[string]bool `json:"events"`
+	QuietHours QuietHours      `json:"quietHours"`
+	TimeZone   string          `json:"timeZone"`
+}
+
+type UpdateNotificationSettingsRequest struct {
+	Events     map[string]bool `json:"events"`
+	QuietHours *QuietHours     `json:"quietHours"`
+	TimeZone   *string         `json:"timeZone"`
+}
+
+// EventEnabled reports whether the user wants notifications for event
+func (ns *NotificationSettings) EventEnabled(event string) bool {
+	enabled, ok := ns.Events[event]
+	return !ok || enabled
+}
+
+// GetSettings returns the signed-in user's notification settings
+func (s *NotificationService) GetSettings(c *gin.Context) {
+	user := store.GetUser(c.GetString("user_id"))
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, notificationSettingsResponse(user))
+}
+
+// UpdateSettings changes event toggles, quiet hours and the time zone.
+// Fields left out are unchanged.
+func (s *NotificationService) UpdateSettings(c *gin.Context) {
+	var req UpdateNotificationSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	for event := range req.Events {
+		if !isNotificationEvent(event) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown event %q", event)})
+			return
+		}
+	}
+
+	if req.QuietHours != nil && req.QuietHours.Enabled {
+		start, err1 := time.Parse(clockLayout, req.QuietHours.Start)
+		end, err2 := time.Parse(clockLayout, req.QuietHours.End)
+		if err1 != nil || err2 != nil || start.Equal(end) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quiet hours"})
+			return
+		}
+	}
+
+	if req.TimeZone != nil {
+		if _, err := time.LoadLocation(*req.TimeZone); err != nil || *req.TimeZone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time zone"})
+			return
+		}
+	}
+
+	user := store.UpdateUser(c.GetString("user_id"), func(u *User) {
+		if len(req.Events) > 0 {
+			events := make(map[string]bool, len(notificationEvents))
+			for event, enabled := range u.Notifications.Events {
+				events[event] = enabled
+			}
+			for event, enabled := range req.Events {
+				events[event] = enabled
+			}
+			u.Notifications.Events = events
+		}
+		if req.QuietHours != nil {
+			u.Notifications.QuietHours = *req.QuietHours
+		}
+		if req.TimeZone != nil {
+			u.TimeZone = *req.TimeZone
+		}
+	})
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, notificationSettingsResponse(user))
+}
+
+func notificationSettingsResponse(user *User) NotificationSettingsResponse {
+	events := make(map[string]bool, len(notificationEvents))
+	for _, event := range notificationEvents {
+		events[event] = user.Notifications.EventEnabled(event)
+	}
+
+	return NotificationSettingsResponse{
+		Events:     events,
+		QuietHours: user.Notifications.QuietHours,
+		TimeZone:   user.TimeZone,
+	}
+}
+
+func isNotificationEvent(event string) bool {
+	for _, known := range notificationEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// quietUntil returns when the user's quiet hours end if now falls inside them
+func quietUntil(user *User, now time.Time) (time.Time, bool) {
+	quiet := user.Notifications.QuietHours
+	if !quiet.Enabled {
+		return time.Time{}, false
+	}
+
+	start, err1 := time.Parse(clockLayout, quiet.Start)
+	end, err2 := time.Parse(clockLayout, quiet.End)
+	if err1 != nil || err2 != nil {
+		return time.Time{}, false
+	}
+
+	local := now.In(userLocation(user))
+	minute := local.Hour()*60 + local.Minute()
+	startMin := start.Hour()*60 + start.Minute()
+	endMin := end.Hour()*60 + end.Minute()
+
+	var inside bool
+	if startMin < endMin {
+		inside = minute >= startMin && minute < endMin
+	} else {
+		inside = minute >= startMin || minute < endMin
+	}
+	if !inside {
+		return time.Time{}, false
+	}
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end.Hour(), end.Minute(), 0, 0, local.Location())
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until, true
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Channel types
+const (
+	ChannelEmail    = "email"
+	ChannelLINE     = "line"
+	ChannelTelegram = "telegram"
+	ChannelSlack    = "slack"
+	ChannelWebhook  = "webhook"
+)
+
+var errChannelNotConfigured = errors.New("channel not configured on this server")
+
+// Notifier delivers a notification over one kind of channel
+type Notifier interface {
+	// Validate checks a user's channel settings before they are saved
+	Validate(config *ChannelConfig) error
+	Send(ctx context.Context, user *User, config *ChannelConfig, n *Notification) error
+}
+
+// Shared clients for outgoing notification requests. URLs users enter go
+// through webhookHTTPClient, which can't reach internal addresses.
+var (
+	notifyHTTPClient  = &http.Client{Timeout: 10 * time.Second}
+	webhookHTTPClient = newPublicHTTPClient(10 * time.Second)
+)
+
+// NewNotifiers builds every channel from the environment. Base URLs can be
+// overridden so tests can point at local fakes.
+func NewNotifiers(mailer Mailer, pusher *WebPusher) map[string]Notifier {
+	allowHTTP := os.Getenv("NOTIFY_ALLOW_HTTP") == "true"
+	allowPrivate := os.Getenv("NOTIFY_ALLOW_PRIVATE") == "true"
+
+	return map[string]Notifier{
+		ChannelEmail: &EmailNotifier{mailer: mailer},
+		ChannelLINE: &LINENotifier{
+			baseURL: envOr("LINE_API_BASE_URL", "https://api.line.me"),
+			token:   os.Getenv("LINE_CHANNEL_ACCESS_TOKEN"),
+		},
+		ChannelTelegram: &TelegramNotifier{
+			baseURL:  envOr("TELEGRAM_API_BASE_URL", "https://api.telegram.org"),
+			botToken: os.Getenv("TELEGRAM_BOT_TOKEN"),
+		},
+		ChannelSlack: &SlackNotifier{
+			webhookBaseURL: envOr("SLACK_WEBHOOK_BASE_URL", "https://hooks.slack.com/"),
+		},
+		ChannelWebhook: &WebhookNotifier{allowHTTP: allowHTTP, allowPrivate: allowPrivate},
+		ChannelPush:    &PushNotifier{pusher: pusher},
+	}
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// EmailNotifier sends through the configured Mailer
+type EmailNotifier struct {
+	mailer Mailer
+}
+
+func (n *EmailNotifier) Validate(config *ChannelConfig) error {
+	// Empty address means the account email
+	if config.Address == "" {
+		return nil
+	}
+	if _, err := parseEmail(config.Address); err != nil {
+		return errors.New("invalid email address")
+	}
+	return nil
+}
+
+func (n *EmailNotifier) Send(ctx context.Context, user *User, config *ChannelConfig, notification *Notification) error {
+	to := config.Address
+	if to == "" {
+		to = user.Email
+	}
+
+	return n.mailer.Send(ctx, &MailMessage{
+		To:      to,
+		Subject: notification.Title,
+		Text:    notification.Text(),
+		HTML:    notification.HTML,
+	})
+}
+
+// LINENotifier pushes a message through the LINE Messaging API
+type LINENotifier struct {
+	baseURL string
+	token   string
+}
+
+func (n *LINENotifier) Validate(config *ChannelConfig) error {
+	if n.token == "" {
+		return errChannelNotConfigured
+	}
+	if config.LineUserID == "" {
+		return errors.New("lineUserId is required")
+	}
+	return nil
+}
+
+func (n *LINENotifier) Send(ctx context.Context, user *User, config *ChannelConfig, notification *Notification) error {
+	if n.token == "" {
+		return errChannelNotConfigured
+	}
+
+	body := map[string]interface{}{
+		"to": config.LineUserID,
+		"messages": []map[string]string{
+			{"type": "text", "text": notification.Text()},
+		},
+	}
+
+	return postJSON(ctx, strings.TrimRight(n.baseURL, "/")+"/v2/bot/message/push", body, map[string]string{
+		"Authorization": "Bearer " + n.token,
+	})
+}
+
+// TelegramNotifier sends a message from our bot to the user's chat
+type TelegramNotifier struct {
+	baseURL  string
+	botToken string
+}
+
+func (n *TelegramNotifier) Validate(config *ChannelConfig) error {
+	if n.botToken == "" {
+		return errChannelNotConfigured
+	}
+	if config.TelegramChatID == "" {
+		return errors.New("telegramChatId is required")
+	}
+	return nil
+}
+
+func (n *TelegramNotifier) Send(ctx context.Context, user *User, config *ChannelConfig, notification *Notification) error {
+	if n.botToken == "" {
+		return errChannelNotConfigured
+	}
+
+	body := map[string]interface{}{
+		"chat_id":                  config.TelegramChatID,
+		"text":                     notification.Text(),
+		"disable_web_page_preview": true,
+	}
+
+	return postJSON(ctx, fmt.Sprintf("%s/bot%s/sendMessage", strings.TrimRight(n.baseURL, "/"), n.botToken), body, nil)
+}
+
+// SlackNotifier posts to a user's Slack incoming webhook
+type SlackNotifier struct {
+	webhookBaseURL string
+}
+
+func (n *SlackNotifier) Validate(config *ChannelConfig) error {
+	if !strings.HasPrefix(config.URL, n.webhookBaseURL) {
+		return fmt.Errorf("url must start with %s", n.webhookBaseURL)
+	}
+	return nil
+}
+
+func (n *SlackNotifier) Send(ctx context.Context, user *User, config *ChannelConfig, notification *Notification) error {
+	if err := n.Validate(config); err != nil {
+		return err
+	}
+
+	body := map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", notification.Title, notification.Body),
+	}
+	return postJSON(ctx, config.URL, body, nil)
+}
+
+// WebhookNotifier posts a JSON event to any public HTTPS endpoint. When a
+// secret is set the body is signed with HMAC-SHA256 in X-SubTrack-Signature.
+type WebhookNotifier struct {
+	allowHTTP    bool
+	allowPrivate bool // for tests and self-hosted receivers
+}
+
+func (n *WebhookNotifier) Validate(config *ChannelConfig) error {
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Hostname() == "" {
+		return errors.New("invalid url")
+	}
+	if u.Scheme != "https" && !(n.allowHTTP && u.Scheme == "http") {
+		return errors.New("url must use https")
+	}
+	if !n.allowPrivate {
+		if err := checkPublicHost(context.Background(), u.Hostname()); err != nil {
+			return errors.New("url must point to a public address")
+		}
+	}
+	return nil
+}
+
+func (n *WebhookNotifier) client() *http.Client {
+	if n.allowPrivate {
+		return notifyHTTPClient
+	}
+	return webhookHTTPClient
+}
+
+func (n *WebhookNotifier) Send(ctx context.Context, user *User, config *ChannelConfig, notification *Notification) error {
+	if err := n.Validate(config); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":     notification.Event,
+		"title":     notification.Title,
+		"body":      notification.Body,
+		"url":       notification.URL,
+		"timestamp": timestamp,
+	})
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"X-SubTrack-Timestamp": timestamp}
+	if config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(config.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(payload)
+		headers["X-SubTrack-Signature"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	return postBody(ctx, n.client(), config.URL, "application/json", payload, headers)
+}
+
+func postJSON(ctx context.Context, endpoint string, body interface{}, headers map[string]string) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return postBody(ctx, notifyHTTPClient, endpoint, "application/json", payload, headers)
+}
+
+// postBody sends payload and fails on a non-2xx answer. The response body
+// is only logged: errors end up in API responses and the delivery log, and
+// the endpoint may not be the user's to read.
+func postBody(ctx context.Context, client *http.Client, endpoint, contentType string, payload []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Without the URL, which can hold a bot token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		fmt.Printf("❌ POST to %s answered %d: %s\n", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(snippet)))
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
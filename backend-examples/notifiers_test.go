@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestWebhookRejectsPrivateAddresses(t *testing.T) {
+	notifier := &WebhookNotifier{}
+	for _, target := range []string{
+		"https://127.0.0.1/hook",
+		"https://localhost/hook",
+		"https://169.254.169.254/latest/meta-data/",
+		"https://10.0.0.5/hook",
+		"https://[::1]/hook",
+		"https://100.64.1.1/hook",
+		"http://93.184.215.14/hook",
+	} {
+		if err := notifier.Validate(&ChannelConfig{URL: target}); err == nil {
+			t.Errorf("Validate(%s) accepted", target)
+		}
+	}
+	if err := notifier.Validate(&ChannelConfig{URL: "https://93.184.215.14/hook"}); err != nil {
+		t.Errorf("public address rejected: %v", err)
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddressesWhenConnecting(t *testing.T) {
+	hit := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+	defer server.Close()
+
+	// As if DNS for a validated host now answered with an internal address
+	if _, err := webhookHTTPClient.Get(server.URL); err == nil || hit {
+		t.Error("webhook client connected to a loopback address")
+	}
+}
+
+func TestWebhookSignsPayload(t *testing.T) {
+	var body []byte
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		headers = r.Header
+	}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{allowHTTP: true, allowPrivate: true}
+	config := &ChannelConfig{URL: server.URL, Secret: "shh"}
+	if err := notifier.Send(context.Background(), nil, config, &Notification{Event: "test", Title: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, []byte("shh"))
+	mac.Write([]byte(headers.Get("X-SubTrack-Timestamp") + "."))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); headers.Get("X-SubTrack-Signature") != want {
+		t.Errorf("signature = %q, want %q", headers.Get("X-SubTrack-Signature"), want)
+	}
+}
+
+func TestTestChannelHidesEndpointResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal-admin-token=abc123", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	user := testUser(t)
+	session, _ := issueSession(user)
+	store.SaveNotificationChannel(&NotificationChannel{
+		ID: "hook-" + user.ID, UserID: user.ID, Type: ChannelWebhook, Name: "hook", Enabled: true,
+		Config: ChannelConfig{URL: server.URL},
+	})
+
+	service := NewNotificationService(map[string]Notifier{
+		ChannelWebhook: &WebhookNotifier{allowHTTP: true, allowPrivate: true},
+	})
+	service.backoff = time.Millisecond
+
+	r := gin.New()
+	r.POST("/channels/:id/test", AuthMiddleware(), service.TestChannel)
+	w := serveJSON(r, http.MethodPost, "/channels/hook-"+user.ID+"/test", nil, session.AccessToken)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("test channel = %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "abc123") {
+		t.Errorf("endpoint response leaked to the client: %s", w.Body.String())
+	}
+	for _, delivery := range store.GetDeliveries(user.ID) {
+		if strings.Contains(delivery.Error, "abc123") {
+			t.Errorf("endpoint response leaked to the delivery log: %s", delivery.Error)
+		}
+	}
+}
+
+// notifyFake records requests to a chat API and fails the first few
+type notifyFake struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	requests []notifyRequest
+}
+
+type notifyRequest struct {
+	path, authorization string
+	body                map[string]interface{}
+}
+
+func newNotifyFake(t *testing.T, failures int) *notifyFake {
+	t.Helper()
+	f := &notifyFake{failures: failures}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.requests = append(f.requests, notifyRequest{r.URL.Path, r.Header.Get("Authorization"), body})
+		if len(f.requests) <= f.failures {
+			http.Error(w, `{"message":"try later"}`, http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *notifyFake) received() []notifyRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]notifyRequest(nil), f.requests...)
+}
+
+func TestLINENotifier(t *testing.T) {
+	fake := newNotifyFake(t, 0)
+	t.Setenv("LINE_API_BASE_URL", fake.URL)
+	t.Setenv("LINE_CHANNEL_ACCESS_TOKEN", "line-token")
+	notifier := NewNotifiers(nil, nil)[ChannelLINE]
+
+	if err := notifier.Validate(&ChannelConfig{}); err == nil {
+		t.Error("channel without lineUserId accepted")
+	}
+	config := &ChannelConfig{LineUserID: "U123"}
+	if err := notifier.Send(context.Background(), nil, config, &Notification{Title: "Netflix renews soon", Body: "$15.49 on Oct 22"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := fake.received()
+	if len(got) != 1 || got[0].path != "/v2/bot/message/push" || got[0].authorization != "Bearer line-token" || got[0].body["to"] != "U123" {
+		t.Fatalf("requests = %+v", got)
+	}
+	messages, _ := got[0].body["messages"].([]interface{})
+	if len(messages) != 1 || !strings.Contains(fmt.Sprint(messages[0]), "Netflix renews soon") {
+		t.Errorf("messages = %v", messages)
+	}
+
+	t.Setenv("LINE_CHANNEL_ACCESS_TOKEN", "")
+	if err := NewNotifiers(nil, nil)[ChannelLINE].Validate(config); !errors.Is(err, errChannelNotConfigured) {
+		t.Errorf("without a token err = %v", err)
+	}
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	fake := newNotifyFake(t, 1)
+	t.Setenv("TELEGRAM_API_BASE_URL", fake.URL+"/")
+	t.Setenv("TELEGRAM_BOT_TOKEN", "123:secret")
+	notifier := NewNotifiers(nil, nil)[ChannelTelegram]
+
+	if err := notifier.Validate(&ChannelConfig{}); err == nil {
+		t.Error("channel without telegramChatId accepted")
+	}
+	config := &ChannelConfig{TelegramChatID: "42"}
+	n := &Notification{Title: "Trial ends", Body: "Calm trial ends tomorrow"}
+
+	// Errors don't carry the bot token in the URL
+	if err := notifier.Send(context.Background(), nil, config, n); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("failed send err = %v", err)
+	}
+	if err := notifier.Send(context.Background(), nil, config, n); err != nil {
+		t.Fatal(err)
+	}
+
+	got := fake.received()
+	if len(got) != 2 || got[1].path != "/bot123:secret/sendMessage" || got[1].body["chat_id"] != "42" ||
+		!strings.Contains(fmt.Sprint(got[1].body["text"]), "Calm trial ends tomorrow") {
+		t.Errorf("requests = %+v", got)
+	}
+}
+
+func TestSlackNotifierChecksWebhookPrefix(t *testing.T) {
+	t.Setenv("SLACK_WEBHOOK_BASE_URL", "")
+	slack := NewNotifiers(nil, nil)[ChannelSlack]
+	for _, target := range []string{
+		"https://hooks.slack.com.evil.example/services/T/B/X",
+		"http://hooks.slack.com/services/T/B/X",
+		"https://example.com/?https://hooks.slack.com/",
+	} {
+		if err := slack.Validate(&ChannelConfig{URL: target}); err == nil {
+			t.Errorf("Validate(%s) accepted", target)
+		}
+	}
+	if err := slack.Validate(&ChannelConfig{URL: "https://hooks.slack.com/services/T/B/X"}); err != nil {
+		t.Errorf("Slack webhook rejected: %v", err)
+	}
+
+	fake := newNotifyFake(t, 0)
+	t.Setenv("SLACK_WEBHOOK_BASE_URL", fake.URL+"/services/")
+	slack = NewNotifiers(nil, nil)[ChannelSlack]
+	n := &Notification{Title: "Price increase", Body: "Spotify now costs $12"}
+	if err := slack.Send(context.Background(), nil, &ChannelConfig{URL: fake.URL + "/other"}, n); err == nil {
+		t.Error("sent outside the webhook prefix")
+	}
+	if err := slack.Send(context.Background(), nil, &ChannelConfig{URL: fake.URL + "/services/T/B/X"}, n); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.received(); len(got) != 1 || got[0].path != "/services/T/B/X" || got[0].body["text"] != "*Price increase*\nSpotify now costs $12" {
+		t.Errorf("requests = %+v", got)
+	}
+}
+
+// lastDelivery returns the newest delivery log entry for a channel
+func lastDelivery(t *testing.T, user *User, channelID string) *Delivery {
+	t.Helper()
+	var last *Delivery
+	for _, delivery := range store.GetDeliveries(user.ID) {
+		if delivery.ChannelID == channelID && (last == nil || !delivery.CreatedAt.Before(last.CreatedAt)) {
+			last = delivery
+		}
+	}
+	if last == nil {
+		t.Fatalf("no delivery logged for %s", channelID)
+	}
+	return last
+}
+
+func TestDeliverRetriesAndLogs(t *testing.T) {
+	user := testUser(t)
+	fake := newNotifyFake(t, notifyMaxAttempts-1)
+	t.Setenv("LINE_API_BASE_URL", fake.URL)
+	t.Setenv("LINE_CHANNEL_ACCESS_TOKEN", "line-token")
+	service := NewNotificationService(NewNotifiers(nil, nil))
+	service.backoff = time.Millisecond
+	n := &Notification{Event: ReminderUpcomingCharge, Title: "Netflix renews soon"}
+
+	ch := &NotificationChannel{ID: uuid.NewString(), UserID: user.ID, Type: ChannelLINE, Enabled: true, Config: ChannelConfig{LineUserID: "U1"}}
+	if err := service.deliver(context.Background(), user, ch, n); err != nil {
+		t.Fatal(err)
+	}
+	if d := lastDelivery(t, user, ch.ID); d.Status != DeliverySent || d.Attempts != notifyMaxAttempts || d.Event != ReminderUpcomingCharge || d.Channel != ChannelLINE {
+		t.Errorf("delivery = %+v", d)
+	}
+
+	// Every attempt fails
+	fake.mu.Lock()
+	fake.failures = 100
+	fake.mu.Unlock()
+	ch.ID = uuid.NewString()
+	if err := service.deliver(context.Background(), user, ch, n); err == nil {
+		t.Fatal("delivery to a failing endpoint succeeded")
+	}
+	if d := lastDelivery(t, user, ch.ID); d.Status != DeliveryFailed || d.Attempts != notifyMaxAttempts || d.Error != "status 500" {
+		t.Errorf("delivery = %+v", d)
+	}
+
+	// A channel the server can't send to isn't retried
+	t.Setenv("LINE_CHANNEL_ACCESS_TOKEN", "")
+	service = NewNotificationService(NewNotifiers(nil, nil))
+	ch.ID = uuid.NewString()
+	calls := len(fake.received())
+	if err := service.deliver(context.Background(), user, ch, n); !errors.Is(err, errChannelNotConfigured) {
+		t.Errorf("unconfigured err = %v", err)
+	}
+	if d := lastDelivery(t, user, ch.ID); d.Status != DeliveryFailed || d.Attempts != 1 || len(fake.received()) != calls {
+		t.Errorf("unconfigured delivery = %+v", d)
+	}
+}
+
+func TestEmailChannelSendsThroughMailer(t *testing.T) {
+	user := testUser(t)
+	sink := newSMTPSink(t)
+	service := NewNotificationService(NewNotifiers(sink.mailer(), nil))
+	service.backoff = time.Millisecond
+	n := &Notification{Event: ReminderUpcomingCharge, Title: "Netflix renews soon", Body: "$15.49 on Oct 22", HTML: "<p>$15.49 on Oct 22</p>"}
+
+	if err := service.notifiers[ChannelEmail].Validate(&ChannelConfig{Address: "not an address"}); err == nil {
+		t.Error("invalid address accepted")
+	}
+
+	// No address means the account email
+	ch := &NotificationChannel{ID: uuid.NewString(), UserID: user.ID, Type: ChannelEmail, Enabled: true}
+	if err := service.deliver(context.Background(), user, ch, n); err != nil {
+		t.Fatal(err)
+	}
+	ch.Config.Address = "billing@example.com"
+	if err := service.deliver(context.Background(), user, ch, n); err != nil {
+		t.Fatal(err)
+	}
+
+	got := sink.received()
+	if len(got) != 2 || !strings.Contains(got[0], "To: "+user.Email) || !strings.Contains(got[1], "To: billing@example.com") {
+		t.Fatalf("messages = %q", got)
+	}
+	if !strings.Contains(got[0], "Subject: Netflix renews soon") || !strings.Contains(got[0], "text/html") {
+		t.Errorf("message = %s", got[0])
+	}
+
+	sink.setFailing(true)
+	ch.ID = uuid.NewString()
+	if err := service.deliver(context.Background(), user, ch, n); err == nil {
+		t.Error("delivery through a failing server succeeded")
+	}
+	if d := lastDelivery(t, user, ch.ID); d.Status != DeliveryFailed || d.Attempts != notifyMaxAttempts {
+		t.Errorf("delivery = %+v", d)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oauthStateTTL      = 10 * time.Minute
+	oauthSessionCookie = "oauth_session"
+
+	flowGoogleLogin    = "google_login"
+	flowGmailConnect   = "gmail_connect"
+	flowOutlookConnect = "outlook_connect"
+)
+
+var errInvalidState = errors.New("invalid or expired state")
+
+// OAuthState is what we remember between starting an OAuth flow and its callback
+type OAuthState struct {
+	Flow         string
+	UserID       string
+	SessionID    string
+	Email        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+// OAuthStateStore issues single-use state values and keeps the PKCE
+// verifier for each one. In production, use Redis or the database.
+type OAuthStateStore struct {
+	states map[string]*OAuthState
+	mu     sync.Mutex
+}
+
+var oauthStates = &OAuthStateStore{
+	states: make(map[string]*OAuthState),
+}
+
+// Issue creates a state bound to the flow, user and browser session
+func (s *OAuthStateStore) Issue(flow, userID, sessionID, email string) (string, *OAuthState, error) {
+	state, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	entry := &OAuthState{
+		Flow:         flow,
+		UserID:       userID,
+		SessionID:    sessionID,
+		Email:        email,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		ExpiresAt:    time.Now().Add(oauthStateTTL),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	s.states[state] = entry
+	return state, entry, nil
+}
+
+// Consume returns the state entry and deletes it so it can't be replayed.
+// Callers that know the user must also check UserID on the result.
+func (s *OAuthStateStore) Consume(state, flow, sessionID string) (*OAuthState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.states[state]
+	if !ok {
+		return nil, errInvalidState
+	}
+	delete(s.states, state)
+
+	if time.Now().After(entry.ExpiresAt) ||
+		entry.Flow != flow ||
+		entry.SessionID != sessionID {
+		return nil, errInvalidState
+	}
+
+	return entry, nil
+}
+
+// Remove expired states
+func (s *OAuthStateStore) sweep() {
+	now := time.Now()
+	for state, entry := range s.states {
+		if now.After(entry.ExpiresAt) {
+			delete(s.states, state)
+		}
+	}
+}
+
+// startOAuthSession returns the browser session ID, creating the cookie if needed
+func startOAuthSession(c *gin.Context) (string, error) {
+	sessionID, err := c.Cookie(oauthSessionCookie)
+	if err != nil || sessionID == "" {
+		sessionID, err = randomToken(32)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Lax so the cookie comes back on the top-level redirect from Google
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oauthSessionCookie, sessionID, int(oauthStateTTL.Seconds()), "/", "", false, true)
+	return sessionID, nil
+}
+
+// Helper to generate a URL-safe random token
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+func TestOAuthStateConsume(t *testing.T) {
+	state, _, _ := oauthStates.Issue(flowGoogleLogin, "", "session-1", "")
+	if _, err := oauthStates.Consume(state, flowGoogleLogin, "session-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oauthStates.Consume(state, flowGoogleLogin, "session-1"); err == nil {
+		t.Error("state was accepted twice")
+	}
+
+	// A mismatch uses the state up, so it can't be retried
+	state, _, _ = oauthStates.Issue(flowGoogleLogin, "", "session-1", "")
+	if _, err := oauthStates.Consume(state, flowGmailConnect, "session-1"); err == nil {
+		t.Error("state accepted for another flow")
+	}
+	if _, err := oauthStates.Consume(state, flowGoogleLogin, "session-1"); err == nil {
+		t.Error("state accepted after a failed check")
+	}
+
+	state, _, _ = oauthStates.Issue(flowGoogleLogin, "", "session-1", "")
+	if _, err := oauthStates.Consume(state, flowGoogleLogin, "session-2"); err == nil {
+		t.Error("state accepted from another browser session")
+	}
+
+	state, entry, _ := oauthStates.Issue(flowGoogleLogin, "", "session-1", "")
+	oauthStates.mu.Lock()
+	entry.ExpiresAt = time.Now().Add(-time.Second)
+	oauthStates.mu.Unlock()
+	if _, err := oauthStates.Consume(state, flowGoogleLogin, "session-1"); err == nil {
+		t.Error("expired state accepted")
+	}
+}
+
+func TestGoogleLoginSendsPKCEVerifier(t *testing.T) {
+	var mu sync.Mutex
+	var verifiers []string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		verifiers = append(verifiers, r.Form.Get("code_verifier"))
+		mu.Unlock()
+		// Stop here, the user info comes from Google itself
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer tokenServer.Close()
+
+	service := &AuthService{googleConfig: &oauth2.Config{
+		ClientID: "test-client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example/auth", TokenURL: tokenServer.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}}
+	r := gin.New()
+	r.GET("/login", service.GoogleLoginRedirect)
+	r.GET("/callback", service.GoogleLoginCallback)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("login = %d", w.Code)
+	}
+	location, _ := url.Parse(w.Header().Get("Location"))
+	query := location.Query()
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oauthSessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %+v", cookies)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" || query.Get("state") == "" {
+		t.Fatalf("auth URL = %s", location)
+	}
+
+	callback := func(state string, cookie *http.Cookie) int {
+		req := httptest.NewRequest(http.MethodGet, "/callback?code=abc&state="+url.QueryEscape(state), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Someone else's browser can't finish the flow
+	state := query.Get("state")
+	if code := callback(state, &http.Cookie{Name: oauthSessionCookie, Value: "other"}); code != http.StatusBadRequest {
+		t.Errorf("callback from another session = %d", code)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	location, _ = url.Parse(w.Header().Get("Location"))
+	state, challenge := location.Query().Get("state"), location.Query().Get("code_challenge")
+	cookie := w.Result().Cookies()[0]
+
+	if code := callback(state, cookie); code != http.StatusInternalServerError {
+		t.Errorf("callback = %d, want the failed exchange", code)
+	}
+	mu.Lock()
+	if len(verifiers) != 1 || oauth2.S256ChallengeFromVerifier(verifiers[0]) != challenge {
+		t.Errorf("token request verifiers = %q, challenge %s", verifiers, challenge)
+	}
+	mu.Unlock()
+
+	// A state is only good once
+	if code := callback(state, cookie); code != http.StatusBadRequest {
+		t.Errorf("replayed callback = %d", code)
+	}
+}
+
+func TestGmailCallbackChecksUser(t *testing.T) {
+	owner, other := testUser(t), store.GetOrCreateEmailUser("other-"+t.Name()+"@example.com")
+	tokens, _ := issueSession(other)
+	r := gin.New()
+	r.POST("/callback", AuthMiddleware(), (&GmailService{config: &oauth2.Config{}}).HandleCallback)
+
+	state, _, _ := oauthStates.Issue(flowGmailConnect, owner.ID, "", owner.Email)
+	if w := serveJSON(r, http.MethodPost, "/callback", CallbackRequest{Code: "abc", State: state}, tokens.AccessToken); w.Code != http.StatusBadRequest {
+		t.Errorf("callback by another user = %d", w.Code)
+	}
+	if store.GetGmailToken(owner.ID) != nil || store.GetGmailToken(other.ID) != nil {
+		t.Error("a token was stored")
+	}
+}
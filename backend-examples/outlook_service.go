@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	SourceOutlook = "outlook"
+
+	graphTimeout  = 30 * time.Second
+	graphPageSize = 50
+	graphMaxPages = 40
+	// Longest Retry-After we wait for when Graph throttles us
+	graphMaxRetryAfter = 30 * time.Second
+)
+
+// OutlookService connects Outlook.com and Microsoft 365 mailboxes through
+// Microsoft Graph
+type OutlookService struct {
+	config   *oauth2.Config
+	graphURL string
+	scanner  *MailScanner
+}
+
+// NewOutlookService reads the app registration from the environment. The
+// login and Graph base URLs can be overridden so tests can point at local fakes.
+func NewOutlookService(scanner *MailScanner) *OutlookService {
+	loginURL := strings.TrimRight(envOr("MICROSOFT_LOGIN_URL", "https://login.microsoftonline.com"), "/")
+	tenant := envOr("MICROSOFT_TENANT", "common") // common = work, school and personal accounts
+
+	config := &oauth2.Config{
+		ClientID:     os.Getenv("MICROSOFT_CLIENT_ID"),
+		ClientSecret: os.Getenv("MICROSOFT_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OUTLOOK_REDIRECT_URL"), // http://localhost:8080/api/outlook/callback/redirect
+		Scopes: []string{
+			"offline_access",
+			"User.Read",
+			"Mail.Read",
+		},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  loginURL + "/" + tenant + "/oauth2/v2.0/authorize",
+			TokenURL: loginURL + "/" + tenant + "/oauth2/v2.0/token",
+		},
+	}
+
+	return &OutlookService{
+		config:   config,
+		graphURL: strings.TrimRight(envOr("MICROSOFT_GRAPH_URL", "https://graph.microsoft.com/v1.0"), "/"),
+		scanner:  scanner,
+	}
+}
+
+// InitiateConnection starts the Outlook OAuth flow for the signed-in user
+func (s *OutlookService) InitiateConnection(c *gin.Context) {
+	// A browser finishes on the redirect callback, so the state is also bound
+	// to its OAuth session cookie
+	sessionID := ""
+	if c.GetString("auth_type") == authTypeSession {
+		var err error
+		sessionID, err = startOAuthSession(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+			return
+		}
+	}
+
+	// Generate state token bound to this user
+	state, entry, err := oauthStates.Issue(flowOutlookConnect, c.GetString("user_id"), sessionID, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate state"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ConnectResponse{
+		AuthURL: s.authURL(state, entry),
+		State:   state,
+	})
+}
+
+// InitiateConnectionRedirect starts the Outlook OAuth flow with redirect
+func (s *OutlookService) InitiateConnectionRedirect(c *gin.Context) {
+	// If no auth, use the visitor's guest session
+	userID := c.GetString("user_id")
+	if userID == "" {
+		guest, err := startGuestSession(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+			return
+		}
+		userID = guest.ID
+	}
+
+	sessionID, err := startOAuthSession(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
+
+	state, entry, err := oauthStates.Issue(flowOutlookConnect, userID, sessionID, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate state"})
+		return
+	}
+
+	fmt.Printf("🔗 Redirecting to Microsoft OAuth for user: %s\n", userID)
+	c.Redirect(http.StatusTemporaryRedirect, s.authURL(state, entry))
+}
+
+// HandleCallbackRedirect processes the OAuth callback from Microsoft and redirects to frontend
+func (s *OutlookService) HandleCallbackRedirect(c *gin.Context) {
+	code := c.Query("code")
+	state := c.Query("state")
+	errorParam := c.Query("error")
+
+	frontendURL := os.Getenv("FRONTEND_URL")
+	if frontendURL == "" {
+		frontendURL = "http://localhost:3000"
+	}
+
+	if errorParam != "" {
+		c.Redirect(http.StatusTemporaryRedirect, frontendURL+"/app?error="+url.QueryEscape(errorParam))
+		return
+	}
+
+	if code == "" || state == "" {
+		c.Redirect(http.StatusTemporaryRedirect, frontendURL+"/app?error=invalid_callback")
+		return
+	}
+
+	// Verify state against the session that started the flow
+	sessionID, _ := c.Cookie(oauthSessionCookie)
+	entry, err := oauthStates.Consume(state, flowOutlookConnect, sessionID)
+	if err != nil || sessionID == "" {
+		c.Redirect(http.StatusTemporaryRedirect, frontendURL+"/app?error=invalid_state")
+		return
+	}
+
+	email, errCode := s.connect(c.Request.Context(), entry, code)
+	if errCode != "" {
+		c.Redirect(http.StatusTemporaryRedirect, frontendURL+"/app?error="+errCode)
+		return
+	}
+
+	c.Redirect(http.StatusTemporaryRedirect, frontendURL+"/app?outlook_connected=true&email="+url.QueryEscape(email))
+}
+
+// HandleCallback processes the OAuth callback
+func (s *OutlookService) HandleCallback(c *gin.Context) {
+	var req CallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Verify state token
+	sessionID, _ := c.Cookie(oauthSessionCookie)
+	entry, err := oauthStates.Consume(req.State, flowOutlookConnect, sessionID)
+	if err != nil || entry.UserID != c.GetString("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+		return
+	}
+
+	email, errCode := s.connect(c.Request.Context(), entry, req.Code)
+	if errCode != "" {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to connect Outlook", "code": errCode})
+		return
+	}
+
+	c.JSON(http.StatusOK, CallbackResponse{
+		Success: true,
+		Email:   email,
+	})
+}
+
+// ScanEmails manually triggers an Outlook scan
+func (s *OutlookService) ScanEmails(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	token, ok := store.GetOutlookToken(userID).(*oauth2.Token)
+	if !ok || token == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Outlook not connected"})
+		return
+	}
+
+	go s.scan(userID, token)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Scan started",
+	})
+}
+
+// Disconnect removes the Outlook connection
+func (s *OutlookService) Disconnect(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	store.DeleteOutlookToken(userID)
+	store.DeleteMailboxState(outlookMailbox(userID).Key)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Outlook disconnected",
+	})
+}
+
+func (s *OutlookService) authURL(state string, entry *OAuthState) string {
+	return s.config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+		oauth2.S256ChallengeOption(entry.CodeVerifier),
+	)
+}
+
+// connect exchanges the code, stores the token and starts the first scan.
+// It returns the mailbox address, or an error code for the frontend.
+func (s *OutlookService) connect(ctx context.Context, entry *OAuthState, code string) (string, string) {
+	token, err := s.config.Exchange(ctx, code, oauth2.VerifierOption(entry.CodeVerifier))
+	if err != nil {
+		return "", "token_exchange_failed"
+	}
+
+	email, err := s.provider(context.Background(), token).Profile(ctx)
+	if err != nil {
+		return "", "profile_failed"
+	}
+
+	store.SaveOutlookToken(entry.UserID, token)
+	fmt.Printf("✅ Outlook connected: %s\n", email)
+
+	// Scan from the start of the mailbox as it may be a different account
+	store.DeleteMailboxState(outlookMailbox(entry.UserID).Key)
+	go s.scan(entry.UserID, token)
+
+	return email, ""
+}
+
+// scan runs a subscription scan over the user's Outlook mailbox in the
+// background and keeps the refreshed token
+func (s *OutlookService) scan(userID string, token *oauth2.Token) {
+	source := s.config.TokenSource(context.Background(), token)
+	provider := &OutlookProvider{
+		client:  oauth2.NewClient(context.Background(), source),
+		baseURL: s.graphURL,
+	}
+	provider.client.Timeout = graphTimeout
+
+	if err := s.scanner.scanAndStoreSubscriptions(userID, provider, outlookMailbox(userID)); err != nil {
+		fmt.Printf("❌ Outlook scan failed for user %s: %v\n", userID, err)
+	}
+
+	// Microsoft rotates refresh tokens
+	if refreshed, err := source.Token(); err == nil && store.GetOutlookToken(userID) != nil {
+		store.SaveOutlookToken(userID, refreshed)
+	}
+}
+
+func (s *OutlookService) provider(ctx context.Context, token *oauth2.Token) *OutlookProvider {
+	client := s.config.Client(ctx, token)
+	client.Timeout = graphTimeout
+	return &OutlookProvider{client: client, baseURL: s.graphURL}
+}
+
+func outlookMailbox(userID string) Mailbox {
+	return Mailbox{Key: "outlook:" + userID, Source: SourceOutlook, Label: "Outlook"}
+}
+
+// OutlookProvider reads a mailbox through Microsoft Graph. The first scan
+// uses $search across all folders. The cursor is a delta link for the inbox,
+// so later scans only see messages that arrived since.
+type OutlookProvider struct {
+	client  *http.Client
+	baseURL string
+	changes map[string][]graphMessage // delta link -> messages it returned
+}
+
+type graphMessage struct {
+	ID               string    `json:"id"`
+	Subject          string    `json:"subject"`
+	ReceivedDateTime time.Time `json:"receivedDateTime"`
+	From             *struct {
+		EmailAddress struct {
+			Name    string `json:"name"`
+			Address string `json:"address"`
+		} `json:"emailAddress"`
+	} `json:"from"`
+	Body *struct {
+		ContentType string `json:"contentType"` // "text" or "html"
+		Content     string `json:"content"`
+	} `json:"body"`
+	Removed *struct {
+		Reason string `json:"reason"`
+	} `json:"@removed"`
+}
+
+type graphPage struct {
+	Value     []graphMessage `json:"value"`
+	NextLink  string         `json:"@odata.nextLink"`
+	DeltaLink string         `json:"@odata.deltaLink"`
+}
+
+type graphError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *graphError) Error() string {
+	return fmt.Sprintf("Graph %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+const graphMessageFields = "id,subject,from,receivedDateTime"
+
+// Profile returns the mailbox address
+func (p *OutlookProvider) Profile(ctx context.Context) (string, error) {
+	var me struct {
+		Mail              string `json:"mail"`
+		UserPrincipalName string `json:"userPrincipalName"`
+	}
+	if err := p.get(ctx, p.baseURL+"/me?$select=mail,userPrincipalName", &me); err != nil {
+		return "", err
+	}
+	if me.Mail != "" {
+		return me.Mail, nil
+	}
+	return me.UserPrincipalName, nil
+}
+
+// Cursor is a delta link for inbox messages received from now on. It starts
+// a little early in case our clock is ahead of Microsoft's.
+func (p *OutlookProvider) Cursor(ctx context.Context) (string, error) {
+	since := time.Now().UTC().Add(-5 * time.Minute)
+	link := p.baseURL + "/me/mailFolders/inbox/messages/delta?" + url.Values{
+		"$select": {graphMessageFields},
+		"$filter": {"receivedDateTime ge " + since.Format(time.RFC3339)},
+	}.Encode()
+
+	_, deltaLink, err := p.pages(ctx, link, 0)
+	if err != nil {
+		return "", err
+	}
+	if deltaLink == "" {
+		return "", fmt.Errorf("Graph returned no delta link")
+	}
+	return deltaLink, nil
+}
+
+func (p *OutlookProvider) Search(ctx context.Context, query MailQuery, cursor string) ([]string, error) {
+	if cursor != "" {
+		messages, err := p.delta(ctx, cursor)
+		if err == nil {
+			return matchingMessageIDs(messages, query), nil
+		}
+		// Delta links expire, search the whole mailbox instead
+		if graphErr, ok := err.(*graphError); !ok || graphErr.Status != http.StatusGone {
+			return nil, err
+		}
+	}
+
+	terms := make([]string, 0, len(query.Subjects)+len(query.Senders))
+	for _, subject := range query.Subjects {
+		terms = append(terms, "subject:"+graphSearchTerm(subject))
+	}
+	for _, sender := range query.Senders {
+		terms = append(terms, "from:"+graphSearchTerm(sender))
+	}
+	if len(terms) == 0 {
+		return []string{}, nil
+	}
+
+	top := graphPageSize
+	if query.Limit > 0 && query.Limit < top {
+		top = query.Limit
+	}
+	link := p.baseURL + "/me/messages?" + url.Values{
+		"$search": {`"` + strings.Join(terms, " OR ") + `"`},
+		"$select": {"id"},
+		"$top":    {strconv.Itoa(top)},
+	}.Encode()
+
+	// Results come newest first
+	messages, _, err := p.pages(ctx, link, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+	return ids, nil
+}
+
+func (p *OutlookProvider) Fetch(ctx context.Context, id string) (*MailboxMessage, error) {
+	var message graphMessage
+	link := p.baseURL + "/me/messages/" + url.PathEscape(id) + "?$select=" + graphMessageFields + ",body"
+	if err := p.get(ctx, link, &message); err != nil {
+		return nil, err
+	}
+
+	result := &MailboxMessage{
+		ID:      message.ID,
+		Subject: message.Subject,
+		Date:    message.ReceivedDateTime,
+		From:    graphSender(message),
+	}
+	if message.Body != nil {
+		if strings.EqualFold(message.Body.ContentType, "html") {
+			result.HTML = message.Body.Content
+		} else {
+			result.Text = message.Body.Content
+		}
+	}
+	return result, nil
+}
+
+func (p *OutlookProvider) Close() error {
+	return nil
+}
+
+// delta follows a delta link once per scan, as every query reads the same
+// changes
+func (p *OutlookProvider) delta(ctx context.Context, link string) ([]graphMessage, error) {
+	if messages, ok := p.changes[link]; ok {
+		return messages, nil
+	}
+	messages, _, err := p.pages(ctx, link, 0)
+	if err != nil {
+		return nil, err
+	}
+	if p.changes == nil {
+		p.changes = make(map[string][]graphMessage)
+	}
+	p.changes[link] = messages
+	return messages, nil
+}
+
+// pages follows @odata.nextLink until limit messages are read or a delta
+// link ends the round
+func (p *OutlookProvider) pages(ctx context.Context, link string, limit int) ([]graphMessage, string, error) {
+	messages := make([]graphMessage, 0)
+	for i := 0; i < graphMaxPages && link != ""; i++ {
+		// Links come from the server, only send our token back to Graph
+		if !strings.HasPrefix(link, p.baseURL+"/") {
+			return nil, "", fmt.Errorf("unexpected paging link %q", link)
+		}
+
+		var page graphPage
+		if err := p.get(ctx, link, &page); err != nil {
+			return nil, "", err
+		}
+		messages = append(messages, page.Value...)
+		if limit > 0 && len(messages) >= limit {
+			return messages[:limit], "", nil
+		}
+		if page.DeltaLink != "" {
+			return messages, page.DeltaLink, nil
+		}
+		link = page.NextLink
+	}
+	return messages, "", nil
+}
+
+// get reads a Graph resource, waiting once if we are throttled
+func (p *OutlookProvider) get(ctx context.Context, link string, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Prefer", "odata.maxpagesize="+strconv.Itoa(graphPageSize))
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt == 0 {
+			wait, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			delay := time.Duration(wait) * time.Second
+			if delay <= 0 || delay > graphMaxRetryAfter {
+				delay = graphMaxRetryAfter
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			var body struct {
+				Error struct {
+					Code    string `json:"code"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+			return &graphError{Status: resp.StatusCode, Code: body.Error.Code, Message: body.Error.Message}
+		}
+		return json.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(out)
+	}
+}
+
+// matchingMessageIDs applies a query to delta results, which Graph can't
+// search, newest first
+func matchingMessageIDs(messages []graphMessage, query MailQuery) []string {
+	matched := make([]graphMessage, 0)
+	for _, message := range messages {
+		if message.Removed == nil && query.Matches(message.Subject, graphSender(message)) {
+			matched = append(matched, message)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].ReceivedDateTime.After(matched[j].ReceivedDateTime)
+	})
+	if query.Limit > 0 && len(matched) > query.Limit {
+		matched = matched[:query.Limit]
+	}
+
+	ids := make([]string, len(matched))
+	for i, message := range matched {
+		ids[i] = message.ID
+	}
+	return ids
+}
+
+// graphSender formats the sender like a From header
+func graphSender(message graphMessage) string {
+	if message.From == nil {
+		return ""
+	}
+	address := message.From.EmailAddress
+	if address.Name == "" {
+		return address.Address
+	}
+	return fmt.Sprintf("%s <%s>", address.Name, address.Address)
+}
+
+// graphSearchTerm keeps a term inside the quoted $search value
+func graphSearchTerm(term string) string {
+	return strings.NewReplacer(`"`, "", `\`, "").Replace(term)
+}
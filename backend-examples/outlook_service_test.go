@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const testGraphToken = "graph-access-token"
+
+// graphFake stands in for the Microsoft login and Graph endpoints
+type graphFake struct {
+	*httptest.Server
+	mu        sync.Mutex
+	messages  map[string]map[string]interface{}
+	verifiers []string // PKCE verifiers sent to the token endpoint
+	searches  []string
+	throttled bool
+}
+
+func newGraphFake(t *testing.T) *graphFake {
+	t.Helper()
+	g := &graphFake{messages: make(map[string]map[string]interface{})}
+	received := time.Now().UTC().Add(-time.Hour)
+	g.addMessage("m1", "Netflix", "info@account.netflix.com", "Your Netflix receipt", "text", "Total: $15.49/month", received)
+	g.addMessage("m2", "GitHub", "billing@github.com", "Your GitHub receipt", "html", "<p>GitHub Pro</p><p>Total: $4.00/month</p>", received.Add(-time.Hour))
+	g.addMessage("m3", "Spotify", "no-reply@spotify.com", "Your Spotify receipt", "text", "Total: $9.99/month", received.Add(time.Minute))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/common/oauth2/v2.0/token", g.token)
+	mux.HandleFunc("/v1.0/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testGraphToken {
+			graphErrorResponse(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token is empty.")
+			return
+		}
+		g.graph(w, r)
+	})
+	g.Server = httptest.NewServer(mux)
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *graphFake) addMessage(id, name, address, subject, contentType, content string, received time.Time) {
+	g.messages[id] = map[string]interface{}{
+		"id":               id,
+		"subject":          subject,
+		"receivedDateTime": received.Format(time.RFC3339),
+		"from":             map[string]interface{}{"emailAddress": map[string]string{"name": name, "address": address}},
+		"body":             map[string]string{"contentType": contentType, "content": content},
+	}
+}
+
+func (g *graphFake) graphURL() string {
+	return g.URL + "/v1.0"
+}
+
+func (g *graphFake) provider() *OutlookProvider {
+	client := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: testGraphToken}))
+	return &OutlookProvider{client: client, baseURL: g.graphURL()}
+}
+
+func (g *graphFake) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") != "good-code" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	g.mu.Lock()
+	g.verifiers = append(g.verifiers, r.Form.Get("code_verifier"))
+	g.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  testGraphToken,
+		"refresh_token": "graph-refresh-token",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+func (g *graphFake) graph(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1.0")
+	query := r.URL.Query()
+	deltaLink := g.graphURL() + "/me/mailFolders/inbox/messages/delta?$deltatoken="
+
+	var page map[string]interface{}
+	switch {
+	case path == "/me":
+		page = map[string]interface{}{"mail": "alice@outlook.example", "userPrincipalName": "alice@contoso.example"}
+	case path == "/me/mailFolders/inbox/messages/delta":
+		switch query.Get("$deltatoken") {
+		case "":
+			if !strings.HasPrefix(query.Get("$filter"), "receivedDateTime ge ") {
+				graphErrorResponse(w, http.StatusBadRequest, "BadRequest", "missing filter")
+				return
+			}
+			page = map[string]interface{}{"value": []interface{}{}, "@odata.deltaLink": deltaLink + "t1"}
+		case "t1":
+			page = map[string]interface{}{
+				"value": []interface{}{
+					g.messages["m3"],
+					map[string]interface{}{"id": "m9", "@removed": map[string]string{"reason": "deleted"}},
+				},
+				"@odata.deltaLink": deltaLink + "t2",
+			}
+		default:
+			graphErrorResponse(w, http.StatusGone, "SyncStateNotFound", "The sync state generation is not found.")
+			return
+		}
+	case path == "/me/messages":
+		search := query.Get("$search")
+		if search != "" {
+			g.searches = append(g.searches, search)
+		}
+		switch {
+		case strings.Contains(search, "elsewhere"):
+			page = map[string]interface{}{"value": []interface{}{}, "@odata.nextLink": "https://evil.example/v1.0/me/messages?page=2"}
+		case query.Get("page") == "2":
+			page = map[string]interface{}{"value": []interface{}{map[string]string{"id": "m2"}}}
+		default:
+			page = map[string]interface{}{
+				"value":           []interface{}{map[string]string{"id": "m1"}},
+				"@odata.nextLink": g.graphURL() + "/me/messages?page=2",
+			}
+		}
+	case strings.HasPrefix(path, "/me/messages/"):
+		if !g.throttled {
+			g.throttled = true
+			w.Header().Set("Retry-After", "1")
+			graphErrorResponse(w, http.StatusTooManyRequests, "TooManyRequests", "Slow down")
+			return
+		}
+		message, ok := g.messages[strings.TrimPrefix(path, "/me/messages/")]
+		if !ok {
+			graphErrorResponse(w, http.StatusNotFound, "ErrorItemNotFound", "Not found")
+			return
+		}
+		page = message
+	default:
+		graphErrorResponse(w, http.StatusNotFound, "BadRequest", "Unknown resource")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func graphErrorResponse(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": code, "message": message}})
+}
+
+func TestOutlookProviderSearch(t *testing.T) {
+	g := newGraphFake(t)
+	p := g.provider()
+	query := MailQuery{Subjects: []string{"receipt"}, Senders: []string{"billing@github.com"}}
+
+	// First scan: $search, following nextLink
+	ids, err := p.Search(context.Background(), query, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ids, ",") != "m1,m2" {
+		t.Errorf("search = %v, want m1,m2", ids)
+	}
+	if want := `"subject:receipt OR from:billing@github.com"`; len(g.searches) != 1 || g.searches[0] != want {
+		t.Errorf("$search = %q, want %s", g.searches, want)
+	}
+
+	// Later scans: the delta link returns only what arrived, without removals
+	cursor, err := p.Cursor(context.Background())
+	if err != nil || !strings.HasSuffix(cursor, "$deltatoken=t1") {
+		t.Fatalf("cursor = %q, %v", cursor, err)
+	}
+	ids, err = p.Search(context.Background(), query, cursor)
+	if err != nil || strings.Join(ids, ",") != "m3" {
+		t.Errorf("delta search = %v, %v, want m3", ids, err)
+	}
+
+	// An expired delta link falls back to searching the mailbox
+	ids, err = p.Search(context.Background(), query, g.graphURL()+"/me/mailFolders/inbox/messages/delta?$deltatoken=old")
+	if err != nil || strings.Join(ids, ",") != "m1,m2" {
+		t.Errorf("expired delta search = %v, %v", ids, err)
+	}
+}
+
+func TestOutlookProviderStaysOnGraph(t *testing.T) {
+	g := newGraphFake(t)
+	if _, err := g.provider().Search(context.Background(), MailQuery{Subjects: []string{"elsewhere"}}, ""); err == nil {
+		t.Error("followed a paging link to another host")
+	}
+}
+
+func TestOutlookProviderFetch(t *testing.T) {
+	g := newGraphFake(t)
+	p := g.provider()
+
+	// The first fetch is throttled and retried after Retry-After
+	message, err := p.Fetch(context.Background(), "m2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.From != "GitHub <billing@github.com>" || message.HTML == "" || message.Text != "" {
+		t.Errorf("message = %+v", message)
+	}
+	if !strings.Contains(strings.Join(message.Lines(), "\n"), "Total: $4.00/month") {
+		t.Errorf("lines = %q", message.Lines())
+	}
+
+	_, err = p.Fetch(context.Background(), "missing")
+	if graphErr, ok := err.(*graphError); !ok || graphErr.Status != http.StatusNotFound || graphErr.Code != "ErrorItemNotFound" {
+		t.Errorf("missing message err = %v", err)
+	}
+
+	unauthorized := &OutlookProvider{client: http.DefaultClient, baseURL: g.graphURL()}
+	if _, err := unauthorized.Profile(context.Background()); err == nil {
+		t.Error("profile read without a token")
+	}
+}
+
+func TestOutlookConnectAndScan(t *testing.T) {
+	g := newGraphFake(t)
+	t.Setenv("MICROSOFT_LOGIN_URL", g.URL)
+	t.Setenv("MICROSOFT_GRAPH_URL", g.graphURL())
+	t.Setenv("MICROSOFT_CLIENT_ID", "test-client")
+	service := NewOutlookService(NewMailScanner(nil))
+	user := testUser(t)
+	tokens, _ := issueSession(user)
+
+	r := gin.New()
+	r.POST("/callback", AuthMiddleware(), service.HandleCallback)
+
+	state, entry, err := oauthStates.Issue(flowOutlookConnect, user.ID, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveJSON(r, http.MethodPost, "/callback", CallbackRequest{Code: "bad-code", State: state}, tokens.AccessToken); w.Code != http.StatusBadGateway {
+		t.Errorf("bad code = %d", w.Code)
+	}
+
+	state, entry, _ = oauthStates.Issue(flowOutlookConnect, user.ID, "", "")
+	w := serveJSON(r, http.MethodPost, "/callback", CallbackRequest{Code: "good-code", State: state}, tokens.AccessToken)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "alice@outlook.example") {
+		t.Fatalf("callback = %d %s", w.Code, w.Body.String())
+	}
+	g.mu.Lock()
+	if len(g.verifiers) != 1 || g.verifiers[0] != entry.CodeVerifier {
+		t.Errorf("PKCE verifiers = %q", g.verifiers)
+	}
+	g.mu.Unlock()
+	if token, ok := store.GetOutlookToken(user.ID).(*oauth2.Token); !ok || token.RefreshToken != "graph-refresh-token" {
+		t.Errorf("stored token = %+v", store.GetOutlookToken(user.ID))
+	}
+
+	// The first scan runs in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for store.GetMailboxState(outlookMailbox(user.ID).Key).Cursor == "" && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	names := make([]string, 0)
+	for _, sub := range store.GetSubscriptions(user.ID) {
+		if len(sub.Sources) != 1 || sub.Sources[0] != SourceOutlook {
+			t.Errorf("%s sources = %v", sub.Name, sub.Sources)
+		}
+		names = append(names, sub.Name)
+	}
+	if got := strings.Join(names, ","); !strings.Contains(got, "Netflix") || !strings.Contains(got, "GitHub") {
+		t.Errorf("subscriptions = %s, want Netflix and GitHub", got)
+	}
+}
+
+func TestOutlookConnectFromSignedInBrowser(t *testing.T) {
+	g := newGraphFake(t)
+	t.Setenv("MICROSOFT_LOGIN_URL", g.URL)
+	t.Setenv("MICROSOFT_GRAPH_URL", g.graphURL())
+	t.Setenv("MICROSOFT_CLIENT_ID", "test-client")
+	service := NewOutlookService(NewMailScanner(nil))
+	user := testUser(t)
+	tokens, _ := issueSession(user)
+
+	r := gin.New()
+	r.POST("/connect", AuthMiddleware(), service.InitiateConnection)
+	r.GET("/callback/redirect", service.HandleCallbackRedirect)
+
+	w := serveJSON(r, http.MethodPost, "/connect", nil, tokens.AccessToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("connect = %d %s", w.Code, w.Body.String())
+	}
+	var resp ConnectResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oauthSessionCookie {
+		t.Fatalf("cookies = %+v", cookies)
+	}
+
+	callback := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/callback/redirect?code=good-code&state="+resp.State, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// The state only works in the browser that asked for it
+	if w := callback(&http.Cookie{Name: oauthSessionCookie, Value: "other"}); !strings.Contains(w.Header().Get("Location"), "error=invalid_state") {
+		t.Fatalf("other browser = %s", w.Header().Get("Location"))
+	}
+	w = serveJSON(r, http.MethodPost, "/connect", nil, tokens.AccessToken)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	w = callback(w.Result().Cookies()[0])
+	if !strings.Contains(w.Header().Get("Location"), "outlook_connected=true") {
+		t.Fatalf("callback = %s", w.Header().Get("Location"))
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == guestCookie {
+			t.Error("signed-in user was given a guest session")
+		}
+	}
+	if _, ok := store.GetOutlookToken(user.ID).(*oauth2.Token); !ok {
+		t.Error("token not stored for the signed-in user")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.GetMailboxState(outlookMailbox(user.ID).Key).Cursor == "" && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ledongthuc/pdf"
+)
+
+const (
+	maxPDFAttachmentSize = 5 << 20
+	maxPDFAttachments    = 3 // per message
+	maxPDFPages          = 5 // invoices put the amount and dates up front
+	maxPDFTextSize       = 64 << 10
+	maxPDFPageSize       = 2 << 20 // decompressed content and font maps of one page
+	maxPDFGlyphs         = 10000   // per page, lining them up is quadratic
+)
+
+// How long one PDF may take. A small file can inflate to gigabytes in parts
+// of the document the reader decodes on its own, like object streams.
+var pdfTimeout = 5 * time.Second
+
+var (
+	errPDFTooLarge = errors.New("PDF is too large")
+	errPDFTimeout  = errors.New("PDF took too long to read")
+)
+
+// pdfSource is the file as the PDF reader sees it. Every read checks the
+// deadline, so decoding stops soon after it passes.
+type pdfSource struct {
+	data     *bytes.Reader
+	deadline time.Time
+}
+
+func (s *pdfSource) expired() bool {
+	return time.Now().After(s.deadline)
+}
+
+func (s *pdfSource) ReadAt(p []byte, off int64) (int, error) {
+	if s.expired() {
+		return 0, errPDFTimeout
+	}
+	return s.data.ReadAt(p, off)
+}
+
+// isPDFAttachment goes by the media type, or the file name when the sender
+// labelled the file application/octet-stream
+func isPDFAttachment(mediaType, filename string) bool {
+	mediaType = strings.ToLower(mediaType)
+	if strings.HasPrefix(mediaType, "application/pdf") {
+		return true
+	}
+	return strings.EqualFold(path.Ext(filename), ".pdf") &&
+		(mediaType == "" || strings.HasPrefix(mediaType, "application/octet-stream"))
+}
+
+// pdfText returns the text of the first pages of a PDF, one line per row of
+// text, so the extractors can read it like an email body
+func pdfText(data []byte) (text string, err error) {
+	if len(data) > maxPDFAttachmentSize {
+		return "", errPDFTooLarge
+	}
+
+	// The PDF reader panics on some malformed files, and when a read fails
+	source := &pdfSource{data: bytes.NewReader(data), deadline: time.Now().Add(pdfTimeout)}
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("unreadable PDF: %v", r)
+			if source.expired() {
+				err = errPDFTimeout
+			}
+		}
+	}()
+
+	reader, err := pdf.NewReader(source, int64(len(data)))
+	if err != nil {
+		if source.expired() {
+			return "", errPDFTimeout
+		}
+		return "", err
+	}
+
+	pages := reader.NumPage()
+	if pages > maxPDFPages {
+		pages = maxPDFPages
+	}
+
+	var b strings.Builder
+	for i := 1; i <= pages && b.Len() < maxPDFTextSize; i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		if err := checkPageSize(page); err != nil {
+			return "", err
+		}
+		glyphs := page.Content().Text
+		if len(glyphs) > maxPDFGlyphs {
+			glyphs = glyphs[:maxPDFGlyphs]
+		}
+		for _, line := range pdfLines(glyphs) {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+
+	text = b.String()
+	if len(text) > maxPDFTextSize {
+		text = strings.ToValidUTF8(text[:maxPDFTextSize], "")
+	}
+	return text, nil
+}
+
+// checkPageSize decodes the streams page.Content reads into memory, without
+// keeping them, and fails when they expand past maxPDFPageSize
+func checkPageSize(page pdf.Page) error {
+	var streams []pdf.Value
+	contents := page.V.Key("Contents")
+	if contents.Kind() == pdf.Array {
+		for i := 0; i < contents.Len(); i++ {
+			streams = append(streams, contents.Index(i))
+		}
+	} else {
+		streams = append(streams, contents)
+	}
+	for _, name := range page.Fonts() {
+		streams = append(streams, page.Font(name).V.Key("ToUnicode"))
+	}
+
+	remaining := int64(maxPDFPageSize)
+	for _, stream := range streams {
+		if stream.Kind() != pdf.Stream {
+			continue
+		}
+		n, err := io.Copy(io.Discard, io.LimitReader(stream.Reader(), remaining+1))
+		if err != nil {
+			return err
+		}
+		if remaining -= n; remaining < 0 {
+			return errPDFTooLarge
+		}
+	}
+	return nil
+}
+
+// pdfLines puts the glyphs of a page back into lines of text, top to bottom.
+// Glyphs on roughly the same baseline share a line, and a gap wider than a
+// quarter of the font size becomes a space.
+func pdfLines(glyphs []pdf.Text) []string {
+	type row struct {
+		y      float64
+		glyphs []pdf.Text
+	}
+	rows := make([]*row, 0)
+
+	for _, glyph := range glyphs {
+		tolerance := math.Max(glyph.FontSize/2, 2)
+		var match *row
+		for _, r := range rows {
+			if math.Abs(r.y-glyph.Y) <= tolerance {
+				match = r
+				break
+			}
+		}
+		if match == nil {
+			match = &row{y: glyph.Y}
+			rows = append(rows, match)
+		}
+		match.glyphs = append(match.glyphs, glyph)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].y > rows[j].y })
+
+	lines := make([]string, 0, len(rows))
+	for _, r := range rows {
+		sort.SliceStable(r.glyphs, func(i, j int) bool { return r.glyphs[i].X < r.glyphs[j].X })
+
+		var line strings.Builder
+		end := math.Inf(-1)
+		for _, glyph := range r.glyphs {
+			if glyph.X-end > glyph.FontSize/4 && line.Len() > 0 {
+				line.WriteByte(' ')
+			}
+			line.WriteString(glyph.S)
+
+			// Fonts without a widths table report no width
+			width := glyph.W
+			if width <= 0 {
+				width = glyph.FontSize / 2
+			}
+			end = glyph.X + width
+		}
+		if text := strings.Join(strings.Fields(line.String()), " "); text != "" {
+			lines = append(lines, text)
+		}
+	}
+	return lines
+}
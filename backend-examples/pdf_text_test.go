@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// onePagePDF builds a PDF whose only page draws content in Helvetica, with
+// the content stream deflated
+func onePagePDF(content string) []byte {
+	var stream bytes.Buffer
+	w := zlib.NewWriter(&stream)
+	w.Write([]byte(content))
+	w.Close()
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", stream.Len(), stream.Bytes()),
+	}
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = pdf.Len()
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return pdf.Bytes()
+}
+
+func TestPDFText(t *testing.T) {
+	data := onePagePDF("BT /F1 12 Tf 72 700 Td (Adobe Creative Cloud) Tj ET\n" +
+		"BT /F1 12 Tf 72 680 Td (Total:) Tj 120 0 Td ($54.99/month) Tj ET\n")
+	text, err := pdfText(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "Adobe Creative Cloud\nTotal: $54.99/month\n" {
+		t.Errorf("text = %q", text)
+	}
+}
+
+func TestPDFTextBounds(t *testing.T) {
+	// A few kilobytes that inflate past the page limit
+	bomb := onePagePDF("BT /F1 12 Tf 72 700 Td (Total: $1.00) Tj ET\n" + strings.Repeat(" ", maxPDFPageSize))
+	if len(bomb) > 16<<10 {
+		t.Fatalf("bomb is %d bytes", len(bomb))
+	}
+	if _, err := pdfText(bomb); !errors.Is(err, errPDFTooLarge) {
+		t.Errorf("bomb err = %v, want errPDFTooLarge", err)
+	}
+
+	// Glyphs past the limit are dropped rather than lined up
+	long := onePagePDF(fmt.Sprintf("BT /F1 1 Tf 0 700 Td (%s) Tj ET\n", strings.Repeat("x", 4*maxPDFGlyphs)))
+	text, err := pdfText(long)
+	if err != nil || strings.Count(text, "x") != maxPDFGlyphs {
+		t.Errorf("kept %d glyphs, err %v", strings.Count(text, "x"), err)
+	}
+
+	defer func(timeout time.Duration) { pdfTimeout = timeout }(pdfTimeout)
+	pdfTimeout = -time.Second
+	if _, err := pdfText(long); !errors.Is(err, errPDFTimeout) {
+		t.Errorf("past the deadline err = %v, want errPDFTimeout", err)
+	}
+}
+
+func TestIsPDFAttachment(t *testing.T) {
+	tests := []struct {
+		mediaType, filename string
+		want                bool
+	}{
+		{"application/pdf", "", true},
+		{"application/octet-stream", "Invoice.PDF", true},
+		{"", "invoice.pdf", true},
+		{"image/png", "invoice.pdf", false},
+		{"application/octet-stream", "invoice.zip", false},
+	}
+	for _, tt := range tests {
+		if got := isPDFAttachment(tt.mediaType, tt.filename); got != tt.want {
+			t.Errorf("isPDFAttachment(%q, %q) = %v", tt.mediaType, tt.filename, got)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Personal access tokens start with this prefix so AuthMiddleware can tell
+// them apart from JWTs (and secret scanners can find leaked ones)
+const patPrefix = "stp_"
+
+const maxPATExpiryDays = 365
+
+type PersonalTokenService struct{}
+
+// PersonalToken is a long-lived token for scripts. Only the hash is stored.
+type PersonalToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"-"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type CreatePersonalTokenRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Scopes        []string `json:"scopes" binding:"required"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+type CreatePersonalTokenResponse struct {
+	Token string         `json:"token"`
+	Info  *PersonalToken `json:"info"`
+}
+
+// Scopes that can be granted to a personal access token
+var personalTokenScopes = map[string]bool{
+	ScopeSubscriptionsRead:  true,
+	ScopeSubscriptionsWrite: true,
+	ScopeGmailRead:          true,
+	ScopeGmailWrite:         true,
+}
+
+func NewPersonalTokenService() *PersonalTokenService {
+	return &PersonalTokenService{}
+}
+
+// CreateToken issues a new personal access token. The plain token is only
+// returned once.
+func (s *PersonalTokenService) CreateToken(c *gin.Context) {
+	var req CreatePersonalTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token name"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !personalTokenScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown scope: %s", scope)})
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxPATExpiryDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry"})
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	plain := patPrefix + secret
+
+	pat := &PersonalToken{
+		ID:        uuid.NewString(),
+		UserID:    c.GetString("user_id"),
+		Name:      req.Name,
+		Hash:      hashToken(plain),
+		Prefix:    plain[:len(patPrefix)+6],
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := pat.CreatedAt.AddDate(0, 0, req.ExpiresInDays)
+		pat.ExpiresAt = &expiresAt
+	}
+
+	store.SavePersonalToken(pat)
+
+	c.JSON(http.StatusCreated, CreatePersonalTokenResponse{
+		Token: plain,
+		Info:  pat,
+	})
+}
+
+// ListTokens returns the user's personal access tokens (without secrets)
+func (s *PersonalTokenService) ListTokens(c *gin.Context) {
+	tokens := store.GetPersonalTokens(c.GetString("user_id"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": tokens,
+		"total":  len(tokens),
+	})
+}
+
+// RevokeToken deletes a personal access token
+func (s *PersonalTokenService) RevokeToken(c *gin.Context) {
+	tokenID := c.Param("id")
+
+	if !store.DeletePersonalToken(c.GetString("user_id"), tokenID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Token revoked",
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createPAT mints a personal access token through the API, as the browser does
+func createPAT(t *testing.T, user *User, scopes ...string) string {
+	t.Helper()
+	session, err := issueSession(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/api/tokens", AuthMiddleware(), RequireSession(), (&PersonalTokenService{}).CreateToken)
+	w := serveJSON(r, http.MethodPost, "/api/tokens", CreatePersonalTokenRequest{Name: "script", Scopes: scopes}, session.AccessToken)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create token = %d %s", w.Code, w.Body.String())
+	}
+	var resp CreatePersonalTokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+func TestPersonalTokenCannotReachProfile(t *testing.T) {
+	user := testUser(t)
+	pat := createPAT(t, user, ScopeSubscriptionsWrite)
+	session, _ := issueSession(user)
+
+	// Same middleware as the routes in main.go
+	r := gin.New()
+	r.GET("/api/subscriptions", AuthMiddleware(), RequireScope(ScopeSubscriptionsRead), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	me := r.Group("/api/me")
+	me.Use(AuthMiddleware(), RequireSession())
+	me.GET("", NewUserService().GetMe)
+	me.PATCH("", NewUserService().UpdateMe)
+
+	if w := serveJSON(r, http.MethodGet, "/api/subscriptions", nil, pat); w.Code != http.StatusOK {
+		t.Fatalf("scoped route with token = %d", w.Code)
+	}
+
+	name := "Renamed by a script"
+	for _, method := range []string{http.MethodGet, http.MethodPatch} {
+		if w := serveJSON(r, method, "/api/me", UpdateProfileRequest{Name: &name}, pat); w.Code != http.StatusForbidden {
+			t.Errorf("%s /api/me with token = %d, want 403", method, w.Code)
+		}
+	}
+	if got := store.GetUser(user.ID); got.Name == name {
+		t.Error("profile was changed with a personal access token")
+	}
+
+	if w := serveJSON(r, http.MethodGet, "/api/me", nil, session.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("GET /api/me with session = %d", w.Code)
+	}
+}
+
+func TestPersonalTokenLifecycle(t *testing.T) {
+	user, other := testUser(t), store.GetOrCreateEmailUser("other-"+t.Name()+"@example.com")
+	session, _ := issueSession(user)
+	otherSession, _ := issueSession(other)
+
+	service := NewPersonalTokenService()
+	r := gin.New()
+	tokens := r.Group("/api/tokens")
+	tokens.Use(AuthMiddleware(), RequireSession())
+	tokens.POST("", service.CreateToken)
+	tokens.GET("", service.ListTokens)
+	tokens.DELETE("/:id", service.RevokeToken)
+	r.GET("/api/subscriptions", AuthMiddleware(), RequireScope(ScopeSubscriptionsRead), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for name, req := range map[string]CreatePersonalTokenRequest{
+		"blank name":    {Name: "  ", Scopes: []string{ScopeSubscriptionsRead}},
+		"no scopes":     {Name: "script", Scopes: []string{}},
+		"unknown scope": {Name: "script", Scopes: []string{"admin"}},
+		"negative days": {Name: "script", Scopes: []string{ScopeSubscriptionsRead}, ExpiresInDays: -1},
+		"too long":      {Name: "script", Scopes: []string{ScopeSubscriptionsRead}, ExpiresInDays: maxPATExpiryDays + 1},
+	} {
+		if w := serveJSON(r, http.MethodPost, "/api/tokens", req, session.AccessToken); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: create = %d", name, w.Code)
+		}
+	}
+
+	pat := createPAT(t, user, ScopeSubscriptionsRead)
+	w := serveJSON(r, http.MethodGet, "/api/tokens", nil, session.AccessToken)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), pat) || strings.Contains(w.Body.String(), hashToken(pat)) {
+		t.Fatalf("list = %d %s", w.Code, w.Body.String())
+	}
+	var list struct {
+		Tokens []PersonalToken `json:"tokens"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Tokens) != 1 || !strings.HasPrefix(pat, list.Tokens[0].Prefix) {
+		t.Fatalf("tokens = %+v", list.Tokens)
+	}
+	id := list.Tokens[0].ID
+
+	if w := serveJSON(r, http.MethodGet, "/api/subscriptions", nil, pat); w.Code != http.StatusOK {
+		t.Fatalf("token = %d", w.Code)
+	}
+	if w := serveJSON(r, http.MethodDelete, "/api/tokens/"+id, nil, otherSession.AccessToken); w.Code != http.StatusNotFound {
+		t.Errorf("revoke by another user = %d", w.Code)
+	}
+	if w := serveJSON(r, http.MethodDelete, "/api/tokens/"+id, nil, session.AccessToken); w.Code != http.StatusOK {
+		t.Fatalf("revoke = %d", w.Code)
+	}
+	if w := serveJSON(r, http.MethodGet, "/api/subscriptions", nil, pat); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token = %d", w.Code)
+	}
+
+	expiring := createPAT(t, user, ScopeSubscriptionsRead)
+	stored := store.GetPersonalTokens(user.ID)[0]
+	past := time.Now().UTC().Add(-time.Minute)
+	stored.ExpiresAt = &past
+	store.SavePersonalToken(stored)
+	if w := serveJSON(r, http.MethodGet, "/api/subscriptions", nil, expiring); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token = %d", w.Code)
+	}
+	store.DeletePersonalToken(user.ID, stored.ID)
+}
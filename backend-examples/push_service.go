@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	ChannelPush = "push"
+
+	pushTTL = 24 * time.Hour
+)
+
+// PushSubscription is a browser endpoint registered for Web Push
+type PushSubscription struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"`
+	Endpoint  string    `json:"endpoint"`
+	P256dh    string    `json:"-"`
+	Auth      string    `json:"-"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SubscribePushRequest matches PushSubscription.toJSON() in the browser
+type SubscribePushRequest struct {
+	Endpoint string `json:"endpoint" binding:"required"`
+	Keys     struct {
+		P256dh string `json:"p256dh" binding:"required"`
+		Auth   string `json:"auth" binding:"required"`
+	} `json:"keys"`
+}
+
+type PushService struct {
+	pusher       *WebPusher
+	allowHTTP    bool
+	allowPrivate bool
+}
+
+func NewPushService(pusher *WebPusher) *PushService {
+	return &PushService{
+		pusher:       pusher,
+		allowHTTP:    os.Getenv("NOTIFY_ALLOW_HTTP") == "true",
+		allowPrivate: os.Getenv("NOTIFY_ALLOW_PRIVATE") == "true",
+	}
+}
+
+// VAPIDPublicKey returns the key browsers pass to pushManager.subscribe
+func (s *PushService) VAPIDPublicKey(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"publicKey": s.pusher.PublicKey()})
+}
+
+// Subscribe registers a browser endpoint for the signed-in user. The first
+// browser also adds a push notification channel.
+func (s *PushService) Subscribe(c *gin.Context) {
+	var req SubscribePushRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, err := url.Parse(req.Endpoint)
+	if err != nil || u.Hostname() == "" || (u.Scheme != "https" && !(s.allowHTTP && u.Scheme == "http")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid endpoint"})
+		return
+	}
+	// Push services are public, anything else is someone aiming us inside
+	if !s.allowPrivate {
+		if err := checkPublicHost(c.Request.Context(), u.Hostname()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid endpoint"})
+			return
+		}
+	}
+
+	p256dh, err := decodeBase64URL(req.Keys.P256dh)
+	if err == nil {
+		_, err = ecdh.P256().NewPublicKey(p256dh)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid p256dh key"})
+		return
+	}
+	if auth, err := decodeBase64URL(req.Keys.Auth); err != nil || len(auth) != 16 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid auth secret"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	sub := &PushSubscription{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Endpoint:  req.Endpoint,
+		P256dh:    req.Keys.P256dh,
+		Auth:      req.Keys.Auth,
+		UserAgent: c.Request.UserAgent(),
+		CreatedAt: time.Now().UTC(),
+	}
+	sub = store.SavePushSubscription(sub)
+
+	hasChannel := false
+	for _, ch := range store.GetNotificationChannels(userID) {
+		if ch.Type == ChannelPush {
+			hasChannel = true
+			break
+		}
+	}
+	if !hasChannel {
+		store.SaveNotificationChannel(&NotificationChannel{
+			ID:        uuid.NewString(),
+			UserID:    userID,
+			Type:      ChannelPush,
+			Name:      "Browser notifications",
+			Enabled:   true,
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+
+	c.JSON(http.StatusCreated, sub)
+}
+
+// ListSubscriptions returns the browsers registered for the signed-in user
+func (s *PushService) ListSubscriptions(c *gin.Context) {
+	subs := store.GetPushSubscriptions(c.GetString("user_id"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"subscriptions": subs,
+		"total":         len(subs),
+	})
+}
+
+// Unsubscribe removes a browser endpoint
+func (s *PushService) Unsubscribe(c *gin.Context) {
+	if !store.DeletePushSubscription(c.GetString("user_id"), c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Push subscription not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Push subscription removed",
+	})
+}
+
+// PushNotifier sends to every browser the user registered. Endpoints the push
+// service reports as gone are removed.
+type PushNotifier struct {
+	pusher *WebPusher
+}
+
+func (n *PushNotifier) Validate(config *ChannelConfig) error {
+	if n.pusher == nil {
+		return errChannelNotConfigured
+	}
+	return nil
+}
+
+func (n *PushNotifier) Send(ctx context.Context, user *User, config *ChannelConfig, notification *Notification) error {
+	if n.pusher == nil {
+		return errChannelNotConfigured
+	}
+
+	subs := store.GetPushSubscriptions(user.ID)
+	if len(subs) == 0 {
+		return errors.New("no browsers registered for push")
+	}
+
+	// Read by the service worker in public/sw.js
+	payload, err := json.Marshal(map[string]string{
+		"title": notification.Title,
+		"body":  notification.Body,
+		"url":   notification.URL,
+		"event": notification.Event,
+	})
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	delivered := 0
+	for _, sub := range subs {
+		err := n.pusher.Send(ctx, sub, payload, pushTTL)
+		switch {
+		case err == nil:
+			delivered++
+		case errors.Is(err, errPushGone):
+			fmt.Printf("🧹 Removing expired push endpoint for user %s\n", user.ID)
+			store.DeletePushSubscription(user.ID, sub.ID)
+		default:
+			lastErr = err
+		}
+	}
+
+	if delivered == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("all push endpoints expired")
+		}
+		return lastErr
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ChargeConfirmed  = "confirmed"  // expected and found on a statement
+	ChargeMissing    = "missing"    // expected but not on any statement
+	ChargeUnexpected = "unexpected" // on a statement but off schedule or a different amount
+
+	FlagNoReceipt = "charge_without_receipt" // paying for something with no receipt in Gmail
+	FlagNoCharge  = "receipt_without_charge" // receipt in Gmail but no matching charge
+)
+
+// ReconciledCharge is one expected or actual charge for a subscription
+type ReconciledCharge struct {
+	Status       string       `json:"status"`
+	ExpectedDate string       `json:"expectedDate,omitempty"`
+	Transaction  *Transaction `json:"transaction,omitempty"`
+	DaysOff      int          `json:"daysOff,omitempty"` // charge date minus expected date
+}
+
+// SubscriptionReconciliation links a subscription to its statement lines
+type SubscriptionReconciliation struct {
+	Subscription *Subscription       `json:"subscription"`
+	Charges      []*ReconciledCharge `json:"charges"`
+	Confirmed    int                 `json:"confirmed"`
+	Missing      int                 `json:"missing"`
+	Unexpected   int                 `json:"unexpected"`
+	Flags        []string            `json:"flags"`
+}
+
+// Reconciliation compares subscriptions with imported transactions over the
+// period the statements cover
+type Reconciliation struct {
+	From          string                        `json:"from,omitempty"`
+	To            string                        `json:"to,omitempty"`
+	Subscriptions []*SubscriptionReconciliation `json:"subscriptions"`
+	Unlinked      []*RecurringCharge            `json:"unlinked"` // recurring charges no subscription explains
+	NoReceipt     int                           `json:"noReceipt"`
+	NoCharge      int                           `json:"noCharge"`
+}
+
+type ReconciliationService struct{}
+
+func NewReconciliationService() *ReconciliationService {
+	return &ReconciliationService{}
+}
+
+// GetReconciliation matches the user's subscriptions to their imported
+// transactions. The period defaults to the dates the statements cover and can
+// be narrowed with ?from= and ?to= (YYYY-MM-DD).
+func (s *ReconciliationService) GetReconciliation(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	now := time.Now()
+	currency := ""
+	if user := store.GetUser(userID); user != nil {
+		now = now.In(userLocation(user))
+		currency = user.HomeCurrency
+	}
+	today := dateOnly(now)
+
+	txns := store.GetTransactions(userID, "")
+	if len(txns) == 0 {
+		c.JSON(http.StatusOK, &Reconciliation{
+			Subscriptions: []*SubscriptionReconciliation{},
+			Unlinked:      []*RecurringCharge{},
+		})
+		return
+	}
+
+	// Transactions are sorted newest first
+	from, _ := time.Parse(dateLayout, txns[len(txns)-1].Date)
+	to, _ := time.Parse(dateLayout, txns[0].Date)
+	if to.After(today) {
+		to = today
+	}
+	for param, bound := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := c.Query(param); value != "" {
+			date, err := time.Parse(dateLayout, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " date"})
+				return
+			}
+			*bound = date
+		}
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	c.JSON(http.StatusOK, reconcile(store.GetSubscriptions(userID), txns, currency, from, to))
+}
+
+// reconcile walks each subscription's billing schedule back through the
+// period and pairs every expected charge with the closest statement line from
+// the same merchant
+func reconcile(subs []*Subscription, txns []*Transaction, homeCurrency string, from, to time.Time) *Reconciliation {
+	result := &Reconciliation{
+		From:          from.Format(dateLayout),
+		To:            to.Format(dateLayout),
+		Subscriptions: make([]*SubscriptionReconciliation, 0, len(subs)),
+	}
+
+	debits := make([]*Transaction, 0, len(txns))
+	for _, txn := range txns {
+		if txn.Amount < 0 && txn.Date >= result.From && txn.Date <= result.To {
+			debits = append(debits, txn)
+		}
+	}
+
+	sorted := append([]*Subscription(nil), subs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	// A statement line belongs to at most one subscription
+	used := make(map[string]bool)
+	for _, sub := range sorted {
+		aliases := subscriptionAliases(sub)
+		candidates := make([]*Transaction, 0)
+		for _, txn := range debits {
+			if !used[txn.ID] && matchesAlias(txn.Description, aliases) {
+				candidates = append(candidates, txn)
+				used[txn.ID] = true
+			}
+		}
+
+		rec := reconcileSubscription(sub, candidates, homeCurrency, from, to)
+		for _, flag := range rec.Flags {
+			switch flag {
+			case FlagNoReceipt:
+				result.NoReceipt++
+			case FlagNoCharge:
+				result.NoCharge++
+			}
+		}
+		result.Subscriptions = append(result.Subscriptions, rec)
+	}
+
+	unlinked := make([]*Transaction, 0)
+	for _, txn := range debits {
+		if !used[txn.ID] {
+			unlinked = append(unlinked, txn)
+		}
+	}
+	result.Unlinked = detectRecurringCharges(unlinked, to)
+	for _, charge := range result.Unlinked {
+		if charge.Confidence >= minRecurringConfidence {
+			result.NoReceipt++
+		}
+	}
+
+	return result
+}
+
+func reconcileSubscription(sub *Subscription, candidates []*Transaction, homeCurrency string, from, to time.Time) *SubscriptionReconciliation {
+	rec := &SubscriptionReconciliation{
+		Subscription: sub,
+		Charges:      make([]*ReconciledCharge, 0),
+		Flags:        []string{},
+	}
+
+	cycle := cycleFor(sub.BillingCycle)
+	matched := make(map[string]bool)
+
+	if cycle != nil {
+		// Statements are the better source for the billing day, Gmail only
+		// estimates the next date
+		anchor, err := time.Parse(dateLayout, sub.NextBillingDate)
+		start := from
+		if len(candidates) > 0 {
+			anchor, _ = time.Parse(dateLayout, candidates[0].Date)
+			earliest, _ := time.Parse(dateLayout, candidates[len(candidates)-1].Date)
+			if first := earliest.AddDate(0, 0, -int(cycle.tolerance)); first.After(start) {
+				start = first
+			}
+			err = nil
+		}
+
+		if err == nil {
+			tolerance := time.Duration(cycle.tolerance*24) * time.Hour
+			for _, expected := range expectedCharges(anchor, cycle.name, start, to) {
+				var best *Transaction
+				bestOff := tolerance + 1
+				for _, txn := range candidates {
+					date, _ := time.Parse(dateLayout, txn.Date)
+					off := date.Sub(expected)
+					if matched[txn.ID] || absDuration(off) > tolerance || !amountMatches(sub, txn, homeCurrency) {
+						continue
+					}
+					if absDuration(off) < absDuration(bestOff) {
+						best, bestOff = txn, off
+					}
+				}
+
+				if best == nil {
+					// Not due yet on the last statement
+					if expected.Add(tolerance).After(to) {
+						continue
+					}
+					rec.Charges = append(rec.Charges, &ReconciledCharge{
+						Status:       ChargeMissing,
+						ExpectedDate: expected.Format(dateLayout),
+					})
+					rec.Missing++
+					continue
+				}
+
+				matched[best.ID] = true
+				rec.Charges = append(rec.Charges, &ReconciledCharge{
+					Status:       ChargeConfirmed,
+					ExpectedDate: expected.Format(dateLayout),
+					Transaction:  best,
+					DaysOff:      int(math.Round(bestOff.Hours() / 24)),
+				})
+				rec.Confirmed++
+			}
+		}
+	}
+
+	for _, txn := range candidates {
+		if !matched[txn.ID] {
+			rec.Charges = append(rec.Charges, &ReconciledCharge{
+				Status:      ChargeUnexpected,
+				Transaction: txn,
+			})
+			rec.Unexpected++
+		}
+	}
+
+	sort.SliceStable(rec.Charges, func(i, j int) bool {
+		return chargeDate(rec.Charges[i]) > chargeDate(rec.Charges[j])
+	})
+
+	// Found in a mailbox, so we have the receipt
+	fromMail := false
+	for _, source := range sub.Sources {
+		switch source {
+		case SourceGmail, SourceOutlook, SourceIMAP, SourceUpload, SourceInbound:
+			fromMail = true
+		}
+	}
+	if !fromMail && len(candidates) > 0 {
+		rec.Flags = append(rec.Flags, FlagNoReceipt)
+	}
+	if fromMail && rec.Missing > 0 {
+		rec.Flags = append(rec.Flags, FlagNoCharge)
+	}
+
+	return rec
+}
+
+// expectedCharges lists the billing dates between start and end on the
+// schedule through anchor. Month-based cycles keep the anchor's day, clamped
+// to the end of short months.
+func expectedCharges(anchor time.Time, cycle string, start, end time.Time) []time.Time {
+	dates := make([]time.Time, 0)
+	for n := 0; n > -1000; n-- {
+		date := cycleDate(anchor, cycle, n)
+		if date.Before(start) {
+			break
+		}
+		if !date.After(end) {
+			dates = append(dates, date)
+		}
+	}
+	// Anchors before the period only happen for Gmail dates in the past
+	for n := 1; n < 1000; n++ {
+		date := cycleDate(anchor, cycle, n)
+		if date.After(end) {
+			break
+		}
+		if !date.Before(start) {
+			dates = append(dates, date)
+		}
+	}
+
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	return dates
+}
+
+func cycleDate(anchor time.Time, cycle string, n int) time.Time {
+	months := map[string]int{"monthly": 1, "quarterly": 3, "yearly": 12, "annual": 12, "annually": 12}[cycle]
+	if months == 0 {
+		date, _ := addCycles(anchor, cycle, n)
+		return date
+	}
+
+	first := time.Date(anchor.Year(), anchor.Month()+time.Month(months*n), 1, 0, 0, 0, 0, time.UTC)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := anchor.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// cycleFor finds the detection cycle for a subscription's billing cycle
+func cycleFor(billingCycle string) *recurringCycle {
+	switch billingCycle {
+	case "annual", "annually":
+		billingCycle = "yearly"
+	}
+	for i := range recurringCycles {
+		if recurringCycles[i].name == billingCycle {
+			return &recurringCycles[i]
+		}
+	}
+	return nil
+}
+
+// subscriptionAliases lists the descriptor fragments that identify the
+// subscription's merchant on a statement
+func subscriptionAliases(sub *Subscription) []string {
+	aliases := append([]string(nil), sub.MerchantAliases...)
+	for keyword, info := range subscriptionKeywords {
+		if info.name == sub.Name {
+			aliases = append(aliases, keyword)
+		}
+	}
+	if name := normalizeDescriptor(sub.Name); name != "" {
+		aliases = append(aliases, name)
+	}
+	return aliases
+}
+
+func matchesAlias(description string, aliases []string) bool {
+	raw := strings.ToLower(description)
+	normalized := normalizeDescriptor(description)
+	for _, alias := range aliases {
+		if strings.Contains(raw, alias) || strings.Contains(normalized, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// amountMatches allows the current or previous price within the detection
+// tolerance. Charges in another currency can't be compared.
+func amountMatches(sub *Subscription, txn *Transaction, homeCurrency string) bool {
+	if sub.Price <= 0 || (homeCurrency != "" && txn.Currency != homeCurrency) {
+		return true
+	}
+	for _, price := range []float64{sub.Price, sub.PreviousPrice} {
+		if price > 0 && math.Abs(-txn.Amount-price) <= price*recurringAmountTolerance {
+			return true
+		}
+	}
+	return false
+}
+
+func chargeDate(charge *ReconciledCharge) string {
+	if charge.Transaction != nil {
+		return charge.Transaction.Date
+	}
+	return charge.ExpectedDate
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReconcile(t *testing.T) {
+	subs := []*Subscription{
+		{ID: "netflix", Name: "Netflix", Price: 15.49, BillingCycle: "monthly", NextBillingDate: "2026-04-05", Sources: []string{SourceGmail}},
+		{ID: "spotify", Name: "Spotify", Price: 9.99, BillingCycle: "monthly", NextBillingDate: "2026-04-10", Sources: []string{SourceStatement}},
+	}
+
+	// Newest first, as the store returns them
+	txns := []*Transaction{
+		{ID: "d3", Date: "2026-03-15", Description: "DROPBOX STORAGE", Amount: -11.99, Currency: "USD"},
+		{ID: "s3", Date: "2026-03-10", Description: "PAYPAL *SPOTIFY P2F1", Amount: -9.99, Currency: "USD"},
+		{ID: "n2", Date: "2026-03-05", Description: "NETFLIX.COM", Amount: -15.49, Currency: "USD"},
+		{ID: "pay", Date: "2026-02-25", Description: "SALARY", Amount: 3000, Currency: "USD"},
+		{ID: "s-odd", Date: "2026-02-20", Description: "SPOTIFY GIFT CARD", Amount: -50, Currency: "USD"},
+		{ID: "d2", Date: "2026-02-15", Description: "DROPBOX STORAGE", Amount: -11.99, Currency: "USD"},
+		{ID: "s2", Date: "2026-02-11", Description: "Spotify P3C7", Amount: -9.99, Currency: "USD"},
+		{ID: "d1", Date: "2026-01-15", Description: "DROPBOX STORAGE", Amount: -11.99, Currency: "USD"},
+		{ID: "s1", Date: "2026-01-10", Description: "Spotify P1A2", Amount: -9.99, Currency: "USD"},
+		{ID: "n1", Date: "2026-01-05", Description: "NETFLIX.COM", Amount: -15.49, Currency: "USD"},
+	}
+
+	result := reconcile(subs, txns, "USD", day("2026-01-01"), day("2026-03-31"))
+
+	if len(result.Subscriptions) != 2 {
+		t.Fatalf("subscriptions = %d", len(result.Subscriptions))
+	}
+	netflix, spotify := result.Subscriptions[0], result.Subscriptions[1]
+
+	// February's Netflix charge never showed up
+	if netflix.Confirmed != 2 || netflix.Missing != 1 || netflix.Unexpected != 0 {
+		t.Errorf("netflix = %d confirmed, %d missing, %d unexpected", netflix.Confirmed, netflix.Missing, netflix.Unexpected)
+	}
+	for _, charge := range netflix.Charges {
+		if charge.Status == ChargeMissing && charge.ExpectedDate != "2026-02-05" {
+			t.Errorf("missing charge expected on %s", charge.ExpectedDate)
+		}
+	}
+	if len(netflix.Flags) != 1 || netflix.Flags[0] != FlagNoCharge {
+		t.Errorf("netflix flags = %v", netflix.Flags)
+	}
+
+	// A day late in February still counts, the gift card doesn't
+	if spotify.Confirmed != 3 || spotify.Missing != 0 || spotify.Unexpected != 1 {
+		t.Errorf("spotify = %d confirmed, %d missing, %d unexpected", spotify.Confirmed, spotify.Missing, spotify.Unexpected)
+	}
+	for _, charge := range spotify.Charges {
+		if charge.Transaction != nil && charge.Transaction.ID == "s2" && charge.DaysOff != 1 {
+			t.Errorf("late charge is %d days off", charge.DaysOff)
+		}
+	}
+	if len(spotify.Flags) != 1 || spotify.Flags[0] != FlagNoReceipt {
+		t.Errorf("spotify flags = %v", spotify.Flags)
+	}
+
+	// Dropbox charges monthly but no subscription explains it
+	if len(result.Unlinked) != 1 || result.Unlinked[0].Occurrences != 3 {
+		t.Fatalf("unlinked = %+v", result.Unlinked)
+	}
+	if result.NoReceipt != 2 || result.NoCharge != 1 {
+		t.Errorf("noReceipt = %d, noCharge = %d, want 2 and 1", result.NoReceipt, result.NoCharge)
+	}
+}
+
+func TestReconcileSkipsChargesNotYetDue(t *testing.T) {
+	subs := []*Subscription{
+		{Name: "Netflix", Price: 15.49, BillingCycle: "monthly", NextBillingDate: "2026-03-30", Sources: []string{SourceGmail}},
+	}
+	txns := []*Transaction{
+		{ID: "n1", Date: "2026-02-28", Description: "NETFLIX.COM", Amount: -15.49},
+	}
+
+	// The statement ends the day before the next charge
+	rec := reconcile(subs, txns, "", day("2026-02-01"), day("2026-03-29")).Subscriptions[0]
+	if rec.Confirmed != 1 || rec.Missing != 0 {
+		t.Errorf("confirmed = %d, missing = %d", rec.Confirmed, rec.Missing)
+	}
+}
+
+func TestExpectedChargesClampsToMonthEnd(t *testing.T) {
+	dates := expectedCharges(day("2026-01-31"), "monthly", day("2026-01-01"), day("2026-04-30"))
+	want := []string{"2026-01-31", "2026-02-28", "2026-03-31", "2026-04-30"}
+	if len(dates) != len(want) {
+		t.Fatalf("dates = %v", dates)
+	}
+	for i, date := range dates {
+		if date.Format(dateLayout) != want[i] {
+			t.Errorf("date %d = %s, want %s", i, date.Format(dateLayout), want[i])
+		}
+	}
+}
+
+func TestGetReconciliation(t *testing.T) {
+	r := gin.New()
+	r.GET("/reconciliation", AuthMiddleware(), NewReconciliationService().GetReconciliation)
+	user := testUser(t)
+	tokens, _ := issueSession(user)
+
+	if w := serveJSON(r, http.MethodGet, "/reconciliation", nil, tokens.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("without transactions = %d", w.Code)
+	}
+
+	store.SaveStatementImport(&StatementImport{ID: "imp", UserID: user.ID}, []*Transaction{
+		{ID: "t1", UserID: user.ID, ImportID: "imp", Date: "2026-01-05", Description: "NETFLIX.COM", Amount: -15.49},
+	})
+	for query, want := range map[string]int{
+		"":                               http.StatusOK,
+		"?from=2026-01-01&to=2026-01-31": http.StatusOK,
+		"?from=January":                  http.StatusBadRequest,
+		"?from=2026-02-01&to=2026-01-01": http.StatusBadRequest,
+	} {
+		if w := serveJSON(r, http.MethodGet, "/reconciliation"+query, nil, tokens.AccessToken); w.Code != want {
+			t.Errorf("GET %q = %d, want %d", query, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Candidates at or above this confidence are saved as subscriptions
+const minRecurringConfidence = 0.6
+
+// recurringCycle is a billing period we look for in statements. Tolerance
+// covers weekends, bank holidays and short months.
+type recurringCycle struct {
+	name      string
+	days      float64
+	tolerance float64
+	minCount  int // charges needed before we propose it
+}
+
+var recurringCycles = []recurringCycle{
+	{"weekly", 7, 2, 3},
+	{"monthly", 30.44, 4, 2},
+	{"quarterly", 91.31, 7, 2},
+	{"yearly", 365.25, 10, 2},
+}
+
+// Allow small price differences between charges, like FX or tax rounding
+const recurringAmountTolerance = 0.15
+
+// RecurringCharge is a merchant that charges on a regular cycle
+type RecurringCharge struct {
+	Merchant       string        `json:"merchant"` // normalized descriptor
+	Subscription   *Subscription `json:"subscription"`
+	Currency       string        `json:"currency"`
+	Occurrences    int           `json:"occurrences"`
+	FirstCharge    string        `json:"firstCharge"`
+	LastCharge     string        `json:"lastCharge"`
+	TransactionIDs []string      `json:"transactionIds"`
+	Confidence     float64       `json:"confidence"`
+}
+
+var (
+	// Card processors and wallets that prefix the real merchant
+	descriptorPrefix = regexp.MustCompile(`^(paypal|pp|sq|sp|tst|google|apple\.com/bill|amzn mktp|dnh|ptt)\s*\*\s*`)
+	descriptorDomain = regexp.MustCompile(`\.(com|net|io|co|tv|th|co\.th)\b`)
+	descriptorNoise  = regexp.MustCompile(`[^\p{L}\p{M}\s]+`)
+)
+
+// Words that appear in descriptors but don't identify the merchant
+var descriptorStopWords = map[string]bool{
+	"pos": true, "purchase": true, "payment": true, "debit": true, "credit": true,
+	"card": true, "visa": true, "mastercard": true, "recurring": true, "online": true,
+	"www": true, "inc": true, "ltd": true, "llc": true, "co": true, "corp": true,
+	"bill": true, "subscription": true,
+}
+
+// Thai has no spaces between words, so these are removed wherever they appear
+var descriptorThaiNoise = strings.NewReplacer(
+	"ชำระค่าบริการ", " ", "ชำระค่า", " ", "ค่าบริการ", " ", "ชำระเงิน", " ",
+	"ซื้อสินค้า", " ", "รายการซื้อ", " ",
+)
+
+// normalizeDescriptor reduces a statement description to a stable merchant
+// key, e.g. "PAYPAL *SPOTIFY P2F1A9 STOCKHOLM" and "Spotify P3C7 Stockholm"
+// both become "spotify stockholm"
+func normalizeDescriptor(description string) string {
+	d := strings.ToLower(strings.TrimSpace(description))
+	d = descriptorPrefix.ReplaceAllString(d, "")
+	d = descriptorDomain.ReplaceAllString(d, " ")
+	d = descriptorThaiNoise.Replace(d)
+
+	words := make([]string, 0, 2)
+	for _, field := range strings.Fields(d) {
+		// Reference numbers, dates and card digits change every charge
+		if strings.ContainsAny(field, "0123456789") {
+			continue
+		}
+		field = strings.TrimSpace(descriptorNoise.ReplaceAllString(field, ""))
+		if len([]rune(field)) < 2 || descriptorStopWords[field] {
+			continue
+		}
+		words = append(words, field)
+		if len(words) == 2 {
+			break
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// detectRecurringCharges groups outgoing transactions by merchant and
+// currency and proposes a subscription for each group that charges on a
+// weekly, monthly, quarterly or yearly cycle
+func detectRecurringCharges(txns []*Transaction, today time.Time) []*RecurringCharge {
+	groups := make(map[string][]*Transaction)
+	for _, txn := range txns {
+		if txn.Amount >= 0 {
+			continue
+		}
+		merchant := normalizeDescriptor(txn.Description)
+		if merchant == "" {
+			continue
+		}
+		key := merchant + "|" + txn.Currency
+		groups[key] = append(groups[key], txn)
+	}
+
+	charges := make([]*RecurringCharge, 0)
+	for key, group := range groups {
+		merchant, currency, _ := strings.Cut(key, "|")
+		if charge := analyzeRecurring(merchant, currency, group, today); charge != nil {
+			charges = append(charges, charge)
+		}
+	}
+
+	sort.Slice(charges, func(i, j int) bool {
+		if charges[i].Confidence != charges[j].Confidence {
+			return charges[i].Confidence > charges[j].Confidence
+		}
+		return charges[i].Merchant < charges[j].Merchant
+	})
+	return charges
+}
+
+func analyzeRecurring(merchant, currency string, group []*Transaction, today time.Time) *RecurringCharge {
+	type charge struct {
+		txn    *Transaction
+		date   time.Time
+		amount float64
+	}
+
+	charges := make([]charge, 0, len(group))
+	for _, txn := range group {
+		date, err := time.Parse(dateLayout, txn.Date)
+		if err != nil {
+			continue
+		}
+		charges = append(charges, charge{txn, date, -txn.Amount})
+	}
+	if len(charges) < 2 {
+		return nil
+	}
+	sort.Slice(charges, func(i, j int) bool { return charges[i].date.Before(charges[j].date) })
+
+	intervals := make([]float64, 0, len(charges)-1)
+	for i := 1; i < len(charges); i++ {
+		days := charges[i].date.Sub(charges[i-1].date).Hours() / 24
+		// Same-day lines are split payments or refunds and re-charges
+		if days >= 1 {
+			intervals = append(intervals, days)
+		}
+	}
+	if len(intervals) == 0 {
+		return nil
+	}
+
+	typical := median(intervals)
+	var cycle *recurringCycle
+	for i := range recurringCycles {
+		if math.Abs(typical-recurringCycles[i].days) <= recurringCycles[i].tolerance {
+			cycle = &recurringCycles[i]
+			break
+		}
+	}
+	if cycle == nil || len(charges) < cycle.minCount {
+		return nil
+	}
+
+	onCycle := 0
+	for _, days := range intervals {
+		if math.Abs(days-cycle.days) <= cycle.tolerance {
+			onCycle++
+		}
+	}
+	regularity := float64(onCycle) / float64(len(intervals))
+
+	amounts := make([]float64, len(charges))
+	for i, c := range charges {
+		amounts[i] = c.amount
+	}
+	typicalAmount := median(amounts)
+	steady := 0
+	for _, amount := range amounts {
+		if math.Abs(amount-typicalAmount) <= typicalAmount*recurringAmountTolerance {
+			steady++
+		}
+	}
+	consistency := float64(steady) / float64(len(amounts))
+
+	// Three on-cycle charges (two for yearly) is enough history
+	wanted := 3.0
+	if cycle.name == "yearly" {
+		wanted = 2
+	}
+	history := math.Min(1, float64(onCycle)/wanted)
+
+	confidence := 0.4*regularity + 0.3*consistency + 0.3*history
+
+	// A merchant that stopped charging was probably cancelled
+	last := charges[len(charges)-1]
+	if today.Sub(last.date).Hours()/24 > cycle.days*1.5+cycle.tolerance {
+		confidence /= 2
+	}
+	confidence = math.Round(confidence*100) / 100
+
+	next, ok := nextOccurrence(last.date.Format(dateLayout), cycle.name, today)
+	if !ok {
+		return nil
+	}
+
+	ids := make([]string, len(charges))
+	for i, c := range charges {
+		ids[i] = c.txn.ID
+	}
+
+	name, category := merchantName(merchant)
+	return &RecurringCharge{
+		Merchant: merchant,
+		Subscription: &Subscription{
+			ID:              uuid.NewString(),
+			Name:            name,
+			Price:           math.Round(last.amount*100) / 100, // the latest price
+			BillingCycle:    cycle.name,
+			NextBillingDate: next.Format(dateLayout),
+			Category:        category,
+			IsAutoDetected:  true,
+			Sources:         []string{SourceStatement},
+			Confidence:      confidence,
+		},
+		Currency:       currency,
+		Occurrences:    len(charges),
+		FirstCharge:    charges[0].txn.Date,
+		LastCharge:     last.txn.Date,
+		TransactionIDs: ids,
+		Confidence:     confidence,
+	}
+}
+
+// merchantName returns the name we'd use for a Gmail match, or the title
+// cased descriptor
+func merchantName(merchant string) (string, string) {
+	for keyword, info := range subscriptionKeywords {
+		if strings.Contains(merchant, keyword) {
+			return info.name, info.category
+		}
+	}
+
+	words := strings.Fields(merchant)
+	for i, word := range words {
+		runes := []rune(word)
+		words[i] = strings.ToUpper(string(runes[0])) + string(runes[1:])
+	}
+	return strings.Join(words, " "), "other"
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// statementLines builds transactions for one merchant from date/amount pairs
+func statementLines(description, currency string, charges ...interface{}) []*Transaction {
+	txns := make([]*Transaction, 0, len(charges)/2)
+	for i := 0; i+1 < len(charges); i += 2 {
+		txns = append(txns, &Transaction{
+			ID:          fmt.Sprintf("%s-%d", description, i/2),
+			Date:        charges[i].(string),
+			Description: description,
+			Amount:      charges[i+1].(float64),
+			Currency:    currency,
+		})
+	}
+	return txns
+}
+
+func TestNormalizeDescriptor(t *testing.T) {
+	tests := map[string]string{
+		"PAYPAL *SPOTIFY P2F1A9 STOCKHOLM": "spotify stockholm",
+		"Spotify P3C7 Stockholm":           "spotify stockholm",
+		"NETFLIX.COM 866-579-7172":         "netflix",
+		"POS PURCHASE Netflix 05/01":       "netflix",
+		"ชำระค่าบริการ TrueID":             "trueid",
+		"12345 6789": "",
+	}
+	for description, want := range tests {
+		if got := normalizeDescriptor(description); got != want {
+			t.Errorf("normalizeDescriptor(%q) = %q, want %q", description, got, want)
+		}
+	}
+}
+
+func TestDetectMonthlyCharge(t *testing.T) {
+	// Dates wander with weekends and the price went up once
+	txns := statementLines("NETFLIX.COM 866-579-7172", "USD",
+		"2026-01-05", -15.49,
+		"2026-02-06", -15.49,
+		"2026-03-05", -16.99,
+	)
+	txns = append(txns, statementLines("SALARY ACME", "USD", "2026-01-25", 3000.0, "2026-02-25", 3000.0)...)
+
+	charges := detectRecurringCharges(txns, day("2026-03-20"))
+	if len(charges) != 1 {
+		t.Fatalf("found %d recurring charges, want only Netflix: %+v", len(charges), charges)
+	}
+	charge := charges[0]
+	sub := charge.Subscription
+	if sub.Name != "Netflix" || sub.BillingCycle != "monthly" || sub.Price != 16.99 || sub.NextBillingDate != "2026-04-05" {
+		t.Errorf("subscription = %+v", sub)
+	}
+	if !sub.IsAutoDetected || len(sub.Sources) != 1 || sub.Sources[0] != SourceStatement {
+		t.Errorf("subscription not marked as detected from statements: %+v", sub)
+	}
+	if charge.Occurrences != 3 || charge.FirstCharge != "2026-01-05" || charge.LastCharge != "2026-03-05" || len(charge.TransactionIDs) != 3 {
+		t.Errorf("charge = %+v", charge)
+	}
+	if charge.Confidence < minRecurringConfidence {
+		t.Errorf("confidence = %v, want at least %v", charge.Confidence, minRecurringConfidence)
+	}
+}
+
+func TestDetectRecurringCycles(t *testing.T) {
+	tests := []struct {
+		name      string
+		txns      []*Transaction
+		wantCycle string // empty means nothing should be proposed
+	}{
+		{
+			name:      "weekly",
+			txns:      statementLines("GYM PASS", "USD", "2026-03-01", -10.0, "2026-03-08", -10.0, "2026-03-16", -10.0),
+			wantCycle: "weekly",
+		},
+		{
+			name: "two weekly charges are not enough",
+			txns: statementLines("GYM PASS", "USD", "2026-03-08", -10.0, "2026-03-16", -10.0),
+		},
+		{
+			name:      "yearly",
+			txns:      statementLines("APPLE.COM/BILL *ICLOUD", "USD", "2025-02-01", -29.0, "2026-02-03", -29.0),
+			wantCycle: "yearly",
+		},
+		{
+			name: "no cycle",
+			txns: statementLines("CORNER SHOP", "USD", "2026-01-02", -4.0, "2026-01-14", -12.0, "2026-01-31", -7.5),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			charges := detectRecurringCharges(tt.txns, day("2026-03-17"))
+			if tt.wantCycle == "" {
+				if len(charges) != 0 {
+					t.Errorf("proposed %+v", charges[0].Subscription)
+				}
+				return
+			}
+			if len(charges) != 1 || charges[0].Subscription.BillingCycle != tt.wantCycle {
+				t.Fatalf("charges = %+v, want one %s charge", charges, tt.wantCycle)
+			}
+		})
+	}
+}
+
+func TestDetectRecurringConfidence(t *testing.T) {
+	monthly := []interface{}{"2025-06-03", -9.99, "2025-07-03", -9.99, "2025-08-04", -9.99}
+
+	current := detectRecurringCharges(statementLines("SPOTIFY P3C7", "EUR", monthly...), day("2025-08-20"))
+	stopped := detectRecurringCharges(statementLines("SPOTIFY P3C7", "EUR", monthly...), day("2026-02-20"))
+	if len(current) != 1 || len(stopped) != 1 {
+		t.Fatalf("current = %d, stopped = %d charges", len(current), len(stopped))
+	}
+	if current[0].Confidence < minRecurringConfidence {
+		t.Errorf("current confidence = %v", current[0].Confidence)
+	}
+	if stopped[0].Confidence >= minRecurringConfidence {
+		t.Errorf("a merchant that stopped charging half a year ago has confidence %v", stopped[0].Confidence)
+	}
+
+	// Amounts all over the place lower confidence even on a steady cycle
+	erratic := detectRecurringCharges(statementLines("UTILITY CO", "EUR",
+		"2025-06-03", -20.0, "2025-07-03", -95.0, "2025-08-04", -41.0), day("2025-08-20"))
+	if len(erratic) != 1 || erratic[0].Confidence >= current[0].Confidence {
+		t.Errorf("erratic amounts = %+v", erratic)
+	}
+}
+
+func TestDetectRecurringKeepsCurrenciesApart(t *testing.T) {
+	txns := statementLines("SPOTIFY", "USD", "2026-01-05", -9.99, "2026-02-05", -9.99, "2026-03-05", -9.99)
+	txns = append(txns, statementLines("SPOTIFY", "THB", "2026-01-20", -149.0)...)
+
+	charges := detectRecurringCharges(txns, day("2026-03-10"))
+	if len(charges) != 1 || charges[0].Currency != "USD" || charges[0].Occurrences != 3 {
+		t.Errorf("charges = %+v", charges)
+	}
+}
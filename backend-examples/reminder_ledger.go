@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long sent reminders are remembered. Longer than any billing cycle we
+// remind about, so a key can't come back around and fire twice.
+const reminderLedgerRetention = 400 * 24 * time.Hour
+
+type ledgerEntry struct {
+	Key      string    `json:"key"`
+	At       time.Time `json:"at"`
+	Released bool      `json:"released,omitempty"`
+}
+
+// ReminderLedger records which reminders have fired. It is an append-only
+// JSON lines file so the record survives restarts even with in-memory storage.
+type ReminderLedger struct {
+	path string
+	sent map[string]time.Time
+	file *os.File
+	mu   sync.Mutex
+}
+
+// ledgerAccount names the user in ledger keys. Storage IDs are regenerated
+// when the data is loaded again, so use the Google subject or the email.
+func ledgerAccount(user *User) string {
+	switch {
+	case user.GoogleSubject != "":
+		return "google:" + user.GoogleSubject
+	case user.Email != "":
+		return "email:" + strings.ToLower(user.Email)
+	}
+	return "user:" + user.ID
+}
+
+// OpenReminderLedger loads the ledger at path, creating it if needed.
+// An empty path keeps the ledger in memory only.
+func OpenReminderLedger(path string) (*ReminderLedger, error) {
+	ledger := &ReminderLedger{
+		path: path,
+		sent: make(map[string]time.Time),
+	}
+	if path == "" {
+		return ledger, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry ledgerEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			if entry.Released {
+				delete(ledger.sent, entry.Key)
+			} else {
+				ledger.sent[entry.Key] = entry.At
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Rewrite the file without expired entries
+	if err := ledger.compact(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return ledger, nil
+}
+
+// Claim marks key as sent. Returns false if it was already claimed.
+func (l *ReminderLedger) Claim(key string, now time.Time) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.sent[key]; ok {
+		return false, nil
+	}
+	if err := l.append(ledgerEntry{Key: key, At: now}); err != nil {
+		return false, err
+	}
+	l.sent[key] = now
+	return true, nil
+}
+
+// Release undoes a claim so the reminder is tried again on the next run
+func (l *ReminderLedger) Release(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.sent[key]; !ok {
+		return nil
+	}
+	delete(l.sent, key)
+	return l.append(ledgerEntry{Key: key, At: time.Now(), Released: true})
+}
+
+// Sent reports whether key has been claimed
+func (l *ReminderLedger) Sent(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.sent[key]
+	return ok
+}
+
+func (l *ReminderLedger) append(entry ledgerEntry) error {
+	if l.file == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *ReminderLedger) compact(now time.Time) error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for key, at := range l.sent {
+		if now.Sub(at) > reminderLedgerRetention {
+			delete(l.sent, key)
+			continue
+		}
+		data, _ := json.Marshal(ledgerEntry{Key: key, At: at})
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	return err
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ReminderUpcomingCharge = "upcoming_charge"
+	ReminderTrialEnding    = "trial_ending"
+
+	dateLayout = "2006-01-02"
+)
+
+// Lead times used when neither the subscription nor the user set their own
+var defaultReminderDays = []int{7, 3, 1}
+
+// Reminder is a single upcoming event the user should hear about
+type Reminder struct {
+	Key          string
+	UserID       string
+	Kind         string
+	Subscription Subscription
+	DueDate      time.Time
+	DaysBefore   int
+	Currency     string
+}
+
+// Notification is a message for a user, produced by the reminder engine and
+// delivered by a NotificationDispatcher
+type Notification struct {
+	UserID string
+	Event  string
+	Title  string
+	Body   string
+	URL    string
+	HTML   string // optional rich version for email
+}
+
+// Text is the plain text version of a notification
+func (n *Notification) Text() string {
+	text := n.Title + "\n\n" + n.Body
+	if n.URL != "" {
+		text += "\n\n" + n.URL
+	}
+	return text
+}
+
+// NotificationDispatcher hands notifications to the user's channels
+type NotificationDispatcher interface {
+	Dispatch(ctx context.Context, notification *Notification) error
+}
+
+// ReminderScheduler periodically finds charges coming up and notifies users.
+// Each reminder is claimed in the ledger before it is dispatched, so it
+// fires once even if the server restarts. Reminders for users in quiet hours
+// are left unclaimed until the hours end: held notifications only live in
+// memory and a restart would lose a claimed one.
+type ReminderScheduler struct {
+	ledger     *ReminderLedger
+	dispatcher NotificationDispatcher
+	interval   time.Duration
+}
+
+func NewReminderScheduler(ledger *ReminderLedger, dispatcher NotificationDispatcher) *ReminderScheduler {
+	interval := 15 * time.Minute
+	if value := os.Getenv("REMINDER_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		}
+	}
+
+	return &ReminderScheduler{
+		ledger:     ledger,
+		dispatcher: dispatcher,
+		interval:   interval,
+	}
+}
+
+// Start runs the scheduler in the background until ctx is cancelled
+func (s *ReminderScheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if sent := s.RunOnce(ctx, time.Now()); sent > 0 {
+				fmt.Printf("🔔 Sent %d reminders\n", sent)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RunOnce dispatches every reminder due at now and returns how many were sent
+func (s *ReminderScheduler) RunOnce(ctx context.Context, now time.Time) int {
+	sent := 0
+
+	for _, reminder := range s.DueReminders(now) {
+		if user := store.GetUser(reminder.UserID); user != nil {
+			if _, quiet := quietUntil(user, now); quiet {
+				continue
+			}
+		}
+
+		claimed, err := s.ledger.Claim(reminder.Key, now)
+		if err != nil {
+			fmt.Printf("❌ Reminder ledger error: %v\n", err)
+			return sent
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := s.dispatcher.Dispatch(ctx, reminderNotification(reminder)); err != nil {
+			// Give it back so the next run tries again
+			fmt.Printf("❌ Failed to dispatch reminder %s: %v\n", reminder.Key, err)
+			s.ledger.Release(reminder.Key)
+			continue
+		}
+		sent++
+	}
+
+	return sent
+}
+
+// DueReminders lists reminders that should fire at now and haven't yet
+func (s *ReminderScheduler) DueReminders(now time.Time) []*Reminder {
+	var reminders []*Reminder
+
+	for userID, subs := range store.GetAllUserSubscriptions() {
+		user := store.GetUser(userID)
+		if user == nil {
+			continue
+		}
+
+		// Billing dates are calendar days in the user's time zone, so count
+		// days from local midnight there
+		today := dateOnly(now.In(userLocation(user)))
+
+		for _, sub := range subs {
+			leads := sub.ReminderDays
+			if leads == nil {
+				leads = user.ReminderDays
+			}
+			if leads == nil {
+				leads = defaultReminderDays
+			}
+
+			if due, ok := nextOccurrence(sub.NextBillingDate, sub.BillingCycle, today); ok {
+				if r := pickReminder(user, ReminderUpcomingCharge, sub, due, today, leads); r != nil && !s.ledger.Sent(r.Key) {
+					r.Currency = user.HomeCurrency
+					reminders = append(reminders, r)
+				}
+			}
+
+			if sub.TrialEndDate != "" {
+				if due, err := time.Parse(dateLayout, sub.TrialEndDate); err == nil {
+					if r := pickReminder(user, ReminderTrialEnding, sub, due, today, leads); r != nil && !s.ledger.Sent(r.Key) {
+						r.Currency = user.HomeCurrency
+						reminders = append(reminders, r)
+					}
+				}
+			}
+		}
+	}
+
+	return reminders
+}
+
+// pickReminder returns the reminder for the closest lead time that has been
+// reached. If the server was down or the subscription was added late, only
+// the most relevant reminder fires instead of all the missed ones.
+func pickReminder(user *User, kind string, sub *Subscription, due, today time.Time, leads []int) *Reminder {
+	daysUntil := int(due.Sub(today).Hours() / 24)
+	if daysUntil < 0 {
+		return nil
+	}
+
+	sorted := append([]int(nil), leads...)
+	sort.Ints(sorted)
+
+	for _, lead := range sorted {
+		if lead < 0 || daysUntil > lead {
+			continue
+		}
+		return &Reminder{
+			Key:          reminderKey(user, kind, sub, due, lead),
+			UserID:       user.ID,
+			Kind:         kind,
+			Subscription: *sub,
+			DueDate:      due,
+			DaysBefore:   daysUntil,
+		}
+	}
+	return nil
+}
+
+// reminderKey identifies a reminder by what survives a restart: the account,
+// the subscription's name, the kind, the due date and the lead time
+func reminderKey(user *User, kind string, sub *Subscription, due time.Time, lead int) string {
+	name := strings.ToLower(strings.Join(strings.Fields(sub.Name), " "))
+	return fmt.Sprintf("%s:%s:%s:%s:%d", ledgerAccount(user), name, kind, due.Format(dateLayout), lead)
+}
+
+// nextOccurrence rolls a stale billing date forward by its cycle so that a
+// date that has already passed still produces the next charge. Each step is
+// counted from the original date, so a charge on the 31st stays at the end
+// of shorter months instead of drifting into the next one.
+func nextOccurrence(date, cycle string, today time.Time) (time.Time, bool) {
+	anchor, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if _, err := addCycles(anchor, cycle, 0); err != nil {
+		return time.Time{}, false
+	}
+
+	due := anchor
+	for i := 1; due.Before(today) && i <= 1000; i++ {
+		due = cycleDate(anchor, cycle, i)
+	}
+
+	return due, !due.Before(today)
+}
+
+// addCycles moves date by n billing cycles, n may be negative
+func addCycles(date time.Time, cycle string, n int) (time.Time, error) {
+	switch cycle {
+	case "weekly":
+		return date.AddDate(0, 0, 7*n), nil
+	case "monthly":
+		return date.AddDate(0, n, 0), nil
+	case "quarterly":
+		return date.AddDate(0, 3*n, 0), nil
+	case "yearly", "annual", "annually":
+		return date.AddDate(n, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown billing cycle %q", cycle)
+}
+
+func dateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// reminderNotification renders a reminder as a user-facing message
+func reminderNotification(r *Reminder) *Notification {
+	when := "today"
+	switch r.DaysBefore {
+	case 0:
+	case 1:
+		when = "tomorrow"
+	default:
+		when = fmt.Sprintf("in %d days", r.DaysBefore)
+	}
+
+	n := &Notification{
+		UserID: r.UserID,
+		Event:  r.Kind,
+	}
+
+	switch r.Kind {
+	case ReminderTrialEnding:
+		n.Title = fmt.Sprintf("%s trial ends %s", r.Subscription.Name, when)
+		n.Body = fmt.Sprintf("Your %s trial ends on %s. Cancel before then if you don't want to be charged.",
+			r.Subscription.Name, r.DueDate.Format(dateLayout))
+	default:
+		price := formatMoney(r.Subscription.Price, r.Currency)
+		n.Title = fmt.Sprintf("%s renews %s for %s", r.Subscription.Name, when, price)
+		n.Body = fmt.Sprintf("%s will charge %s on %s.",
+			r.Subscription.Name, price, r.DueDate.Format(dateLayout))
+	}
+
+	return n
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDispatcher keeps the notifications handed to it
+type recordingDispatcher struct {
+	mu   sync.Mutex
+	sent []*Notification
+}
+
+func (d *recordingDispatcher) Dispatch(ctx context.Context, n *Notification) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sent = append(d.sent, n)
+	return nil
+}
+
+// count returns how many notifications went to userID
+func (d *recordingDispatcher) count(userID string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, sent := range d.sent {
+		if sent.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+func TestNextOccurrence(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse(dateLayout, s)
+		return d
+	}
+
+	tests := []struct {
+		date, cycle, today string
+		want               string
+	}{
+		{"2026-01-31", "monthly", "2026-01-20", "2026-01-31"},
+		{"2026-01-31", "monthly", "2026-02-10", "2026-02-28"},
+		{"2026-01-31", "monthly", "2026-03-15", "2026-03-31"},
+		{"2026-01-31", "monthly", "2026-04-05", "2026-04-30"},
+		{"2025-11-30", "quarterly", "2026-03-01", "2026-05-30"},
+		{"2024-02-29", "yearly", "2025-01-01", "2025-02-28"},
+		{"2024-02-29", "annual", "2027-06-01", "2028-02-29"},
+		{"2026-03-02", "weekly", "2026-03-10", "2026-03-16"},
+	}
+	for _, tt := range tests {
+		got, ok := nextOccurrence(tt.date, tt.cycle, day(tt.today))
+		if !ok || got.Format(dateLayout) != tt.want {
+			t.Errorf("nextOccurrence(%s, %s, %s) = %s, %v, want %s", tt.date, tt.cycle, tt.today, got.Format(dateLayout), ok, tt.want)
+		}
+	}
+
+	if _, ok := nextOccurrence("2026-01-31", "fortnightly", day("2026-03-01")); ok {
+		t.Error("unknown cycle gave a date")
+	}
+	if _, ok := nextOccurrence("not a date", "monthly", day("2026-03-01")); ok {
+		t.Error("bad date gave a date")
+	}
+}
+
+func TestRescanKeepsReminderSettings(t *testing.T) {
+	user := testUser(t)
+	store.SaveSubscription(user.ID, &Subscription{ID: generateTempID(), Name: "Netflix", Price: 15.49, BillingCycle: "monthly"})
+	saved := store.GetSubscriptions(user.ID)[0]
+	store.UpdateSubscription(user.ID, saved.ID, func(sub *Subscription) {
+		sub.ReminderDays = []int{2}
+		sub.TrialEndDate = "2026-12-01"
+	})
+
+	// The next scan finds the same subscription under a fresh ID
+	store.SaveSubscription(user.ID, &Subscription{ID: generateTempID(), Name: "Netflix", Price: 15.49, BillingCycle: "monthly"})
+
+	got := store.GetSubscriptions(user.ID)
+	if len(got) != 1 {
+		t.Fatalf("%d subscriptions after rescan, want 1", len(got))
+	}
+	if got[0].ID != saved.ID || len(got[0].ReminderDays) != 1 || got[0].TrialEndDate != "2026-12-01" {
+		t.Errorf("rescan lost settings: %+v", got[0])
+	}
+}
+
+func TestReminderFiresOnceAcrossRescansAndRestarts(t *testing.T) {
+	user := testUser(t)
+	ledgerPath := filepath.Join(t.TempDir(), "reminders.jsonl")
+	now := time.Now()
+	due := dateOnly(now.In(userLocation(user))).AddDate(0, 0, 3).Format(dateLayout)
+
+	scan := func(name string) {
+		store.SaveSubscription(user.ID, &Subscription{
+			ID: generateTempID(), Name: name, Price: 10.99, BillingCycle: "monthly", NextBillingDate: due,
+		})
+	}
+	run := func() int {
+		ledger, err := OpenReminderLedger(ledgerPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dispatcher := &recordingDispatcher{}
+		NewReminderScheduler(ledger, dispatcher).RunOnce(context.Background(), now)
+		return dispatcher.count(user.ID)
+	}
+
+	scan("Spotify")
+	if got := run(); got != 1 {
+		t.Fatalf("first run sent %d reminders, want 1", got)
+	}
+	scan("Spotify")
+	if got := run(); got != 0 {
+		t.Errorf("run after rescan sent %d reminders, want 0", got)
+	}
+
+	// A restart loads the account and subscription again under new IDs
+	oldID := user.ID
+	store.DeleteUser(user.ID)
+	user = testUser(t)
+	if user.ID == oldID {
+		t.Fatal("user kept its ID")
+	}
+	scan("spotify ")
+	if got := run(); got != 0 {
+		t.Errorf("run after restart sent %d reminders, want 0", got)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+	authCodeTTL     = 60 * time.Second
+
+	sessionSweepPeriod = time.Hour
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token invalid or expired")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// RefreshToken is the server-side record of an opaque refresh token.
+// Tokens issued by rotating one another share a FamilyID.
+type RefreshToken struct {
+	Hash      string
+	UserID    string
+	FamilyID  string
+	ExpiresAt time.Time
+	UsedAt    time.Time
+	Revoked   bool
+}
+
+// AuthCode is a one-time code handed to the frontend after the login redirect
+type AuthCode struct {
+	Hash      string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+// SessionTokens is what a client gets after login or refresh
+type SessionTokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// issueSession creates an access token and starts a new refresh token family
+func issueSession(user *User) (*SessionTokens, error) {
+	return issueSessionInFamily(user, uuid.NewString())
+}
+
+func issueSessionInFamily(user *User, familyID string) (*SessionTokens, error) {
+	accessToken, err := generateJWT(user, familyID)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	store.SaveRefreshToken(&RefreshToken{
+		Hash:      hashToken(refreshToken),
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+
+	return &SessionTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// startSessionJanitor sweeps expired and spent refresh tokens
+func startSessionJanitor() {
+	ticker := time.NewTicker(sessionSweepPeriod)
+	go func() {
+		for range ticker.C {
+			if purged := store.PurgeExpiredSessions(time.Now()); purged > 0 {
+				fmt.Printf("🧹 Purged %d spent refresh tokens\n", purged)
+			}
+		}
+	}()
+}
+
+// redirectWithAuthCode sends the browser to the frontend with a one-time
+// code instead of putting the JWT in the URL
+func redirectWithAuthCode(c *gin.Context, user *User) {
+	authCode, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate code"})
+		return
+	}
+	store.SaveAuthCode(&AuthCode{
+		Hash:      hashToken(authCode),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(authCodeTTL),
+	})
+
+	// Redirect to frontend with code
+	frontendURL := os.Getenv("FRONTEND_URL")
+	if frontendURL == "" {
+		frontendURL = "http://localhost:3000"
+	}
+
+	// The login page at "/" exchanges the code and then opens /app
+	c.Redirect(http.StatusTemporaryRedirect,
+		fmt.Sprintf("%s/?auth_code=%s", frontendURL, authCode))
+}
+
+// Helper to hash opaque tokens before storing them
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RefreshSession rotates a refresh token and returns a new token pair
+func (s *AuthService) RefreshSession(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	old, err := store.UseRefreshToken(hashToken(req.RefreshToken))
+	if err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			fmt.Printf("⚠️  Refresh token reuse detected, family %s revoked\n", old.FamilyID)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	user := store.GetUser(old.UserID)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	tokens, err := issueSessionInFamily(user, old.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// Logout revokes the current access token and its refresh token family
+func (s *AuthService) Logout(c *gin.Context) {
+	var req LogoutRequest
+	c.ShouldBindJSON(&req)
+
+	if req.RefreshToken != "" {
+		store.RevokeRefreshFamily(hashToken(req.RefreshToken))
+	}
+
+	// Revoke the access token too if one was sent and is still valid
+	if claims, err := parseBearerToken(c); err == nil {
+		store.RevokeJTI(claims.ID, claims.ExpiresAt.Time)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Logged out",
+	})
+}
+
+// LogoutAll revokes every session of the signed-in user
+func (s *AuthService) LogoutAll(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	store.RevokeUserSessions(userID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Logged out of all sessions",
+	})
+}
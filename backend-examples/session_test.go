@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sessionRouter() *gin.Engine {
+	authService := &AuthService{}
+	r := gin.New()
+	r.POST("/refresh", authService.RefreshSession)
+	r.POST("/logout", authService.Logout)
+	r.GET("/me", AuthMiddleware(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetString("user_id")})
+	})
+	return r
+}
+
+func refresh(t *testing.T, r http.Handler, refreshToken string) (*SessionTokens, int) {
+	t.Helper()
+	w := serveJSON(r, http.MethodPost, "/refresh", RefreshRequest{RefreshToken: refreshToken}, "")
+	if w.Code != http.StatusOK {
+		return nil, w.Code
+	}
+	var tokens SessionTokens
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	return &tokens, w.Code
+}
+
+func TestRefreshRotation(t *testing.T) {
+	r := sessionRouter()
+	first, err := issueSession(testUser(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, code := refresh(t, r, first.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh = %d", code)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+	if w := serveJSON(r, http.MethodGet, "/me", nil, second.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("new access token = %d", w.Code)
+	}
+
+	third, code := refresh(t, r, second.RefreshToken)
+	if code != http.StatusOK || third == nil {
+		t.Fatalf("second refresh = %d", code)
+	}
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	r := sessionRouter()
+	first, _ := issueSession(testUser(t))
+	second, _ := refresh(t, r, first.RefreshToken)
+
+	// An attacker replays the first token
+	if _, code := refresh(t, r, first.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("reused token = %d, want 401", code)
+	}
+
+	// The legitimate holder's refresh token is gone too
+	if _, code := refresh(t, r, second.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after reuse = %d, want 401", code)
+	}
+
+	// And so are access tokens already minted from the family
+	for name, token := range map[string]string{"first": first.AccessToken, "second": second.AccessToken} {
+		if w := serveJSON(r, http.MethodGet, "/me", nil, token); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s access token after reuse = %d, want 401", name, w.Code)
+		}
+	}
+}
+
+func TestReuseLeavesOtherSessionsAlone(t *testing.T) {
+	r := sessionRouter()
+	user := testUser(t)
+	laptop, _ := issueSession(user)
+	phone, _ := issueSession(user)
+
+	refresh(t, r, laptop.RefreshToken)
+	refresh(t, r, laptop.RefreshToken)
+
+	if w := serveJSON(r, http.MethodGet, "/me", nil, phone.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("other session access token = %d", w.Code)
+	}
+	if _, code := refresh(t, r, phone.RefreshToken); code != http.StatusOK {
+		t.Errorf("other session refresh = %d", code)
+	}
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	r := sessionRouter()
+	tokens, _ := issueSession(testUser(t))
+
+	if w := serveJSON(r, http.MethodPost, "/logout", LogoutRequest{RefreshToken: tokens.RefreshToken}, tokens.AccessToken); w.Code != http.StatusOK {
+		t.Fatalf("logout = %d", w.Code)
+	}
+	if w := serveJSON(r, http.MethodGet, "/me", nil, tokens.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("access token after logout = %d", w.Code)
+	}
+	if _, code := refresh(t, r, tokens.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout = %d", code)
+	}
+}
+
+func TestPurgeExpiredSessions(t *testing.T) {
+	r := sessionRouter()
+	user := testUser(t)
+
+	// A finished session: its only token was rotated and the successor used too
+	ended, _ := issueSession(user)
+	next, _ := refresh(t, r, ended.RefreshToken)
+	active, _ := issueSession(user)
+
+	// Pretend the successor's successor expired unused
+	last, _ := refresh(t, r, next.RefreshToken)
+	store.mu.Lock()
+	store.refreshTokens[hashToken(last.RefreshToken)].ExpiresAt = time.Now().Add(-time.Minute)
+	store.mu.Unlock()
+
+	store.PurgeExpiredSessions(time.Now())
+
+	store.mu.RLock()
+	_, endedKept := store.refreshTokens[hashToken(ended.RefreshToken)]
+	_, activeKept := store.refreshTokens[hashToken(active.RefreshToken)]
+	store.mu.RUnlock()
+	if endedKept {
+		t.Error("used token of an ended session was kept")
+	}
+	if !activeKept {
+		t.Error("live token was purged")
+	}
+
+	// A used token stays while its family is live, so reuse is still caught
+	live, _ := issueSession(user)
+	refresh(t, r, live.RefreshToken)
+	store.PurgeExpiredSessions(time.Now())
+	if _, code := refresh(t, r, live.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("reuse after purge = %d", code)
+	}
+}
+
+func TestRevokedFamilyExpires(t *testing.T) {
+	store.mu.Lock()
+	store.revokedFamily["old-family"] = time.Now().Add(-time.Second)
+	store.mu.Unlock()
+
+	store.PurgeExpiredSessions(time.Now())
+	if store.IsSessionRevoked("old-family") {
+		t.Error("expired family revocation was kept")
+	}
+	if store.IsSessionRevoked("") {
+		t.Error("tokens without a session were treated as revoked")
+	}
+}
+
+func TestRedirectWithAuthCodeOpensLoginPage(t *testing.T) {
+	t.Setenv("FRONTEND_URL", "https://subtrack.example")
+	user := testUser(t)
+
+	r := gin.New()
+	r.GET("/callback", func(c *gin.Context) { redirectWithAuthCode(c, user) })
+	w := serveJSON(r, http.MethodGet, "/callback", nil, "")
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Login.tsx, mounted at "/", is what exchanges the code
+	if location.Path != "/" {
+		t.Errorf("redirect path = %q, want /", location.Path)
+	}
+	code := location.Query().Get("auth_code")
+	if code == "" {
+		t.Fatal("no auth_code in redirect")
+	}
+
+	exchange := gin.New()
+	exchange.POST("/exchange", (&AuthService{}).ExchangeAuthCode)
+	if w := serveJSON(exchange, http.MethodPost, "/exchange", gin.H{"code": code}, ""); w.Code != http.StatusOK {
+		t.Errorf("exchange = %d %s", w.Code, w.Body.String())
+	}
+	if w := serveJSON(exchange, http.MethodPost, "/exchange", gin.H{"code": code}, ""); w.Code == http.StatusOK {
+		t.Error("auth code accepted twice")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	devJWTSecret = "your-secret-key-change-this-in-production"
+
+	// HS256 secrets shorter than the hash output are easy to brute force
+	minJWTSecretLength = 32
+)
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type verificationKey struct {
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+// KeyManager signs our JWTs with the active key and verifies them with
+// any key still in rotation
+type KeyManager struct {
+	kid        string
+	method     jwt.SigningMethod
+	signingKey interface{}
+	verifyKeys map[string]verificationKey
+	jwks       []JWK
+}
+
+var tokenKeys *KeyManager
+
+// LoadKeyManager reads signing keys from the environment:
+//
+//	JWT_SIGNING_KEY_FILE    PEM private key (RSA or Ed25519) used to sign
+//	JWT_SIGNING_KEY_ID      kid for the signing key (default: key thumbprint)
+//	JWT_VERIFICATION_KEYS   extra keys during rotation, "kid=path.pem,..."
+//	JWT_SECRET              HS256 secret when no key file is configured
+//
+// Outside APP_ENV=development one of JWT_SIGNING_KEY_FILE or JWT_SECRET is required.
+func LoadKeyManager() (*KeyManager, error) {
+	km := &KeyManager{verifyKeys: make(map[string]verificationKey)}
+
+	if path := os.Getenv("JWT_SIGNING_KEY_FILE"); path != "" {
+		signer, err := readPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY_FILE: %w", err)
+		}
+
+		method, err := signingMethodFor(signer.Public())
+		if err != nil {
+			return nil, err
+		}
+
+		kid := os.Getenv("JWT_SIGNING_KEY_ID")
+		if kid == "" {
+			kid, err = keyThumbprint(signer.Public())
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		km.kid = kid
+		km.method = method
+		km.signingKey = signer
+		if err := km.addVerificationKey(kid, signer.Public()); err != nil {
+			return nil, err
+		}
+	} else {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			if !isDevMode() {
+				return nil, errors.New("no JWT signing key configured: set JWT_SIGNING_KEY_FILE or JWT_SECRET")
+			}
+			log.Printf("⚠️  Using development JWT secret, do not use in production")
+			secret = devJWTSecret
+		} else if !isDevMode() {
+			if secret == devJWTSecret {
+				return nil, errors.New("JWT_SECRET is the development secret: set a random secret or JWT_SIGNING_KEY_FILE")
+			}
+			if len(secret) < minJWTSecretLength {
+				return nil, fmt.Errorf("JWT_SECRET must be at least %d characters", minJWTSecretLength)
+			}
+		}
+
+		km.kid = "hs256"
+		km.method = jwt.SigningMethodHS256
+		km.signingKey = []byte(secret)
+		km.verifyKeys[km.kid] = verificationKey{method: km.method, key: []byte(secret)}
+	}
+
+	// Keys that are being rotated out (or in) stay valid for verification
+	for _, entry := range strings.Split(os.Getenv("JWT_VERIFICATION_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kid, path, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || path == "" {
+			return nil, fmt.Errorf("JWT_VERIFICATION_KEYS: invalid entry %q", entry)
+		}
+
+		public, err := readPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_VERIFICATION_KEYS %s: %w", kid, err)
+		}
+		if err := km.addVerificationKey(kid, public); err != nil {
+			return nil, err
+		}
+	}
+
+	return km, nil
+}
+
+func isDevMode() bool {
+	env := os.Getenv("APP_ENV")
+	return env == "development" || env == "dev"
+}
+
+func (km *KeyManager) addVerificationKey(kid string, public crypto.PublicKey) error {
+	method, err := signingMethodFor(public)
+	if err != nil {
+		return err
+	}
+	if _, exists := km.verifyKeys[kid]; exists {
+		return fmt.Errorf("duplicate key id %q", kid)
+	}
+
+	jwk, err := publicJWK(kid, method, public)
+	if err != nil {
+		return err
+	}
+
+	km.verifyKeys[kid] = verificationKey{method: method, key: public}
+	km.jwks = append(km.jwks, jwk)
+	return nil
+}
+
+// Sign creates a signed token with the active key and its kid
+func (km *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(km.method, claims)
+	token.Header["kid"] = km.kid
+	return token.SignedString(km.signingKey)
+}
+
+// Keyfunc picks the verification key by kid and checks the algorithm matches it
+func (km *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	vk, ok := km.verifyKeys[kid]
+	if !ok {
+		return nil, errUnknownKeyID
+	}
+	if token.Method.Alg() != vk.method.Alg() {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return vk.key, nil
+}
+
+// ValidMethods lists the algorithms we accept
+func (km *KeyManager) ValidMethods() []string {
+	seen := make(map[string]bool)
+	var methods []string
+	for _, vk := range km.verifyKeys {
+		if alg := vk.method.Alg(); !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+// JWKS serves the public verification keys
+func (km *KeyManager) JWKS(c *gin.Context) {
+	keys := km.jwks
+	if keys == nil {
+		keys = []JWK{}
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func signingMethodFor(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+}
+
+func publicJWK(kid string, method jwt.SigningMethod, public crypto.PublicKey) (JWK, error) {
+	jwk := JWK{Kid: kid, Use: "sig", Alg: method.Alg()}
+
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	return jwk, nil
+}
+
+// keyThumbprint derives a stable kid from the public key
+func keyThumbprint(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// readPublicKey accepts a public key or a private key (whose public half is used)
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		signer, err := readPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return signer.Public(), nil
+	}
+}
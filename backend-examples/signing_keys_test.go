@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestLoadKeyManagerSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		secret  string
+		wantErr bool
+	}{
+		{name: "random secret", secret: "test-secret-that-is-long-enough-for-hs256"},
+		{name: "no secret", wantErr: true},
+		{name: "development secret", secret: devJWTSecret, wantErr: true},
+		{name: "short secret", secret: "changeme", wantErr: true},
+		{name: "no secret in development", env: "development"},
+		{name: "short secret in development", env: "dev", secret: "changeme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("APP_ENV", tt.env)
+			t.Setenv("JWT_SIGNING_KEY_FILE", "")
+			t.Setenv("JWT_SECRET", tt.secret)
+
+			_, err := LoadKeyManager()
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("LoadKeyManager: %v", err)
+			}
+		})
+	}
+}
+
+// writeKey stores key as a PKCS#8 PEM file in dir
+func writeKey(t *testing.T, dir, name string, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadKeys builds a KeyManager from a signing key file and rotation keys
+func loadKeys(t *testing.T, signingKey, kid, verificationKeys string) *KeyManager {
+	t.Helper()
+	t.Setenv("APP_ENV", "")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_SIGNING_KEY_FILE", signingKey)
+	t.Setenv("JWT_SIGNING_KEY_ID", kid)
+	t.Setenv("JWT_VERIFICATION_KEYS", verificationKeys)
+	km, err := LoadKeyManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return km
+}
+
+func signTestToken(t *testing.T, km *KeyManager) string {
+	t.Helper()
+	token, err := km.Sign(&jwt.RegisteredClaims{Subject: "user-1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func verifyTestToken(km *KeyManager, token string) error {
+	_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, km.Keyfunc, jwt.WithValidMethods(km.ValidMethods()))
+	return err
+}
+
+func TestLoadKeyManagerKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, tt := range []struct {
+		name string
+		key  crypto.Signer
+		alg  string
+	}{
+		{"rsa", rsaKey, "RS256"},
+		{"ed25519", edKey, "EdDSA"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			km := loadKeys(t, writeKey(t, dir, tt.name, tt.key), "", "")
+			thumbprint, _ := keyThumbprint(tt.key.Public())
+
+			token := signTestToken(t, km)
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Method.Alg() != tt.alg || parsed.Header["kid"] != thumbprint {
+				t.Errorf("header = %v, want %s with kid %s", parsed.Header, tt.alg, thumbprint)
+			}
+			if err := verifyTestToken(km, token); err != nil {
+				t.Errorf("own token: %v", err)
+			}
+		})
+	}
+
+	km := loadKeys(t, writeKey(t, dir, "named", edKey), "2026-10", "")
+	parsed, _, _ := jwt.NewParser().ParseUnverified(signTestToken(t, km), &jwt.RegisteredClaims{})
+	if parsed.Header["kid"] != "2026-10" {
+		t.Errorf("kid = %v, want JWT_SIGNING_KEY_ID", parsed.Header["kid"])
+	}
+
+	for name, verificationKeys := range map[string]string{
+		"no path":   "old",
+		"duplicate": "2026-10=" + filepath.Join(dir, "rsa.pem"),
+		"missing":   "old=" + filepath.Join(dir, "missing.pem"),
+	} {
+		t.Setenv("JWT_VERIFICATION_KEYS", verificationKeys)
+		if _, err := LoadKeyManager(); err == nil {
+			t.Errorf("%s: verification keys accepted", name)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	oldPath, newPath := writeKey(t, dir, "old", oldKey), writeKey(t, dir, "new", newKey)
+
+	// Only the public half of the old key is left on the servers
+	der, _ := x509.MarshalPKIXPublicKey(oldKey.Public())
+	oldPublic := filepath.Join(dir, "old.pub.pem")
+	os.WriteFile(oldPublic, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+
+	oldToken := signTestToken(t, loadKeys(t, oldPath, "old", ""))
+
+	rotating := loadKeys(t, newPath, "new", "old="+oldPublic)
+	if err := verifyTestToken(rotating, oldToken); err != nil {
+		t.Errorf("old token during rotation: %v", err)
+	}
+	if err := verifyTestToken(rotating, signTestToken(t, rotating)); err != nil {
+		t.Errorf("new token: %v", err)
+	}
+	if methods := strings.Join(rotating.ValidMethods(), ","); !strings.Contains(methods, "RS256") || !strings.Contains(methods, "EdDSA") {
+		t.Errorf("valid methods = %s", methods)
+	}
+
+	rotated := loadKeys(t, newPath, "new", "")
+	if err := verifyTestToken(rotated, oldToken); err == nil {
+		t.Error("old token accepted after rotation")
+	}
+}
+
+func TestKeyfuncChecksAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	km := loadKeys(t, writeKey(t, dir, "rsa", rsaKey), "rsa", "ed="+writeKey(t, dir, "ed", edKey))
+	claims := &jwt.RegisteredClaims{Subject: "user-1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}
+
+	forge := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	// HS256 keyed with the published RSA key
+	der, _ := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := verifyTestToken(km, forge(jwt.SigningMethodHS256, "rsa", public)); err == nil {
+		t.Error("HS256 token signed with the public key accepted")
+	}
+
+	// A real key, but under the kid of the other algorithm
+	if err := verifyTestToken(km, forge(jwt.SigningMethodEdDSA, "rsa", edKey)); err == nil {
+		t.Error("EdDSA token under the RSA kid accepted")
+	}
+	if err := verifyTestToken(km, forge(jwt.SigningMethodRS256, "ed", rsaKey)); err == nil {
+		t.Error("RS256 token under the Ed25519 kid accepted")
+	}
+	if err := verifyTestToken(km, forge(jwt.SigningMethodEdDSA, "ed", edKey)); err != nil {
+		t.Errorf("matching kid and algorithm: %v", err)
+	}
+	if err := verifyTestToken(km, forge(jwt.SigningMethodRS256, "", rsaKey)); !errors.Is(err, errUnknownKeyID) {
+		t.Errorf("no kid err = %v, want errUnknownKeyID", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	km := loadKeys(t, writeKey(t, dir, "rsa", rsaKey), "rsa", "ed="+writeKey(t, dir, "ed", edKey))
+
+	r := gin.New()
+	r.GET("/.well-known/jwks.json", km.JWKS)
+	w := serveJSON(r, http.MethodGet, "/.well-known/jwks.json", nil, "")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, max-age=300" {
+		t.Fatalf("jwks = %d, cache %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	if strings.Contains(w.Body.String(), `"d"`) {
+		t.Fatalf("private key material in %s", w.Body.String())
+	}
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &jwks)
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("keys = %+v", jwks.Keys)
+	}
+
+	rsaJWK, edJWK := jwks.Keys[0], jwks.Keys[1]
+	n, _ := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	e, _ := base64.RawURLEncoding.DecodeString(rsaJWK.E)
+	if rsaJWK.Kid != "rsa" || rsaJWK.Kty != "RSA" || rsaJWK.Alg != "RS256" || rsaJWK.Use != "sig" ||
+		new(big.Int).SetBytes(n).Cmp(rsaKey.N) != 0 || new(big.Int).SetBytes(e).Int64() != int64(rsaKey.E) {
+		t.Errorf("rsa jwk = %+v", rsaJWK)
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(edJWK.X)
+	if edJWK.Kid != "ed" || edJWK.Kty != "OKP" || edJWK.Crv != "Ed25519" || edJWK.Alg != "EdDSA" ||
+		!bytes.Equal(x, edKey.Public().(ed25519.PublicKey)) {
+		t.Errorf("ed25519 jwk = %+v", edJWK)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SPF results (RFC 7208 section 2.6)
+const (
+	spfPass      = "pass"
+	spfFail      = "fail"
+	spfSoftFail  = "softfail"
+	spfNeutral   = "neutral"
+	spfNone      = "none"
+	spfTempError = "temperror"
+	spfPermError = "permerror"
+)
+
+const (
+	maxSPFLookups = 10 // DNS-querying mechanisms and redirects a check may use
+	spfTimeout    = 20 * time.Second
+)
+
+// spfResolver is the part of net.Resolver an SPF check needs
+type spfResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+type spfCheck struct {
+	ctx      context.Context
+	resolver spfResolver
+	ip       net.IP
+	lookups  int
+}
+
+// checkSPF reports whether ip may send mail for the domain of sender. Macros
+// and ptr aren't supported: a record using macros is a permerror and ptr
+// never matches.
+func checkSPF(ctx context.Context, resolver spfResolver, ip net.IP, sender string) string {
+	_, domain, ok := strings.Cut(sender, "@")
+	if !ok || domain == "" {
+		return spfNone
+	}
+	ctx, cancel := context.WithTimeout(ctx, spfTimeout)
+	defer cancel()
+	check := &spfCheck{ctx: ctx, resolver: resolver, ip: ip}
+	return check.evaluate(strings.ToLower(domain))
+}
+
+func (c *spfCheck) evaluate(domain string) string {
+	record, result := c.record(domain)
+	if result != "" {
+		return result
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		name := term
+		if i := strings.IndexAny(term, ":/"); i >= 0 {
+			name = term[:i]
+		}
+		if key, value, ok := strings.Cut(name, "="); ok {
+			// Modifiers: only redirect changes the result
+			if strings.EqualFold(key, "redirect") {
+				redirect = value + term[len(name):]
+			}
+			continue
+		}
+
+		qualifier := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = spfFail, term[1:]
+		case '~':
+			qualifier, term = spfSoftFail, term[1:]
+		case '?':
+			qualifier, term = spfNeutral, term[1:]
+		}
+
+		matched, result := c.match(term, domain)
+		if result != "" {
+			return result
+		}
+		if matched {
+			return qualifier
+		}
+	}
+
+	if redirect == "" {
+		return spfNeutral
+	}
+	if !c.lookup() || strings.Contains(redirect, "%") {
+		return spfPermError
+	}
+	if result := c.evaluate(strings.ToLower(redirect)); result != spfNone {
+		return result
+	}
+	return spfPermError
+}
+
+// record returns the domain's single "v=spf1" record, or the result to use
+// when there isn't one
+func (c *spfCheck) record(domain string) (string, string) {
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if notFound(err) {
+			return "", spfNone
+		}
+		return "", spfTempError
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", spfNone
+	case 1:
+		return records[0], ""
+	}
+	return "", spfPermError
+}
+
+// match checks one mechanism, returning a result instead when the check
+// can't continue
+func (c *spfCheck) match(term, domain string) (bool, string) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	if strings.Contains(arg, "%") {
+		return false, spfPermError
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, spfPermError
+		}
+		return true, ""
+	case "ip4", "ip6":
+		network, ok := parseSPFNetwork(strings.TrimPrefix(arg, ":"), strings.EqualFold(name, "ip4"))
+		if !ok {
+			return false, spfPermError
+		}
+		return network.Contains(c.ip), ""
+	case "a", "mx":
+		target, v4, v6, ok := spfTarget(arg, domain)
+		if !ok || !c.lookup() {
+			return false, spfPermError
+		}
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := c.resolver.LookupMX(c.ctx, target)
+			if err != nil && !notFound(err) {
+				return false, spfTempError
+			}
+			if len(mxs) > maxSPFLookups {
+				return false, spfPermError
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+			if err != nil && !notFound(err) {
+				return false, spfTempError
+			}
+			for _, addr := range addrs {
+				if sameNetwork(addr.IP, c.ip, v4, v6) {
+					return true, ""
+				}
+			}
+		}
+		return false, ""
+	case "include":
+		if !strings.HasPrefix(arg, ":") || !c.lookup() {
+			return false, spfPermError
+		}
+		switch result := c.evaluate(strings.ToLower(arg[1:])); result {
+		case spfPass:
+			return true, ""
+		case spfFail, spfSoftFail, spfNeutral:
+			return false, ""
+		case spfTempError:
+			return false, spfTempError
+		}
+		return false, spfPermError
+	case "exists":
+		if !strings.HasPrefix(arg, ":") || !c.lookup() {
+			return false, spfPermError
+		}
+		addrs, err := c.resolver.LookupIPAddr(c.ctx, arg[1:])
+		if err != nil && !notFound(err) {
+			return false, spfTempError
+		}
+		return len(addrs) > 0, ""
+	case "ptr":
+		if !c.lookup() {
+			return false, spfPermError
+		}
+		return false, ""
+	}
+	return false, spfPermError
+}
+
+// lookup counts one DNS-querying term against the limit
+func (c *spfCheck) lookup() bool {
+	c.lookups++
+	return c.lookups <= maxSPFLookups
+}
+
+// spfTarget parses the ":domain/cidr4//cidr6" of an a or mx mechanism
+func spfTarget(arg, domain string) (string, int, int, bool) {
+	target, v4, v6 := domain, 32, 128
+	spec, cidr, _ := strings.Cut(arg, "/")
+	if spec != "" {
+		if spec == ":" || spec[0] != ':' {
+			return "", 0, 0, false
+		}
+		target = strings.ToLower(spec[1:])
+	}
+	if cidr == "" {
+		if strings.HasSuffix(arg, "/") {
+			return "", 0, 0, false
+		}
+		return target, v4, v6, true
+	}
+
+	four, six, dual := strings.Cut(cidr, "//")
+	if strings.HasPrefix(cidr, "/") {
+		four, six, dual = "", cidr[1:], true
+	}
+	var err error
+	if four != "" {
+		if v4, err = strconv.Atoi(four); err != nil || v4 < 0 || v4 > 32 {
+			return "", 0, 0, false
+		}
+	}
+	if dual {
+		if v6, err = strconv.Atoi(six); err != nil || v6 < 0 || v6 > 128 {
+			return "", 0, 0, false
+		}
+	}
+	return target, v4, v6, true
+}
+
+func parseSPFNetwork(value string, v4 bool) (*net.IPNet, bool) {
+	if !strings.Contains(value, "/") {
+		if v4 {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil || (network.IP.To4() != nil) != v4 {
+		return nil, false
+	}
+	return network, true
+}
+
+// sameNetwork reports whether ip is within the v4 or v6 prefix of addr
+func sameNetwork(addr, ip net.IP, v4, v6 int) bool {
+	if addr4, ip4 := addr.To4(), ip.To4(); addr4 != nil || ip4 != nil {
+		if addr4 == nil || ip4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(v4, 32)
+		return addr4.Mask(mask).Equal(ip4.Mask(mask))
+	}
+	mask := net.CIDRMask(v6, 128)
+	return addr.Mask(mask).Equal(ip.Mask(mask))
+}
+
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeDNS answers SPF lookups from maps; missing names are NXDOMAIN
+type fakeDNS struct {
+	txt     map[string][]string
+	ips     map[string][]string
+	mx      map[string][]string
+	failing map[string]bool
+}
+
+func (d *fakeDNS) answer(name string) error {
+	if d.failing[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (d *fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := d.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, d.answer(name)
+}
+
+func (d *fakeDNS) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	values, ok := d.ips[host]
+	if !ok {
+		return nil, d.answer(host)
+	}
+	addrs := make([]net.IPAddr, 0, len(values))
+	for _, value := range values {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(value)})
+	}
+	return addrs, nil
+}
+
+func (d *fakeDNS) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := d.mx[name]
+	if !ok {
+		return nil, d.answer(name)
+	}
+	mxs := make([]*net.MX, 0, len(hosts))
+	for _, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host})
+	}
+	return mxs, nil
+}
+
+func TestCheckSPF(t *testing.T) {
+	dns := &fakeDNS{
+		txt: map[string][]string{
+			"mail.example":      {"google-site-verification=abc", "v=spf1 include:_spf.mail.example mx a:out.mail.example/28 -all"},
+			"_spf.mail.example": {"v=spf1 ip4:203.0.113.0/24 ip6:2001:db8::/32 ~all"},
+			"soft.example":      {"v=spf1 ~all"},
+			"redirect.example":  {"v=spf1 redirect=_spf.mail.example"},
+			"two.example":       {"v=spf1 -all", "v=spf1 +all"},
+			"macro.example":     {"v=spf1 exists:%{i}.spf.macro.example -all"},
+			"loop.example":      {"v=spf1 include:loop.example -all"},
+			"broken.example":    {"v=spf1 include:down.example -all"},
+		},
+		ips: map[string][]string{
+			"mx1.mail.example": {"198.51.100.7"},
+			"out.mail.example": {"192.0.2.16"},
+		},
+		mx:      map[string][]string{"mail.example": {"mx1.mail.example"}},
+		failing: map[string]bool{"down.example": true},
+	}
+
+	tests := []struct {
+		ip     string
+		sender string
+		want   string
+	}{
+		{"203.0.113.9", "alice@mail.example", spfPass},
+		{"2001:db8::25", "alice@mail.example", spfPass},
+		{"198.51.100.7", "alice@mail.example", spfPass},
+		{"192.0.2.30", "alice@mail.example", spfPass},
+		{"192.0.2.40", "alice@mail.example", spfFail},
+		{"192.0.2.40", "alice@soft.example", spfSoftFail},
+		{"203.0.113.9", "alice@redirect.example", spfPass},
+		{"192.0.2.40", "alice@redirect.example", spfSoftFail},
+		{"192.0.2.40", "alice@none.example", spfNone},
+		{"192.0.2.40", "alice@two.example", spfPermError},
+		{"192.0.2.40", "alice@macro.example", spfPermError},
+		{"192.0.2.40", "alice@loop.example", spfPermError},
+		{"192.0.2.40", "alice@broken.example", spfTempError},
+		{"192.0.2.40", "", spfNone},
+	}
+	for _, tt := range tests {
+		if got := checkSPF(context.Background(), dns, net.ParseIP(tt.ip), tt.sender); got != tt.want {
+			t.Errorf("checkSPF(%s, %q) = %s, want %s", tt.ip, tt.sender, got, tt.want)
+		}
+	}
+}
+
+func TestSPFTarget(t *testing.T) {
+	tests := []struct {
+		arg    string
+		target string
+		v4, v6 int
+		ok     bool
+	}{
+		{"", "example.com", 32, 128, true},
+		{":other.example", "other.example", 32, 128, true},
+		{"/24", "example.com", 24, 128, true},
+		{"//64", "example.com", 32, 64, true},
+		{":other.example/28//48", "other.example", 28, 48, true},
+		{"/33", "", 0, 0, false},
+		{":", "", 0, 0, false},
+		{"/", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		target, v4, v6, ok := spfTarget(tt.arg, "example.com")
+		if target != tt.target || v4 != tt.v4 || v6 != tt.v6 || ok != tt.ok {
+			t.Errorf("spfTarget(%q) = %s %d %d %v", tt.arg, target, v4, v6, ok)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	if !notFound(&net.DNSError{IsNotFound: true}) || notFound(&net.DNSError{IsTemporary: true}) || notFound(errors.New("x")) {
+		t.Error("notFound misclassified an error")
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var statementTimeSuffix = regexp.MustCompile(`[ T]\d{1,2}:\d{2}(:\d{2})?.*$`)
+
+const (
+	FormatCSV = "csv"
+	FormatOFX = "ofx"
+	FormatQIF = "qif"
+)
+
+// ParsedTransaction is a statement line before it is stored
+type ParsedTransaction struct {
+	Date        time.Time
+	Description string
+	Amount      float64 // negative for money out
+	Currency    string  // empty means the import's currency
+	Reference   string  // bank's transaction ID when the format has one
+}
+
+// CSVProfile maps a bank's CSV export to transactions. Each column is a list
+// of header names to look for, compared case-insensitively.
+type CSVProfile struct {
+	Name         string   `json:"name"`
+	Label        string   `json:"label"`
+	Date         []string `json:"date"`
+	Description  []string `json:"description"`
+	Amount       []string `json:"amount,omitempty"` // signed amount
+	Debit        []string `json:"debit,omitempty"`  // money out, positive
+	Credit       []string `json:"credit,omitempty"` // money in, positive
+	DateLayouts  []string `json:"dateLayouts"`
+	BuddhistEra  bool     `json:"buddhistEra,omitempty"` // years like 2567 are BE
+	InvertAmount bool     `json:"invertAmount,omitempty"`
+}
+
+// Thai banks export in Thai or English depending on the app language
+var thaiDateHeaders = []string{"วันที่", "วันที่ทำรายการ", "date", "transaction date", "trans. date"}
+var thaiDescriptionHeaders = []string{"รายละเอียด", "รายการ", "details", "description", "transaction", "channel"}
+var thaiDebitHeaders = []string{"ถอนเงิน", "เงินออก", "withdrawal", "withdrawals", "debit"}
+var thaiCreditHeaders = []string{"ฝากเงิน", "เงินเข้า", "deposit", "deposits", "credit"}
+var thaiDateLayouts = []string{"02/01/2006", "2/1/2006", "02/01/06", "2/1/06", "02-01-2006", "2006-01-02"}
+
+var csvProfiles = map[string]*CSVProfile{
+	"generic": {
+		Name:        "generic",
+		Label:       "Generic (Date, Description, Amount)",
+		Date:        []string{"date", "transaction date", "posting date", "posted date", "booking date"},
+		Description: []string{"description", "details", "payee", "memo", "narrative", "name"},
+		Amount:      []string{"amount", "transaction amount"},
+		Debit:       []string{"debit", "withdrawal", "money out", "paid out"},
+		Credit:      []string{"credit", "deposit", "money in", "paid in"},
+		DateLayouts: []string{"2006-01-02", "01/02/2006", "1/2/2006", "01/02/06", "2006/01/02", "02 Jan 2006"},
+	},
+	"generic-dmy": {
+		Name:        "generic-dmy",
+		Label:       "Generic, day before month (31/12/2026)",
+		Date:        []string{"date", "transaction date", "posting date", "posted date", "booking date"},
+		Description: []string{"description", "details", "payee", "memo", "narrative", "name"},
+		Amount:      []string{"amount", "transaction amount"},
+		Debit:       []string{"debit", "withdrawal", "money out", "paid out"},
+		Credit:      []string{"credit", "deposit", "money in", "paid in"},
+		DateLayouts: []string{"2006-01-02", "02/01/2006", "2/1/2006", "02/01/06", "02.01.2006", "02 Jan 2006"},
+	},
+	"chase": {
+		Name:        "chase",
+		Label:       "Chase",
+		Date:        []string{"transaction date", "posting date"},
+		Description: []string{"description"},
+		Amount:      []string{"amount"},
+		DateLayouts: []string{"01/02/2006"},
+	},
+	"amex": {
+		Name:        "amex",
+		Label:       "American Express",
+		Date:        []string{"date"},
+		Description: []string{"description"},
+		Amount:      []string{"amount"},
+		DateLayouts: []string{"01/02/2006", "01/02/06"},
+		// Amex shows charges as positive
+		InvertAmount: true,
+	},
+	"kbank": {
+		Name:        "kbank",
+		Label:       "Kasikorn Bank (KBank)",
+		Date:        thaiDateHeaders,
+		Description: thaiDescriptionHeaders,
+		Debit:       thaiDebitHeaders,
+		Credit:      thaiCreditHeaders,
+		DateLayouts: thaiDateLayouts,
+		BuddhistEra: true,
+	},
+	"scb": {
+		Name:        "scb",
+		Label:       "Siam Commercial Bank (SCB)",
+		Date:        thaiDateHeaders,
+		Description: append([]string{"คำอธิบาย"}, thaiDescriptionHeaders...),
+		Debit:       thaiDebitHeaders,
+		Credit:      thaiCreditHeaders,
+		DateLayouts: thaiDateLayouts,
+		BuddhistEra: true,
+	},
+	"bbl": {
+		Name:        "bbl",
+		Label:       "Bangkok Bank (BBL)",
+		Date:        thaiDateHeaders,
+		Description: thaiDescriptionHeaders,
+		Debit:       thaiDebitHeaders,
+		Credit:      thaiCreditHeaders,
+		DateLayouts: thaiDateLayouts,
+		BuddhistEra: true,
+	},
+	"ktb": {
+		Name:        "ktb",
+		Label:       "Krungthai Bank (KTB)",
+		Date:        thaiDateHeaders,
+		Description: thaiDescriptionHeaders,
+		Amount:      []string{"จำนวนเงิน", "amount"},
+		Debit:       thaiDebitHeaders,
+		Credit:      thaiCreditHeaders,
+		DateLayouts: thaiDateLayouts,
+		BuddhistEra: true,
+	},
+}
+
+// detectStatementFormat guesses the format from the file name, then content
+func detectStatementFormat(fileName string, data []byte) string {
+	lower := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(lower, ".ofx"), strings.HasSuffix(lower, ".qfx"):
+		return FormatOFX
+	case strings.HasSuffix(lower, ".qif"):
+		return FormatQIF
+	case strings.HasSuffix(lower, ".csv"):
+		return FormatCSV
+	}
+
+	head := strings.ToUpper(string(data[:min(len(data), 512)]))
+	switch {
+	case strings.Contains(head, "OFXHEADER") || strings.Contains(head, "<OFX>"):
+		return FormatOFX
+	case strings.HasPrefix(strings.TrimSpace(head), "!TYPE:"):
+		return FormatQIF
+	}
+	return FormatCSV
+}
+
+// parseCSVStatement reads a CSV export. Banks often put account details above
+// the header row, so the header is the first row that has the profile's date
+// column and an amount column.
+func parseCSVStatement(data []byte, profile *CSVProfile) ([]ParsedTransaction, int, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		return nil, 0, errors.New("file is not UTF-8, export it as UTF-8 CSV")
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if firstLine, _, _ := bufio.NewReader(bytes.NewReader(data)).ReadLine(); bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid CSV: %w", err)
+	}
+
+	header := -1
+	var dateCol, descCol, amountCol, debitCol, creditCol int
+	for i := 0; i < len(rows) && i < 30; i++ {
+		dateCol = findColumn(rows[i], profile.Date)
+		amountCol = findColumn(rows[i], profile.Amount)
+		debitCol = findColumn(rows[i], profile.Debit)
+		creditCol = findColumn(rows[i], profile.Credit)
+		if dateCol >= 0 && (amountCol >= 0 || debitCol >= 0 || creditCol >= 0) {
+			descCol = findColumn(rows[i], profile.Description)
+			header = i
+			break
+		}
+	}
+	if header < 0 {
+		return nil, 0, fmt.Errorf("no header row matching the %s profile", profile.Name)
+	}
+
+	var txns []ParsedTransaction
+	skipped := 0
+	for _, row := range rows[header+1:] {
+		date, err := parseStatementDate(cell(row, dateCol), profile.DateLayouts, profile.BuddhistEra)
+		if err != nil {
+			// Totals and footer lines don't have a date
+			skipped++
+			continue
+		}
+
+		var amount float64
+		var ok bool
+		if amountCol >= 0 && cell(row, amountCol) != "" {
+			amount, ok = parseStatementAmount(cell(row, amountCol))
+		} else {
+			debit, hasDebit := parseStatementAmount(cell(row, debitCol))
+			credit, hasCredit := parseStatementAmount(cell(row, creditCol))
+			amount, ok = credit-abs(debit), hasDebit || hasCredit
+		}
+		if !ok || amount == 0 {
+			skipped++
+			continue
+		}
+		if profile.InvertAmount {
+			amount = -amount
+		}
+
+		txns = append(txns, ParsedTransaction{
+			Date:        date,
+			Description: cell(row, descCol),
+			Amount:      amount,
+		})
+	}
+
+	return txns, skipped, nil
+}
+
+var ofxTransactionPattern = regexp.MustCompile(`(?is)<STMTTRN>(.*?)</STMTTRN>`)
+
+var ofxFieldPatterns = map[string]*regexp.Regexp{}
+
+func init() {
+	for _, tag := range []string{"CURDEF", "CURRENCY", "DTPOSTED", "TRNAMT", "NAME", "MEMO", "FITID"} {
+		ofxFieldPatterns[tag] = regexp.MustCompile(`(?i)<` + tag + `>([^<\r\n]*)`)
+	}
+}
+
+// parseOFXStatement handles both SGML (OFX 1.x, where leaf elements have no
+// closing tag) and XML (OFX 2.x) files
+func parseOFXStatement(data []byte) ([]ParsedTransaction, string, int, error) {
+	content := string(data)
+	currency := ofxField(content, "CURDEF")
+
+	blocks := ofxTransactionPattern.FindAllStringSubmatch(content, -1)
+	if len(blocks) == 0 && !strings.Contains(strings.ToUpper(content), "<OFX>") {
+		return nil, "", 0, errors.New("not an OFX file")
+	}
+
+	var txns []ParsedTransaction
+	skipped := 0
+	for _, block := range blocks {
+		body := block[1]
+
+		posted := ofxField(body, "DTPOSTED")
+		if len(posted) < 8 {
+			skipped++
+			continue
+		}
+		date, err := time.Parse("20060102", posted[:8])
+		if err != nil {
+			skipped++
+			continue
+		}
+
+		amount, ok := parseStatementAmount(ofxField(body, "TRNAMT"))
+		if !ok {
+			skipped++
+			continue
+		}
+
+		description := ofxField(body, "NAME")
+		if memo := ofxField(body, "MEMO"); memo != "" && memo != description {
+			description = strings.TrimSpace(description + " " + memo)
+		}
+
+		txns = append(txns, ParsedTransaction{
+			Date:        date,
+			Description: description,
+			Amount:      amount,
+			Currency:    ofxField(body, "CURRENCY"),
+			Reference:   ofxField(body, "FITID"),
+		})
+	}
+
+	return txns, currency, skipped, nil
+}
+
+func ofxField(content, tag string) string {
+	if match := ofxFieldPatterns[tag].FindStringSubmatch(content); match != nil {
+		return unescapeOFX(strings.TrimSpace(match[1]))
+	}
+	return ""
+}
+
+var ofxEntities = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", `"`, "&apos;", "'")
+
+func unescapeOFX(value string) string {
+	return ofxEntities.Replace(value)
+}
+
+// parseQIFStatement reads Quicken interchange files. Records are lines keyed
+// by their first letter and end with ^.
+func parseQIFStatement(data []byte, dateLayouts []string) ([]ParsedTransaction, int, error) {
+	if len(dateLayouts) == 0 {
+		dateLayouts = []string{"1/2/2006", "1/2/06", "2006-01-02", "2/1/2006"}
+	}
+
+	var txns []ParsedTransaction
+	var current ParsedTransaction
+	var memo string
+	hasAmount, hasDate := false, false
+	skipped := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		value := strings.TrimSpace(line[1:])
+		switch line[0] {
+		case '!':
+			// Section header like !Type:Bank
+		case 'D':
+			// Quicken writes dates like 1/ 5'26
+			normalized := strings.ReplaceAll(strings.ReplaceAll(value, "'", "/"), " ", "")
+			if date, err := parseStatementDate(normalized, dateLayouts, false); err == nil {
+				current.Date, hasDate = date, true
+			}
+		case 'T', 'U':
+			if amount, ok := parseStatementAmount(value); ok {
+				current.Amount, hasAmount = amount, true
+			}
+		case 'P':
+			current.Description = value
+		case 'M':
+			memo = value
+		case 'N':
+			current.Reference = value
+		case '^':
+			if current.Description == "" {
+				current.Description = memo
+			}
+			if hasDate && hasAmount {
+				txns = append(txns, current)
+			} else {
+				skipped++
+			}
+			current, memo = ParsedTransaction{}, ""
+			hasAmount, hasDate = false, false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(txns) == 0 && skipped == 0 {
+		return nil, 0, errors.New("no QIF records found")
+	}
+
+	return txns, skipped, nil
+}
+
+// parseStatementDate tries each layout. With buddhistEra, years after 2400
+// are converted from the Thai calendar (BE = CE + 543).
+func parseStatementDate(value string, layouts []string, buddhistEra bool) (time.Time, error) {
+	// Some exports append the time to the date
+	value = statementTimeSuffix.ReplaceAllString(strings.TrimSpace(value), "")
+
+	for _, layout := range layouts {
+		date, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+
+		if buddhistEra {
+			if date.Year() > 2400 {
+				date = date.AddDate(-543, 0, 0)
+			} else if yy := date.Year() % 100; !strings.Contains(layout, "2006") && yy >= 43 {
+				// Two digit years from 43 on are BE (2543 = 2000), 67 means 2567
+				date = date.AddDate(2500+yy-543-date.Year(), 0, 0)
+			}
+		}
+		return date, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", value)
+}
+
+// parseStatementAmount accepts the ways banks write money: 1,234.56,
+// (12.00), 12.00-, 12.00 DR, ฿419 and European 1.234,56
+func parseStatementAmount(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	negative := false
+	upper := strings.ToUpper(value)
+	switch {
+	case strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")"):
+		negative = true
+		value = value[1 : len(value)-1]
+	case strings.HasSuffix(value, "-"):
+		negative = true
+		value = strings.TrimSuffix(value, "-")
+	case strings.HasSuffix(upper, "DR"):
+		negative = true
+		value = value[:len(value)-2]
+	case strings.HasSuffix(upper, "CR"):
+		value = value[:len(value)-2]
+	}
+
+	var cleaned strings.Builder
+	for _, r := range value {
+		if (r >= '0' && r <= '9') || r == '.' || r == ',' || r == '-' {
+			cleaned.WriteRune(r)
+		}
+	}
+	number := cleaned.String()
+
+	// A comma after the last dot is a decimal comma
+	if strings.LastIndex(number, ",") > strings.LastIndex(number, ".") && len(number)-strings.LastIndex(number, ",") <= 3 {
+		number = strings.ReplaceAll(number, ".", "")
+		number = strings.Replace(number, ",", ".", 1)
+	} else {
+		number = strings.ReplaceAll(number, ",", "")
+	}
+
+	amount, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, false
+	}
+	if negative {
+		amount = -abs(amount)
+	}
+	return amount, true
+}
+
+func findColumn(row []string, names []string) int {
+	for _, name := range names {
+		for i, header := range row {
+			if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(header, "\ufeff")), name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func cell(row []string, i int) string {
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+func abs(value float64) float64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// readLimited reads at most limit bytes from r
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("file is larger than %d MB", limit>>20)
+	}
+	return data, nil
+}
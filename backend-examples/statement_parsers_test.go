@@ -0,0 +1,258 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func day(value string) time.Time {
+	date, err := time.Parse(dateLayout, value)
+	if err != nil {
+		panic(err)
+	}
+	return date
+}
+
+func checkTransactions(t *testing.T, got []ParsedTransaction, want []ParsedTransaction) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d transactions %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if !got[i].Date.Equal(want[i].Date) || got[i].Description != want[i].Description || got[i].Amount != want[i].Amount || got[i].Reference != want[i].Reference {
+			t.Errorf("transaction %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseCSVStatement(t *testing.T) {
+	tests := []struct {
+		name        string
+		profile     string
+		data        string
+		want        []ParsedTransaction
+		wantSkipped int
+	}{
+		{
+			name:    "generic",
+			profile: "generic",
+			data: "Date,Description,Amount\n" +
+				"2026-01-05,NETFLIX.COM,-15.49\n" +
+				"2026-01-06,\"ACME, INC\",\"1,200.00\"\n" +
+				"Total,,1184.51\n",
+			want: []ParsedTransaction{
+				{Date: day("2026-01-05"), Description: "NETFLIX.COM", Amount: -15.49},
+				{Date: day("2026-01-06"), Description: "ACME, INC", Amount: 1200},
+			},
+			wantSkipped: 1,
+		},
+		{
+			name:    "semicolons and a preamble",
+			profile: "generic-dmy",
+			data: "Account;12345\n" +
+				"Statement;January 2026\n" +
+				"\n" +
+				"Booking Date;Narrative;Debit;Credit\n" +
+				"05/01/2026;Spotify;9,99;\n" +
+				"06/01/2026;Salary;;2.500,00\n",
+			want: []ParsedTransaction{
+				{Date: day("2026-01-05"), Description: "Spotify", Amount: -9.99},
+				{Date: day("2026-01-06"), Description: "Salary", Amount: 2500},
+			},
+		},
+		{
+			name:    "kbank Thai headers and Buddhist era",
+			profile: "kbank",
+			data: "\xef\xbb\xbfวันที่,รายละเอียด,ถอนเงิน,ฝากเงิน\n" +
+				"05/01/2569 14:30,NETFLIX,419.00,\n" +
+				"06/01/69,โอนเงินเข้า,,\"1,000.00\"\n",
+			want: []ParsedTransaction{
+				{Date: day("2026-01-05"), Description: "NETFLIX", Amount: -419},
+				{Date: day("2026-01-06"), Description: "โอนเงินเข้า", Amount: 1000},
+			},
+		},
+		{
+			name:    "amex charges are positive",
+			profile: "amex",
+			data: "Date,Description,Amount\n" +
+				"01/05/2026,SPOTIFY USA,10.99\n" +
+				"01/06/2026,PAYMENT RECEIVED - THANK YOU,-500.00\n" +
+				"01/07/2026,ZERO,0.00\n",
+			want: []ParsedTransaction{
+				{Date: day("2026-01-05"), Description: "SPOTIFY USA", Amount: -10.99},
+				{Date: day("2026-01-06"), Description: "PAYMENT RECEIVED - THANK YOU", Amount: 500},
+			},
+			wantSkipped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped, err := parseCSVStatement([]byte(tt.data), csvProfiles[tt.profile])
+			if err != nil {
+				t.Fatalf("parseCSVStatement: %v", err)
+			}
+			checkTransactions(t, got, tt.want)
+			if skipped != tt.wantSkipped {
+				t.Errorf("skipped = %d, want %d", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestParseCSVStatementErrors(t *testing.T) {
+	tests := map[string]string{
+		"not UTF-8": "Date,Description,Amount\n2026-01-05,Caf\xe9,-3.00\n",
+		"no header": "when,what\n2026-01-05,coffee\n",
+	}
+	for name, data := range tests {
+		if _, _, err := parseCSVStatement([]byte(data), csvProfiles["generic"]); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseOFXStatement(t *testing.T) {
+	sgml := "OFXHEADER:100\r\nDATA:OFXSGML\r\nVERSION:102\r\n\r\n" +
+		"<OFX><BANKMSGSRSV1><STMTTRNRS><STMTRS>\r\n" +
+		"<CURDEF>GBP\r\n<BANKTRANLIST>\r\n" +
+		"<STMTTRN>\r\n<TRNTYPE>DEBIT\r\n<DTPOSTED>20260105120000[0:GMT]\r\n<TRNAMT>-9.99\r\n<FITID>A1\r\n<NAME>SPOTIFY\r\n<MEMO>Premium\r\n</STMTTRN>\r\n" +
+		"<STMTTRN>\r\n<TRNTYPE>DEBIT\r\n<DTPOSTED>20260106\r\n<TRNAMT>-12.50\r\n<FITID>A2\r\n<NAME>AT&amp;T\r\n</STMTTRN>\r\n" +
+		"<STMTTRN>\r\n<DTPOSTED>pending\r\n<TRNAMT>-1.00\r\n</STMTTRN>\r\n" +
+		"</BANKTRANLIST></STMTRS></STMTTRNRS></BANKMSGSRSV1></OFX>\r\n"
+
+	got, currency, skipped, err := parseOFXStatement([]byte(sgml))
+	if err != nil {
+		t.Fatalf("SGML: %v", err)
+	}
+	checkTransactions(t, got, []ParsedTransaction{
+		{Date: day("2026-01-05"), Description: "SPOTIFY Premium", Amount: -9.99, Reference: "A1"},
+		{Date: day("2026-01-06"), Description: "AT&T", Amount: -12.5, Reference: "A2"},
+	})
+	if currency != "GBP" || skipped != 1 {
+		t.Errorf("currency = %q, skipped = %d", currency, skipped)
+	}
+
+	xml := `<?xml version="1.0" encoding="UTF-8"?><?OFX OFXHEADER="200" VERSION="220"?>
+<OFX><BANKMSGSRSV1><STMTTRNRS><STMTRS><CURDEF>EUR</CURDEF><BANKTRANLIST>
+<STMTTRN><TRNTYPE>DEBIT</TRNTYPE><DTPOSTED>20260201</DTPOSTED><TRNAMT>-4.99</TRNAMT><FITID>X1</FITID><NAME>iCloud</NAME><MEMO>iCloud</MEMO></STMTTRN>
+</BANKTRANLIST></STMTRS></STMTTRNRS></BANKMSGSRSV1></OFX>`
+
+	got, currency, _, err = parseOFXStatement([]byte(xml))
+	if err != nil {
+		t.Fatalf("XML: %v", err)
+	}
+	checkTransactions(t, got, []ParsedTransaction{
+		{Date: day("2026-02-01"), Description: "iCloud", Amount: -4.99, Reference: "X1"},
+	})
+	if currency != "EUR" {
+		t.Errorf("currency = %q", currency)
+	}
+
+	if _, _, _, err := parseOFXStatement([]byte("Date,Amount\n")); err == nil {
+		t.Error("CSV accepted as OFX")
+	}
+}
+
+func TestParseQIFStatement(t *testing.T) {
+	data := "!Type:CCard\r\n" +
+		"D1/ 5'26\r\nT-15.49\r\nPNetflix\r\nN1001\r\n^\r\n" +
+		"D01/06/2026\r\nU-3.00\r\nMCoffee\r\n^\r\n" +
+		"PNo date\r\nT-1.00\r\n^\r\n"
+
+	got, skipped, err := parseQIFStatement([]byte(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, got, []ParsedTransaction{
+		{Date: day("2026-01-05"), Description: "Netflix", Amount: -15.49, Reference: "1001"},
+		{Date: day("2026-01-06"), Description: "Coffee", Amount: -3},
+	})
+	if skipped != 1 {
+		t.Errorf("skipped = %d, want 1", skipped)
+	}
+
+	if _, _, err := parseQIFStatement([]byte("!Type:Bank\n"), nil); err == nil {
+		t.Error("empty QIF accepted")
+	}
+}
+
+func TestParseStatementAmount(t *testing.T) {
+	tests := map[string]float64{
+		"1,234.56": 1234.56,
+		"-15.49":   -15.49,
+		"(12.00)":  -12,
+		"12.00-":   -12,
+		"12.00 DR": -12,
+		"12.00 CR": 12,
+		"฿419":     419,
+		"$1,000":   1000,
+		"1.234,56": 1234.56,
+		"9,99":     9.99,
+	}
+	for value, want := range tests {
+		got, ok := parseStatementAmount(value)
+		if !ok || got != want {
+			t.Errorf("parseStatementAmount(%q) = %v, %v, want %v", value, got, ok, want)
+		}
+	}
+
+	for _, value := range []string{"", "  ", "n/a"} {
+		if _, ok := parseStatementAmount(value); ok {
+			t.Errorf("parseStatementAmount(%q) accepted", value)
+		}
+	}
+}
+
+func TestParseStatementDate(t *testing.T) {
+	tests := []struct {
+		value       string
+		layouts     []string
+		buddhistEra bool
+		want        string
+	}{
+		{"2026-01-05", csvProfiles["generic"].DateLayouts, false, "2026-01-05"},
+		{"2026-01-05T08:15:00Z", csvProfiles["generic"].DateLayouts, false, "2026-01-05"},
+		{"01/02/2026", csvProfiles["generic"].DateLayouts, false, "2026-01-02"},
+		{"01/02/2026", csvProfiles["generic-dmy"].DateLayouts, false, "2026-02-01"},
+		{"05/01/2569", thaiDateLayouts, true, "2026-01-05"},
+		{"5/1/69", thaiDateLayouts, true, "2026-01-05"},
+		{"05/01/2026", thaiDateLayouts, true, "2026-01-05"},
+	}
+	for _, tt := range tests {
+		got, err := parseStatementDate(tt.value, tt.layouts, tt.buddhistEra)
+		if err != nil {
+			t.Errorf("parseStatementDate(%q): %v", tt.value, err)
+			continue
+		}
+		if got.Format(dateLayout) != tt.want {
+			t.Errorf("parseStatementDate(%q) = %s, want %s", tt.value, got.Format(dateLayout), tt.want)
+		}
+	}
+
+	if _, err := parseStatementDate("Total", thaiDateLayouts, true); err == nil {
+		t.Error("non-date accepted")
+	}
+}
+
+func TestDetectStatementFormat(t *testing.T) {
+	tests := []struct {
+		fileName string
+		data     string
+		want     string
+	}{
+		{"export.QFX", "", FormatOFX},
+		{"money.qif", "", FormatQIF},
+		{"statement.csv", "OFXHEADER:100", FormatCSV},
+		{"download", "OFXHEADER:100\nDATA:OFXSGML", FormatOFX},
+		{"download", `<?xml version="1.0"?><OFX>`, FormatOFX},
+		{"download", "  !Type:Bank\nD1/5/26", FormatQIF},
+		{"download", strings.Repeat("Date,Amount\n", 3), FormatCSV},
+	}
+	for _, tt := range tests {
+		if got := detectStatementFormat(tt.fileName, []byte(tt.data)); got != tt.want {
+			t.Errorf("detectStatementFormat(%q, %q) = %s, want %s", tt.fileName, tt.data, got, tt.want)
+		}
+	}
+}
@@ -1,42 +1,147 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 // In-memory storage (for development/demo)
 // In production, use PostgreSQL or MongoDB
 type Storage struct {
-	subscriptions map[string][]*Subscription // userID -> subscriptions
-	gmailTokens   map[string]interface{}     // userID -> token
+	subscriptions map[string][]*Subscription        // userID -> subscriptions
+	gmailTokens   map[string]interface{}            // userID -> token
+	outlookTokens map[string]interface{}            // userID -> Microsoft token
+	users         map[string]*User                  // userID -> user
+	googleUsers   map[string]string                 // Google subject -> userID
+	emails        map[string]string                 // lowercased email -> the one user that owns it
+	refreshTokens map[string]*RefreshToken          // token hash -> refresh token
+	accessTokens  map[string]map[string]time.Time   // userID -> jti -> expiry
+	revokedJTIs   map[string]time.Time              // jti -> expiry
+	revokedFamily map[string]time.Time              // refresh family -> until its access tokens expire
+	authCodes     map[string]*AuthCode              // code hash -> auth code
+	patTokens     map[string]*PersonalToken         // token hash -> personal access token
+	guests        map[string]*GuestSession          // token hash -> guest session
+	mergedGuests  map[string]mergedGuest            // guest ID -> account it was merged into
+	magicLinks    map[string]time.Time              // jti -> expiry (unused links)
+	magicLinkSent map[string]time.Time              // email -> last link sent
+	passkeys      map[string][]*Passkey             // userID -> passkeys
+	ceremonies    map[string]*WebAuthnCeremony      // ceremony ID -> WebAuthn session
+	stepUps       map[string]time.Time              // jti -> passkey verified until
+	channels      map[string][]*NotificationChannel // userID -> notification channels
+	deliveries    map[string][]*Delivery            // userID -> delivery log, oldest first
+	deferred      []*DeferredNotification           // held back by quiet hours
+	mailboxes     map[string]MailboxState           // mailbox key -> where the last scan stopped
+	mailAccounts  map[string][]*MailAccount         // userID -> IMAP mailboxes
+	scanJobs      map[string][]*ScanJob             // userID -> uploaded mail scans, oldest first
+	inbound       map[string]*InboundAddress        // userID -> forwarding address
+	inboundLocal  map[string]string                 // forwarding address local part -> userID
+	pushSubs      map[string][]*PushSubscription    // userID -> browser push endpoints
+	imports       map[string][]*StatementImport     // userID -> statement imports
+	transactions  map[string][]*Transaction         // userID -> imported transactions
 	mu            sync.RWMutex
 }
 
 var store = &Storage{
 	subscriptions: make(map[string][]*Subscription),
 	gmailTokens:   make(map[string]interface{}),
+	outlookTokens: make(map[string]interface{}),
+	users:         make(map[string]*User),
+	googleUsers:   make(map[string]string),
+	emails:        make(map[string]string),
+	refreshTokens: make(map[string]*RefreshToken),
+	accessTokens:  make(map[string]map[string]time.Time),
+	revokedJTIs:   make(map[string]time.Time),
+	revokedFamily: make(map[string]time.Time),
+	authCodes:     make(map[string]*AuthCode),
+	patTokens:     make(map[string]*PersonalToken),
+	guests:        make(map[string]*GuestSession),
+	mergedGuests:  make(map[string]mergedGuest),
+	magicLinks:    make(map[string]time.Time),
+	magicLinkSent: make(map[string]time.Time),
+	passkeys:      make(map[string][]*Passkey),
+	ceremonies:    make(map[string]*WebAuthnCeremony),
+	stepUps:       make(map[string]time.Time),
+	channels:      make(map[string][]*NotificationChannel),
+	deliveries:    make(map[string][]*Delivery),
+	mailboxes:     make(map[string]MailboxState),
+	mailAccounts:  make(map[string][]*MailAccount),
+	scanJobs:      make(map[string][]*ScanJob),
+	inbound:       make(map[string]*InboundAddress),
+	inboundLocal:  make(map[string]string),
+	pushSubs:      make(map[string][]*PushSubscription),
+	imports:       make(map[string][]*StatementImport),
+	transactions:  make(map[string][]*Transaction),
 }
 
-// Store subscription
-func (s *Storage) SaveSubscription(userID string, sub *Subscription) {
+// Store subscription. Returns true if it replaced one with a different
+// price, sub.PreviousPrice then holds the old price.
+func (s *Storage) SaveSubscription(userID string, sub *Subscription) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	userID = s.ownerLocked(userID)
 	if s.subscriptions[userID] == nil {
 		s.subscriptions[userID] = []*Subscription{}
 	}
 
+	now := time.Now().UTC()
+
 	// Check if subscription already exists (by name)
 	for _, existing := range s.subscriptions[userID] {
 		if existing.Name == sub.Name {
+			// Keep history and user settings the caller doesn't know about
+			sub.ID = existing.ID
+			sub.ReminderDays = existing.ReminderDays
+			if sub.TrialEndDate == "" {
+				sub.TrialEndDate = existing.TrialEndDate
+			}
+			sub.MerchantAliases = existing.MerchantAliases
+			sub.Sources = mergeSources(existing.Sources, sub.Sources)
+			sub.DetectedAt = existing.DetectedAt
+			sub.PreviousPrice = existing.PreviousPrice
+			sub.PriceChangedAt = existing.PriceChangedAt
+			priceChanged := existing.Price != 0 && sub.Price != existing.Price
+			if priceChanged {
+				sub.PreviousPrice = existing.Price
+				sub.PriceChangedAt = &now
+			}
+
 			// Update existing
 			*existing = *sub
-			return
+			return priceChanged
 		}
 	}
 
+	if sub.IsAutoDetected && sub.DetectedAt == nil {
+		sub.DetectedAt = &now
+	}
+
 	// Add new subscription
 	s.subscriptions[userID] = append(s.subscriptions[userID], sub)
+	return false
+}
+
+// mergeSources adds the sources in b to a, without duplicates
+func mergeSources(a, b []string) []string {
+	merged := append([]string(nil), a...)
+	for _, source := range b {
+		found := false
+		for _, existing := range merged {
+			if existing == source {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, source)
+		}
+	}
+	return merged
 }
 
 // Get all subscriptions for user
@@ -65,6 +170,38 @@ func (s *Storage) GetSubscription(userID, subID string) *Subscription {
 	return nil
 }
 
+// Update subscription in place
+func (s *Storage) UpdateSubscription(userID, subID string, update func(*Subscription)) *Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subscriptions[userID] {
+		if sub.ID == subID {
+			update(sub)
+			result := *sub
+			return &result
+		}
+	}
+	return nil
+}
+
+// Get a copy of every user's subscriptions
+func (s *Storage) GetAllUserSubscriptions() map[string][]*Subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[string][]*Subscription, len(s.subscriptions))
+	for userID, subs := range s.subscriptions {
+		copies := make([]*Subscription, 0, len(subs))
+		for _, sub := range subs {
+			result := *sub
+			copies = append(copies, &result)
+		}
+		all[userID] = copies
+	}
+	return all
+}
+
 // Delete subscription
 func (s *Storage) DeleteSubscription(userID, subID string) bool {
 	s.mu.Lock()
@@ -101,3 +238,1233 @@ func (s *Storage) DeleteGmailToken(userID string) {
 	defer s.mu.Unlock()
 	delete(s.gmailTokens, userID)
 }
+
+// Store Outlook token
+func (s *Storage) SaveOutlookToken(userID string, token interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outlookTokens[userID] = token
+}
+
+// Get Outlook token
+func (s *Storage) GetOutlookToken(userID string) interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.outlookTokens[userID]
+}
+
+// Delete Outlook token
+func (s *Storage) DeleteOutlookToken(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.outlookTokens, userID)
+}
+
+// Create or update the user for a Google account and record the login. Only a
+// verified email links to an existing account or replaces the stored one.
+func (s *Storage) UpsertGoogleUser(profile GoogleUser) *User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	if userID, ok := s.googleUsers[profile.ID]; ok {
+		user := s.users[userID]
+		// Take the new address unless another account already owns it
+		if profile.VerifiedEmail && s.claimEmailLocked(profile.Email, user.ID) {
+			if !strings.EqualFold(user.Email, profile.Email) {
+				s.releaseEmailLocked(user)
+			}
+			user.Email = profile.Email
+		}
+		user.Name = profile.Name
+		user.Picture = profile.Picture
+		if profile.Locale != "" {
+			user.Locale = profile.Locale
+		}
+		user.LastLoginAt = now
+		result := *user
+		return &result
+	}
+
+	// Link to an account created by email sign-in with the same address. An
+	// address that belongs to another Google account stays with that account.
+	var user *User
+	if profile.VerifiedEmail {
+		user = s.findUserByEmailLocked(profile.Email)
+	}
+	if user == nil || user.GoogleSubject != "" {
+		user = newUser(profile.Email, now)
+		s.users[user.ID] = user
+		if profile.VerifiedEmail {
+			s.claimEmailLocked(profile.Email, user.ID)
+		}
+	}
+	user.GoogleSubject = profile.ID
+	user.Name = profile.Name
+	user.Picture = profile.Picture
+	user.Locale = profile.Locale
+	user.LastLoginAt = now
+	s.googleUsers[profile.ID] = user.ID
+
+	result := *user
+	return &result
+}
+
+// Find the user with this email or create one, and record the login
+func (s *Storage) GetOrCreateEmailUser(email string) *User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	user := s.findUserByEmailLocked(email)
+	if user == nil {
+		user = newUser(email, now)
+		s.users[user.ID] = user
+		s.claimEmailLocked(email, user.ID)
+	}
+	user.LastLoginAt = now
+
+	result := *user
+	return &result
+}
+
+// The account that owns an email. Only verified addresses are indexed, so an
+// unverified Google email never receives magic links.
+func (s *Storage) findUserByEmailLocked(email string) *User {
+	return s.users[s.emails[strings.ToLower(email)]]
+}
+
+// Make userID the owner of email unless another account already is
+func (s *Storage) claimEmailLocked(email, userID string) bool {
+	key := strings.ToLower(email)
+	if owner, ok := s.emails[key]; ok && owner != userID {
+		return false
+	}
+	s.emails[key] = userID
+	return true
+}
+
+// Drop the user's current address from the index if they own it
+func (s *Storage) releaseEmailLocked(user *User) {
+	key := strings.ToLower(user.Email)
+	if s.emails[key] == user.ID {
+		delete(s.emails, key)
+	}
+}
+
+func newUser(email string, now time.Time) *User {
+	return &User{
+		ID:           uuid.NewString(),
+		Email:        email,
+		Roles:        []string{RoleUser},
+		TimeZone:     defaultTimeZone,
+		HomeCurrency: defaultHomeCurrency,
+		Digest:       defaultDigestSettings,
+		CreatedAt:    now,
+		LastLoginAt:  now,
+	}
+}
+
+// Get user by internal ID
+func (s *Storage) GetUser(userID string) *User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user := s.users[userID]
+	if user == nil {
+		return nil
+	}
+	result := *user
+	return &result
+}
+
+// Get all users
+func (s *Storage) GetUsers() []*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		result := *user
+		users = append(users, &result)
+	}
+	return users
+}
+
+// Update user profile
+func (s *Storage) UpdateUser(userID string, update func(*User)) *User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.users[userID]
+	if user == nil {
+		return nil
+	}
+	update(user)
+	result := *user
+	return &result
+}
+
+// Store refresh token
+func (s *Storage) SaveRefreshToken(token *RefreshToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshTokens[token.Hash] = token
+}
+
+// Mark a refresh token as used so it can be rotated. Presenting a token
+// that was already used revokes its whole family.
+func (s *Storage) UseRefreshToken(hash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := s.refreshTokens[hash]
+	if token == nil || token.Revoked || time.Now().After(token.ExpiresAt) {
+		return nil, errRefreshTokenInvalid
+	}
+
+	result := *token
+	if !token.UsedAt.IsZero() {
+		s.revokeFamilyLocked(token.FamilyID)
+		return &result, errRefreshTokenReused
+	}
+
+	token.UsedAt = time.Now()
+	return &result, nil
+}
+
+// Revoke every refresh token in the same family as hash
+func (s *Storage) RevokeRefreshFamily(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token := s.refreshTokens[hash]; token != nil {
+		s.revokeFamilyLocked(token.FamilyID)
+	}
+}
+
+// revokeFamilyLocked deletes the family's refresh tokens and remembers the
+// family until the access tokens minted from it have expired
+func (s *Storage) revokeFamilyLocked(familyID string) {
+	for hash, token := range s.refreshTokens {
+		if token.FamilyID == familyID {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	s.revokedFamily[familyID] = time.Now().Add(accessTokenTTL)
+}
+
+// Check whether the refresh family an access token came from was revoked
+func (s *Storage) IsSessionRevoked(familyID string) bool {
+	if familyID == "" {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, revoked := s.revokedFamily[familyID]
+	return revoked
+}
+
+// Delete expired session records. Used refresh tokens are kept for reuse
+// detection while their family still has a live token, and dropped once the
+// session has ended.
+func (s *Storage) PurgeExpiredSessions(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	live := make(map[string]bool)
+	for _, token := range s.refreshTokens {
+		if token.UsedAt.IsZero() && now.Before(token.ExpiresAt) {
+			live[token.FamilyID] = true
+		}
+	}
+
+	purged := 0
+	for hash, token := range s.refreshTokens {
+		if now.After(token.ExpiresAt) || !token.UsedAt.IsZero() && !live[token.FamilyID] {
+			delete(s.refreshTokens, hash)
+			purged++
+		}
+	}
+	for familyID, until := range s.revokedFamily {
+		if now.After(until) {
+			delete(s.revokedFamily, familyID)
+		}
+	}
+	for jti, exp := range s.revokedJTIs {
+		if now.After(exp) {
+			delete(s.revokedJTIs, jti)
+		}
+	}
+	for userID, tokens := range s.accessTokens {
+		for jti, exp := range tokens {
+			if now.After(exp) {
+				delete(tokens, jti)
+			}
+		}
+		if len(tokens) == 0 {
+			delete(s.accessTokens, userID)
+		}
+	}
+	for hash, code := range s.authCodes {
+		if now.After(code.ExpiresAt) {
+			delete(s.authCodes, hash)
+		}
+	}
+	return purged
+}
+
+// Remember an issued access token so it can be revoked later
+func (s *Storage) TrackAccessToken(userID, jti string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tokens := s.accessTokens[userID]
+	if tokens == nil {
+		tokens = make(map[string]time.Time)
+		s.accessTokens[userID] = tokens
+	}
+	for id, exp := range tokens {
+		if now.After(exp) {
+			delete(tokens, id)
+		}
+	}
+	tokens[jti] = expiresAt
+}
+
+// Add an access token to the revocation list
+func (s *Storage) RevokeJTI(jti string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revokeJTILocked(jti, expiresAt)
+}
+
+func (s *Storage) revokeJTILocked(jti string, expiresAt time.Time) {
+	now := time.Now()
+	for id, exp := range s.revokedJTIs {
+		if now.After(exp) {
+			delete(s.revokedJTIs, id)
+		}
+	}
+	s.revokedJTIs[jti] = expiresAt
+}
+
+// Check the revocation list
+func (s *Storage) IsJTIRevoked(jti string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, revoked := s.revokedJTIs[jti]
+	return revoked
+}
+
+// Revoke all refresh and access tokens of a user
+func (s *Storage) RevokeUserSessions(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.refreshTokens {
+		if token.UserID == userID {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	for jti, exp := range s.accessTokens[userID] {
+		s.revokeJTILocked(jti, exp)
+	}
+	delete(s.accessTokens, userID)
+}
+
+// Store one-time login code
+func (s *Storage) SaveAuthCode(code *AuthCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for hash, existing := range s.authCodes {
+		if now.After(existing.ExpiresAt) {
+			delete(s.authCodes, hash)
+		}
+	}
+	s.authCodes[code.Hash] = code
+}
+
+// Get and delete a login code, returns nil if missing or expired
+func (s *Storage) ConsumeAuthCode(hash string) *AuthCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := s.authCodes[hash]
+	if code == nil {
+		return nil
+	}
+	delete(s.authCodes, hash)
+
+	if time.Now().After(code.ExpiresAt) {
+		return nil
+	}
+	return code
+}
+
+// Store personal access token
+func (s *Storage) SavePersonalToken(pat *PersonalToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.patTokens[pat.Hash] = pat
+}
+
+// Look up a personal access token and record its use, returns nil if
+// missing or expired
+func (s *Storage) UsePersonalToken(hash string) *PersonalToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pat := s.patTokens[hash]
+	if pat == nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if pat.ExpiresAt != nil && now.After(*pat.ExpiresAt) {
+		return nil
+	}
+	pat.LastUsedAt = &now
+
+	result := *pat
+	return &result
+}
+
+// Get all personal access tokens for user
+func (s *Storage) GetPersonalTokens(userID string) []*PersonalToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := []*PersonalToken{}
+	for _, pat := range s.patTokens {
+		if pat.UserID == userID {
+			result := *pat
+			tokens = append(tokens, &result)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// Delete personal access token
+func (s *Storage) DeletePersonalToken(userID, tokenID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, pat := range s.patTokens {
+		if pat.ID == tokenID && pat.UserID == userID {
+			delete(s.patTokens, hash)
+			return true
+		}
+	}
+	return false
+}
+
+// Store guest session
+func (s *Storage) SaveGuestSession(guest *GuestSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.guests[guest.TokenHash] = guest
+}
+
+// Get guest session, returns nil if missing or expired
+func (s *Storage) GetGuestSession(tokenHash string) *GuestSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	guest := s.guests[tokenHash]
+	if guest == nil || time.Now().After(guest.ExpiresAt) {
+		return nil
+	}
+	result := *guest
+	return &result
+}
+
+// Move a guest's subscriptions and Gmail token into a real account and
+// delete the guest. Returns the number of subscriptions moved.
+func (s *Storage) MergeGuest(guestID, userID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	moved := 0
+	for _, sub := range s.subscriptions[guestID] {
+		merged := false
+		for _, existing := range s.subscriptions[userID] {
+			if existing.Name == sub.Name {
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			s.subscriptions[userID] = append(s.subscriptions[userID], sub)
+			moved++
+		}
+	}
+
+	// Keep the account's own Gmail and Outlook tokens if it already has them
+	if token, ok := s.gmailTokens[guestID]; ok {
+		if _, exists := s.gmailTokens[userID]; !exists {
+			s.gmailTokens[userID] = token
+		}
+	}
+	if token, ok := s.outlookTokens[guestID]; ok {
+		if _, exists := s.outlookTokens[userID]; !exists {
+			s.outlookTokens[userID] = token
+		}
+	}
+
+	s.deleteGuestLocked(guestID)
+
+	// Scans the guest started may still be running
+	s.mergedGuests[guestID] = mergedGuest{UserID: userID, ExpiresAt: time.Now().Add(mergedGuestTTL)}
+	return moved
+}
+
+// ownerLocked returns the account a merged guest's data now belongs to
+func (s *Storage) ownerLocked(userID string) string {
+	if merged, ok := s.mergedGuests[userID]; ok && s.users[merged.UserID] != nil {
+		return merged.UserID
+	}
+	return userID
+}
+
+// Delete expired guest sessions and everything stored under them
+func (s *Storage) PurgeExpiredGuests(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for _, guest := range s.guests {
+		if now.After(guest.ExpiresAt) {
+			s.deleteGuestLocked(guest.ID)
+			purged++
+		}
+	}
+
+	// Drop whatever late scans left under merged guest IDs
+	for guestID, merged := range s.mergedGuests {
+		if now.After(merged.ExpiresAt) {
+			s.deleteGuestLocked(guestID)
+			delete(s.mergedGuests, guestID)
+		}
+	}
+	return purged
+}
+
+func (s *Storage) deleteGuestLocked(guestID string) {
+	delete(s.subscriptions, guestID)
+	delete(s.gmailTokens, guestID)
+	delete(s.outlookTokens, guestID)
+	delete(s.mailboxes, "gmail:"+guestID)
+	delete(s.mailboxes, "outlook:"+guestID)
+	s.deleteInboundLocked(guestID)
+	for hash, guest := range s.guests {
+		if guest.ID == guestID {
+			delete(s.guests, hash)
+		}
+	}
+}
+
+// Rate limit magic links per email. Returns false if one was sent within
+// cooldown. A send that fails must call ReleaseMagicLink.
+func (s *Storage) AllowMagicLink(email string, now time.Time, cooldown time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for address, sentAt := range s.magicLinkSent {
+		if now.Sub(sentAt) >= cooldown {
+			delete(s.magicLinkSent, address)
+		}
+	}
+	if _, recent := s.magicLinkSent[email]; recent {
+		return false
+	}
+	s.magicLinkSent[email] = now
+	return true
+}
+
+// Clear the cooldown taken by AllowMagicLink when no email went out
+func (s *Storage) ReleaseMagicLink(email string, sentAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.magicLinkSent[email].Equal(sentAt) {
+		delete(s.magicLinkSent, email)
+	}
+}
+
+// Store an unused magic link
+func (s *Storage) SaveMagicLink(jti string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range s.magicLinks {
+		if now.After(exp) {
+			delete(s.magicLinks, id)
+		}
+	}
+	s.magicLinks[jti] = expiresAt
+}
+
+// Mark a magic link as used. Returns false if it was already used or expired.
+func (s *Storage) ConsumeMagicLink(jti string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiresAt, ok := s.magicLinks[jti]
+	if !ok {
+		return false
+	}
+	delete(s.magicLinks, jti)
+	return time.Now().Before(expiresAt)
+}
+
+// Store passkey
+func (s *Storage) SavePasskey(passkey *Passkey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passkeys[passkey.UserID] = append(s.passkeys[passkey.UserID], passkey)
+}
+
+// Get all passkeys for user
+func (s *Storage) GetPasskeys(userID string) []*Passkey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	passkeys := make([]*Passkey, 0, len(s.passkeys[userID]))
+	for _, passkey := range s.passkeys[userID] {
+		result := *passkey
+		passkeys = append(passkeys, &result)
+	}
+	return passkeys
+}
+
+// Save the sign counter after a successful assertion
+func (s *Storage) UpdatePasskeyCounter(userID string, credentialID []byte, signCount uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := findPasskey(s.passkeys[userID], credentialID)
+	if i < 0 {
+		return false
+	}
+
+	now := time.Now().UTC()
+	passkey := s.passkeys[userID][i]
+	passkey.Credential.Authenticator.SignCount = signCount
+	passkey.LastUsedAt = &now
+	return true
+}
+
+// Delete passkey
+func (s *Storage) DeletePasskey(userID, passkeyID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, passkey := range s.passkeys[userID] {
+		if passkey.ID == passkeyID {
+			s.passkeys[userID] = append(s.passkeys[userID][:i:i], s.passkeys[userID][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Store WebAuthn ceremony between begin and finish
+func (s *Storage) SaveWebAuthnCeremony(id string, ceremony *WebAuthnCeremony) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, existing := range s.ceremonies {
+		if now.After(existing.ExpiresAt) {
+			delete(s.ceremonies, key)
+		}
+	}
+	s.ceremonies[id] = ceremony
+}
+
+// Get and delete a WebAuthn ceremony, returns nil if missing, expired or
+// started for another purpose
+func (s *Storage) ConsumeWebAuthnCeremony(id, purpose string) *WebAuthnCeremony {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ceremony := s.ceremonies[id]
+	if ceremony == nil {
+		return nil
+	}
+	delete(s.ceremonies, id)
+
+	if ceremony.Purpose != purpose || time.Now().After(ceremony.ExpiresAt) {
+		return nil
+	}
+	return ceremony
+}
+
+// Record a passkey step-up for an access token
+func (s *Storage) SaveStepUp(jti string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range s.stepUps {
+		if now.After(exp) {
+			delete(s.stepUps, id)
+		}
+	}
+	s.stepUps[jti] = expiresAt
+}
+
+// Check whether an access token was recently verified with a passkey
+func (s *Storage) HasStepUp(jti string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	expiresAt, ok := s.stepUps[jti]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// Store notification channel
+func (s *Storage) SaveNotificationChannel(ch *NotificationChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[ch.UserID] = append(s.channels[ch.UserID], ch)
+}
+
+// Get all notification channels for user
+func (s *Storage) GetNotificationChannels(userID string) []*NotificationChannel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	channels := make([]*NotificationChannel, 0, len(s.channels[userID]))
+	for _, ch := range s.channels[userID] {
+		result := *ch
+		channels = append(channels, &result)
+	}
+	return channels
+}
+
+// Get notification channel by ID
+func (s *Storage) GetNotificationChannel(userID, channelID string) *NotificationChannel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, ch := range s.channels[userID] {
+		if ch.ID == channelID {
+			result := *ch
+			return &result
+		}
+	}
+	return nil
+}
+
+// Update notification channel, returns the updated copy or nil if not found
+func (s *Storage) UpdateNotificationChannel(userID, channelID string, update func(ch *NotificationChannel)) *NotificationChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range s.channels[userID] {
+		if ch.ID == channelID {
+			update(ch)
+			result := *ch
+			return &result
+		}
+	}
+	return nil
+}
+
+// Delete notification channel
+func (s *Storage) DeleteNotificationChannel(userID, channelID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := s.channels[userID]
+	for i, ch := range channels {
+		if ch.ID == channelID {
+			s.channels[userID] = append(channels[:i], channels[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Append to the delivery log, keeping the most recent entries per user
+func (s *Storage) SaveDelivery(delivery *Delivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log := append(s.deliveries[delivery.UserID], delivery)
+	if len(log) > maxDeliveriesPerUser {
+		log = append([]*Delivery(nil), log[len(log)-maxDeliveriesPerUser:]...)
+	}
+	s.deliveries[delivery.UserID] = log
+}
+
+// Store push subscription. An endpoint belongs to one browser, so
+// registering it again replaces the old entry, even from another account.
+func (s *Storage) SavePushSubscription(sub *PushSubscription) *PushSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for userID, subs := range s.pushSubs {
+		for i, existing := range subs {
+			if existing.Endpoint == sub.Endpoint {
+				s.pushSubs[userID] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+
+	s.pushSubs[sub.UserID] = append(s.pushSubs[sub.UserID], sub)
+	result := *sub
+	return &result
+}
+
+// Get all push subscriptions for user
+func (s *Storage) GetPushSubscriptions(userID string) []*PushSubscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subs := make([]*PushSubscription, 0, len(s.pushSubs[userID]))
+	for _, sub := range s.pushSubs[userID] {
+		result := *sub
+		subs = append(subs, &result)
+	}
+	return subs
+}
+
+// Delete push subscription
+func (s *Storage) DeletePushSubscription(userID, subID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := s.pushSubs[userID]
+	for i, sub := range subs {
+		if sub.ID == subID {
+			s.pushSubs[userID] = append(subs[:i], subs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Store statement import and its transactions. Transactions already stored
+// from an earlier import are skipped. Returns how many were stored and skipped.
+func (s *Storage) SaveStatementImport(imp *StatementImport, txns []*Transaction) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := make(map[string]bool, len(s.transactions[imp.UserID]))
+	for _, txn := range s.transactions[imp.UserID] {
+		existing[transactionKey(txn)] = true
+	}
+
+	saved, duplicates := 0, 0
+	for _, txn := range txns {
+		if existing[transactionKey(txn)] {
+			duplicates++
+			continue
+		}
+		s.transactions[imp.UserID] = append(s.transactions[imp.UserID], txn)
+		saved++
+	}
+
+	imp.TransactionCount, imp.Duplicates = saved, duplicates
+	s.imports[imp.UserID] = append(s.imports[imp.UserID], imp)
+	return saved, duplicates
+}
+
+// Get all statement imports for user, newest first
+func (s *Storage) GetStatementImports(userID string) []*StatementImport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	imports := s.imports[userID]
+	result := make([]*StatementImport, 0, len(imports))
+	for i := len(imports) - 1; i >= 0; i-- {
+		imp := *imports[i]
+		result = append(result, &imp)
+	}
+	return result
+}
+
+// Get statement import by ID
+func (s *Storage) GetStatementImport(userID, importID string) *StatementImport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, imp := range s.imports[userID] {
+		if imp.ID == importID {
+			result := *imp
+			return &result
+		}
+	}
+	return nil
+}
+
+// Get transactions for user, optionally only those from one import, newest first
+func (s *Storage) GetTransactions(userID, importID string) []*Transaction {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	txns := make([]*Transaction, 0)
+	for _, txn := range s.transactions[userID] {
+		if importID == "" || txn.ImportID == importID {
+			result := *txn
+			txns = append(txns, &result)
+		}
+	}
+	sort.SliceStable(txns, func(i, j int) bool { return txns[i].Date > txns[j].Date })
+	return txns
+}
+
+// Delete statement import and its transactions
+func (s *Storage) DeleteStatementImport(userID, importID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	imports := s.imports[userID]
+	for i, imp := range imports {
+		if imp.ID != importID {
+			continue
+		}
+		s.imports[userID] = append(imports[:i], imports[i+1:]...)
+
+		kept := make([]*Transaction, 0, len(s.transactions[userID]))
+		for _, txn := range s.transactions[userID] {
+			if txn.ImportID != importID {
+				kept = append(kept, txn)
+			}
+		}
+		s.transactions[userID] = kept
+		return true
+	}
+	return false
+}
+
+// transactionKey identifies a statement line across overlapping imports
+func transactionKey(txn *Transaction) string {
+	if txn.Reference != "" {
+		return fmt.Sprintf("ref|%s|%s|%.2f", txn.Reference, txn.Date, txn.Amount)
+	}
+	return fmt.Sprintf("%s|%.2f|%s", txn.Date, txn.Amount, strings.ToLower(strings.Join(strings.Fields(txn.Description), " ")))
+}
+
+// Hold a notification until deliverAt
+func (s *Storage) DeferNotification(d *DeferredNotification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deferred = append(s.deferred, d)
+}
+
+// Remove and return deferred notifications that are due at now
+func (s *Storage) TakeDueNotifications(now time.Time) []*DeferredNotification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*DeferredNotification
+	kept := s.deferred[:0]
+	for _, d := range s.deferred {
+		if now.Before(d.DeliverAt) {
+			kept = append(kept, d)
+		} else {
+			due = append(due, d)
+		}
+	}
+	s.deferred = kept
+	return due
+}
+
+// Get where the last scan of a mailbox stopped, zero if never scanned
+func (s *Storage) GetMailboxState(key string) MailboxState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mailboxes[key]
+}
+
+// Store where a mailbox scan stopped
+func (s *Storage) SaveMailboxState(key string, state MailboxState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mailboxes[key] = state
+}
+
+// Forget a mailbox's scan position so the next scan reads everything
+func (s *Storage) DeleteMailboxState(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mailboxes, key)
+}
+
+// Store IMAP mailbox
+func (s *Storage) SaveMailAccount(account *MailAccount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mailAccounts[account.UserID] = append(s.mailAccounts[account.UserID], account)
+}
+
+// Get IMAP mailboxes for user
+func (s *Storage) GetMailAccounts(userID string) []*MailAccount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accounts := make([]*MailAccount, 0, len(s.mailAccounts[userID]))
+	for _, account := range s.mailAccounts[userID] {
+		result := *account
+		accounts = append(accounts, &result)
+	}
+	return accounts
+}
+
+// Get single IMAP mailbox
+func (s *Storage) GetMailAccount(userID, accountID string) *MailAccount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, account := range s.mailAccounts[userID] {
+		if account.ID == accountID {
+			result := *account
+			return &result
+		}
+	}
+	return nil
+}
+
+// Update IMAP mailbox in place
+func (s *Storage) UpdateMailAccount(userID, accountID string, update func(*MailAccount)) *MailAccount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, account := range s.mailAccounts[userID] {
+		if account.ID == accountID {
+			update(account)
+			result := *account
+			return &result
+		}
+	}
+	return nil
+}
+
+// Delete IMAP mailbox and its scan position
+func (s *Storage) DeleteMailAccount(userID, accountID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := s.mailAccounts[userID]
+	for i, account := range accounts {
+		if account.ID == accountID {
+			s.mailAccounts[userID] = append(accounts[:i], accounts[i+1:]...)
+			delete(s.mailboxes, "imap:"+accountID)
+			return true
+		}
+	}
+	return false
+}
+
+// Store a new scan job, keeping the last maxScanJobs per user. Only one job
+// per user may be queued or running; if there is one it is returned instead.
+func (s *Storage) StartScanJob(job *ScanJob) *ScanJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.scanJobs[job.UserID] {
+		if existing.Status == ScanQueued || existing.Status == ScanRunning {
+			return existing.copy()
+		}
+	}
+
+	jobs := append(s.scanJobs[job.UserID], job)
+	if len(jobs) > maxScanJobs {
+		jobs = jobs[len(jobs)-maxScanJobs:]
+	}
+	s.scanJobs[job.UserID] = jobs
+	return nil
+}
+
+// Delete scan job
+func (s *Storage) DeleteScanJob(userID, jobID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := s.scanJobs[userID]
+	for i, job := range jobs {
+		if job.ID == jobID {
+			s.scanJobs[userID] = append(jobs[:i], jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get scan jobs for user, newest first
+func (s *Storage) GetScanJobs(userID string) []*ScanJob {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := s.scanJobs[userID]
+	result := make([]*ScanJob, 0, len(jobs))
+	for i := len(jobs) - 1; i >= 0; i-- {
+		result = append(result, jobs[i].copy())
+	}
+	return result
+}
+
+// Get scan job by ID
+func (s *Storage) GetScanJob(userID, jobID string) *ScanJob {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, job := range s.scanJobs[userID] {
+		if job.ID == jobID {
+			return job.copy()
+		}
+	}
+	return nil
+}
+
+// Update scan job in place
+func (s *Storage) UpdateScanJob(userID, jobID string, update func(*ScanJob)) *ScanJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.scanJobs[userID] {
+		if job.ID == jobID {
+			update(job)
+			return job.copy()
+		}
+	}
+	return nil
+}
+
+// Store a user's forwarding address, replacing any earlier one
+func (s *Storage) SaveInboundAddress(address *InboundAddress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteInboundLocked(address.UserID)
+	s.inbound[address.UserID] = address
+	s.inboundLocal[address.LocalPart] = address.UserID
+}
+
+// Get a user's forwarding address
+func (s *Storage) GetInboundAddress(userID string) *InboundAddress {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if address := s.inbound[userID]; address != nil {
+		return address.copy()
+	}
+	return nil
+}
+
+// Find a forwarding address by its local part
+func (s *Storage) FindInboundAddress(localPart string) *InboundAddress {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if address := s.inbound[s.inboundLocal[localPart]]; address != nil {
+		return address.copy()
+	}
+	return nil
+}
+
+// Update a user's forwarding address in place
+func (s *Storage) UpdateInboundAddress(userID string, update func(*InboundAddress)) *InboundAddress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	address := s.inbound[userID]
+	if address == nil {
+		return nil
+	}
+	update(address)
+	return address.copy()
+}
+
+func (s *Storage) deleteInboundLocked(userID string) {
+	if address := s.inbound[userID]; address != nil {
+		delete(s.inboundLocal, address.LocalPart)
+		delete(s.inbound, userID)
+	}
+}
+
+// Get delivery log for user, newest first
+func (s *Storage) GetDeliveries(userID string) []*Delivery {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	log := s.deliveries[userID]
+	deliveries := make([]*Delivery, 0, len(log))
+	for i := len(log) - 1; i >= 0; i-- {
+		result := *log[i]
+		deliveries = append(deliveries, &result)
+	}
+	return deliveries
+}
+
+// Delete a user and everything stored for them
+func (s *Storage) DeleteUser(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.users[userID]
+	if user == nil {
+		return false
+	}
+
+	delete(s.users, userID)
+	s.releaseEmailLocked(user)
+	if user.GoogleSubject != "" {
+		delete(s.googleUsers, user.GoogleSubject)
+	}
+	delete(s.subscriptions, userID)
+	delete(s.gmailTokens, userID)
+	delete(s.outlookTokens, userID)
+	delete(s.passkeys, userID)
+	delete(s.channels, userID)
+	delete(s.deliveries, userID)
+	delete(s.mailboxes, "gmail:"+userID)
+	delete(s.mailboxes, "outlook:"+userID)
+	for _, account := range s.mailAccounts[userID] {
+		delete(s.mailboxes, "imap:"+account.ID)
+	}
+	delete(s.mailAccounts, userID)
+	delete(s.scanJobs, userID)
+	s.deleteInboundLocked(userID)
+	delete(s.pushSubs, userID)
+	delete(s.imports, userID)
+	delete(s.transactions, userID)
+
+	kept := s.deferred[:0]
+	for _, d := range s.deferred {
+		if d.Notification.UserID != userID {
+			kept = append(kept, d)
+		}
+	}
+	s.deferred = kept
+
+	for hash, token := range s.refreshTokens {
+		if token.UserID == userID {
+			delete(s.refreshTokens, hash)
+		}
+	}
+	for hash, pat := range s.patTokens {
+		if pat.UserID == userID {
+			delete(s.patTokens, hash)
+		}
+	}
+	for jti, exp := range s.accessTokens[userID] {
+		s.revokeJTILocked(jti, exp)
+	}
+	delete(s.accessTokens, userID)
+
+	return true
+}
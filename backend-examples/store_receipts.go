@@ -0,0 +1,237 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	PlatformApple      = "apple"
+	PlatformGooglePlay = "google_play"
+	PlatformDirect     = "direct"
+)
+
+// receiptExtractor splits an app store receipt into one subscription per app
+type receiptExtractor struct {
+	platform string
+	senders  []string // matched against the From header
+	extract  func(lines []string, received time.Time) []*Subscription
+}
+
+var receiptExtractors = []receiptExtractor{
+	{PlatformApple, []string{"no_reply@email.apple.com", "do_not_reply@apple.com"}, extractAppleReceipt},
+	{PlatformGooglePlay, []string{"googleplay-noreply@google.com"}, extractGooglePlayReceipt},
+}
+
+// storeReceiptSenders lists the senders above for a mail search
+func storeReceiptSenders() []string {
+	senders := make([]string, 0)
+	for _, extractor := range receiptExtractors {
+		senders = append(senders, extractor.senders...)
+	}
+	return senders
+}
+
+var (
+	receiptPrice  = regexp.MustCompile(`(?i)(?:(?:US|A|C|NZ|S|HK)?\$|[€£¥฿₩₹]|\b(?:THB|USD|EUR|GBP|JPY|SGD|AUD)\s?)\s?(\d[\d.,]*)|(\d[\d.,]*)\s?(?:€|฿|บาท|\b(?:THB|USD|EUR|GBP|JPY)\b)`)
+	receiptRenews = regexp.MustCompile(`(?i)^(?:renews on|renewal date|renews|next (?:payment|renewal|billing)(?: date)?)\s*:?\s*(.+)$`)
+	receiptPeriod = regexp.MustCompile(`(?i)\s*(?:/|per\s+)\s*(week|month|3 months|year)\b`)
+	receiptOrder  = regexp.MustCompile(`(?i)^order date\s*:?\s*(.+)$`)
+	receiptTotals = regexp.MustCompile(`(?i)^(sub)?total|^tax|^vat`)
+)
+
+var receiptDateLayouts = []string{
+	"Jan 2, 2006", "January 2, 2006", "Jan 2 2006", "2 Jan 2006", "2 January 2006",
+	"02/01/2006", "2006-01-02",
+}
+
+// Lines in an Apple receipt that head a section rather than name an app
+var appleHeadings = map[string]bool{
+	"app store": true, "apple services": true, "apple receipt": true, "apple one": true,
+}
+
+// extractAppleReceipt reads App Store receipts, where each item is the app,
+// the plan with its period, a "Renews" line and the price:
+//
+//	YouTube: Watch, Listen, Stream
+//	YouTube Premium (Monthly)
+//	Renews Nov 12, 2024
+//	Report a Problem
+//	฿179.00
+func extractAppleReceipt(lines []string, received time.Time) []*Subscription {
+	subs := make([]*Subscription, 0)
+
+	for i, line := range lines {
+		match := receiptRenews.FindStringSubmatch(line)
+		if match == nil || i == 0 {
+			continue
+		}
+		renews, ok := parseReceiptDate(match[1])
+		if !ok {
+			continue
+		}
+
+		plan := lines[i-1]
+		app := ""
+		if i >= 2 && !appleHeadings[strings.ToLower(lines[i-2])] {
+			app = lines[i-2]
+		}
+
+		// The price follows the item, in some layouts it shares the plan line
+		price, ok := receiptAmount(plan)
+		for j := i + 1; !ok && j < len(lines) && j <= i+4; j++ {
+			if receiptRenews.MatchString(lines[j]) {
+				break
+			}
+			price, ok = receiptAmount(lines[j])
+		}
+		if !ok {
+			continue
+		}
+		plan = strings.TrimSpace(receiptPrice.ReplaceAllString(plan, ""))
+
+		name, category := receiptAppName(app, plan)
+		subs = append(subs, &Subscription{
+			Name:            name,
+			Price:           price,
+			BillingCycle:    cycleFromText(plan),
+			NextBillingDate: renews.Format(dateLayout),
+			Category:        category,
+		})
+	}
+
+	return subs
+}
+
+// extractGooglePlayReceipt reads Google Play receipts, where items carry a
+// period price:
+//
+//	Premium Individual (Spotify: Music and Podcasts)   ฿149.00/month
+//
+// They rarely show the renewal date, so it is worked out from the order date.
+func extractGooglePlayReceipt(lines []string, received time.Time) []*Subscription {
+	ordered := received
+	var renews time.Time
+	for _, line := range lines {
+		if match := receiptOrder.FindStringSubmatch(line); match != nil {
+			if date, ok := parseReceiptDate(match[1]); ok {
+				ordered = date
+			}
+		}
+		if match := receiptRenews.FindStringSubmatch(line); match != nil {
+			if date, ok := parseReceiptDate(match[1]); ok {
+				renews = date
+			}
+		}
+	}
+
+	subs := make([]*Subscription, 0)
+	for i, line := range lines {
+		period := receiptPeriod.FindStringSubmatch(line)
+		if period == nil || receiptTotals.MatchString(line) {
+			continue
+		}
+		price, ok := receiptAmount(line)
+		if !ok {
+			continue
+		}
+
+		item := strings.TrimSpace(receiptPrice.ReplaceAllString(receiptPeriod.ReplaceAllString(line, ""), ""))
+		item = strings.TrimSpace(strings.TrimPrefix(item, "Item:"))
+		if item == "" && i > 0 {
+			item = lines[i-1]
+		}
+		if item == "" || strings.EqualFold(item, "price") {
+			continue
+		}
+
+		// "Plan (App: tagline)" names the app in parentheses
+		plan, app := item, ""
+		if open := strings.LastIndex(item, "("); open > 0 && strings.HasSuffix(item, ")") {
+			plan, app = strings.TrimSpace(item[:open]), item[open+1:len(item)-1]
+		}
+
+		cycle := cycleFromText(period[1])
+		next := renews
+		if next.IsZero() {
+			var err error
+			if next, err = addCycles(dateOnly(ordered), cycle, 1); err != nil {
+				continue
+			}
+		}
+		if due, ok := nextOccurrence(next.Format(dateLayout), cycle, dateOnly(time.Now())); ok {
+			next = due
+		}
+
+		name, category := receiptAppName(app, plan)
+		subs = append(subs, &Subscription{
+			Name:            name,
+			Price:           price,
+			BillingCycle:    cycle,
+			NextBillingDate: next.Format(dateLayout),
+			Category:        category,
+		})
+	}
+
+	return subs
+}
+
+// receiptAppName prefers the name a Gmail match would use, then the app name
+// without its tagline, then the plan without its period
+func receiptAppName(app, plan string) (string, string) {
+	text := strings.ToLower(app + " " + plan)
+	for keyword, info := range subscriptionKeywords {
+		if strings.Contains(text, keyword) {
+			return info.name, info.category
+		}
+	}
+
+	name := app
+	for _, sep := range []string{":", " - ", " – ", " | "} {
+		if i := strings.Index(name, sep); i > 0 {
+			name = name[:i]
+		}
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		name = plan
+		if i := strings.LastIndex(name, "("); i > 0 {
+			name = name[:i]
+		}
+	}
+	return strings.TrimSpace(name), "apps"
+}
+
+// cycleFromText reads the billing period from a plan like "(Annual)" or
+// "/month"
+func cycleFromText(text string) string {
+	lower := strings.ToLower(text)
+	switch {
+	case strings.Contains(lower, "week"):
+		return "weekly"
+	case strings.Contains(lower, "3 month"), strings.Contains(lower, "quarter"):
+		return "quarterly"
+	case strings.Contains(lower, "year"), strings.Contains(lower, "annual"):
+		return "yearly"
+	}
+	return "monthly"
+}
+
+func receiptAmount(line string) (float64, bool) {
+	match := receiptPrice.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+	value := match[1]
+	if value == "" {
+		value = match[2]
+	}
+	amount, ok := parseStatementAmount(value)
+	return abs(amount), ok && amount != 0
+}
+
+func parseReceiptDate(value string) (time.Time, bool) {
+	value = strings.TrimSuffix(strings.TrimSpace(value), ".")
+	date, err := parseStatementDate(value, receiptDateLayouts, false)
+	return date, err == nil
+}
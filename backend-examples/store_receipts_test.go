@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const appleReceipt = `Apple Receipt
+APPLE ID alice@example.com
+App Store
+YouTube: Watch, Listen, Stream
+YouTube Premium (Monthly)
+Renews Nov 12, 2024
+Report a Problem
+฿179.00
+Bear Markdown Notes
+Bear Pro (Annual)
+Renews on Jan 3, 2025
+Report a Problem
+฿1,050.00
+Subtotal ฿1,229.00`
+
+const googlePlayReceipt = `Thank you. You've made a purchase from the Google Play Store.
+Order number: GPA.1234-5678-9012-34567
+Order date: Nov 12, 2024 10:15:22 AM GMT+7
+Item                                               Price
+Premium Individual (Spotify: Music and Podcasts)   ฿149.00/month
+Calm Premium (Calm - Sleep, Meditate, Relax)       ฿1,290.00/year
+Tax: ฿0.00
+Total: ฿1,439.00`
+
+func checkSubscription(t *testing.T, got *Subscription, name string, price float64, cycle, next string) {
+	t.Helper()
+	if got.Name != name || got.Price != price || got.BillingCycle != cycle || got.NextBillingDate != next {
+		t.Errorf("subscription = %s %.2f %s %s, want %s %.2f %s %s",
+			got.Name, got.Price, got.BillingCycle, got.NextBillingDate, name, price, cycle, next)
+	}
+}
+
+func TestReceiptRenewsLine(t *testing.T) {
+	tests := map[string]string{
+		"Renews Nov 12, 2024":          "Nov 12, 2024",
+		"Renews on Nov 12, 2024":       "Nov 12, 2024",
+		"Renewal date: 12 Nov 2024":    "12 Nov 2024",
+		"Next billing date 2024-11-12": "2024-11-12",
+	}
+	for line, want := range tests {
+		match := receiptRenews.FindStringSubmatch(line)
+		if match == nil || match[1] != want {
+			t.Errorf("receiptRenews(%q) = %q, want %q", line, match, want)
+			continue
+		}
+		if date, ok := parseReceiptDate(match[1]); !ok || date.Format(dateLayout) != "2024-11-12" {
+			t.Errorf("parseReceiptDate(%q) = %v, %v", match[1], date, ok)
+		}
+	}
+}
+
+func TestExtractAppleReceipt(t *testing.T) {
+	message := &MailboxMessage{Text: appleReceipt}
+	subs := extractAppleReceipt(message.Lines(), time.Now())
+	if len(subs) != 2 {
+		t.Fatalf("got %d subscriptions, want 2: %+v", len(subs), subs)
+	}
+	checkSubscription(t, subs[0], "YouTube Premium", 179, "monthly", "2024-11-12")
+	checkSubscription(t, subs[1], "Bear Markdown Notes", 1050, "yearly", "2025-01-03")
+	if subs[1].Category != "apps" {
+		t.Errorf("category = %q, want apps", subs[1].Category)
+	}
+}
+
+func TestExtractGooglePlayReceipt(t *testing.T) {
+	message := &MailboxMessage{Text: googlePlayReceipt}
+	subs := extractGooglePlayReceipt(message.Lines(), time.Now())
+	if len(subs) != 2 {
+		t.Fatalf("got %d subscriptions, want 2: %+v", len(subs), subs)
+	}
+
+	// Renewals are worked out from the order date and rolled forward
+	today := dateOnly(time.Now())
+	monthly, _ := nextOccurrence("2024-12-12", "monthly", today)
+	yearly, _ := nextOccurrence("2025-11-12", "yearly", today)
+	checkSubscription(t, subs[0], "Spotify", 149, "monthly", monthly.Format(dateLayout))
+	checkSubscription(t, subs[1], "Calm", 1290, "yearly", yearly.Format(dateLayout))
+}
+
+func TestExtractSubscriptionsMarksPlatform(t *testing.T) {
+	scanner := NewMailScanner(nil)
+	tests := []struct {
+		from     string
+		text     string
+		platform string
+		count    int
+	}{
+		{"App Store <no_reply@email.apple.com>", appleReceipt, PlatformApple, 2},
+		{"Google Play <googleplay-noreply@google.com>", googlePlayReceipt, PlatformGooglePlay, 2},
+		{"Netflix <info@account.netflix.com>", "Your Netflix membership\nTotal: $15.49/month", PlatformDirect, 1},
+		{"Friend <friend@example.com>", "Lunch tomorrow?", "", 0},
+	}
+
+	for _, tt := range tests {
+		subs := scanner.extractSubscriptions(&MailboxMessage{From: tt.from, Text: tt.text, Date: time.Now()})
+		if len(subs) != tt.count {
+			t.Errorf("%s: got %d subscriptions, want %d", tt.from, len(subs), tt.count)
+			continue
+		}
+		for _, sub := range subs {
+			if sub.BillingPlatform != tt.platform || sub.ID == "" || !sub.IsAutoDetected {
+				t.Errorf("%s: subscription = %+v", tt.from, sub)
+			}
+		}
+	}
+}
+
+func TestStoreReceiptSenders(t *testing.T) {
+	senders := strings.Join(storeReceiptSenders(), " ")
+	for _, want := range []string{"no_reply@email.apple.com", "googleplay-noreply@google.com"} {
+		if !strings.Contains(senders, want) {
+			t.Errorf("senders %q missing %s", senders, want)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,6 +22,31 @@ type Subscription struct {
 	Category        string  `json:"category"`
 	Color           string  `json:"color,omitempty"`
 	IsAutoDetected  bool    `json:"isAutoDetected"`
+	TrialEndDate    string  `json:"trialEndDate,omitempty"`
+	ReminderDays    []int   `json:"reminderDays,omitempty"` // overrides the user's lead times
+
+	Sources         []string `json:"sources,omitempty"`         // where we found it, see SourceGmail
+	BillingPlatform string   `json:"billingPlatform,omitempty"` // apple, google_play or direct
+	MerchantAliases []string `json:"merchantAliases,omitempty"` // statement descriptors that mean this service
+
+	DetectedAt     *time.Time `json:"detectedAt,omitempty"` // first found by a scan
+	Confidence     float64    `json:"confidence,omitempty"` // 0-1, set by statement detection
+	PreviousPrice  float64    `json:"previousPrice,omitempty"`
+	PriceChangedAt *time.Time `json:"priceChangedAt,omitempty"`
+}
+
+const (
+	SourceGmail     = "gmail"
+	SourceStatement = "statement"
+)
+
+type UpdateAliasesRequest struct {
+	MerchantAliases []string `json:"merchantAliases"`
+}
+
+type UpdateRemindersRequest struct {
+	ReminderDays []int  `json:"reminderDays"`
+	TrialEndDate string `json:"trialEndDate"`
 }
 
 func NewSubscriptionService() *SubscriptionService {
@@ -29,10 +56,6 @@ func NewSubscriptionService() *SubscriptionService {
 // GetSubscriptions returns all subscriptions for a user
 func (s *SubscriptionService) GetSubscriptions(c *gin.Context) {
 	userID := c.GetString("user_id")
-	if userID == "" {
-		// For demo, use temp_user
-		userID = "temp_user"
-	}
 
 	// Fetch from storage
 	subscriptions := store.GetSubscriptions(userID)
@@ -46,9 +69,6 @@ func (s *SubscriptionService) GetSubscriptions(c *gin.Context) {
 // GetSubscription returns a single subscription
 func (s *SubscriptionService) GetSubscription(c *gin.Context) {
 	userID := c.GetString("user_id")
-	if userID == "" {
-		userID = "temp_user"
-	}
 	subID := c.Param("id")
 
 	subscription := store.GetSubscription(userID, subID)
@@ -63,9 +83,6 @@ func (s *SubscriptionService) GetSubscription(c *gin.Context) {
 // DeleteSubscription removes a subscription
 func (s *SubscriptionService) DeleteSubscription(c *gin.Context) {
 	userID := c.GetString("user_id")
-	if userID == "" {
-		userID = "temp_user"
-	}
 	subID := c.Param("id")
 
 	success := store.DeleteSubscription(userID, subID)
@@ -80,4 +97,89 @@ func (s *SubscriptionService) DeleteSubscription(c *gin.Context) {
 		"success": true,
 		"message": "Subscription deleted",
 	})
-}
\ No newline at end of file
+}
+
+// UpdateReminders sets per-subscription reminder lead times and trial end
+func (s *SubscriptionService) UpdateReminders(c *gin.Context) {
+	userID := c.GetString("user_id")
+	subID := c.Param("id")
+
+	var req UpdateRemindersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if !validReminderDays(req.ReminderDays) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reminder days"})
+		return
+	}
+	if req.TrialEndDate != "" {
+		if _, err := time.Parse(dateLayout, req.TrialEndDate); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid trial end date"})
+			return
+		}
+	}
+
+	subscription := store.UpdateSubscription(userID, subID, func(sub *Subscription) {
+		sub.ReminderDays = req.ReminderDays
+		sub.TrialEndDate = req.TrialEndDate
+	})
+	if subscription == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// UpdateAliases sets the statement descriptors that reconciliation matches
+// to this subscription, e.g. "nflx" or "ptt*netflix"
+func (s *SubscriptionService) UpdateAliases(c *gin.Context) {
+	userID := c.GetString("user_id")
+	subID := c.Param("id")
+
+	var req UpdateAliasesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if len(req.MerchantAliases) > 10 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most 10 aliases"})
+		return
+	}
+	aliases := make([]string, 0, len(req.MerchantAliases))
+	for _, alias := range req.MerchantAliases {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		if alias == "" || len(alias) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alias"})
+			return
+		}
+		aliases = append(aliases, alias)
+	}
+
+	subscription := store.UpdateSubscription(userID, subID, func(sub *Subscription) {
+		sub.MerchantAliases = aliases
+	})
+	if subscription == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// validReminderDays allows up to 5 lead times between 0 and 60 days.
+// nil means "use the default".
+func validReminderDays(days []int) bool {
+	if len(days) > 5 {
+		return false
+	}
+	for _, d := range days {
+		if d < 0 || d > 60 {
+			return false
+		}
+	}
+	return true
+}
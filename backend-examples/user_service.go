@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTimeZone     = "UTC"
+	defaultHomeCurrency = "USD"
+)
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Symbols for currencies we format with a prefix, others get the code
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"THB": "฿",
+	"INR": "₹",
+	"KRW": "₩",
+}
+
+// formatMoney renders amount for people, e.g. ฿419, $15.99 or 12.50 SEK.
+// Whole amounts drop the decimals.
+func formatMoney(amount float64, currency string) string {
+	value := fmt.Sprintf("%.2f", amount)
+	if amount == float64(int64(amount)) || currency == "JPY" || currency == "KRW" {
+		value = fmt.Sprintf("%.0f", amount)
+	}
+
+	if symbol, ok := currencySymbols[currency]; ok {
+		return symbol + value
+	}
+	return value + " " + currency
+}
+
+type UserService struct{}
+
+// User is an account created at first login
+type User struct {
+	ID            string               `json:"id"`
+	GoogleSubject string               `json:"-"`
+	Email         string               `json:"email"`
+	Name          string               `json:"name"`
+	Picture       string               `json:"picture"`
+	Locale        string               `json:"locale,omitempty"`
+	Roles         []string             `json:"roles"`
+	TimeZone      string               `json:"timeZone"`
+	HomeCurrency  string               `json:"homeCurrency"`
+	ReminderDays  []int                `json:"reminderDays,omitempty"`
+	Digest        DigestSettings       `json:"digest"`
+	Notifications NotificationSettings `json:"-"` // see /api/settings/notifications
+	CreatedAt     time.Time            `json:"createdAt"`
+	LastLoginAt   time.Time            `json:"lastLoginAt"`
+}
+
+type UpdateProfileRequest struct {
+	Name         *string         `json:"name"`
+	Locale       *string         `json:"locale"`
+	TimeZone     *string         `json:"timeZone"`
+	HomeCurrency *string         `json:"homeCurrency"`
+	ReminderDays *[]int          `json:"reminderDays"`
+	Digest       *DigestSettings `json:"digest"`
+}
+
+func NewUserService() *UserService {
+	return &UserService{}
+}
+
+// GetMe returns the profile of the signed-in user
+func (s *UserService) GetMe(c *gin.Context) {
+	user := store.GetUser(c.GetString("user_id"))
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// UpdateMe updates the editable fields of the signed-in user's profile
+func (s *UserService) UpdateMe(c *gin.Context) {
+	var req UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if req.TimeZone != nil {
+		if _, err := time.LoadLocation(*req.TimeZone); err != nil || *req.TimeZone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time zone"})
+			return
+		}
+	}
+
+	if req.HomeCurrency != nil {
+		currency := strings.ToUpper(strings.TrimSpace(*req.HomeCurrency))
+		if !currencyCodePattern.MatchString(currency) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid currency code"})
+			return
+		}
+		req.HomeCurrency = &currency
+	}
+
+	if req.ReminderDays != nil && !validReminderDays(*req.ReminderDays) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reminder days"})
+		return
+	}
+
+	if req.Digest != nil && !validDigestSettings(req.Digest) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid digest settings"})
+		return
+	}
+
+	user := store.UpdateUser(c.GetString("user_id"), func(u *User) {
+		if req.Name != nil {
+			u.Name = strings.TrimSpace(*req.Name)
+		}
+		if req.Locale != nil {
+			u.Locale = *req.Locale
+		}
+		if req.TimeZone != nil {
+			u.TimeZone = *req.TimeZone
+		}
+		if req.HomeCurrency != nil {
+			u.HomeCurrency = *req.HomeCurrency
+		}
+		if req.ReminderDays != nil {
+			u.ReminderDays = *req.ReminderDays
+		}
+		if req.Digest != nil {
+			u.Digest = *req.Digest
+		}
+	})
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// DeleteMe deletes the signed-in user's account and all of its data
+func (s *UserService) DeleteMe(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	if !store.DeleteUser(userID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	fmt.Printf("🗑️  Deleted account: %s\n", userID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Account deleted",
+	})
+}
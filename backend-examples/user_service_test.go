@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func userRouter() *gin.Engine {
+	s := NewUserService()
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.GET("/me", s.GetMe)
+	r.PATCH("/me", s.UpdateMe)
+	r.DELETE("/me", s.DeleteMe)
+	return r
+}
+
+func TestEmailUserCreatedOnce(t *testing.T) {
+	user := testUser(t)
+	if user.TimeZone != defaultTimeZone || user.HomeCurrency != defaultHomeCurrency || len(user.Roles) != 1 || user.Roles[0] != RoleUser {
+		t.Errorf("new user = %+v", user)
+	}
+
+	again := store.GetOrCreateEmailUser(strings.ToUpper(user.Email))
+	if again.ID != user.ID || again.CreatedAt != user.CreatedAt {
+		t.Errorf("second login created %s, want %s", again.ID, user.ID)
+	}
+}
+
+func TestUpdateMe(t *testing.T) {
+	r := userRouter()
+	user := testUser(t)
+	tokens, _ := issueSession(user)
+
+	for name, body := range map[string]gin.H{
+		"time zone":     {"timeZone": "Mars/Olympus_Mons"},
+		"empty zone":    {"timeZone": ""},
+		"currency":      {"homeCurrency": "baht"},
+		"reminder days": {"reminderDays": []int{-1}},
+	} {
+		if w := serveJSON(r, http.MethodPatch, "/me", body, tokens.AccessToken); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: PATCH = %d", name, w.Code)
+		}
+	}
+
+	w := serveJSON(r, http.MethodPatch, "/me", gin.H{"name": "  Alice ", "timeZone": "Asia/Bangkok", "homeCurrency": " thb"}, tokens.AccessToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d %s", w.Code, w.Body.String())
+	}
+	var updated User
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.Name != "Alice" || updated.TimeZone != "Asia/Bangkok" || updated.HomeCurrency != "THB" || updated.Email != user.Email {
+		t.Errorf("updated = %+v", updated)
+	}
+	if got := store.GetUser(user.ID); got.HomeCurrency != "THB" {
+		t.Errorf("stored currency = %s", got.HomeCurrency)
+	}
+}
+
+func TestDeleteMe(t *testing.T) {
+	r := userRouter()
+	user := testUser(t)
+	tokens, _ := issueSession(user)
+	store.SaveSubscription(user.ID, &Subscription{ID: "sub-1", Name: "Netflix", Price: 15.49, BillingCycle: "monthly"})
+
+	if w := serveJSON(r, http.MethodDelete, "/me", nil, tokens.AccessToken); w.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d %s", w.Code, w.Body.String())
+	}
+	if store.GetUser(user.ID) != nil || len(store.GetSubscriptions(user.ID)) != 0 {
+		t.Error("account data left behind")
+	}
+	if w := serveJSON(r, http.MethodGet, "/me", nil, tokens.AccessToken); w.Code == http.StatusOK {
+		t.Error("deleted account still readable")
+	}
+
+	// The next sign-in with the address starts a fresh account
+	if again := store.GetOrCreateEmailUser(user.Email); again.ID == user.ID {
+		t.Error("deleted account came back")
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{419, "THB", "฿419"},
+		{15.99, "USD", "$15.99"},
+		{1200.5, "JPY", "¥1200"},
+		{12.5, "SEK", "12.50 SEK"},
+	}
+	for _, tt := range tests {
+		if got := formatMoney(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("formatMoney(%v, %s) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
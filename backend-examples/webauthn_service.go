@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+const (
+	ceremonyTTL = 5 * time.Minute
+	stepUpTTL   = 5 * time.Minute
+
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+	ceremonyStepUp   = "step_up"
+)
+
+type WebAuthnService struct {
+	webAuthn *webauthn.WebAuthn
+}
+
+// Passkey is a WebAuthn credential registered to a user
+type Passkey struct {
+	ID         string              `json:"id"`
+	UserID     string              `json:"-"`
+	Name       string              `json:"name"`
+	Credential webauthn.Credential `json:"-"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	LastUsedAt *time.Time          `json:"lastUsedAt,omitempty"`
+}
+
+// WebAuthnCeremony holds the challenge between a begin and finish call
+type WebAuthnCeremony struct {
+	Purpose   string
+	UserID    string
+	JTI       string
+	Session   webauthn.SessionData
+	ExpiresAt time.Time
+}
+
+// webAuthnUser adapts User to the webauthn.User interface
+type webAuthnUser struct {
+	user     *User
+	passkeys []*Passkey
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte   { return []byte(u.user.ID) }
+func (u *webAuthnUser) WebAuthnName() string { return u.user.Email }
+func (u *webAuthnUser) WebAuthnIcon() string { return "" }
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if u.user.Name == "" {
+		return u.user.Email
+	}
+	return u.user.Name
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, passkey := range u.passkeys {
+		credentials = append(credentials, passkey.Credential)
+	}
+	return credentials
+}
+
+func NewWebAuthnService() (*WebAuthnService, error) {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = "localhost"
+	}
+
+	origins := os.Getenv("WEBAUTHN_RP_ORIGINS")
+	if origins == "" {
+		origins = os.Getenv("FRONTEND_URL")
+	}
+	if origins == "" {
+		origins = "http://localhost:3000"
+	}
+
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "SubTrack",
+		RPOrigins:     strings.Split(origins, ","),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnService{webAuthn: wa}, nil
+}
+
+// BeginRegistration starts adding a passkey to the signed-in user
+func (s *WebAuthnService) BeginRegistration(c *gin.Context) {
+	user := store.GetUser(c.GetString("user_id"))
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	waUser := &webAuthnUser{user: user, passkeys: store.GetPasskeys(user.ID)}
+
+	// Don't let the same authenticator register twice
+	exclude := make([]protocol.CredentialDescriptor, 0, len(waUser.passkeys))
+	for _, credential := range waUser.WebAuthnCredentials() {
+		exclude = append(exclude, credential.Descriptor())
+	}
+
+	options, session, err := s.webAuthn.BeginRegistration(waUser,
+		webauthn.WithExclusions(exclude),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start registration"})
+		return
+	}
+
+	s.respondWithCeremony(c, ceremonyRegister, user.ID, "", session, options)
+}
+
+// FinishRegistration verifies the attestation and stores the passkey
+func (s *WebAuthnService) FinishRegistration(c *gin.Context) {
+	userID := c.GetString("user_id")
+	ceremony := store.ConsumeWebAuthnCeremony(c.Query("session"), ceremonyRegister)
+	if ceremony == nil || ceremony.UserID != userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired session"})
+		return
+	}
+
+	user := store.GetUser(userID)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	waUser := &webAuthnUser{user: user, passkeys: store.GetPasskeys(user.ID)}
+	credential, err := s.webAuthn.FinishRegistration(waUser, ceremony.Session, c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey registration failed"})
+		return
+	}
+
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+
+	passkey := &Passkey{
+		ID:         uuid.NewString(),
+		UserID:     user.ID,
+		Name:       name,
+		Credential: *credential,
+		CreatedAt:  time.Now().UTC(),
+	}
+	store.SavePasskey(passkey)
+
+	fmt.Printf("🔑 Passkey registered for user %s\n", user.ID)
+
+	c.JSON(http.StatusCreated, passkey)
+}
+
+// BeginLogin starts a passkey sign-in. Discoverable credentials mean the
+// user doesn't have to type an email first.
+func (s *WebAuthnService) BeginLogin(c *gin.Context) {
+	options, session, err := s.webAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	s.respondWithCeremony(c, ceremonyLogin, "", "", session, options)
+}
+
+// FinishLogin verifies the assertion and issues the same tokens as Google sign-in
+func (s *WebAuthnService) FinishLogin(c *gin.Context) {
+	ceremony := store.ConsumeWebAuthnCeremony(c.Query("session"), ceremonyLogin)
+	if ceremony == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired session"})
+		return
+	}
+
+	var signedIn *User
+	credential, err := s.webAuthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		user := store.GetUser(string(userHandle))
+		if user == nil {
+			return nil, errors.New("unknown user")
+		}
+		signedIn = user
+		return &webAuthnUser{user: user, passkeys: store.GetPasskeys(user.ID)}, nil
+	}, ceremony.Session, c.Request)
+	if err != nil || signedIn == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey sign-in failed"})
+		return
+	}
+
+	if !s.recordUse(signedIn.ID, credential) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey sign-in failed"})
+		return
+	}
+
+	claimGuestSession(c, signedIn.ID)
+
+	tokens, err := issueSession(signedIn)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, TokenResponse{
+		SessionTokens: tokens,
+		User:          signedIn,
+	})
+}
+
+// BeginStepUp asks the signed-in user to confirm a sensitive action with a passkey
+func (s *WebAuthnService) BeginStepUp(c *gin.Context) {
+	user := store.GetUser(c.GetString("user_id"))
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	waUser := &webAuthnUser{user: user, passkeys: store.GetPasskeys(user.ID)}
+	if len(waUser.passkeys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No passkeys registered"})
+		return
+	}
+
+	options, session, err := s.webAuthn.BeginLogin(waUser,
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start verification"})
+		return
+	}
+
+	s.respondWithCeremony(c, ceremonyStepUp, user.ID, c.GetString("jti"), session, options)
+}
+
+// FinishStepUp verifies the assertion and marks the current access token as
+// recently verified
+func (s *WebAuthnService) FinishStepUp(c *gin.Context) {
+	userID := c.GetString("user_id")
+	jti := c.GetString("jti")
+
+	ceremony := store.ConsumeWebAuthnCeremony(c.Query("session"), ceremonyStepUp)
+	if ceremony == nil || ceremony.UserID != userID || ceremony.JTI != jti {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired session"})
+		return
+	}
+
+	user := store.GetUser(userID)
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	waUser := &webAuthnUser{user: user, passkeys: store.GetPasskeys(user.ID)}
+	credential, err := s.webAuthn.FinishLogin(waUser, ceremony.Session, c.Request)
+	if err != nil || !s.recordUse(user.ID, credential) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey verification failed"})
+		return
+	}
+
+	expiresAt := time.Now().Add(stepUpTTL)
+	store.SaveStepUp(jti, expiresAt)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"expiresAt": expiresAt.UTC(),
+	})
+}
+
+// ListPasskeys returns the user's registered passkeys
+func (s *WebAuthnService) ListPasskeys(c *gin.Context) {
+	passkeys := store.GetPasskeys(c.GetString("user_id"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"passkeys": passkeys,
+		"total":    len(passkeys),
+	})
+}
+
+// DeletePasskey removes a passkey, e.g. for a lost authenticator
+func (s *WebAuthnService) DeletePasskey(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	if !store.DeletePasskey(userID, c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+		return
+	}
+
+	fmt.Printf("🔑 Passkey removed for user %s\n", userID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Passkey removed",
+	})
+}
+
+// recordUse stores the new sign counter. Returns false if the authenticator
+// looks cloned.
+func (s *WebAuthnService) recordUse(userID string, credential *webauthn.Credential) bool {
+	if credential.Authenticator.CloneWarning {
+		fmt.Printf("⚠️  Passkey sign counter went backwards for user %s, possible clone\n", userID)
+		return false
+	}
+	return store.UpdatePasskeyCounter(userID, credential.ID, credential.Authenticator.SignCount)
+}
+
+func (s *WebAuthnService) respondWithCeremony(c *gin.Context, purpose, userID, jti string, session *webauthn.SessionData, options interface{}) {
+	ceremonyID, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
+
+	store.SaveWebAuthnCeremony(ceremonyID, &WebAuthnCeremony{
+		Purpose:   purpose,
+		UserID:    userID,
+		JTI:       jti,
+		Session:   *session,
+		ExpiresAt: time.Now().Add(ceremonyTTL),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"session": ceremonyID,
+		"options": options,
+	})
+}
+
+// RequireStepUp protects sensitive actions. Users with a passkey must have
+// confirmed with it recently; users without one are let through.
+func RequireStepUp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		if len(store.GetPasskeys(userID)) == 0 {
+			c.Next()
+			return
+		}
+
+		if c.GetString("auth_type") != authTypeSession || !store.HasStepUp(c.GetString("jti")) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Passkey verification required",
+				"code":  "step_up_required",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// findPasskey returns the index of the credential in passkeys, or -1
+func findPasskey(passkeys []*Passkey, credentialID []byte) int {
+	for i, passkey := range passkeys {
+		if bytes.Equal(passkey.Credential.ID, credentialID) {
+			return i
+		}
+	}
+	return -1
+}
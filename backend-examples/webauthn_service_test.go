@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:3000"
+)
+
+// softAuthenticator is a passkey held in memory. It answers WebAuthn
+// ceremonies the way a browser and platform authenticator would, with "none"
+// attestation.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	origin       string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, credentialID: id, origin: testOrigin}
+}
+
+// ceremonyOptions is the begin response with just what the authenticator reads
+type ceremonyOptions struct {
+	Session string `json:"session"`
+	Options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	} `json:"options"`
+}
+
+func (a *softAuthenticator) clientData(ceremonyType, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+	return data
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+// create answers navigator.credentials.create()
+func (a *softAuthenticator) create(t *testing.T, options ceremonyOptions) interface{} {
+	t.Helper()
+	userHandle, err := base64.RawURLEncoding.DecodeString(options.Options.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = userHandle
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(struct {
+		Fmt      string                 `cbor:"fmt"`
+		AttStmt  map[string]interface{} `cbor:"attStmt"`
+		AuthData []byte                 `cbor:"authData"`
+	}{"none", map[string]interface{}{}, a.authData(0x45, attested)}) // UP, UV, AT
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options.Options.PublicKey.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	}
+}
+
+// get answers navigator.credentials.get(), counting the use
+func (a *softAuthenticator) get(t *testing.T, options ceremonyOptions) interface{} {
+	t.Helper()
+	a.signCount++
+	authData := a.authData(0x05, nil) // UP, UV
+	clientData := a.clientData("webauthn.get", options.Options.PublicKey.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	return map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+func webAuthnRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	t.Setenv("WEBAUTHN_RP_ID", testRPID)
+	t.Setenv("WEBAUTHN_RP_ORIGINS", testOrigin)
+	service, err := NewWebAuthnService()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/login/begin", service.BeginLogin)
+	r.POST("/login/finish", service.FinishLogin)
+	passkeys := r.Group("", AuthMiddleware(), RequireSession())
+	passkeys.POST("/register/begin", RequireStepUp(), service.BeginRegistration)
+	passkeys.POST("/register/finish", RequireStepUp(), service.FinishRegistration)
+	passkeys.DELETE("/credentials/:id", RequireStepUp(), service.DeletePasskey)
+	passkeys.POST("/verify/begin", service.BeginStepUp)
+	passkeys.POST("/verify/finish", service.FinishStepUp)
+	passkeys.DELETE("/sensitive", RequireStepUp(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	return r
+}
+
+// begin starts a ceremony and decodes its options
+func begin(t *testing.T, r http.Handler, path, token string) ceremonyOptions {
+	t.Helper()
+	w := serveJSON(r, http.MethodPost, path, nil, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s = %d %s", path, w.Code, w.Body.String())
+	}
+	var options ceremonyOptions
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+// finish posts the authenticator's answer for the ceremony
+func finish(r http.Handler, path string, options ceremonyOptions, credential interface{}, token string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(credential)
+	req := httptest.NewRequest(http.MethodPost, path+"?session="+options.Session, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// registerPasskey signs user in and adds a passkey held by a new authenticator
+func registerPasskey(t *testing.T, r http.Handler, user *User) (*softAuthenticator, string) {
+	t.Helper()
+	session, err := issueSession(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, passkey := range store.GetPasskeys(user.ID) {
+			store.DeletePasskey(user.ID, passkey.ID)
+		}
+	})
+	authenticator := newSoftAuthenticator(t)
+	options := begin(t, r, "/register/begin", session.AccessToken)
+	if w := finish(r, "/register/finish", options, authenticator.create(t, options), session.AccessToken); w.Code != http.StatusCreated {
+		t.Fatalf("register = %d %s", w.Code, w.Body.String())
+	}
+	return authenticator, session.AccessToken
+}
+
+func TestPasskeySignIn(t *testing.T) {
+	r := webAuthnRouter(t)
+	user := testUser(t)
+	authenticator, _ := registerPasskey(t, r, user)
+
+	options := begin(t, r, "/login/begin", "")
+	w := finish(r, "/login/finish", options, authenticator.get(t, options), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login = %d %s", w.Code, w.Body.String())
+	}
+	var resp TokenResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.User == nil || resp.User.ID != user.ID || resp.AccessToken == "" {
+		t.Fatalf("login response = %s", w.Body.String())
+	}
+
+	// Each challenge is good for one ceremony
+	if w := finish(r, "/login/finish", options, authenticator.get(t, options), ""); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed ceremony = %d, want 400", w.Code)
+	}
+}
+
+func TestPasskeyRejectsBadAssertions(t *testing.T) {
+	r := webAuthnRouter(t)
+	authenticator, _ := registerPasskey(t, r, testUser(t))
+
+	t.Run("wrong origin", func(t *testing.T) {
+		authenticator.origin = "https://evil.example"
+		defer func() { authenticator.origin = testOrigin }()
+		options := begin(t, r, "/login/begin", "")
+		if w := finish(r, "/login/finish", options, authenticator.get(t, options), ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("login = %d, want 401", w.Code)
+		}
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		impostor := newSoftAuthenticator(t)
+		impostor.credentialID, impostor.userHandle = authenticator.credentialID, authenticator.userHandle
+		impostor.signCount = 100
+		options := begin(t, r, "/login/begin", "")
+		if w := finish(r, "/login/finish", options, impostor.get(t, options), ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("login = %d, want 401", w.Code)
+		}
+	})
+
+	t.Run("counter went backwards", func(t *testing.T) {
+		options := begin(t, r, "/login/begin", "")
+		if w := finish(r, "/login/finish", options, authenticator.get(t, options), ""); w.Code != http.StatusOK {
+			t.Fatalf("login = %d %s", w.Code, w.Body.String())
+		}
+
+		// A copy of the key that hasn't seen the last use
+		authenticator.signCount--
+		options = begin(t, r, "/login/begin", "")
+		if w := finish(r, "/login/finish", options, authenticator.get(t, options), ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("cloned authenticator = %d, want 401", w.Code)
+		}
+	})
+}
+
+func TestPasskeyStepUp(t *testing.T) {
+	r := webAuthnRouter(t)
+	user := testUser(t)
+	authenticator, token := registerPasskey(t, r, user)
+
+	w := serveJSON(r, http.MethodDelete, "/sensitive", nil, token)
+	if w.Code != http.StatusForbidden || !bytes.Contains(w.Body.Bytes(), []byte("step_up_required")) {
+		t.Fatalf("before step-up = %d %s", w.Code, w.Body.String())
+	}
+
+	options := begin(t, r, "/verify/begin", token)
+	if w := finish(r, "/verify/finish", options, authenticator.get(t, options), token); w.Code != http.StatusOK {
+		t.Fatalf("step-up = %d %s", w.Code, w.Body.String())
+	}
+	if w := serveJSON(r, http.MethodDelete, "/sensitive", nil, token); w.Code != http.StatusNoContent {
+		t.Errorf("after step-up = %d", w.Code)
+	}
+
+	// The step-up belongs to the access token that did it
+	other, _ := issueSession(user)
+	if w := serveJSON(r, http.MethodDelete, "/sensitive", nil, other.AccessToken); w.Code != http.StatusForbidden {
+		t.Errorf("another session = %d, want 403", w.Code)
+	}
+}
+
+func TestPasskeyChangesNeedStepUp(t *testing.T) {
+	r := webAuthnRouter(t)
+	user := testUser(t)
+	authenticator, token := registerPasskey(t, r, user)
+	first := store.GetPasskeys(user.ID)[0].ID
+
+	// A stolen access token can't swap in the attacker's own passkey
+	stolen, _ := issueSession(user)
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPost, "/register/begin"},
+		{http.MethodPost, "/register/finish"},
+		{http.MethodDelete, "/credentials/" + first},
+	} {
+		if w := serveJSON(r, req.method, req.path, nil, stolen.AccessToken); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s without step-up = %d, want 403", req.method, req.path, w.Code)
+		}
+	}
+
+	options := begin(t, r, "/verify/begin", token)
+	if w := finish(r, "/verify/finish", options, authenticator.get(t, options), token); w.Code != http.StatusOK {
+		t.Fatalf("step-up = %d %s", w.Code, w.Body.String())
+	}
+	replacement := newSoftAuthenticator(t)
+	options = begin(t, r, "/register/begin", token)
+	if w := finish(r, "/register/finish", options, replacement.create(t, options), token); w.Code != http.StatusCreated {
+		t.Fatalf("second passkey = %d %s", w.Code, w.Body.String())
+	}
+
+	if w := serveJSON(r, http.MethodDelete, "/credentials/"+first, nil, token); w.Code != http.StatusOK {
+		t.Fatalf("remove = %d %s", w.Code, w.Body.String())
+	}
+	if w := serveJSON(r, http.MethodDelete, "/credentials/"+first, nil, token); w.Code != http.StatusNotFound {
+		t.Errorf("remove twice = %d, want 404", w.Code)
+	}
+	if passkeys := store.GetPasskeys(user.ID); len(passkeys) != 1 || passkeys[0].ID == first {
+		t.Fatalf("passkeys = %+v", passkeys)
+	}
+
+	// The removed key no longer signs in, the new one does
+	options = begin(t, r, "/login/begin", "")
+	if w := finish(r, "/login/finish", options, authenticator.get(t, options), ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("removed passkey login = %d, want 401", w.Code)
+	}
+	options = begin(t, r, "/login/begin", "")
+	if w := finish(r, "/login/finish", options, replacement.get(t, options), ""); w.Code != http.StatusOK {
+		t.Errorf("new passkey login = %d %s", w.Code, w.Body.String())
+	}
+}
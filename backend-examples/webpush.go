@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	pushRecordSize = 4096
+	// Push services accept 4096 byte bodies, minus the 86 byte header, the
+	// 16 byte tag and the padding delimiter
+	maxPushPayload = 4096 - 86 - 16 - 1
+	vapidTokenTTL  = 12 * time.Hour
+)
+
+// errPushGone means the push service dropped the subscription (404/410)
+var errPushGone = errors.New("push subscription expired")
+
+// WebPusher encrypts and sends Web Push messages (RFC 8291) signed with our
+// VAPID key (RFC 8292)
+type WebPusher struct {
+	key       *ecdsa.PrivateKey
+	publicKey string // uncompressed point, base64url, what browsers call applicationServerKey
+	subject   string
+	client    *http.Client
+}
+
+// NewWebPusher loads the VAPID key from VAPID_PRIVATE_KEY (base64url, as
+// printed by most web-push tools) or VAPID_KEY_FILE. If neither exists a key
+// is generated and written to VAPID_KEY_FILE so subscriptions keep working
+// across restarts.
+func NewWebPusher() (*WebPusher, error) {
+	var key *ecdsa.PrivateKey
+	var err error
+
+	if raw := os.Getenv("VAPID_PRIVATE_KEY"); raw != "" {
+		key, err = parseVAPIDPrivateKey(raw)
+	} else {
+		key, err = loadOrCreateVAPIDKey(envOr("VAPID_KEY_FILE", "data/vapid.pem"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := key.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+
+	// Endpoints come from browsers, so only public addresses are dialled
+	client := newPublicHTTPClient(10 * time.Second)
+	if os.Getenv("NOTIFY_ALLOW_PRIVATE") == "true" {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &WebPusher{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(public.Bytes()),
+		subject:   envOr("VAPID_SUBJECT", envOr("PUBLIC_URL", "http://localhost:8080")),
+		client:    client,
+	}, nil
+}
+
+// PublicKey returns the applicationServerKey browsers subscribe with
+func (p *WebPusher) PublicKey() string {
+	return p.publicKey
+}
+
+// Send encrypts payload for sub and posts it to the push service
+func (p *WebPusher) Send(ctx context.Context, sub *PushSubscription, payload []byte, ttl time.Duration) error {
+	if len(payload) > maxPushPayload {
+		return fmt.Errorf("push payload too large (%d bytes)", len(payload))
+	}
+
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+
+	authorization, err := p.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", fmt.Sprintf("%d", int(ttl.Seconds())))
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushGone
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		// Logged only, the error reaches the delivery log
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		fmt.Printf("❌ Push service %s answered %d: %s\n", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(snippet)))
+		return fmt.Errorf("push service returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// vapidAuthorization builds the "vapid t=..., k=..." header for the origin
+// of endpoint
+func (p *WebPusher) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(vapidTokenTTL).Unix(),
+		"sub": p.subject,
+	}).SignedString(p.key)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("vapid t=%s, k=%s", token, p.publicKey), nil
+}
+
+// encryptPushPayload implements the aes128gcm content coding from RFC 8291
+// as a single record
+func encryptPushPayload(sub *PushSubscription, payload []byte) ([]byte, error) {
+	uaPublicBytes, err := decodeBase64URL(sub.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeBase64URL(sub.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// A fresh key pair per message, its public half goes in the header
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdfSHA256(authSecret, sharedSecret, keyInfo, 32)
+
+	cek := hkdfSHA256(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfSHA256(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// 0x02 marks the last (and only) record
+	plaintext := append(append([]byte(nil), payload...), 0x02)
+
+	header := make([]byte, 0, 21+len(asPublicBytes))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, pushRecordSize)
+	header = append(header, byte(len(asPublicBytes)))
+	header = append(header, asPublicBytes...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// hkdfSHA256 is HKDF extract and expand (RFC 5869) for outputs up to one
+// hash length, which is all Web Push needs
+func hkdfSHA256(salt, secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)[:length]
+}
+
+func parseVAPIDPrivateKey(raw string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeBase64URL(raw)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("VAPID_PRIVATE_KEY must be a base64url P-256 private key")
+	}
+
+	priv, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID_PRIVATE_KEY: %w", err)
+	}
+	point := priv.PublicKey().Bytes()
+
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(point[1:33]),
+			Y:     new(big.Int).SetBytes(point[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}, nil
+}
+
+func loadOrCreateVAPIDKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("🔑 Generated VAPID key at %s\n", path)
+	return key, nil
+}
+
+// decodeBase64URL accepts base64url with or without padding, as browsers
+// and tools disagree
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// pushStandIn plays a browser together with its push service: it holds the
+// subscription keys and decrypts what is posted to its endpoint
+type pushStandIn struct {
+	*httptest.Server
+	uaKey  *ecdh.PrivateKey
+	auth   []byte
+	status int
+
+	mu       sync.Mutex
+	messages [][]byte
+	requests []*http.Request
+}
+
+func newPushStandIn(t *testing.T) *pushStandIn {
+	t.Helper()
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+
+	p := &pushStandIn{uaKey: uaKey, auth: auth, status: http.StatusCreated}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		plaintext, err := p.decrypt(body)
+		if err != nil {
+			t.Errorf("push stand-in could not decrypt: %v", err)
+			http.Error(w, "bad encryption", http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		p.messages = append(p.messages, plaintext)
+		p.requests = append(p.requests, r)
+		p.mu.Unlock()
+		http.Error(w, "push service internals", p.status)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *pushStandIn) subscription(userID string) *PushSubscription {
+	return &PushSubscription{
+		ID:       "push-" + userID,
+		UserID:   userID,
+		Endpoint: p.URL + "/push/abc",
+		P256dh:   base64.RawURLEncoding.EncodeToString(p.uaKey.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(p.auth),
+	}
+}
+
+// decrypt reverses the aes128gcm content coding (RFC 8188) with the keys
+// derived as in RFC 8291
+func (p *pushStandIn) decrypt(body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("short header")
+	}
+	salt := body[:16]
+	idLen := int(body[20])
+	if binary.BigEndian.Uint32(body[16:20]) < 18 || len(body) < 21+idLen {
+		return nil, errors.New("bad header")
+	}
+	asPublicBytes := body[21 : 21+idLen]
+	ciphertext := body[21+idLen:]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := p.uaKey.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), p.uaKey.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdfSHA256(p.auth, shared, keyInfo, 32)
+	cek := hkdfSHA256(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfSHA256(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Strip the padding back to the last-record delimiter
+	end := bytes.LastIndexByte(plaintext, 0x02)
+	if end < 0 || len(bytes.Trim(plaintext[end+1:], "\x00")) != 0 {
+		return nil, errors.New("no record delimiter")
+	}
+	return plaintext[:end], nil
+}
+
+func (p *pushStandIn) received() ([][]byte, []*http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]byte(nil), p.messages...), append([]*http.Request(nil), p.requests...)
+}
+
+func newTestPusher(t *testing.T) *WebPusher {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := key.PublicKey.ECDH()
+	return &WebPusher{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(public.Bytes()),
+		subject:   "mailto:ops@example.com",
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func TestHKDFSHA256(t *testing.T) {
+	// RFC 5869 test case 1, first 32 bytes of the output
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	want := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf"
+	if got := hex.EncodeToString(hkdfSHA256(salt, ikm, info, 32)); got != want {
+		t.Errorf("hkdfSHA256 = %s, want %s", got, want)
+	}
+}
+
+func TestPushStandInReadsRFC8291Example(t *testing.T) {
+	// The worked example in RFC 8291 section 5 checks the stand-in itself
+	d, _ := decodeBase64URL("q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94")
+	uaKey, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, _ := decodeBase64URL("BTBZMqHH6r4Tts7J_aSIgg")
+	body, _ := decodeBase64URL("DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+
+	standIn := &pushStandIn{uaKey: uaKey, auth: auth}
+	plaintext, err := standIn.decrypt(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "When I grow up, I want to be a watermelon" {
+		t.Errorf("plaintext = %q", plaintext)
+	}
+}
+
+func TestWebPushSend(t *testing.T) {
+	standIn := newPushStandIn(t)
+	pusher := newTestPusher(t)
+
+	payload := []byte(`{"title":"Netflix renews tomorrow"}`)
+	if err := pusher.Send(context.Background(), standIn.subscription("u1"), payload, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, requests := standIn.received()
+	if len(messages) != 1 || !bytes.Equal(messages[0], payload) {
+		t.Fatalf("push service got %q", messages)
+	}
+	req := requests[0]
+	if req.Header.Get("Content-Encoding") != "aes128gcm" || req.Header.Get("TTL") != "3600" {
+		t.Errorf("headers = %v", req.Header)
+	}
+
+	// VAPID: a JWT for the push service's origin, signed by the key in k=
+	var token, k string
+	for _, part := range strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), "vapid "), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			token = value
+		case "k":
+			k = value
+		}
+	}
+	if k != pusher.PublicKey() {
+		t.Errorf("k = %q, want the VAPID public key", k)
+	}
+	point, _ := decodeBase64URL(k)
+	public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(point[1:33]), Y: new(big.Int).SetBytes(point[33:])}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) { return public, nil },
+		jwt.WithValidMethods([]string{"ES256"}), jwt.WithAudience(standIn.URL), jwt.WithExpirationRequired()); err != nil {
+		t.Errorf("VAPID token: %v", err)
+	}
+	if claims["sub"] != "mailto:ops@example.com" {
+		t.Errorf("sub = %v", claims["sub"])
+	}
+
+	// Each message gets its own salt and key
+	pusher.Send(context.Background(), standIn.subscription("u1"), payload, time.Hour)
+	if messages, _ := standIn.received(); len(messages) != 2 {
+		t.Errorf("second message not delivered")
+	}
+}
+
+func TestWebPushErrors(t *testing.T) {
+	standIn := newPushStandIn(t)
+	pusher := newTestPusher(t)
+
+	standIn.status = http.StatusInternalServerError
+	err := pusher.Send(context.Background(), standIn.subscription("u1"), []byte("hi"), time.Hour)
+	if err == nil || strings.Contains(err.Error(), "internals") {
+		t.Errorf("err = %v, want a status without the response body", err)
+	}
+
+	if err := pusher.Send(context.Background(), standIn.subscription("u1"), make([]byte, maxPushPayload+1), time.Hour); err == nil {
+		t.Error("oversized payload accepted")
+	}
+}
+
+func TestPushNotifierRemovesGoneEndpoints(t *testing.T) {
+	standIn := newPushStandIn(t)
+	standIn.status = http.StatusGone
+	user := testUser(t)
+	store.SavePushSubscription(standIn.subscription(user.ID))
+
+	notifier := &PushNotifier{pusher: newTestPusher(t)}
+	if err := notifier.Send(context.Background(), user, nil, &Notification{Title: "Hi"}); err == nil {
+		t.Error("send to an expired endpoint succeeded")
+	}
+	if subs := store.GetPushSubscriptions(user.ID); len(subs) != 0 {
+		t.Errorf("%d expired endpoints kept", len(subs))
+	}
+}
+
+func TestSubscribeRejectsPrivateEndpoints(t *testing.T) {
+	standIn := newPushStandIn(t)
+	user := testUser(t)
+	session, _ := issueSession(user)
+	sub := standIn.subscription(user.ID)
+
+	service := &PushService{pusher: newTestPusher(t), allowHTTP: true}
+	r := gin.New()
+	r.POST("/subscribe", AuthMiddleware(), service.Subscribe)
+
+	for _, endpoint := range []string{sub.Endpoint, "https://169.254.169.254/latest", "https://10.1.2.3/push", "https://localhost/push"} {
+		req := SubscribePushRequest{Endpoint: endpoint}
+		req.Keys.P256dh, req.Keys.Auth = sub.P256dh, sub.Auth
+		if w := serveJSON(r, http.MethodPost, "/subscribe", req, session.AccessToken); w.Code != http.StatusBadRequest {
+			t.Errorf("subscribe %s = %d, want 400", endpoint, w.Code)
+		}
+	}
+	if subs := store.GetPushSubscriptions(user.ID); len(subs) != 0 {
+		t.Errorf("%d private endpoints saved", len(subs))
+	}
+
+	// Allowed for development against a local push service
+	service.allowPrivate = true
+	req := SubscribePushRequest{Endpoint: sub.Endpoint}
+	req.Keys.P256dh, req.Keys.Auth = sub.P256dh, sub.Auth
+	if w := serveJSON(r, http.MethodPost, "/subscribe", req, session.AccessToken); w.Code != http.StatusCreated {
+		t.Errorf("subscribe with private addresses allowed = %d", w.Code)
+	}
+}
@@ -0,0 +1,17 @@
+// Service worker for SubTrack browser notifications
+self.addEventListener('push', (event) => {
+  const data = event.data ? event.data.json() : {};
+
+  event.waitUntil(
+    self.registration.showNotification(data.title || 'SubTrack', {
+      body: data.body,
+      tag: data.event,
+      data: { url: data.url || '/app' },
+    })
+  );
+});
+
+self.addEventListener('notificationclick', (event) => {
+  event.notification.close();
+  event.waitUntil(self.clients.openWindow(event.notification.data.url));
+});
@@ -23,6 +23,7 @@ export interface Subscription {
   category: string;
   color: string;
   isAutoDetected?: boolean;
+  billingPlatform?: 'apple' | 'google_play' | 'direct';
 }
 
 interface DashboardProps {
@@ -11,6 +11,7 @@ import {
 } from 'lucide-react';
 import { motion } from 'motion/react';
 import { clsx } from 'clsx';
+import { apiService } from '../services/api';
 
 interface IntegrationsProps {
   isSyncing: boolean;
@@ -19,6 +20,15 @@ interface IntegrationsProps {
 }
 
 export const Integrations: React.FC<IntegrationsProps> = ({ isSyncing, onSync, lastSync }) => {
+  const handleAddOutlook = async () => {
+    try {
+      const { authUrl } = await apiService.initiateOutlookConnection();
+      window.location.href = authUrl;
+    } catch (error) {
+      console.error('Failed to initiate Outlook connection:', error);
+    }
+  };
+
   return (
     <div className="max-w-4xl space-y-8 animate-in fade-in duration-500">
       <header>
@@ -81,6 +91,28 @@ export const Integrations: React.FC<IntegrationsProps> = ({ isSyncing, onSync, l
           </div>
         </div>
 
+        {/* Outlook Integration Card */}
+        <div className="bg-white rounded-[32px] border border-slate-100 shadow-sm p-8 flex flex-col md:flex-row items-start md:items-center gap-6">
+          <div className="w-16 h-16 bg-sky-50 rounded-2xl flex items-center justify-center shrink-0">
+            <Mail className="w-8 h-8 text-sky-600" />
+          </div>
+
+          <div className="flex-1">
+            <h3 className="text-xl font-bold text-slate-900 mb-1">Microsoft Outlook</h3>
+            <p className="text-slate-500 text-sm max-w-md">
+              Outlook.com, Hotmail and Microsoft 365 mailboxes, scanned the same way as Gmail.
+            </p>
+          </div>
+
+          <button
+            onClick={handleAddOutlook}
+            className="w-full md:w-auto flex items-center justify-center gap-2 px-6 py-3 rounded-xl font-bold transition-all bg-indigo-600 text-white hover:bg-indigo-700 shadow-lg shadow-indigo-100"
+          >
+            <Plus className="w-4 h-4" />
+            Add Outlook
+          </button>
+        </div>
+
         {/* Future Integrations */}
         <div className="grid grid-cols-1 md:grid-cols-2 gap-6">
           <div className="bg-white p-8 rounded-[32px] border border-slate-100 border-dashed opacity-60 grayscale hover:grayscale-0 hover:opacity-100 transition-all cursor-not-allowed">
@@ -92,13 +124,13 @@ export const Integrations: React.FC<IntegrationsProps> = ({ isSyncing, onSync, l
             <div className="mt-4 px-3 py-1 bg-slate-100 text-slate-500 text-[10px] font-bold rounded-full w-fit uppercase tracking-widest">Coming Soon</div>
           </div>
 
-          <div className="bg-white p-8 rounded-[32px] border border-slate-100 border-dashed opacity-60 grayscale hover:grayscale-0 hover:opacity-100 transition-all cursor-not-allowed">
+          <div className="bg-white p-8 rounded-[32px] border border-slate-100">
             <div className="w-12 h-12 bg-indigo-50 rounded-xl flex items-center justify-center mb-4">
               <ShieldCheck className="w-6 h-6 text-indigo-500" />
             </div>
-            <h4 className="font-bold text-slate-900 mb-1">Apple Subscriptions</h4>
-            <p className="text-sm text-slate-500">Import your App Store and iCloud subscriptions.</p>
-            <div className="mt-4 px-3 py-1 bg-slate-100 text-slate-500 text-[10px] font-bold rounded-full w-fit uppercase tracking-widest">Coming Soon</div>
+            <h4 className="font-bold text-slate-900 mb-1">App Store &amp; Google Play</h4>
+            <p className="text-sm text-slate-500">Receipts that bundle several apps are split into one subscription per app.</p>
+            <div className="mt-4 px-3 py-1 bg-indigo-50 text-indigo-600 text-[10px] font-bold rounded-full w-fit uppercase tracking-widest">Included in mailbox scans</div>
           </div>
         </div>
       </div>
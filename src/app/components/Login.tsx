@@ -46,14 +46,22 @@ export const Login: React.FC = () => {
   const [password, setPassword] = useState('');
   const [isLoading, setIsLoading] = useState(false);
 
-  // Check for token in URL (from OAuth callback)
+  // Check for one-time code in URL (from OAuth callback)
   useEffect(() => {
-    const token = searchParams.get('token');
-    if (token) {
-      apiService.setAuthToken(token);
-      toast.success('Successfully signed in with Google!');
-      navigate('/app');
-    }
+    const authCode = searchParams.get('auth_code');
+    if (!authCode) return;
+
+    apiService
+      .exchangeAuthCode(authCode)
+      .then((session) => {
+        apiService.setAuthToken(session.token);
+        apiService.setRefreshToken(session.refreshToken);
+        toast.success('Successfully signed in with Google!');
+        navigate('/app', { replace: true });
+      })
+      .catch(() => {
+        toast.error('Google sign-in expired, please try again');
+      });
   }, [searchParams, navigate]);
 
   const handleLogin = async (e: React.FormEvent) => {
@@ -1,6 +1,10 @@
-import React, { useState } from 'react';
-import { Bell, Mail, Shield, Smartphone, ChevronRight } from 'lucide-react';
+import React, { useRef, useState } from 'react';
+import { Bell, Mail, Shield, Smartphone, ChevronRight, Upload } from 'lucide-react';
 import { clsx } from 'clsx';
+import { apiService } from '../services/api';
+import { enablePushNotifications } from '../services/push';
+
+const statementProfiles = ['generic', 'generic-dmy', 'chase', 'amex', 'kbank', 'scb', 'bbl', 'ktb'];
 
 export const Settings: React.FC = () => {
   const [reminders, setReminders] = useState({
@@ -8,10 +12,46 @@ export const Settings: React.FC = () => {
     threeDay: true,
     oneDay: true,
     email: false,
-    push: true
+    push: typeof Notification !== 'undefined' && Notification.permission === 'granted'
   });
+  const [pushBlocked, setPushBlocked] = useState(false);
+  const [statementProfile, setStatementProfile] = useState('generic');
+  const [importStatus, setImportStatus] = useState('Upload a CSV, OFX or QIF statement');
+  const [importing, setImporting] = useState(false);
+  const statementInput = useRef<HTMLInputElement>(null);
+
+  const handleStatementUpload = async (event: React.ChangeEvent<HTMLInputElement>) => {
+    const file = event.target.files?.[0];
+    event.target.value = '';
+    if (!file) return;
 
-  const toggle = (key: keyof typeof reminders) => {
+    setImporting(true);
+    setImportStatus(`Importing ${file.name}...`);
+    try {
+      const result = await apiService.importStatement(file, statementProfile);
+      setImportStatus(
+        `${file.name}: ${result.transactionCount} transactions, ${result.duplicates} duplicates, ${result.detected} subscriptions found`
+      );
+    } catch (error) {
+      console.error('Failed to import statement:', error);
+      setImportStatus(`Could not import ${file.name}`);
+    } finally {
+      setImporting(false);
+    }
+  };
+
+  const toggle = async (key: keyof typeof reminders) => {
+    // Turning push on registers this browser with the server
+    if (key === 'push' && !reminders.push) {
+      try {
+        const enabled = await enablePushNotifications();
+        setPushBlocked(!enabled);
+        if (!enabled) return;
+      } catch (error) {
+        console.error('Failed to enable push notifications:', error);
+        return;
+      }
+    }
     setReminders(prev => ({ ...prev, [key]: !prev[key] }));
   };
 
@@ -77,7 +117,11 @@ export const Settings: React.FC = () => {
                       </div>
                       <div>
                         <p className="font-semibold text-slate-900">{item.label}</p>
-                        <p className="text-sm text-slate-500">{item.desc}</p>
+                        <p className="text-sm text-slate-500">
+                          {item.id === 'push' && pushBlocked
+                            ? 'Notifications are blocked or not supported in this browser'
+                            : item.desc}
+                        </p>
                       </div>
                     </div>
                     <button 
@@ -106,13 +150,38 @@ export const Settings: React.FC = () => {
             Security & Data
           </h3>
           <div className="space-y-4">
-            <button className="w-full flex items-center justify-between p-4 bg-slate-50 hover:bg-slate-100 rounded-2xl transition-colors text-left group">
+            <div className="w-full flex items-center justify-between gap-4 p-4 bg-slate-50 rounded-2xl">
               <div>
                 <p className="font-semibold text-slate-900">Connected Bank Accounts</p>
-                <p className="text-sm text-slate-500">Chase Bank •••• 4242</p>
+                <p className="text-sm text-slate-500">{importStatus}</p>
               </div>
-              <ChevronRight className="w-5 h-5 text-slate-300 group-hover:text-slate-400" />
-            </button>
+              <div className="flex items-center gap-2">
+                <select
+                  value={statementProfile}
+                  onChange={e => setStatementProfile(e.target.value)}
+                  className="text-sm bg-white border border-slate-200 rounded-xl px-2 py-2 text-slate-700"
+                >
+                  {statementProfiles.map(profile => (
+                    <option key={profile} value={profile}>{profile}</option>
+                  ))}
+                </select>
+                <button
+                  onClick={() => statementInput.current?.click()}
+                  disabled={importing}
+                  className="flex items-center gap-2 px-3 py-2 bg-indigo-600 hover:bg-indigo-700 disabled:opacity-50 text-white text-sm font-semibold rounded-xl transition-colors"
+                >
+                  <Upload className="w-4 h-4" />
+                  Import
+                </button>
+                <input
+                  ref={statementInput}
+                  type="file"
+                  accept=".csv,.ofx,.qfx,.qif"
+                  onChange={handleStatementUpload}
+                  className="hidden"
+                />
+              </div>
+            </div>
             <button className="w-full flex items-center justify-between p-4 bg-slate-50 hover:bg-slate-100 rounded-2xl transition-colors text-left group">
               <div>
                 <p className="font-semibold text-slate-900">Privacy Mode</p>
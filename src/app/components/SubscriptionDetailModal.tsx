@@ -57,6 +57,13 @@ export const SubscriptionDetailModal: React.FC<SubscriptionDetailModalProps> = (
                         <span className="text-[10px] font-bold uppercase tracking-wider">Auto-detected</span>
                       </div>
                     )}
+                    {subscription.billingPlatform && subscription.billingPlatform !== 'direct' && (
+                      <div className="px-2 py-1 bg-slate-100 text-slate-600 rounded-lg">
+                        <span className="text-[10px] font-bold uppercase tracking-wider">
+                          {subscription.billingPlatform === 'apple' ? 'App Store' : 'Google Play'}
+                        </span>
+                      </div>
+                    )}
                   </div>
                   <p className="text-sm text-slate-500 capitalize">{subscription.category}</p>
                 </div>
@@ -95,11 +95,12 @@ export const DashboardPage: React.FC = () => {
     setActiveTab('dashboard');
 
     const gmailConnected = searchParams.get('gmail_connected');
+    const outlookConnected = searchParams.get('outlook_connected');
     const email = searchParams.get('email');
     const error = searchParams.get('error');
 
-    if (gmailConnected === 'true' && email) {
-      toast.success(`Gmail connected successfully!`);
+    if ((gmailConnected === 'true' || outlookConnected === 'true') && email) {
+      toast.success(`${outlookConnected === 'true' ? 'Outlook' : 'Gmail'} connected successfully!`);
       toast.info(`Scanning ${email} for subscriptions...`);
 
       setSearchParams({});
@@ -50,6 +50,8 @@ export interface GoogleAuthRequest {
 
 export interface GoogleAuthResponse {
   token: string;
+  refreshToken: string;
+  expiresIn: number;
   user: {
     id: string;
     email: string;
@@ -63,6 +65,8 @@ export interface GoogleAuthResponse {
 ======================= */
 class ApiService {
   private baseUrl: string;
+  // Refresh tokens are single use, so parallel 401s share one refresh
+  private refreshing: Promise<boolean> | null = null;
 
   constructor() {
     this.baseUrl = API_BASE_URL;
@@ -72,13 +76,19 @@ class ApiService {
      🔴 ใช้จริงตอนนี้
   ======================= */
   async getSubscriptions(): Promise<Subscription[]> {
-    const response = await fetch(`${this.baseUrl}/subscriptions`, {
+    // Guests are known by the guest_session cookie, which the API on another
+    // origin only gets with credentials: 'include'
+    const init: RequestInit = {
       method: 'GET',
       headers: {
         'Content-Type': 'application/json',
-        // ❌ เอา Authorization ออกก่อน
       },
-    });
+      credentials: 'include',
+    };
+    const url = `${this.baseUrl}/subscriptions`;
+    const response = this.getAuthToken()
+      ? await this.authFetch(url, init)
+      : await fetch(url, init);
 
     if (!response.ok) {
       throw new Error('Failed to fetch subscriptions');
@@ -93,9 +103,11 @@ class ApiService {
   ======================= */
 
   async googleSignIn(credential: string): Promise<GoogleAuthResponse> {
+    // credentials: moves the guest session's subscriptions into the account
     const response = await fetch(`${this.baseUrl}/auth/google`, {
       method: 'POST',
       headers: { 'Content-Type': 'application/json' },
+      credentials: 'include',
       body: JSON.stringify({ credential }),
     });
 
@@ -106,14 +118,27 @@ class ApiService {
     return response.json();
   }
 
+  async exchangeAuthCode(code: string): Promise<GoogleAuthResponse> {
+    const response = await fetch(`${this.baseUrl}/auth/exchange`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ code }),
+    });
+
+    if (!response.ok) {
+      throw new Error('Failed to exchange login code');
+    }
+
+    return response.json();
+  }
+
   async initiateGmailConnection(email: string): Promise<GmailConnectResponse> {
     const redirectUri = `${window.location.origin}/gmail-callback`;
 
-    const response = await fetch(`${this.baseUrl}/gmail/connect`, {
+    const response = await this.authFetch(`${this.baseUrl}/gmail/connect`, {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
-        'Authorization': `Bearer ${this.getAuthToken()}`,
       },
       body: JSON.stringify({ email, redirectUri }),
     });
@@ -129,11 +154,10 @@ class ApiService {
     code: string,
     state: string
   ): Promise<GmailCallbackResponse> {
-    const response = await fetch(`${this.baseUrl}/gmail/callback`, {
+    const response = await this.authFetch(`${this.baseUrl}/gmail/callback`, {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
-        'Authorization': `Bearer ${this.getAuthToken()}`,
       },
       body: JSON.stringify({ code, state }),
     });
@@ -146,15 +170,70 @@ class ApiService {
   }
 
   async scanGmail() {
-    const response = await fetch(`${this.baseUrl}/gmail/scan`, {
+    const response = await this.authFetch(`${this.baseUrl}/gmail/scan`, {
+      method: 'POST',
+    });
+
+    if (!response.ok) {
+      throw new Error('Failed to scan Gmail');
+    }
+
+    return response.json();
+  }
+
+  async initiateOutlookConnection(): Promise<GmailConnectResponse> {
+    // credentials: the backend ties the OAuth state to this browser's cookie
+    const response = await this.authFetch(`${this.baseUrl}/outlook/connect`, {
+      method: 'POST',
+      credentials: 'include',
+    });
+
+    if (!response.ok) {
+      throw new Error('Failed to initiate Outlook connection');
+    }
+
+    return response.json();
+  }
+
+  async importStatement(file: File, profile = 'generic') {
+    const form = new FormData();
+    form.append('file', file);
+    form.append('profile', profile);
+
+    const response = await this.authFetch(`${this.baseUrl}/imports/statements`, {
+      method: 'POST',
+      body: form,
+    });
+
+    if (!response.ok) {
+      throw new Error('Failed to import statement');
+    }
+
+    return response.json();
+  }
+
+  async getVapidPublicKey(): Promise<string> {
+    const response = await fetch(`${this.baseUrl}/push/vapid-public-key`);
+
+    if (!response.ok) {
+      throw new Error('Failed to load push key');
+    }
+
+    const data = await response.json();
+    return data.publicKey;
+  }
+
+  async registerPushSubscription(subscription: PushSubscription) {
+    const response = await this.authFetch(`${this.baseUrl}/push/subscriptions`, {
       method: 'POST',
       headers: {
-        'Authorization': `Bearer ${this.getAuthToken()}`,
+        'Content-Type': 'application/json',
       },
+      body: JSON.stringify(subscription.toJSON()),
     });
 
     if (!response.ok) {
-      throw new Error('Failed to scan Gmail');
+      throw new Error('Failed to register push subscription');
     }
 
     return response.json();
@@ -163,16 +242,79 @@ class ApiService {
   /* =======================
      Helpers
   ======================= */
+
+  // Access tokens only last 15 minutes. On a 401 the session is refreshed
+  // once and the request sent again with the new token.
+  private async authFetch(url: string, init: RequestInit = {}): Promise<Response> {
+    const send = () =>
+      fetch(url, {
+        ...init,
+        headers: {
+          ...(init.headers as Record<string, string>),
+          'Authorization': `Bearer ${this.getAuthToken()}`,
+        },
+      });
+
+    const response = await send();
+    if (response.status !== 401 || !this.getRefreshToken()) {
+      return response;
+    }
+    if (!(await this.refreshSession())) {
+      return response;
+    }
+    return send();
+  }
+
+  private refreshSession(): Promise<boolean> {
+    if (!this.refreshing) {
+      this.refreshing = (async () => {
+        try {
+          const response = await fetch(`${this.baseUrl}/auth/refresh`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ refreshToken: this.getRefreshToken() }),
+          });
+
+          if (!response.ok) {
+            // Expired or revoked, the user has to sign in again
+            this.clearAuthToken();
+            return false;
+          }
+
+          const session: GoogleAuthResponse = await response.json();
+          this.setAuthToken(session.token);
+          this.setRefreshToken(session.refreshToken);
+          return true;
+        } catch {
+          // Offline, keep the tokens for the next try
+          return false;
+        } finally {
+          this.refreshing = null;
+        }
+      })();
+    }
+    return this.refreshing;
+  }
+
   private getAuthToken(): string {
     return localStorage.getItem('authToken') || '';
   }
 
+  private getRefreshToken(): string {
+    return localStorage.getItem('refreshToken') || '';
+  }
+
   setAuthToken(token: string): void {
     localStorage.setItem('authToken', token);
   }
 
+  setRefreshToken(token: string): void {
+    localStorage.setItem('refreshToken', token);
+  }
+
   clearAuthToken(): void {
     localStorage.removeItem('authToken');
+    localStorage.removeItem('refreshToken');
   }
 }
 